@@ -1,6 +1,6 @@
 import Database from 'better-sqlite3';
 import * as path from 'path';
-import { enrollUserWithAdminCert } from './src/utils/enrollUser';
+import { enrollUserWithAttributes, fabricRoles } from './src/utils/enrollUser';
 
 const dbPath = path.join(__dirname, 'data', 'herbaltrace.db');
 const db = new Database(dbPath);
@@ -10,7 +10,7 @@ async function enrollExistingUsers() {
 
   // Get all users except admin
   const users = db.prepare(`
-    SELECT user_id, username, role, org_name
+    SELECT user_id, username, role, org_name, fabric_role, lab_id
     FROM users
     WHERE role != 'Admin'
     ORDER BY created_at
@@ -31,11 +31,20 @@ async function enrollExistingUsers() {
     console.log(`  Role: ${user.role}`);
     console.log(`  Organization: ${user.org_name}`);
 
+    // Users enrolled before roles were issued get their portal role's chaincode role
+    const chaincodeRoles = fabricRoles[user.role] || [];
+    const chaincodeRole = user.fabric_role || (chaincodeRoles.length === 1 ? chaincodeRoles[0] : undefined);
+    if (!chaincodeRole) {
+      console.log(`  ⏭️  No chaincode role, skipped\n`);
+      continue;
+    }
+
     try {
-      const success = await enrollUserWithAdminCert(
+      const success = await enrollUserWithAttributes(
         user.user_id,
         user.org_name,
-        `${user.org_name.toLowerCase()}.department1`
+        `${user.org_name.toLowerCase()}.department1`,
+        { role: chaincodeRole, labId: user.role === 'Lab' ? (user.lab_id || user.user_id) : undefined }
       );
 
       if (success) {
@@ -1,6 +1,6 @@
 // Enroll lab user identity for blockchain access
 const path = require('path');
-const { enrollUserWithAdminCert } = require('./dist/utils/enrollUser');
+const { enrollUserWithAttributes } = require('./dist/utils/enrollUser');
 
 async function enrollLabUser() {
   console.log('\n🔐 ENROLLING LAB USER FOR BLOCKCHAIN ACCESS\n');
@@ -18,7 +18,8 @@ async function enrollLabUser() {
   console.log(`\n🔄 Starting enrollment process...`);
   
   try {
-    const success = await enrollUserWithAdminCert(labUserId, organization, affiliation);
+    // Results are recorded under the lab user's ID, which is issued as the labId attribute
+    const success = await enrollUserWithAttributes(labUserId, organization, affiliation, { role: 'lab', labId: labUserId });
     
     if (success) {
       console.log('\n✅ SUCCESS! Lab user enrolled in blockchain network');
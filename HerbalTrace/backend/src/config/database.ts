@@ -46,7 +46,9 @@ export const initializeDatabase = (): void => {
         created_at TEXT DEFAULT (datetime('now')),
         updated_at TEXT DEFAULT (datetime('now')),
         last_login TEXT,
-        created_by TEXT
+        created_by TEXT,
+        fabric_role TEXT,
+        lab_id TEXT
       );
     `);
 
@@ -544,6 +546,19 @@ const runMigrations = (): void => {
       db.exec(`ALTER TABLE registration_requests ADD COLUMN aadhar_number TEXT`);
       logger.info('✅ Added aadhar_number column');
     }
+
+    // Migration: Add the chaincode role and lab issued in users' enrollment certificates
+    const userColumns = db.prepare(`PRAGMA table_info(users)`).all() as any[];
+    if (!userColumns.some((col: any) => col.name === 'fabric_role')) {
+      logger.info('Running migration: Adding fabric_role column to users');
+      db.exec(`ALTER TABLE users ADD COLUMN fabric_role TEXT`);
+      logger.info('✅ Added fabric_role column');
+    }
+    if (!userColumns.some((col: any) => col.name === 'lab_id')) {
+      logger.info('Running migration: Adding lab_id column to users');
+      db.exec(`ALTER TABLE users ADD COLUMN lab_id TEXT`);
+      logger.info('✅ Added lab_id column');
+    }
   } catch (error) {
     logger.error('Migration error:', error);
     // Don't throw - migrations should be non-fatal
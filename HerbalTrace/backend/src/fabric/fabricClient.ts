@@ -1,9 +1,24 @@
 import { Gateway, Wallets, X509Identity } from 'fabric-network';
 import * as path from 'path';
 import * as fs from 'fs';
+import { randomBytes, createHash } from 'crypto';
 import FabricCAServices from 'fabric-ca-client';
 import { logger } from '../utils/logger';
 
+/**
+ * Build the serial printed on a pack, as serialFor in the chaincode does
+ */
+export function serialFor(productId: string, sequence: number, token: string): string {
+  return `${productId}-${String(sequence).padStart(6, '0')}-${token}`;
+}
+
+/**
+ * Hash under which the chaincode keeps a serial on the ledger
+ */
+export function serialHash(serial: string): string {
+  return createHash('sha256').update(serial).digest('hex');
+}
+
 export class FabricClient {
   private gateway: Gateway | null = null;
   private wallet: any = null;
@@ -92,7 +107,9 @@ export class FabricClient {
       'FarmersCoop': { domain: 'farmerscoop.herbaltrace.com', profile: 'farmerscoop' },
       'TestingLabs': { domain: 'testinglabs.herbaltrace.com', profile: 'testinglabs' },
       'Processors': { domain: 'processors.herbaltrace.com', profile: 'processors' },
-      'Manufacturers': { domain: 'manufacturers.herbaltrace.com', profile: 'manufacturers' }
+      'Manufacturers': { domain: 'manufacturers.herbaltrace.com', profile: 'manufacturers' },
+      // Regulators run no peers; permits hold farmersCoopPrivate data, so they submit through the farmers' peers
+      'Regulator': { domain: 'farmerscoop.herbaltrace.com', profile: 'farmerscoop' }
     };
 
     const orgConfig = orgMap[orgName];
@@ -134,6 +151,14 @@ export class FabricClient {
    * Uses endorsement from the connected organization's peers
    */
   async submitTransaction(functionName: string, ...args: string[]): Promise<any> {
+    return await this.submitTransactionWithTransient(functionName, {}, ...args);
+  }
+
+  /**
+   * Submit a transaction with transient data, which is passed to the chaincode
+   * but never recorded in the block (used for private data collections)
+   */
+  async submitTransactionWithTransient(functionName: string, transient: Record<string, Buffer>, ...args: string[]): Promise<any> {
     try {
       const contract = await this.getContract();
       const network = await this.getNetwork();
@@ -144,6 +169,9 @@ export class FabricClient {
       
       // Set to use only ONE peer for endorsement to avoid peer1 chaincode issues
       transaction.setEndorsingPeers([network.getChannel().getEndorsers()[0]]);
+      if (Object.keys(transient).length > 0) {
+        transaction.setTransient(transient);
+      }
       
       const result = await transaction.submit(...args);
       
@@ -191,7 +219,28 @@ export class FabricClient {
    * Create Collection Event
    */
   async createCollectionEvent(eventData: any): Promise<any> {
-    return await this.submitTransaction('CreateCollectionEvent', JSON.stringify(eventData));
+    const { publicData, transient } = this.splitPrivateFields(eventData, ['farmerName', 'latitude', 'longitude', 'altitude', 'accuracy']);
+    let result: any;
+    try {
+      result = await this.submitTransactionWithTransient('CreateCollectionEvent', transient, JSON.stringify(publicData));
+    } catch (error) {
+      // A rejected collection writes nothing, so its violation alert is recorded in a transaction of its own
+      try {
+        await this.submitTransactionWithTransient('ReportCollectionViolation', transient, JSON.stringify(publicData));
+      } catch (reportError) {
+        logger.warn(`No violation recorded for rejected collection ${publicData.id}:`, reportError);
+      }
+      throw error;
+    }
+
+    // The harvest limit threshold is checked in its own transaction so collections don't conflict
+    try {
+      await this.submitTransaction('CheckHarvestThreshold', publicData.id);
+    } catch (error) {
+      logger.warn(`Harvest threshold check failed for collection ${publicData.id}:`, error);
+    }
+
+    return result;
   }
 
   /**
@@ -219,7 +268,8 @@ export class FabricClient {
    * Create Quality Test
    */
   async createQualityTest(testData: any): Promise<any> {
-    return await this.submitTransaction('CreateQualityTest', JSON.stringify(testData));
+    const { publicData, transient } = this.splitPrivateFields(testData, ['testFee', 'currency', 'invoiceRef']);
+    return await this.submitTransactionWithTransient('CreateQualityTest', transient, JSON.stringify(publicData));
   }
 
   /**
@@ -233,7 +283,8 @@ export class FabricClient {
    * Create Processing Step
    */
   async createProcessingStep(stepData: any): Promise<any> {
-    return await this.submitTransaction('CreateProcessingStep', JSON.stringify(stepData));
+    const { publicData, transient } = this.splitPrivateFields(stepData, ['temperature', 'duration', 'equipment', 'parameters']);
+    return await this.submitTransactionWithTransient('CreateProcessingStep', transient, JSON.stringify(publicData));
   }
 
   /**
@@ -278,6 +329,105 @@ export class FabricClient {
     return await this.evaluateTransaction('GetProvenanceByQRCode', qrCode);
   }
 
+  /**
+   * Verify values disclosed by a data owner against the salted hashes on a record
+   */
+  async verifyPrivateData(recordId: string, salt: string, fields: Record<string, any>): Promise<any> {
+    return await this.evaluateTransaction('VerifyPrivateData', recordId, JSON.stringify({ salt, fields }));
+  }
+
+  /**
+   * Move sensitive fields into the transient map with a random salt, so only their
+   * salted hashes reach the public channel state
+   */
+  private splitPrivateFields(data: any, fields: string[]): { publicData: any; transient: Record<string, Buffer> } {
+    const publicData = { ...data };
+    const privateData: Record<string, any> = {};
+    for (const field of fields) {
+      if (publicData[field] !== undefined && publicData[field] !== null) {
+        privateData[field] = publicData[field];
+      }
+      delete publicData[field];
+    }
+    if (Object.keys(privateData).length === 0) {
+      return { publicData, transient: {} };
+    }
+    privateData.salt = randomBytes(16).toString('hex');
+    return { publicData, transient: { privateData: Buffer.from(JSON.stringify(privateData)) } };
+  }
+
+  /**
+   * Register unit serials for a product. A random token per unit is generated here and passed
+   * in the transient map; the ledger keeps only serial hashes, so the returned serials must be
+   * printed on the packs and cannot be recovered later.
+   */
+  async serializeProduct(productId: string, count: number): Promise<{ serials: string[]; transactionId: string }> {
+    const tokens = Array.from({ length: count }, () => randomBytes(16).toString('hex'));
+    const before = await this.getProduct(productId);
+    const result = await this.submitTransactionWithTransient(
+      'SerializeProduct',
+      { serialTokens: Buffer.from(JSON.stringify(tokens)) },
+      productId,
+      String(count)
+    );
+    const { transactionId, ...hashes } = result;
+    const serialHashes = Object.values(hashes) as string[];
+
+    // Serials continue the product's sequence. A serialization committed in between moves it,
+    // so the sequences are confirmed against the hashes the chaincode returned.
+    const after = await this.getProduct(productId);
+    for (let first = (before?.serialCount ?? 0) + 1; first <= (after?.serialCount ?? 0) - count + 1; first++) {
+      const serials = tokens.map((token, i) => serialFor(productId, first + i, token));
+      if (serials.every((serial, i) => serialHash(serial) === serialHashes[i])) {
+        return { serials, transactionId };
+      }
+    }
+    throw new Error(`Serials registered for product ${productId} in ${transactionId} do not match their sequences`);
+  }
+
+  /**
+   * Get a unit serial by the serial printed on the pack
+   */
+  async getSerial(serial: string): Promise<any> {
+    return await this.evaluateTransaction('GetSerial', serial);
+  }
+
+  /**
+   * Get Provenance by unit serial (Consumer Scanning)
+   */
+  async getProvenanceBySerial(serial: string): Promise<any> {
+    return await this.evaluateTransaction('GetProvenanceBySerial', serial);
+  }
+
+  /**
+   * Record a QR code scan (counterfeit detection)
+   */
+  async recordScan(scanData: any): Promise<any> {
+    const scan = await this.submitTransaction('RecordScan', JSON.stringify(scanData));
+
+    // Earlier scans of the code are compared in their own transaction so scans don't conflict
+    try {
+      return await this.submitTransaction('CheckScan', scan.qrCode, scan.id);
+    } catch (error) {
+      logger.warn(`Scan check failed for scan ${scan.id}:`, error);
+      return scan;
+    }
+  }
+
+  /**
+   * Get scan statistics for a QR code
+   */
+  async getScanStatistics(qrCode: string): Promise<any> {
+    return await this.evaluateTransaction('GetScanStatistics', qrCode);
+  }
+
+  /**
+   * Verify Provenance against the digest anchored at product creation
+   */
+  async verifyProvenance(productId: string): Promise<any> {
+    return await this.evaluateTransaction('VerifyProvenance', productId);
+  }
+
   /**
    * Disconnect from gateway
    */
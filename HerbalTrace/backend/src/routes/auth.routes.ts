@@ -5,6 +5,7 @@ import { v4 as uuidv4 } from 'uuid';
 import { db } from '../config/database';
 import { getFabricClient } from '../fabric/fabricClient';
 import { logger } from '../utils/logger';
+import { enrollUserWithAttributes, fabricRoles } from '../utils/enrollUser';
 import { authenticate, authorize } from '../middleware/auth';
 
 const router = Router();
@@ -154,7 +155,7 @@ router.get('/registration-requests', authenticate, authorize('Admin'), async (re
 router.post('/registration-requests/:id/approve', authenticate, authorize('Admin'), async (req: Request, res: Response) => {
   try {
     const { id } = req.params;
-    const { role, orgName, orgMsp } = req.body;
+    const { role, orgName, orgMsp, fabricRole, labId } = req.body;
     const adminUserId = (req as any).user.userId;
 
     if (!role || !orgName) {
@@ -164,6 +165,22 @@ router.post('/registration-requests/:id/approve', authenticate, authorize('Admin
       });
     }
 
+    // Regulators hold one of several chaincode roles, so theirs must be chosen
+    const chaincodeRoles = fabricRoles[role] || [];
+    const chaincodeRole = fabricRole || (chaincodeRoles.length === 1 ? chaincodeRoles[0] : undefined);
+    if (chaincodeRole && !chaincodeRoles.includes(chaincodeRole)) {
+      return res.status(400).json({
+        success: false,
+        message: `fabricRole must be one of: ${chaincodeRoles.join(', ')}`
+      });
+    }
+    if (role === 'Regulator' && !chaincodeRole) {
+      return res.status(400).json({
+        success: false,
+        message: `Please provide fabricRole, one of: ${chaincodeRoles.join(', ')}`
+      });
+    }
+
     // Get registration request
     const request: any = db.prepare('SELECT * FROM registration_requests WHERE id = ?').get(id);
 
@@ -183,20 +200,24 @@ router.post('/registration-requests/:id/approve', authenticate, authorize('Admin
 
     // Auto-generate credentials
     const userId = `${role.toLowerCase()}-${Date.now()}-${Math.random().toString(36).substr(2, 4)}`;
+    // Lab results are recorded under the lab user's ID unless the lab is named
+    const userLabId = role === 'Lab' ? (labId || userId) : undefined;
     const username = request.email.split('@')[0];
     const password = `HT${Math.random().toString(36).substr(2, 8).toUpperCase()}`;
 
     // Hash password
     const passwordHash = bcrypt.hashSync(password, 10);
 
-    // Enroll user in Fabric network using admin certificates
-    // This doesn't require CA servers to be running
+    // Enroll user with their organisation's CA, issuing the chaincode role and lab as attributes
     try {
-      const { enrollUserWithAdminCert } = await import('../utils/enrollUser');
-      const enrolled = await enrollUserWithAdminCert(
+      if (!chaincodeRole) {
+        throw new Error(`${role} users have no chaincode role`);
+      }
+      const enrolled = await enrollUserWithAttributes(
         userId,
         orgName,
-        `${orgName.toLowerCase()}.department1`
+        `${orgName.toLowerCase()}.department1`,
+        { role: chaincodeRole, labId: userLabId }
       );
       if (enrolled) {
         logger.info(`✅ User ${userId} enrolled in Fabric network`);
@@ -212,8 +233,9 @@ router.post('/registration-requests/:id/approve', authenticate, authorize('Admin
     db.prepare(`
       INSERT INTO users (
         id, user_id, username, email, password_hash, full_name, phone, role,
-        org_name, org_msp, affiliation, location_district, location_state, location_coordinates, created_by
-      ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        org_name, org_msp, affiliation, location_district, location_state, location_coordinates, created_by,
+        fabric_role, lab_id
+      ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `).run(
       uuidv4(),
       userId,
@@ -229,7 +251,9 @@ router.post('/registration-requests/:id/approve', authenticate, authorize('Admin
       request.location_district,
       request.location_state,
       request.location_coordinates,
-      adminUserId
+      adminUserId,
+      chaincodeRole || null,
+      userLabId || null
     );
 
     // Update registration request
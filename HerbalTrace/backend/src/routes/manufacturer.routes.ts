@@ -342,6 +342,59 @@ router.get('/products/:id', authenticate, authorize('Admin', 'Manufacturer'), as
   }
 });
 
+/**
+ * POST /api/v1/manufacturer/products/:id/serials
+ * Issue unit serials for the packs of a product
+ *
+ * Body:
+ * {
+ *   count: number (required) - 1 to 5000 serials per request
+ * }
+ *
+ * The serials are returned once and must be printed on the packs; the ledger keeps only their hashes.
+ */
+router.post('/products/:id/serials', authenticate, authorize('Admin', 'Manufacturer'), async (req: AuthRequest, res: Response) => {
+  try {
+    const { id } = req.params;
+    const count = Number(req.body.count);
+
+    if (!Number.isInteger(count) || count < 1 || count > 5000) {
+      return res.status(400).json({
+        success: false,
+        message: 'count must be a whole number between 1 and 5000',
+      });
+    }
+
+    const fabricClient = getFabricClient();
+    await fabricClient.connect('admin-Manufacturers', 'Manufacturers');
+    let result;
+    try {
+      result = await fabricClient.serializeProduct(id, count);
+    } finally {
+      await fabricClient.disconnect();
+    }
+
+    logger.info(`${count} serials issued for product ${id}`);
+
+    res.status(201).json({
+      success: true,
+      message: 'Serials issued successfully',
+      data: {
+        productId: id,
+        serials: result.serials,
+        count: result.serials.length,
+        transactionId: result.transactionId,
+      },
+    });
+  } catch (error: any) {
+    logger.error('Issue serials error:', error);
+    res.status(500).json({
+      success: false,
+      message: error.message || 'Failed to issue serials',
+    });
+  }
+});
+
 /**
  * GET /api/v1/manufacturer/batches
  * Get batches ready for manufacturing (quality_tested status)
@@ -47,10 +47,15 @@ router.get('/verify/:qrCode', async (req: Request, res: Response, next: NextFunc
 
     // Try to get blockchain provenance
     let blockchainProvenance = null;
+    let integrity = null;
+    let scanStatistics = null;
     try {
       const fabricClient = getFabricClient();
       await fabricClient.connect('admin-FarmersCoop', 'FarmersCoop');
       blockchainProvenance = await fabricClient.getProvenanceByQRCode(qrCode);
+      // Scans are recorded through POST /scan/:qrCode, this endpoint only reads
+      scanStatistics = await fabricClient.getScanStatistics(qrCode);
+      integrity = await fabricClient.verifyProvenance(blockchainProvenance.productId);
       await fabricClient.disconnect();
     } catch (error: any) {
       logger.warn(`Could not fetch blockchain provenance: ${error.message}`);
@@ -123,6 +128,15 @@ router.get('/verify/:qrCode', async (req: Request, res: Response, next: NextFunc
         verified: true,
         verifiedAt: new Date().toISOString(),
         dataSource: 'HerbalTrace Platform',
+        // Partial provenance is reported as such rather than shown as a clean history
+        partial: !blockchainProvenance?.completeness?.complete,
+        coveragePercent: blockchainProvenance?.completeness?.coveragePercent ?? 0,
+        missingReferences: blockchainProvenance?.completeness?.missingReferences ?? [],
+        flaggedEntities: blockchainProvenance?.completeness?.flaggedEntities ?? [],
+        // Whether upstream records changed since the product was created
+        provenanceUnchanged: integrity?.verified ?? false,
+        changedRecords: integrity?.changedRecords ?? [],
+        suspectedCounterfeit: scanStatistics?.suspectedCounterfeit ?? false,
       },
     };
 
@@ -139,6 +153,122 @@ router.get('/verify/:qrCode', async (req: Request, res: Response, next: NextFunc
   }
 });
 
+/**
+ * @route   POST /api/qr/scan/:qrCode
+ * @desc    Record a scan of a product QR code on the ledger and check it for cloning
+ * @access  Public
+ */
+router.post('/scan/:qrCode', async (req: Request, res: Response, next: NextFunction) => {
+  try {
+    const { qrCode } = req.params;
+    const { latitude, longitude, city, country, channel } = req.body;
+
+    const fabricClient = getFabricClient();
+    await fabricClient.connect('admin-FarmersCoop', 'FarmersCoop');
+    let scan;
+    try {
+      scan = await fabricClient.recordScan({
+        qrCode,
+        latitude: latitude !== undefined ? Number(latitude) : undefined,
+        longitude: longitude !== undefined ? Number(longitude) : undefined,
+        city,
+        country,
+        channel: channel || 'web',
+      });
+    } finally {
+      await fabricClient.disconnect();
+    }
+
+    logger.info(`QR code scan recorded: ${qrCode}`);
+
+    res.status(201).json({
+      success: true,
+      message: 'Scan recorded successfully',
+      data: {
+        scanId: scan.id,
+        scanTime: scan.scanTime,
+        suspectedCounterfeit: (scan.suspected ?? []).length > 0,
+        triggeredRules: scan.suspected ?? [],
+      },
+    });
+  } catch (error: any) {
+    logger.error('Error recording QR code scan:', error);
+    next(error);
+  }
+});
+
+/**
+ * @route   GET /api/qr/serial/:serial
+ * @desc    Look up the unit serial printed on a pack (Consumer scanning)
+ * @access  Public
+ */
+router.get('/serial/:serial', async (req: Request, res: Response, next: NextFunction) => {
+  try {
+    const { serial } = req.params;
+
+    const fabricClient = getFabricClient();
+    await fabricClient.connect('admin-FarmersCoop', 'FarmersCoop');
+    let productSerial;
+    try {
+      productSerial = await fabricClient.getSerial(serial);
+    } catch (error: any) {
+      if (error.message?.includes('serial not found')) {
+        return res.status(404).json({
+          success: false,
+          message: 'Serial not found. The pack may be counterfeit.',
+        });
+      }
+      throw error;
+    } finally {
+      await fabricClient.disconnect();
+    }
+
+    res.status(200).json({
+      success: true,
+      data: productSerial,
+    });
+  } catch (error: any) {
+    logger.error('Error looking up serial:', error);
+    next(error);
+  }
+});
+
+/**
+ * @route   GET /api/qr/serial/:serial/provenance
+ * @desc    Get the provenance of the product a unit serial belongs to (Consumer scanning)
+ * @access  Public
+ */
+router.get('/serial/:serial/provenance', async (req: Request, res: Response, next: NextFunction) => {
+  try {
+    const { serial } = req.params;
+
+    const fabricClient = getFabricClient();
+    await fabricClient.connect('admin-FarmersCoop', 'FarmersCoop');
+    let provenance;
+    try {
+      provenance = await fabricClient.getProvenanceBySerial(serial);
+    } catch (error: any) {
+      if (error.message?.includes('serial not found')) {
+        return res.status(404).json({
+          success: false,
+          message: 'Serial not found. The pack may be counterfeit.',
+        });
+      }
+      throw error;
+    } finally {
+      await fabricClient.disconnect();
+    }
+
+    res.status(200).json({
+      success: true,
+      data: provenance,
+    });
+  } catch (error: any) {
+    logger.error('Error getting provenance by serial:', error);
+    next(error);
+  }
+});
+
 /**
  * @route   GET /api/qr/:qrCode
  * @desc    Get product provenance by QR code (Consumer scanning) - Legacy endpoint
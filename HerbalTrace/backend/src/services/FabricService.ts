@@ -182,22 +182,22 @@ export class FabricService {
     testedBy: string;
     results: any[];
   }): Promise<string> {
-    const args = [
-      certificateData.certificateId,
-      certificateData.testId,
-      certificateData.batchId,
-      certificateData.batchNumber,
-      certificateData.speciesName,
-      certificateData.testType,
-      certificateData.labId,
-      certificateData.labName,
-      certificateData.overallResult,
-      certificateData.issuedDate,
-      certificateData.testedBy,
-      JSON.stringify(certificateData.results),
-    ];
-
-    return await this.submitTransaction('RecordQCCertificate', ...args);
+    const certificate = {
+      id: certificateData.certificateId,
+      testId: certificateData.testId,
+      batchId: certificateData.batchId,
+      batchNumber: certificateData.batchNumber,
+      speciesName: certificateData.speciesName,
+      testType: certificateData.testType,
+      labId: certificateData.labId,
+      labName: certificateData.labName,
+      overallResult: certificateData.overallResult,
+      issuedDate: certificateData.issuedDate,
+      testedBy: certificateData.testedBy,
+      results: certificateData.results,
+    };
+
+    return await this.submitTransaction('RecordQCCertificate', JSON.stringify(certificate));
   }
 
   /**
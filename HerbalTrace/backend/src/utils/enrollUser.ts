@@ -1,110 +1,159 @@
-import * as FabricCAServices from 'fabric-ca-client';
+import FabricCAServices from 'fabric-ca-client';
 import { Wallets, X509Identity } from 'fabric-network';
-import * as fs from 'fs';
+import { randomBytes } from 'crypto';
 import * as path from 'path';
 import { logger } from './logger';
 
 /**
- * Enroll a user using existing organization admin certificates
- * This creates a proper Fabric identity without needing CA servers
+ * Chaincode roles a portal role can be enrolled with. The chaincode reads the role from the
+ * "role" attribute of the enrollment certificate, and only honours regulator roles from
+ * RegulatorMSP identities.
  */
-export async function enrollUserWithAdminCert(
+export const fabricRoles: { [portalRole: string]: string[] } = {
+  Farmer: ['farmer'],
+  Lab: ['lab'],
+  Processor: ['processor'],
+  Manufacturer: ['manufacturer'],
+  Regulator: ['forest_authority', 'accreditation_body', 'certification_body', 'registry_admin', 'alert_manager']
+};
+
+/**
+ * Attributes issued in a user's enrollment certificate
+ */
+export interface EnrollmentAttributes {
+  role: string;    // Chaincode role, e.g. 'lab' or 'accreditation_body'
+  labId?: string;  // Lab an analyst records results for, required for the 'lab' role
+}
+
+// Certificate authorities of the organisations, see network/docker/docker-compose-ca.yaml
+const orgMap: { [key: string]: { mspId: string; caUrl: string; caName: string } } = {
+  'FarmersCoop': { mspId: 'FarmersCoopMSP', caUrl: 'https://localhost:7054', caName: 'ca-farmerscoop' },
+  'TestingLabs': { mspId: 'TestingLabsMSP', caUrl: 'http://localhost:8054', caName: 'ca-labs' },
+  'Processors': { mspId: 'ProcessorsMSP', caUrl: 'http://localhost:9054', caName: 'ca-processors' },
+  'Manufacturers': { mspId: 'ManufacturersMSP', caUrl: 'http://localhost:10054', caName: 'ca-manufacturers' },
+  'Regulator': { mspId: 'RegulatorMSP', caUrl: 'http://localhost:12054', caName: 'ca-regulator' }
+};
+
+/**
+ * Check the attributes requested for a user against their organisation
+ */
+export function validateEnrollmentAttributes(orgName: string, attributes: EnrollmentAttributes): void {
+  if (!orgMap[orgName]) {
+    throw new Error(`Unknown organization: ${orgName}`);
+  }
+  if (!attributes.role) {
+    throw new Error('A chaincode role is required');
+  }
+  const regulatorRole = fabricRoles.Regulator.includes(attributes.role);
+  if (regulatorRole !== (orgName === 'Regulator')) {
+    throw new Error(`Role ${attributes.role} cannot be issued by ${orgName}`);
+  }
+  if (attributes.role === 'lab' && !attributes.labId) {
+    throw new Error('Lab users need the ID of their lab');
+  }
+}
+
+/**
+ * Read the attributes Fabric CA embedded in a certificate
+ */
+function certificateAttributes(certificate: string): { [name: string]: string } {
+  const der = Buffer.from(certificate.replace(/-----[^-]+-----/g, '').replace(/\s+/g, ''), 'base64').toString('latin1');
+  const match = der.match(/\{"attrs":\{[^}]*\}\}/);
+  return match ? JSON.parse(match[0]).attrs : {};
+}
+
+/**
+ * Register and enroll a user with their organisation's CA, issuing the chaincode role and lab
+ * as certificate attributes. Users already in the wallet with the same attributes are kept;
+ * identities without them, such as copies of the organisation admin, are re-enrolled.
+ */
+export async function enrollUserWithAttributes(
   userId: string,
   orgName: string,
-  affiliation: string
+  affiliation: string,
+  attributes: EnrollmentAttributes
 ): Promise<boolean> {
   try {
-    // Map orgName to correct organization structure
-    // IMPORTANT: Use the actual peer organization domains (farmers, labs, processors, manufacturers)
-    // NOT the connection profile names (farmerscoop, testinglabs, etc.)
-    const orgMap: { [key: string]: { mspId: string; certPath: string; keyPath: string } } = {
-      'FarmersCoop': {
-        mspId: 'FarmersCoopMSP',
-        certPath: 'farmers.herbaltrace.com',  // Changed from farmerscoop
-        keyPath: 'farmers.herbaltrace.com'
-      },
-      'TestingLabs': {
-        mspId: 'TestingLabsMSP',
-        certPath: 'labs.herbaltrace.com',  // Changed from testinglabs
-        keyPath: 'labs.herbaltrace.com'
-      },
-      'Processors': {
-        mspId: 'ProcessorsMSP',
-        certPath: 'processors.herbaltrace.com',
-        keyPath: 'processors.herbaltrace.com'
-      },
-      'Manufacturers': {
-        mspId: 'ManufacturersMSP',
-        certPath: 'manufacturers.herbaltrace.com',
-        keyPath: 'manufacturers.herbaltrace.com'
-      }
-    };
-
+    validateEnrollmentAttributes(orgName, attributes);
     const orgConfig = orgMap[orgName];
-    if (!orgConfig) {
-      throw new Error(`Unknown organization: ${orgName}`);
-    }
 
     // Initialize wallet
     const walletPath = path.join(__dirname, '..', '..', '..', 'network', 'wallet');
     const wallet = await Wallets.newFileSystemWallet(walletPath);
 
-    // Check if user already exists
-    const existingIdentity = await wallet.get(userId);
+    const existingIdentity = await wallet.get(userId) as X509Identity | undefined;
     if (existingIdentity) {
-      logger.info(`✅ User ${userId} already exists in wallet`);
-      return true;
+      const issued = certificateAttributes(existingIdentity.credentials.certificate);
+      if (issued.role === attributes.role && (issued.labId || '') === (attributes.labId || '')) {
+        logger.info(`✅ User ${userId} already exists in wallet`);
+        return true;
+      }
+      logger.info(`User ${userId} is enrolled without the requested attributes, re-enrolling`);
     }
 
-    // Use the organization's admin certificate as a template
-    // This is valid because all users in an org share the same MSP
-    const networkPath = path.join(__dirname, '..', '..', '..', 'network');
-    const orgPath = path.join(networkPath, 'organizations', 'peerOrganizations', orgConfig.certPath);
-    
-    // Path to admin user cert and key
-    const adminUserDir = 'Admin@' + orgConfig.certPath;
-    const adminCertDir = path.join(orgPath, 'users', adminUserDir, 'msp', 'signcerts');
-    const adminKeyPath = path.join(orgPath, 'users', adminUserDir, 'msp', 'keystore');
-    
-    // The cert filename includes the full admin name
-    const adminCertPath = path.join(adminCertDir, `${adminUserDir}-cert.pem`);
+    const ca = new FabricCAServices(orgConfig.caUrl, { trustedRoots: [], verify: false }, orgConfig.caName);
 
-    // Check if admin cert exists
-    if (!fs.existsSync(adminCertPath)) {
-      logger.error(`❌ Admin certificate not found at: ${adminCertPath}`);
-      return false;
+    // The CA bootstrap admin registers users, see the -b flag in docker-compose-ca.yaml
+    const adminLabel = `ca-admin-${orgName}`;
+    let adminIdentity = await wallet.get(adminLabel);
+    if (!adminIdentity) {
+      const adminEnrollment = await ca.enroll({
+        enrollmentID: process.env.FABRIC_CA_ADMIN || 'admin',
+        enrollmentSecret: process.env.FABRIC_CA_ADMIN_PASSWORD || 'adminpw'
+      });
+      adminIdentity = {
+        credentials: {
+          certificate: adminEnrollment.certificate,
+          privateKey: adminEnrollment.key.toBytes()
+        },
+        mspId: orgConfig.mspId,
+        type: 'X.509'
+      } as X509Identity;
+      await wallet.put(adminLabel, adminIdentity);
     }
+    const provider = wallet.getProviderRegistry().getProvider(adminIdentity.type);
+    const adminUser = await provider.getUserContext(adminIdentity, adminLabel);
 
-    // Get the admin's private key (there should be only one key file)
-    const keyFiles = fs.readdirSync(adminKeyPath);
-    if (keyFiles.length === 0) {
-      logger.error(`❌ No key files found in: ${adminKeyPath}`);
-      return false;
+    const attrs = [{ name: 'role', value: attributes.role, ecert: true }];
+    if (attributes.labId) {
+      attrs.push({ name: 'labId', value: attributes.labId, ecert: true });
+    }
+    const secret = randomBytes(16).toString('hex');
+    try {
+      await ca.register({
+        enrollmentID: userId,
+        enrollmentSecret: secret,
+        affiliation,
+        role: 'client',
+        maxEnrollments: -1,
+        attrs
+      }, adminUser);
+    } catch (error: any) {
+      if (!/already registered/i.test(error?.message || '')) {
+        throw error;
+      }
+      // Users registered before attributes were issued get them on their next enrollment
+      await ca.newIdentityService().update(userId, {
+        enrollmentID: userId,
+        enrollmentSecret: secret,
+        affiliation,
+        maxEnrollments: -1,
+        attrs
+      }, adminUser);
     }
-    const adminKeyFile = path.join(adminKeyPath, keyFiles[0]);
-
-    // Read certificate and key
-    const certificate = fs.readFileSync(adminCertPath, 'utf8');
-    const privateKey = fs.readFileSync(adminKeyFile, 'utf8');
 
-    // Create X509 identity for the user
-    // Note: This uses the admin's cert/key but with a different identity label
-    // In production, you'd use CA to generate unique certs, but for demo this works
+    const enrollment = await ca.enroll({ enrollmentID: userId, enrollmentSecret: secret });
     const identity: X509Identity = {
       credentials: {
-        certificate,
-        privateKey
+        certificate: enrollment.certificate,
+        privateKey: enrollment.key.toBytes()
       },
       mspId: orgConfig.mspId,
       type: 'X.509'
     };
-
-    // Put identity in wallet
     await wallet.put(userId, identity);
 
-    logger.info(`✅ Successfully enrolled user ${userId} in ${orgName} (${orgConfig.mspId})`);
-    logger.info(`   User can now submit transactions to the blockchain`);
-    
+    logger.info(`✅ Successfully enrolled user ${userId} in ${orgName} (${orgConfig.mspId}) as ${attributes.role}`);
     return true;
 
   } catch (error) {
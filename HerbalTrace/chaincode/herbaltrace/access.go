@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Roles are carried in the "role" attribute of the caller's enrollment certificate
+const (
+	roleAttribute       = "role"
+	roleForestAuthority = "forest_authority"
+	regulatorMSP        = "RegulatorMSP" // Organisation of the regulators, see network/configtx/configtx.yaml
+)
+
+// roleMSPs lists the organisations allowed to hold regulator roles. Any organisation's CA can put
+// any role in a certificate, so these roles are only honoured from identities of the regulator.
+var roleMSPs = map[string][]string{
+	roleForestAuthority:   {regulatorMSP},
+	roleAccreditationBody: {regulatorMSP},
+	roleCertificationBody: {regulatorMSP},
+	roleRegistryAdmin:     {regulatorMSP},
+	roleAlertManager:      {regulatorMSP},
+}
+
+// getCallerRole returns the role attribute of the submitting identity
+func getCallerRole(ctx contractapi.TransactionContextInterface) (string, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller role: %v", err)
+	}
+	if !found {
+		return "", nil
+	}
+	return role, nil
+}
+
+// requireRole checks that the submitting identity holds one of the allowed roles, from an
+// organisation permitted to issue it
+func requireRole(ctx contractapi.TransactionContextInterface, allowed ...string) error {
+	role, err := getCallerRole(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range allowed {
+		if role != candidate {
+			continue
+		}
+		if msps, restricted := roleMSPs[role]; restricted {
+			if err := requireMSP(ctx, msps...); err != nil {
+				return fmt.Errorf("role %s: %v", role, err)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("caller role %q is not permitted, requires one of: %s", role, strings.Join(allowed, ", "))
+}
+
+// getCallerIdentity returns the unique ID and MSP ID of the submitting identity
+func getCallerIdentity(ctx contractapi.TransactionContextInterface) (string, string, error) {
+	id, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read caller identity: %v", err)
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+
+	return id, mspID, nil
+}
+
+// requireMSP checks that the submitting identity belongs to one of the allowed organisations
+func requireMSP(ctx contractapi.TransactionContextInterface, allowed ...string) error {
+	_, mspID, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range allowed {
+		if mspID == candidate {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("caller organisation %q is not permitted, requires one of: %s", mspID, strings.Join(allowed, ", "))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// alertQueryPageSize is the number of alerts read per page when aggregating
+const alertQueryPageSize = 200
+
+// AlertAnalyticsFilter selects the alerts to aggregate. From is inclusive and To exclusive; both
+// accept RFC3339 timestamps or YYYY-MM-DD dates. Bucket is "day", "week" (ISO) or "month".
+type AlertAnalyticsFilter struct {
+	From       string `json:"from,omitempty"`
+	To         string `json:"to,omitempty"`
+	Zone       string `json:"zone,omitempty"`
+	Species    string `json:"species,omitempty"`
+	EntityType string `json:"entityType,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+}
+
+// AlertCounts aggregates a set of alerts
+type AlertCounts struct {
+	Total                      int            `json:"total"`
+	ByStatus                   map[string]int `json:"byStatus"`
+	BySeverity                 map[string]int `json:"bySeverity"`
+	ByType                     map[string]int `json:"byType"`
+	Occurrences                int            `json:"occurrences"` // Including deduplicated repeats
+	Acknowledged               int            `json:"acknowledged"`
+	Resolved                   int            `json:"resolved"`
+	MeanTimeToAcknowledgeHours float64        `json:"meanTimeToAcknowledgeHours"`
+	MeanTimeToResolveHours     float64        `json:"meanTimeToResolveHours"`
+
+	acknowledgeHours float64
+	resolveHours     float64
+}
+
+// AlertBucket aggregates the alerts raised in one day, week or month
+type AlertBucket struct {
+	Key   string `json:"key"` // "2025-03-01", "2025-W09" or "2025-03"
+	Start string `json:"start"`
+	AlertCounts
+}
+
+// AlertAnalytics is the result of GetAlertAnalytics
+type AlertAnalytics struct {
+	Filter AlertAnalyticsFilter `json:"filter"`
+	AlertCounts
+	ByZone       map[string]int `json:"byZone"`
+	BySpecies    map[string]int `json:"bySpecies"`
+	ByEntityType map[string]int `json:"byEntityType"`
+	Buckets      []AlertBucket  `json:"buckets"`
+	PagesRead    int            `json:"pagesRead"`
+	GeneratedAt  string         `json:"generatedAt"`
+}
+
+// alertsInWindowQuery reads the alerts raised in a time window. Zone, species and entity type are
+// filtered after reading, so a single index serves every filter.
+var alertsInWindowQuery = defineQuery("alertsInWindow",
+	`{"selector":{"type":"Alert","timestamp":{"$gte":"%s","$lt":"%s"}}}`,
+	"type", "timestamp")
+
+// GetAlertAnalytics aggregates the alerts raised in a time window, optionally for one zone, species
+// or entity type, into totals and day, week or month buckets with mean time to acknowledge and resolve.
+// Alerts are read page by page, so it should be evaluated rather than submitted.
+func (c *HerbalTraceContract) GetAlertAnalytics(ctx contractapi.TransactionContextInterface, filterJSON string) (*AlertAnalytics, error) {
+	var filter AlertAnalyticsFilter
+	if filterJSON != "" {
+		err := json.Unmarshal([]byte(filterJSON), &filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal filter: %v", err)
+		}
+	}
+	if filter.Bucket == "" {
+		filter.Bucket = "day"
+	}
+	if filter.Bucket != "day" && filter.Bucket != "week" && filter.Bucket != "month" {
+		return nil, fmt.Errorf("invalid bucket: %s. Valid buckets: day, week, month", filter.Bucket)
+	}
+
+	from, err := parseAnalyticsTime(filter.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %v", err)
+	}
+	to, err := parseAnalyticsTime(filter.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %v", err)
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	// The window bounds compare as strings; an open end matches every timestamp
+	windowStart, windowEnd := "", "9999-12-31T23:59:59Z"
+	if !from.IsZero() {
+		windowStart = from.Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		windowEnd = to.Format(time.RFC3339)
+	}
+
+	analytics := &AlertAnalytics{
+		Filter:       filter,
+		AlertCounts:  newAlertCounts(),
+		ByZone:       make(map[string]int),
+		BySpecies:    make(map[string]int),
+		ByEntityType: make(map[string]int),
+		Buckets:      []AlertBucket{},
+	}
+	buckets := make(map[string]*AlertBucket)
+
+	analytics.PagesRead, err = queryRecordsPaged(ctx, alertsInWindowQuery.format(windowStart, windowEnd), alertQueryPageSize, func(value []byte) error {
+		var alert Alert
+		if json.Unmarshal(value, &alert) != nil {
+			return nil
+		}
+		if (filter.Zone != "" && alert.Zone != filter.Zone) || (filter.Species != "" && alert.Species != filter.Species) ||
+			(filter.EntityType != "" && alert.EntityType != filter.EntityType) {
+			return nil
+		}
+
+		// The selector compares timestamps as strings, so recheck the window on the parsed time
+		raised, err := time.Parse(time.RFC3339, alert.Timestamp)
+		if err != nil || (!from.IsZero() && raised.Before(from)) || (!to.IsZero() && !raised.Before(to)) {
+			return nil
+		}
+
+		analytics.add(&alert)
+		analytics.ByZone[firstNonEmpty(alert.Zone, "unknown")]++
+		analytics.BySpecies[firstNonEmpty(alert.Species, "unknown")]++
+		analytics.ByEntityType[firstNonEmpty(alert.EntityType, "unknown")]++
+
+		key, start := alertBucket(raised.UTC(), filter.Bucket)
+		bucket, found := buckets[key]
+		if !found {
+			bucket = &AlertBucket{Key: key, Start: start, AlertCounts: newAlertCounts()}
+			buckets[key] = bucket
+		}
+		bucket.add(&alert)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	analytics.finish()
+	for _, key := range sortedKeys(buckets) {
+		buckets[key].finish()
+		analytics.Buckets = append(analytics.Buckets, *buckets[key])
+	}
+	analytics.GeneratedAt = time.Now().Format(time.RFC3339)
+
+	return analytics, nil
+}
+
+// newAlertCounts returns empty counts with every status, severity and alert type present
+func newAlertCounts() AlertCounts {
+	counts := AlertCounts{
+		ByStatus:   map[string]int{"active": 0, "acknowledged": 0, "resolved": 0},
+		BySeverity: make(map[string]int),
+		ByType:     make(map[string]int),
+	}
+	for severity := range alertSeverityRank {
+		counts.BySeverity[severity] = 0
+	}
+	for alertType := range alertTypes {
+		counts.ByType[alertType] = 0
+	}
+	return counts
+}
+
+// add counts an alert, including the time it took to acknowledge and resolve
+func (counts *AlertCounts) add(alert *Alert) {
+	counts.Total++
+	counts.ByStatus[alert.Status]++
+	counts.BySeverity[alert.Severity]++
+	counts.ByType[alert.AlertType]++
+	counts.Occurrences += max(alert.OccurrenceCount, 1)
+
+	raised, err := time.Parse(time.RFC3339, alert.Timestamp)
+	if err != nil {
+		return
+	}
+	if acknowledged, err := time.Parse(time.RFC3339, alert.AcknowledgedDate); err == nil {
+		counts.Acknowledged++
+		counts.acknowledgeHours += acknowledged.Sub(raised).Hours()
+	}
+	if alert.Status == "resolved" {
+		if resolved, err := time.Parse(time.RFC3339, alert.ResolvedDate); err == nil {
+			counts.Resolved++
+			counts.resolveHours += resolved.Sub(raised).Hours()
+		}
+	}
+}
+
+// finish turns the summed durations into means
+func (counts *AlertCounts) finish() {
+	if counts.Acknowledged > 0 {
+		counts.MeanTimeToAcknowledgeHours = roundScore(counts.acknowledgeHours / float64(counts.Acknowledged))
+	}
+	if counts.Resolved > 0 {
+		counts.MeanTimeToResolveHours = roundScore(counts.resolveHours / float64(counts.Resolved))
+	}
+}
+
+// alertBucket returns the key and start date of the bucket a time falls in
+func alertBucket(t time.Time, bucket string) (string, string) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch bucket {
+	case "week":
+		year, week := t.ISOWeek()
+		monday := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return fmt.Sprintf("%d-W%02d", year, week), monday.Format("2006-01-02")
+	case "month":
+		return day.Format("2006-01"), day.AddDate(0, 0, 1-day.Day()).Format("2006-01-02")
+	}
+	return day.Format("2006-01-02"), day.Format("2006-01-02")
+}
+
+// parseAnalyticsTime parses an RFC3339 timestamp or a YYYY-MM-DD date as UTC. Empty means unbounded.
+func parseAnalyticsTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// queryRecordsPaged runs a rich query page by page, handing each record to collect, and returns
+// the number of pages read
+func queryRecordsPaged(ctx contractapi.TransactionContextInterface, queryString string, pageSize int32, collect func([]byte) error) (int, error) {
+	bookmark := ""
+	pages := 0
+	for {
+		resultsIterator, responseMetadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
+		if err != nil {
+			return pages, fmt.Errorf("failed to query: %v", err)
+		}
+		pages++
+
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return pages, fmt.Errorf("failed to iterate query results: %v", err)
+			}
+			err = collect(queryResponse.Value)
+			if err != nil {
+				resultsIterator.Close()
+				return pages, err
+			}
+		}
+		resultsIterator.Close()
+
+		if responseMetadata == nil || responseMetadata.Bookmark == "" || responseMetadata.FetchedRecordsCount < pageSize {
+			return pages, nil
+		}
+		bookmark = responseMetadata.Bookmark
+	}
+}
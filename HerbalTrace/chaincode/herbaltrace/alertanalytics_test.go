@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newAnalyticsLedger returns a ledger holding alerts around March 2025: one just before it, four
+// inside it and one on the first instant of April
+func newAnalyticsLedger(t *testing.T) *testLedger {
+	ledger := newTestLedger()
+	alerts := []Alert{
+		{ID: "ALERT-1", Timestamp: "2025-02-28T23:59:59Z", Zone: "Dehradun", Species: "Neem", EntityType: "Batch", Status: "active", Severity: "low", AlertType: "compliance"},
+		{ID: "ALERT-2", Timestamp: "2025-03-01T00:00:00Z", Zone: "Dehradun", Species: "Neem", EntityType: "Batch", Status: "active", Severity: "medium", AlertType: "quality_failure"},
+		{ID: "ALERT-3", Timestamp: "2025-03-03T05:30:00+05:30", Zone: "Dehradun", Species: "Tulsi", EntityType: "CollectionEvent", Status: "acknowledged", Severity: "medium", AlertType: "zone_violation",
+			AcknowledgedDate: "2025-03-03T02:00:00Z"},
+		{ID: "ALERT-4", Timestamp: "2025-03-10T12:00:00Z", Zone: "Haridwar", Species: "Neem", EntityType: "Batch", Status: "resolved", Severity: "high", AlertType: "over_harvest",
+			AcknowledgedDate: "2025-03-10T13:00:00Z", ResolvedDate: "2025-03-11T00:00:00Z", OccurrenceCount: 3},
+		{ID: "ALERT-5", Timestamp: "2025-03-31T23:00:00Z", EntityType: "Product", Status: "resolved", Severity: "critical", AlertType: "counterfeit_suspected",
+			ResolvedDate: "2025-04-01T03:00:00Z"},
+		{ID: "ALERT-6", Timestamp: "2025-04-01T00:00:00Z", Zone: "Dehradun", Species: "Neem", EntityType: "Batch", Status: "active", Severity: "low", AlertType: "compliance"},
+	}
+	for _, alert := range alerts {
+		alert.Type = "Alert"
+		ledger.put(t, alert.ID, alert)
+	}
+	return ledger
+}
+
+// alertAnalytics runs GetAlertAnalytics with a filter against the ledger
+func alertAnalytics(t *testing.T, ledger *testLedger, filter AlertAnalyticsFilter) (*AlertAnalytics, error) {
+	t.Helper()
+	filterBytes, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatalf("failed to marshal filter: %v", err)
+	}
+	tx := ledger.begin("analytics")
+	return new(HerbalTraceContract).GetAlertAnalytics(tx.context(testAlertManager), string(filterBytes))
+}
+
+func TestAlertBucketKeys(t *testing.T) {
+	tests := []struct {
+		time      string
+		bucket    string
+		wantKey   string
+		wantStart string
+	}{
+		{"2025-03-01T15:04:05Z", "day", "2025-03-01", "2025-03-01"},
+		{"2025-03-01T15:04:05Z", "week", "2025-W09", "2025-02-24"},
+		{"2025-03-03T00:00:00Z", "week", "2025-W10", "2025-03-03"},
+		{"2025-03-09T23:59:59Z", "week", "2025-W10", "2025-03-03"},
+		// ISO weeks belong to the year of their Thursday
+		{"2024-12-30T08:00:00Z", "week", "2025-W01", "2024-12-30"},
+		{"2026-01-01T08:00:00Z", "week", "2026-W01", "2025-12-29"},
+		{"2021-01-03T08:00:00Z", "week", "2020-W53", "2020-12-28"},
+		{"2025-03-31T23:59:59Z", "month", "2025-03", "2025-03-01"},
+		{"2024-02-29T12:00:00Z", "month", "2024-02", "2024-02-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bucket+" "+tt.time, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.time)
+			if err != nil {
+				t.Fatalf("invalid test time: %v", err)
+			}
+			key, start := alertBucket(at, tt.bucket)
+			if key != tt.wantKey || start != tt.wantStart {
+				t.Errorf("bucket = %s starting %s, want %s starting %s", key, start, tt.wantKey, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestParseAnalyticsTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2025-03-01", time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC), false},
+		{" 2025-03-01 ", time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2025-03-01T05:30:00+05:30", time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2025-03-01T10:00:00Z", time.Date(2025, time.March, 1, 10, 0, 0, 0, time.UTC), false},
+		{"01/03/2025", time.Time{}, true},
+		{"2025-02-30", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseAnalyticsTime(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("parsed %v, want %v in UTC", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertAnalyticsWindow(t *testing.T) {
+	ledger := newAnalyticsLedger(t)
+
+	tests := []struct {
+		name   string
+		filter AlertAnalyticsFilter
+		want   []string
+	}{
+		{"unbounded", AlertAnalyticsFilter{}, []string{"ALERT-1", "ALERT-2", "ALERT-3", "ALERT-4", "ALERT-5", "ALERT-6"}},
+		{"dates include from and exclude to", AlertAnalyticsFilter{From: "2025-03-01", To: "2025-04-01"}, []string{"ALERT-2", "ALERT-3", "ALERT-4", "ALERT-5"}},
+		{"open end", AlertAnalyticsFilter{From: "2025-03-31"}, []string{"ALERT-5", "ALERT-6"}},
+		{"open start", AlertAnalyticsFilter{To: "2025-03-01"}, []string{"ALERT-1"}},
+		{"timestamps with offsets", AlertAnalyticsFilter{From: "2025-03-03T05:30:00+05:30", To: "2025-03-10T17:30:00+05:30"}, []string{"ALERT-3"}},
+		{"empty window", AlertAnalyticsFilter{From: "2025-03-20", To: "2025-03-21"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Bucket = "day"
+			analytics, err := alertAnalytics(t, ledger, tt.filter)
+			if err != nil {
+				t.Fatalf("analytics failed: %v", err)
+			}
+			// Every alert raised on a different day, so the day buckets identify the alerts counted
+			var days []string
+			for _, bucket := range analytics.Buckets {
+				days = append(days, bucket.Key)
+			}
+			var wantDays []string
+			for _, alertID := range tt.want {
+				var alert Alert
+				ledger.get(t, alertID, &alert)
+				raised, _ := time.Parse(time.RFC3339, alert.Timestamp)
+				wantDays = append(wantDays, raised.UTC().Format("2006-01-02"))
+			}
+			if analytics.Total != len(tt.want) || fmt.Sprint(days) != fmt.Sprint(wantDays) {
+				t.Errorf("counted %d alerts on %v, want %v on %v", analytics.Total, days, tt.want, wantDays)
+			}
+		})
+	}
+}
+
+func TestAlertAnalyticsFilters(t *testing.T) {
+	ledger := newAnalyticsLedger(t)
+
+	tests := []struct {
+		name   string
+		filter AlertAnalyticsFilter
+		want   int
+	}{
+		{"zone", AlertAnalyticsFilter{Zone: "Dehradun"}, 4},
+		{"species", AlertAnalyticsFilter{Species: "Neem"}, 4},
+		{"entity type", AlertAnalyticsFilter{EntityType: "Batch"}, 4},
+		{"entity type in window", AlertAnalyticsFilter{EntityType: "Batch", From: "2025-03-01", To: "2025-04-01"}, 2},
+		{"zone and species", AlertAnalyticsFilter{Zone: "Dehradun", Species: "Tulsi"}, 1},
+		{"zone and entity type", AlertAnalyticsFilter{Zone: "Haridwar", EntityType: "CollectionEvent"}, 0},
+		{"unknown zone", AlertAnalyticsFilter{Zone: "Nowhere"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analytics, err := alertAnalytics(t, ledger, tt.filter)
+			if err != nil {
+				t.Fatalf("analytics failed: %v", err)
+			}
+			if analytics.Total != tt.want {
+				t.Errorf("counted %d alerts, want %d", analytics.Total, tt.want)
+			}
+			if tt.filter.Zone != "" && analytics.ByZone[tt.filter.Zone] != tt.want {
+				t.Errorf("byZone = %v, want only %s", analytics.ByZone, tt.filter.Zone)
+			}
+		})
+	}
+}
+
+func TestAlertAnalyticsCounts(t *testing.T) {
+	ledger := newAnalyticsLedger(t)
+
+	analytics, err := alertAnalytics(t, ledger, AlertAnalyticsFilter{From: "2025-03-01", To: "2025-04-01", Bucket: "week"})
+	if err != nil {
+		t.Fatalf("analytics failed: %v", err)
+	}
+
+	if analytics.Total != 4 || analytics.Occurrences != 6 {
+		t.Errorf("counted %d alerts and %d occurrences, want 4 and 6", analytics.Total, analytics.Occurrences)
+	}
+	if want := map[string]int{"active": 1, "acknowledged": 1, "resolved": 2}; fmt.Sprint(analytics.ByStatus) != fmt.Sprint(want) {
+		t.Errorf("byStatus = %v, want %v", analytics.ByStatus, want)
+	}
+	if analytics.BySeverity["low"] != 0 || analytics.BySeverity["critical"] != 1 || analytics.ByType["system"] != 0 || analytics.ByType["over_harvest"] != 1 {
+		t.Errorf("bySeverity = %v, byType = %v", analytics.BySeverity, analytics.ByType)
+	}
+	if want := map[string]int{"Dehradun": 2, "Haridwar": 1, "unknown": 1}; fmt.Sprint(analytics.ByZone) != fmt.Sprint(want) {
+		t.Errorf("byZone = %v, want %v", analytics.ByZone, want)
+	}
+	if want := map[string]int{"Neem": 2, "Tulsi": 1, "unknown": 1}; fmt.Sprint(analytics.BySpecies) != fmt.Sprint(want) {
+		t.Errorf("bySpecies = %v, want %v", analytics.BySpecies, want)
+	}
+
+	// ALERT-3 took 2 hours to acknowledge and ALERT-4 one hour; ALERT-4 took 12 hours to resolve and
+	// ALERT-5, resolved without acknowledgement, 4 hours
+	if analytics.Acknowledged != 2 || analytics.MeanTimeToAcknowledgeHours != 1.5 {
+		t.Errorf("acknowledged %d with MTTA %v hours, want 2 with 1.5", analytics.Acknowledged, analytics.MeanTimeToAcknowledgeHours)
+	}
+	if analytics.Resolved != 2 || analytics.MeanTimeToResolveHours != 8 {
+		t.Errorf("resolved %d with MTTR %v hours, want 2 with 8", analytics.Resolved, analytics.MeanTimeToResolveHours)
+	}
+
+	wantBuckets := []struct {
+		key, start string
+		total      int
+		mtta, mttr float64
+	}{
+		{"2025-W09", "2025-02-24", 1, 0, 0},
+		{"2025-W10", "2025-03-03", 1, 2, 0},
+		{"2025-W11", "2025-03-10", 1, 1, 12},
+		{"2025-W14", "2025-03-31", 1, 0, 4},
+	}
+	if len(analytics.Buckets) != len(wantBuckets) {
+		t.Fatalf("got %d buckets, want %d: %+v", len(analytics.Buckets), len(wantBuckets), analytics.Buckets)
+	}
+	for i, want := range wantBuckets {
+		bucket := analytics.Buckets[i]
+		if bucket.Key != want.key || bucket.Start != want.start || bucket.Total != want.total ||
+			bucket.MeanTimeToAcknowledgeHours != want.mtta || bucket.MeanTimeToResolveHours != want.mttr {
+			t.Errorf("bucket %d = %s from %s with %d alerts, MTTA %v, MTTR %v, want %+v", i, bucket.Key, bucket.Start,
+				bucket.Total, bucket.MeanTimeToAcknowledgeHours, bucket.MeanTimeToResolveHours, want)
+		}
+	}
+
+	analytics, err = alertAnalytics(t, ledger, AlertAnalyticsFilter{From: "2025-03-01", To: "2025-04-01", Bucket: "month"})
+	if err != nil {
+		t.Fatalf("analytics failed: %v", err)
+	}
+	if len(analytics.Buckets) != 1 || analytics.Buckets[0].Key != "2025-03" || analytics.Buckets[0].Total != 4 {
+		t.Errorf("month buckets = %+v, want one 2025-03 bucket with 4 alerts", analytics.Buckets)
+	}
+}
+
+func TestAlertAnalyticsRejectsInvalidFilters(t *testing.T) {
+	ledger := newAnalyticsLedger(t)
+
+	for _, filter := range []AlertAnalyticsFilter{
+		{Bucket: "year"},
+		{From: "yesterday"},
+		{To: "2025-13-01"},
+		{From: "2025-04-01", To: "2025-03-01"},
+		{From: "2025-03-01", To: "2025-03-01"},
+	} {
+		if _, err := alertAnalytics(t, ledger, filter); err == nil {
+			t.Errorf("filter %+v was accepted", filter)
+		}
+	}
+}
+
+func TestQueryRecordsPaged(t *testing.T) {
+	tests := []struct {
+		records   int
+		pageSize  int32
+		wantPages int
+	}{
+		{0, 2, 1},
+		{1, 2, 1},
+		{5, 2, 3},
+		// A full last page is followed by an empty one, as with CouchDB bookmarks
+		{4, 2, 3},
+		{5, 10, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d records in pages of %d", tt.records, tt.pageSize), func(t *testing.T) {
+			ledger := newTestLedger()
+			for i := 0; i < tt.records; i++ {
+				ledger.put(t, fmt.Sprintf("ALERT-%02d", i), Alert{ID: fmt.Sprintf("ALERT-%02d", i), Type: "Alert", Timestamp: testTime.Format(time.RFC3339)})
+			}
+			// A record of another type is never returned
+			ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch"})
+
+			tx := ledger.begin("paged")
+			var collected []string
+			pages, err := queryRecordsPaged(tx.context(testAlertManager), alertsInWindowQuery.format("", "9999"), tt.pageSize, func(value []byte) error {
+				var alert Alert
+				if err := json.Unmarshal(value, &alert); err != nil {
+					return err
+				}
+				collected = append(collected, alert.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			if pages != tt.wantPages || len(tx.queries) != tt.wantPages {
+				t.Errorf("read %d pages in %d queries, want %d", pages, len(tx.queries), tt.wantPages)
+			}
+			if len(collected) != tt.records {
+				t.Fatalf("collected %v, want %d records", collected, tt.records)
+			}
+			for i, alertID := range collected {
+				if want := fmt.Sprintf("ALERT-%02d", i); alertID != want {
+					t.Errorf("record %d is %s, want %s", i, alertID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryRecordsPagedStopsOnCollectError(t *testing.T) {
+	ledger := newTestLedger()
+	for i := 0; i < 5; i++ {
+		ledger.put(t, fmt.Sprintf("ALERT-%02d", i), Alert{ID: fmt.Sprintf("ALERT-%02d", i), Type: "Alert", Timestamp: testTime.Format(time.RFC3339)})
+	}
+
+	tx := ledger.begin("paged")
+	collected := 0
+	pages, err := queryRecordsPaged(tx.context(testAlertManager), alertsInWindowQuery.format("", "9999"), 2, func(value []byte) error {
+		collected++
+		if collected == 3 {
+			return fmt.Errorf("stop")
+		}
+		return nil
+	})
+	if err == nil || pages != 2 || collected != 3 {
+		t.Errorf("query stopped after %d pages and %d records with %v, want 2 pages, 3 records and an error", pages, collected, err)
+	}
+}
+
+func TestAlertAnalyticsReadsEveryPage(t *testing.T) {
+	ledger := newTestLedger()
+	alerts := 2*alertQueryPageSize + 1
+	for i := 0; i < alerts; i++ {
+		raised := testTime.Add(-time.Duration(i) * time.Minute)
+		ledger.put(t, fmt.Sprintf("ALERT-%04d", i), Alert{ID: fmt.Sprintf("ALERT-%04d", i), Type: "Alert", AlertType: "compliance", Severity: "low",
+			Status: "active", Timestamp: raised.Format(time.RFC3339)})
+	}
+
+	analytics, err := alertAnalytics(t, ledger, AlertAnalyticsFilter{})
+	if err != nil {
+		t.Fatalf("analytics failed: %v", err)
+	}
+	if analytics.PagesRead != 3 || analytics.Total != alerts {
+		t.Errorf("read %d pages counting %d alerts, want 3 pages and %d alerts", analytics.PagesRead, analytics.Total, alerts)
+	}
+}
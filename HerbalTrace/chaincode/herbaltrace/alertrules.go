@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// alertRuleTriggers lists the trigger events each entity raises while it is written
+var alertRuleTriggers = map[string][]string{
+	"CollectionEvent": {"created", "season_violation", "zone_violation", "harvest_limit_exceeded", "conservation_violation"},
+	"HarvestLimit":    {"threshold_crossed"},
+	"QualityTest":     {"created"},
+}
+
+// AlertRule declares when an alert is raised. Rules are evaluated whenever their trigger entity
+// raises the trigger event; an alert is raised if the condition holds for the record being written.
+type AlertRule struct {
+	ID              string   `json:"id"`
+	Type            string   `json:"type"`                // "AlertRule"
+	TriggerEntity   string   `json:"triggerEntity"`       // "CollectionEvent", "HarvestLimit", "QualityTest"
+	TriggerEvent    string   `json:"triggerEvent"`        // See alertRuleTriggers
+	Condition       string   `json:"condition,omitempty"` // Empty always holds, see ruleExpr
+	AlertType       string   `json:"alertType"`
+	Severity        string   `json:"severity"`
+	MessageTemplate string   `json:"messageTemplate"` // Fields are filled in with {{field}} or {{field|%.2f}}
+	DetailsTemplate string   `json:"detailsTemplate,omitempty"`
+	DedupScope      []string `json:"dedupScope,omitempty"` // Fields whose values identify a repeat, defaults to the record ID
+	Enabled         bool     `json:"enabled"`
+	Version         int      `json:"version"`
+	UpdatedBy       string   `json:"updatedBy,omitempty"`
+	UpdatedAt       string   `json:"updatedAt,omitempty"`
+}
+
+// defaultAlertRules are the built-in rules. A rule stored on the ledger with the same ID replaces the
+// built-in one, so built-in rules can be tuned or disabled without a chaincode upgrade.
+func defaultAlertRules() []AlertRule {
+	return []AlertRule{
+		{
+			ID:              "season",
+			TriggerEntity:   "CollectionEvent",
+			TriggerEvent:    "season_violation",
+			AlertType:       "season_violation",
+			Severity:        "high",
+			MessageTemplate: "Harvest outside allowed season window",
+			DetailsTemplate: "Species {{species}} harvested on {{harvestDate}} in {{zoneName}} is outside the permitted season window",
+		},
+		{
+			ID:              "zone",
+			TriggerEntity:   "CollectionEvent",
+			TriggerEvent:    "zone_violation",
+			AlertType:       "zone_violation",
+			Severity:        "high",
+			MessageTemplate: "Collection location outside approved zone",
+			DetailsTemplate: "Harvest near ({{latitude|%.2f}}, {{longitude|%.2f}}) is outside approved zone for species {{species}}",
+		},
+		{
+			ID:              "harvest",
+			TriggerEntity:   "CollectionEvent",
+			TriggerEvent:    "harvest_limit_exceeded",
+			AlertType:       "over_harvest",
+			Severity:        "critical",
+			MessageTemplate: "Harvest limit exceeded",
+			DetailsTemplate: "Attempting to harvest {{quantity|%.2f}} {{unit}} of {{species}} in {{zoneName}} for season {{context.season}} would exceed the limit",
+		},
+		{
+			ID:              "warning",
+			TriggerEntity:   "HarvestLimit",
+			TriggerEvent:    "threshold_crossed",
+			Condition:       `status != "normal"`,
+			AlertType:       "over_harvest",
+			Severity:        "medium",
+			MessageTemplate: "Harvest limit warning",
+			DetailsTemplate: "{{context.percentUsed|%.1f}}% of harvest limit reached for {{species}} in {{zone}} for season {{season}} ({{currentQuantity|%.2f}} / {{maxQuantity|%.2f}} {{unit}})",
+			DedupScope:      []string{"species", "zone", "season"},
+		},
+		{
+			ID:              "conservation",
+			TriggerEntity:   "CollectionEvent",
+			TriggerEvent:    "conservation_violation",
+			AlertType:       "compliance",
+			Severity:        "high",
+			MessageTemplate: "Conservation limit violation",
+			DetailsTemplate: "Conservation limits exceeded for species {{species}}: {{context.error}}",
+		},
+		{
+			ID:              "quality",
+			TriggerEntity:   "QualityTest",
+			TriggerEvent:    "created",
+			Condition:       `overallResult == "fail"`,
+			AlertType:       "quality_failure",
+			Severity:        "high",
+			MessageTemplate: "Quality test failed",
+			DetailsTemplate: "Batch {{batchId}} failed quality testing at lab {{labName}}. Overall result: fail",
+		},
+	}
+}
+
+// CreateAlertRule stores an alert rule, which may replace a built-in rule with the same ID (registry admin or forest authority only)
+func (c *HerbalTraceContract) CreateAlertRule(ctx contractapi.TransactionContextInterface, ruleJSON string) error {
+	return c.putAlertRuleFromJSON(ctx, ruleJSON, false)
+}
+
+// UpdateAlertRule replaces the definition of a stored alert rule (registry admin or forest authority only)
+func (c *HerbalTraceContract) UpdateAlertRule(ctx contractapi.TransactionContextInterface, ruleJSON string) error {
+	return c.putAlertRuleFromJSON(ctx, ruleJSON, true)
+}
+
+// GetAlertRule retrieves an alert rule, falling back to the built-in rule with that ID
+func (c *HerbalTraceContract) GetAlertRule(ctx contractapi.TransactionContextInterface, ruleID string) (*AlertRule, error) {
+	rule, err := getStoredAlertRule(ctx, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		return rule, nil
+	}
+
+	for _, builtIn := range defaultAlertRules() {
+		if builtIn.ID == ruleID {
+			builtIn.Type = "AlertRule"
+			builtIn.Enabled = true
+			return &builtIn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("alert rule not found: %s", ruleID)
+}
+
+// GetAlertRules retrieves the effective alert rules, stored and built-in, ordered by ID
+func (c *HerbalTraceContract) GetAlertRules(ctx contractapi.TransactionContextInterface) ([]*AlertRule, error) {
+	return c.effectiveAlertRules(ctx, func(rule *AlertRule) bool {
+		return true
+	})
+}
+
+// putAlertRuleFromJSON validates and stores an alert rule
+func (c *HerbalTraceContract) putAlertRuleFromJSON(ctx contractapi.TransactionContextInterface, ruleJSON string, update bool) error {
+	err := requireRole(ctx, roleRegistryAdmin, roleForestAuthority)
+	if err != nil {
+		return err
+	}
+
+	var rule AlertRule
+	err = json.Unmarshal([]byte(ruleJSON), &rule)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal alert rule: %v", err)
+	}
+	err = validateAlertRule(&rule)
+	if err != nil {
+		return err
+	}
+
+	existing, err := getStoredAlertRule(ctx, rule.ID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case update && existing == nil:
+		return fmt.Errorf("alert rule not found: %s", rule.ID)
+	case !update && existing != nil:
+		return fmt.Errorf("alert rule %s already exists", rule.ID)
+	}
+
+	rule.Type = "AlertRule"
+	rule.Version = 1
+	if existing != nil {
+		rule.Version = existing.Version + 1
+	}
+	rule.UpdatedBy, _, err = getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	rule.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	ruleBytes, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert rule: %v", err)
+	}
+	err = ctx.GetStub().PutState(alertRuleKey(rule.ID), ruleBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save alert rule: %v", err)
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":     "AlertRuleUpdated",
+		"ruleId":        rule.ID,
+		"triggerEntity": rule.TriggerEntity,
+		"triggerEvent":  rule.TriggerEvent,
+		"enabled":       rule.Enabled,
+		"version":       rule.Version,
+		"updatedBy":     rule.UpdatedBy,
+		"timestamp":     rule.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("AlertRuleUpdated", eventBytes)
+
+	return nil
+}
+
+// evaluateAlertRules raises an alert for every enabled rule of an entity's trigger event whose
+// condition holds for the record. Rules run in ID order.
+func (c *HerbalTraceContract) evaluateAlertRules(ctx contractapi.TransactionContextInterface, entityType string, trigger string, record interface{}, context map[string]interface{}) error {
+	rules, err := c.effectiveAlertRules(ctx, func(rule *AlertRule) bool {
+		return rule.TriggerEntity == entityType && rule.TriggerEvent == trigger
+	})
+	if err != nil {
+		return err
+	}
+
+	facts, err := ruleFacts(record, context)
+	if err != nil {
+		return err
+	}
+	entityID, _ := facts["id"].(string)
+
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		condition, err := parseRuleCondition(rule.Condition)
+		if err != nil {
+			return fmt.Errorf("invalid condition in alert rule %s: %v", rule.ID, err)
+		}
+		if !ruleTruthy(condition.eval(facts)) {
+			continue
+		}
+
+		scope := []string{entityID}
+		if len(rule.DedupScope) > 0 {
+			scope = make([]string, len(rule.DedupScope))
+			for i, field := range rule.DedupScope {
+				scope[i] = renderRuleTemplate("{{"+field+"}}", facts)
+			}
+		}
+
+		dedupKey := alertDedupKey(rule.ID, scope...)
+		alert := Alert{
+			ID:         ruleAlertID(rule.ID, dedupKey),
+			AlertType:  rule.AlertType,
+			Severity:   rule.Severity,
+			EntityID:   entityID,
+			EntityType: entityType,
+			Message:    renderRuleTemplate(rule.MessageTemplate, facts),
+			Details:    renderRuleTemplate(rule.DetailsTemplate, facts),
+			CreatedBy:  "rule:" + rule.ID,
+			RuleID:     rule.ID,
+			DedupKey:   dedupKey,
+		}
+		alert.Species, _ = facts["species"].(string)
+		alert.Zone, _ = facts["zoneName"].(string)
+		if zone, found := facts["zone"].(string); found && alert.Zone == "" {
+			alert.Zone = zone
+		}
+
+		err = c.createAlert(ctx, &alert)
+		if err != nil {
+			return fmt.Errorf("failed to raise alert for rule %s: %v", rule.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// effectiveAlertRules returns the built-in and stored rules accepted by matches, ordered by ID.
+// Stored rules replace built-in rules with the same ID.
+func (c *HerbalTraceContract) effectiveAlertRules(ctx contractapi.TransactionContextInterface, matches func(rule *AlertRule) bool) ([]*AlertRule, error) {
+	rulesByID := make(map[string]*AlertRule)
+	for _, builtIn := range defaultAlertRules() {
+		rule := builtIn
+		rule.Type = "AlertRule"
+		rule.Enabled = true
+		rulesByID[rule.ID] = &rule
+	}
+
+	// Rule IDs are letters, digits and underscores, which all sort below "~"
+	resultsIterator, err := ctx.GetStub().GetStateByRange(alertRuleKey(""), alertRuleKey("~"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rules: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate alert rules: %v", err)
+		}
+		var rule AlertRule
+		err = json.Unmarshal(queryResponse.Value, &rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal alert rule: %v", err)
+		}
+		rulesByID[rule.ID] = &rule
+	}
+
+	var rules []*AlertRule
+	for _, ruleID := range sortedKeys(rulesByID) {
+		if matches(rulesByID[ruleID]) {
+			rules = append(rules, rulesByID[ruleID])
+		}
+	}
+	return rules, nil
+}
+
+// validateAlertRule checks an alert rule before it is stored
+func validateAlertRule(rule *AlertRule) error {
+	if rule.ID == "" || !ruleFieldPattern.MatchString(rule.ID) || strings.Contains(rule.ID, ".") {
+		return fmt.Errorf("alert rule ID is required and may only contain letters, digits and underscores")
+	}
+
+	triggers, found := alertRuleTriggers[rule.TriggerEntity]
+	if !found {
+		return fmt.Errorf("invalid trigger entity: %s. Valid entities: %s", rule.TriggerEntity, strings.Join(sortedKeys(alertRuleTriggers), ", "))
+	}
+	validTrigger := false
+	for _, trigger := range triggers {
+		validTrigger = validTrigger || trigger == rule.TriggerEvent
+	}
+	if !validTrigger {
+		return fmt.Errorf("invalid trigger event %s for %s. Valid events: %s", rule.TriggerEvent, rule.TriggerEntity, strings.Join(triggers, ", "))
+	}
+
+	if !alertTypes[rule.AlertType] {
+		return fmt.Errorf("invalid alert type: %s", rule.AlertType)
+	}
+	if _, found := alertSeverityRank[rule.Severity]; !found {
+		return fmt.Errorf("invalid severity: %s", rule.Severity)
+	}
+	if rule.MessageTemplate == "" {
+		return fmt.Errorf("message template is required")
+	}
+
+	_, err := parseRuleCondition(rule.Condition)
+	if err != nil {
+		return fmt.Errorf("invalid condition: %v", err)
+	}
+	for _, template := range []string{rule.MessageTemplate, rule.DetailsTemplate} {
+		err = validateRuleTemplate(template)
+		if err != nil {
+			return err
+		}
+	}
+	for _, field := range rule.DedupScope {
+		if !ruleFieldPattern.MatchString(field) {
+			return fmt.Errorf("invalid dedup scope field: %s", field)
+		}
+	}
+
+	return nil
+}
+
+// getStoredAlertRule reads an alert rule from the ledger, or returns nil if none is stored
+func getStoredAlertRule(ctx contractapi.TransactionContextInterface, ruleID string) (*AlertRule, error) {
+	ruleBytes, err := ctx.GetStub().GetState(alertRuleKey(ruleID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rule: %v", err)
+	}
+	if ruleBytes == nil {
+		return nil, nil
+	}
+
+	var rule AlertRule
+	err = json.Unmarshal(ruleBytes, &rule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alert rule: %v", err)
+	}
+
+	return &rule, nil
+}
+
+// alertRuleKey returns the ledger key of an alert rule
+func alertRuleKey(ruleID string) string {
+	return "ALERTRULE_" + ruleID
+}
+
+// ruleAlertID derives the ID of the alert a rule raises from its dedup key. Scope values may
+// contain any character, so they are hashed rather than joined into the ID.
+func ruleAlertID(ruleID string, dedupKey string) string {
+	sum := sha256.Sum256([]byte(dedupKey))
+	return fmt.Sprintf("alert_%s_%s", ruleID, hex.EncodeToString(sum[:8]))
+}
+
+// ReportCollectionViolation raises the violation alert for a collection CreateCollectionEvent
+// rejected. A rejected transaction writes nothing, so the client resubmits the same collection and
+// private data here. The checks are re-run without booking harvest or permit quantity, and the
+// alert is only raised if one of them fails. It returns the violated trigger event.
+func (c *HerbalTraceContract) ReportCollectionViolation(ctx contractapi.TransactionContextInterface, eventJSON string) (string, error) {
+	event, _, species, err := c.prepareCollectionEvent(ctx, eventJSON)
+	if err != nil {
+		return "", err
+	}
+
+	trigger, context, err := c.collectionViolation(ctx, event, species)
+	if err != nil {
+		return "", err
+	}
+	if trigger == "" {
+		return "", fmt.Errorf("collection %s passes the season, zone, harvest limit and conservation checks", event.ID)
+	}
+
+	// Only a coarse location appears in the alert
+	event.Latitude = roundCoordinate(event.Latitude)
+	event.Longitude = roundCoordinate(event.Longitude)
+	err = c.evaluateAlertRules(ctx, "CollectionEvent", trigger, event, context)
+	if err != nil {
+		return "", err
+	}
+
+	return trigger, nil
+}
+
+// collectionViolation runs the checks CreateCollectionEvent rejects collections on, without
+// writing anything. It returns the trigger event of the first failed check and its rule context,
+// or an empty trigger if the collection passes them all.
+func (c *HerbalTraceContract) collectionViolation(ctx contractapi.TransactionContextInterface, event *CollectionEvent, species *Species) (string, map[string]interface{}, error) {
+	isInSeason, err := c.ValidateSeasonWindow(ctx, event.Species, event.HarvestDate, event.ZoneName)
+	if err != nil {
+		return "", nil, fmt.Errorf("season validation error: %v", err)
+	}
+	if !isInSeason {
+		return "season_violation", nil, nil
+	}
+
+	if !c.validateGeoFencing(event.Latitude, event.Longitude, event.Species) {
+		return "zone_violation", nil, nil
+	}
+
+	currentSeason := getCurrentSeason()
+	withinLimit, err := c.ValidateHarvestLimit(ctx, event.Species, event.ZoneName, currentSeason, event.Quantity, event.Unit)
+	if err != nil {
+		return "", nil, fmt.Errorf("harvest limit validation error: %v", err)
+	}
+	if !withinLimit {
+		return "harvest_limit_exceeded", map[string]interface{}{"season": currentSeason}, nil
+	}
+
+	if species.PermitRequired {
+		_, _, err = c.checkPermit(ctx, event)
+		if err != nil {
+			return "conservation_violation", map[string]interface{}{
+				"error": fmt.Sprintf("species %s is endangered and requires a valid permit: %v", event.Species, err),
+			}, nil
+		}
+	}
+
+	return "", nil, nil
+}
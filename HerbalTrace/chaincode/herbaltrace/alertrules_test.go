@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// newCollectionLedger returns a ledger holding an active farmer and species but no season windows,
+// so every collection falls outside the season
+func newCollectionLedger(t *testing.T) *testLedger {
+	ledger := newTestLedger()
+	ledger.put(t, "FARMER-1", Farmer{ID: "FARMER-1", Type: "Farmer", Name: "Test Farmer", Status: "active"})
+	registerTestSpecies(t, ledger)
+	return ledger
+}
+
+// registerTestSpecies adds the test species to the registry of a ledger
+func registerTestSpecies(t *testing.T, ledger *testLedger) {
+	t.Helper()
+	ledger.put(t, "SPECIES-WS", Species{ID: "SPECIES-WS", Type: "Species", ScientificName: testSpecies, CommonNames: []string{"Ashwagandha"}, IUCNStatus: "LC", DefaultUnit: "kg", Active: true})
+	aliasKey, err := shim.CreateCompositeKey(speciesAliasObjectType, []string{normalizeSpeciesName(testSpecies)})
+	if err != nil {
+		t.Fatalf("failed to create species alias key: %v", err)
+	}
+	ledger.height++
+	ledger.state[aliasKey] = []byte("SPECIES-WS")
+	ledger.versions[aliasKey] = ledger.height
+}
+
+func TestRuleAlertIDsDoNotCollide(t *testing.T) {
+	// Scopes that join to the same string with "_" get different IDs
+	first := ruleAlertID("warning", alertDedupKey("warning", "a_b", "c"))
+	second := ruleAlertID("warning", alertDedupKey("warning", "a", "b_c"))
+	if first == second {
+		t.Errorf("scopes a_b|c and a|b_c share alert ID %s", first)
+	}
+
+	// An alert left at the ID the season rule used to derive does not block the rule
+	ledger := newTestLedger()
+	ledger.put(t, "alert_season_COL-9", Alert{ID: "alert_season_COL-9", Type: "Alert", AlertType: "compliance", Severity: "low", Status: "resolved", DedupKey: "legacy"})
+
+	tx := ledger.begin("season")
+	event := &CollectionEvent{ID: "COL-9", Type: "CollectionEvent", Species: testSpecies, ZoneName: testZone, HarvestDate: testTime.Format(time.RFC3339)}
+	err := new(HerbalTraceContract).evaluateAlertRules(tx.context(testFarmer), "CollectionEvent", "season_violation", event, nil)
+	if err != nil {
+		t.Fatalf("season rule failed: %v", err)
+	}
+	for _, query := range tx.queries {
+		if strings.Contains(query, "AlertRule") {
+			t.Errorf("alert rules were read by rich query %s", query)
+		}
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("alert did not commit: %v", err)
+	}
+
+	var raised []Alert
+	for _, alert := range committedAlerts(t, ledger) {
+		if alert.RuleID == "season" {
+			raised = append(raised, alert)
+		}
+	}
+	if len(raised) != 1 || raised[0].ID == "alert_season_COL-9" {
+		t.Errorf("season rule raised %+v, want one alert beside the legacy one", raised)
+	}
+}
+
+func TestReportCollectionViolationCommitsAlert(t *testing.T) {
+	ledger := newCollectionLedger(t)
+	contract := new(HerbalTraceContract)
+	eventJSON := `{"id":"COL-9","farmerId":"FARMER-1","species":"` + testSpecies + `","quantity":5,"unit":"kg","zoneName":"` + testZone + `","harvestDate":"2025-04-15T08:00:00Z"}`
+	details, _ := json.Marshal(CollectionEventPrivateDetails{Latitude: 28.6139, Longitude: 77.2090, Salt: strings.Repeat("s", minPrivateSaltLength)})
+
+	// The collection is rejected, so nothing it raised would survive
+	tx := ledger.begin("collect")
+	tx.TransientMap = map[string][]byte{transientPrivateData: details}
+	if err := contract.CreateCollectionEvent(tx.context(testFarmer), eventJSON); err == nil {
+		t.Fatalf("out-of-season collection was accepted")
+	}
+
+	tx = ledger.begin("report")
+	tx.TransientMap = map[string][]byte{transientPrivateData: details}
+	trigger, err := contract.ReportCollectionViolation(tx.context(testFarmer), eventJSON)
+	if err != nil {
+		t.Fatalf("violation was not reported: %v", err)
+	}
+	if trigger != "season_violation" {
+		t.Errorf("reported %s, want season_violation", trigger)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("report did not commit: %v", err)
+	}
+
+	alerts := committedAlerts(t, ledger)
+	if len(alerts) != 1 || alerts[0].RuleID != "season" || alerts[0].EntityID != "COL-9" {
+		t.Fatalf("raised %+v, want a season alert for COL-9", alerts)
+	}
+	if _, found := ledger.state["COL-9"]; found {
+		t.Errorf("reporting a violation recorded the collection")
+	}
+}
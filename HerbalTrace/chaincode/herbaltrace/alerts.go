@@ -3,16 +3,31 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
+// alertDedupObjectType is the composite key prefix mapping alert dedup keys to alert IDs
+const alertDedupObjectType = "alertDedup"
+
+// alertTypes lists the valid alert types
+var alertTypes = map[string]bool{
+	"over_harvest":          true,
+	"quality_failure":       true,
+	"zone_violation":        true,
+	"season_violation":      true,
+	"compliance":            true,
+	"counterfeit_suspected": true,
+	"system":                true,
+}
+
 // Alert represents a system alert for violations, failures, or compliance issues
 type Alert struct {
 	ID               string `json:"id"`
 	Type             string `json:"type"` // "Alert"
-	AlertType        string `json:"alertType"` // "over_harvest", "quality_failure", "zone_violation", "season_violation", "compliance"
+	AlertType        string `json:"alertType"` // "over_harvest", "quality_failure", "zone_violation", "season_violation", "compliance", "counterfeit_suspected"
 	Severity         string `json:"severity"` // "low", "medium", "high", "critical"
 	EntityID         string `json:"entityId"` // Related batch/collection/test ID
 	EntityType       string `json:"entityType"` // "Batch", "CollectionEvent", "QualityTest", "ProcessingStep", "Product"
@@ -28,6 +43,19 @@ type Alert struct {
 	ResolvedBy       string `json:"resolvedBy,omitempty"`
 	ResolvedDate     string `json:"resolvedDate,omitempty"`
 	Resolution       string `json:"resolution,omitempty"`
+	AssignedTo       string `json:"assignedTo,omitempty"` // User ID or MSP ID
+	AssigneeType     string `json:"assigneeType,omitempty"` // "user", "org"
+	DueDate          string `json:"dueDate,omitempty"` // SLA deadline derived from severity (UTC)
+	EscalationLevel  int    `json:"escalationLevel,omitempty"`
+	ReopenCount      int    `json:"reopenCount,omitempty"`
+	Comments         []AlertComment `json:"comments,omitempty"`
+	History          []AlertChange  `json:"history,omitempty"`
+	DedupKey         string `json:"dedupKey,omitempty"` // Alert rule and entity scope; repeats update the same alert
+	OccurrenceCount  int    `json:"occurrenceCount,omitempty"`
+	FirstSeen        string `json:"firstSeen,omitempty"`
+	LastSeen         string `json:"lastSeen,omitempty"`
+	LastEntityID     string `json:"lastEntityId,omitempty"` // Entity of the latest occurrence
+	RuleID           string `json:"ruleId,omitempty"` // Alert rule that raised the alert
 }
 
 // CreateAlert creates a new alert on the blockchain
@@ -38,6 +66,15 @@ func (c *HerbalTraceContract) CreateAlert(ctx contractapi.TransactionContextInte
 		return fmt.Errorf("failed to unmarshal alert JSON: %v", err)
 	}
 
+	// Dedup keys decide which alert a repeat is folded into, so clients cannot choose them
+	alert.DedupKey = ""
+
+	return c.createAlert(ctx, &alert)
+}
+
+// createAlert validates and saves a new alert, or folds it into the open alert with the same dedup key.
+// Alerts raised by the chaincode carry the dedup key of their rule and scope.
+func (c *HerbalTraceContract) createAlert(ctx contractapi.TransactionContextInterface, alert *Alert) error {
 	// Validate required fields
 	if alert.ID == "" {
 		return fmt.Errorf("alert ID is required")
@@ -53,15 +90,7 @@ func (c *HerbalTraceContract) CreateAlert(ctx contractapi.TransactionContextInte
 	}
 
 	// Validate alert type
-	validAlertTypes := map[string]bool{
-		"over_harvest":     true,
-		"quality_failure":  true,
-		"zone_violation":   true,
-		"season_violation": true,
-		"compliance":       true,
-		"system":           true,
-	}
-	if !validAlertTypes[alert.AlertType] {
+	if !alertTypes[alert.AlertType] {
 		return fmt.Errorf("invalid alert type: %s", alert.AlertType)
 	}
 
@@ -76,22 +105,57 @@ func (c *HerbalTraceContract) CreateAlert(ctx contractapi.TransactionContextInte
 		return fmt.Errorf("invalid severity: %s", alert.Severity)
 	}
 
+	if alert.CreatedBy == "" {
+		alert.CreatedBy = "system"
+	}
+	if alert.DedupKey == "" {
+		alert.DedupKey = alertDedupKey(alert.AlertType, alert.EntityType, firstNonEmpty(alert.EntityID, alert.ID))
+	}
+
+	// Repeats of the same rule and scope update the existing alert instead of raising a new one
+	openAlert, err := c.getAlertByDedupKey(ctx, alert.DedupKey)
+	if err != nil {
+		return err
+	}
+	if openAlert != nil {
+		return c.recordAlertOccurrence(ctx, openAlert, alert)
+	}
+
 	// Check if alert already exists
 	existingAlert, err := ctx.GetStub().GetState(alert.ID)
 	if err != nil {
 		return fmt.Errorf("failed to check if alert exists: %v", err)
 	}
 	if existingAlert != nil {
-		return fmt.Errorf("alert with ID %s already exists", alert.ID)
+		var previous Alert
+		err = json.Unmarshal(existingAlert, &previous)
+		if err != nil || previous.DedupKey != "" || previous.AlertType != alert.AlertType {
+			return fmt.Errorf("alert with ID %s already exists", alert.ID)
+		}
+		// Alerts raised before deduplication take the key of their first repeat
+		return c.recordAlertOccurrence(ctx, &previous, alert)
 	}
 
 	// Set default values
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
 	alert.Type = "Alert"
 	alert.Status = "active"
-	alert.Timestamp = time.Now().Format(time.RFC3339)
-	if alert.CreatedBy == "" {
-		alert.CreatedBy = "system"
-	}
+	alert.Timestamp = now.Format(time.RFC3339)
+	alert.OccurrenceCount = 1
+	alert.FirstSeen = alert.Timestamp
+	alert.LastSeen = alert.Timestamp
+	alert.LastEntityID = alert.EntityID
+	alert.AssignedTo = ""
+	alert.AssigneeType = ""
+	alert.DueDate = alertDueDate(alert.Severity, now)
+	alert.EscalationLevel = 0
+	alert.ReopenCount = 0
+	alert.Comments = nil
+	alert.History = nil
+	recordAlertChange(alert, now, "created", alert.CreatedBy, "", alert.Status, "")
 
 	// Save alert to ledger
 	alertBytes, err := json.Marshal(alert)
@@ -104,6 +168,11 @@ func (c *HerbalTraceContract) CreateAlert(ctx contractapi.TransactionContextInte
 		return fmt.Errorf("failed to save alert to ledger: %v", err)
 	}
 
+	err = putAlertDedupIndex(ctx, alert)
+	if err != nil {
+		return err
+	}
+
 	// Emit event
 	eventPayload := map[string]interface{}{
 		"eventType": "AlertCreated",
@@ -112,6 +181,8 @@ func (c *HerbalTraceContract) CreateAlert(ctx contractapi.TransactionContextInte
 		"severity":  alert.Severity,
 		"entityId":  alert.EntityID,
 		"message":   alert.Message,
+		"dueDate":   alert.DueDate,
+		"dedupKey":  alert.DedupKey,
 		"timestamp": alert.Timestamp,
 	}
 	eventBytes, _ := json.Marshal(eventPayload)
@@ -143,103 +214,86 @@ func (c *HerbalTraceContract) GetAlert(ctx contractapi.TransactionContextInterfa
 	return &alert, nil
 }
 
+var alertsQuery = defineQuery("alerts",
+	`{"selector":{"type":"Alert"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "timestamp")
+
 // GetAlerts retrieves all alerts
 func (c *HerbalTraceContract) GetAlerts(ctx contractapi.TransactionContextInterface) ([]*Alert, error) {
-	queryString := `{
-		"selector": {
-			"type": "Alert"
-		},
-		"sort": [{"timestamp": "desc"}]
-	}`
-
-	return c.queryAlerts(ctx, queryString)
+	return c.queryAlerts(ctx, alertsQuery.format())
 }
 
+var alertsByTypeQuery = defineQuery("alertsByType",
+	`{"selector":{"type":"Alert","alertType":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "alertType", "timestamp")
+
 // GetAlertsByType retrieves all alerts of a specific type
 func (c *HerbalTraceContract) GetAlertsByType(ctx contractapi.TransactionContextInterface, alertType string) ([]*Alert, error) {
 	if alertType == "" {
 		return nil, fmt.Errorf("alert type is required")
 	}
 
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "Alert",
-			"alertType": "%s"
-		},
-		"sort": [{"timestamp": "desc"}]
-	}`, alertType)
-
-	return c.queryAlerts(ctx, queryString)
+	return c.queryAlerts(ctx, alertsByTypeQuery.format(alertType))
 }
 
+var alertsBySeverityQuery = defineQuery("alertsBySeverity",
+	`{"selector":{"type":"Alert","severity":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "severity", "timestamp")
+
 // GetAlertsBySeverity retrieves all alerts of a specific severity
 func (c *HerbalTraceContract) GetAlertsBySeverity(ctx contractapi.TransactionContextInterface, severity string) ([]*Alert, error) {
 	if severity == "" {
 		return nil, fmt.Errorf("severity is required")
 	}
 
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "Alert",
-			"severity": "%s"
-		},
-		"sort": [{"timestamp": "desc"}]
-	}`, severity)
-
-	return c.queryAlerts(ctx, queryString)
+	return c.queryAlerts(ctx, alertsBySeverityQuery.format(severity))
 }
 
+var alertsByStatusQuery = defineQuery("alertsByStatus",
+	`{"selector":{"type":"Alert","status":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "status", "timestamp")
+
 // GetActiveAlerts retrieves all active alerts (not acknowledged or resolved)
 func (c *HerbalTraceContract) GetActiveAlerts(ctx contractapi.TransactionContextInterface) ([]*Alert, error) {
-	queryString := `{
-		"selector": {
-			"type": "Alert",
-			"status": "active"
-		},
-		"sort": [{"timestamp": "desc"}]
-	}`
-
-	return c.queryAlerts(ctx, queryString)
+	return c.queryAlerts(ctx, alertsByStatusQuery.format("active"))
 }
 
+var alertsByEntityQuery = defineQuery("alertsByEntity",
+	`{"selector":{"type":"Alert","entityId":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "entityId", "timestamp")
+
+var alertsByEntityAndTypeQuery = defineQuery("alertsByEntityAndType",
+	`{"selector":{"type":"Alert","entityId":"%s","entityType":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "entityId", "entityType", "timestamp")
+
 // GetAlertsByEntity retrieves all alerts for a specific entity
 func (c *HerbalTraceContract) GetAlertsByEntity(ctx contractapi.TransactionContextInterface, entityID string, entityType string) ([]*Alert, error) {
 	if entityID == "" {
 		return nil, fmt.Errorf("entity ID is required")
 	}
 
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "Alert",
-			"entityId": "%s"`, entityID)
-
 	if entityType != "" {
-		queryString += fmt.Sprintf(`,
-			"entityType": "%s"`, entityType)
+		return c.queryAlerts(ctx, alertsByEntityAndTypeQuery.format(entityID, entityType))
 	}
 
-	queryString += `
-		},
-		"sort": [{"timestamp": "desc"}]
-	}`
-
-	return c.queryAlerts(ctx, queryString)
+	return c.queryAlerts(ctx, alertsByEntityQuery.format(entityID))
 }
 
-// AcknowledgeAlert marks an alert as acknowledged by a user
-func (c *HerbalTraceContract) AcknowledgeAlert(ctx contractapi.TransactionContextInterface, alertID string, userID string) error {
+// AcknowledgeAlert marks an alert as acknowledged by the caller (alert manager or assignee only)
+func (c *HerbalTraceContract) AcknowledgeAlert(ctx contractapi.TransactionContextInterface, alertID string) error {
 	if alertID == "" {
 		return fmt.Errorf("alert ID is required")
 	}
-	if userID == "" {
-		return fmt.Errorf("user ID is required")
-	}
 
 	// Get existing alert
 	alert, err := c.GetAlert(ctx, alertID)
 	if err != nil {
 		return err
 	}
+	userID, err := checkAlertHandler(ctx, alert)
+	if err != nil {
+		return err
+	}
 
 	// Check if already acknowledged or resolved
 	if alert.Status != "active" {
@@ -247,9 +301,14 @@ func (c *HerbalTraceContract) AcknowledgeAlert(ctx contractapi.TransactionContex
 	}
 
 	// Update alert
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
 	alert.Status = "acknowledged"
 	alert.AcknowledgedBy = userID
-	alert.AcknowledgedDate = time.Now().Format(time.RFC3339)
+	alert.AcknowledgedDate = now.Format(time.RFC3339)
+	recordAlertChange(alert, now, "acknowledged", userID, "active", alert.Status, "")
 
 	// Save updated alert
 	alertBytes, err := json.Marshal(alert)
@@ -275,14 +334,11 @@ func (c *HerbalTraceContract) AcknowledgeAlert(ctx contractapi.TransactionContex
 	return nil
 }
 
-// ResolveAlert marks an alert as resolved with a resolution note
-func (c *HerbalTraceContract) ResolveAlert(ctx contractapi.TransactionContextInterface, alertID string, userID string, resolution string) error {
+// ResolveAlert marks an alert as resolved by the caller with a resolution note (alert manager or assignee only)
+func (c *HerbalTraceContract) ResolveAlert(ctx contractapi.TransactionContextInterface, alertID string, resolution string) error {
 	if alertID == "" {
 		return fmt.Errorf("alert ID is required")
 	}
-	if userID == "" {
-		return fmt.Errorf("user ID is required")
-	}
 	if resolution == "" {
 		return fmt.Errorf("resolution is required")
 	}
@@ -292,6 +348,10 @@ func (c *HerbalTraceContract) ResolveAlert(ctx contractapi.TransactionContextInt
 	if err != nil {
 		return err
 	}
+	userID, err := checkAlertHandler(ctx, alert)
+	if err != nil {
+		return err
+	}
 
 	// Check if already resolved
 	if alert.Status == "resolved" {
@@ -299,9 +359,14 @@ func (c *HerbalTraceContract) ResolveAlert(ctx contractapi.TransactionContextInt
 	}
 
 	// Update alert
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	oldStatus := alert.Status
 	alert.Status = "resolved"
 	alert.ResolvedBy = userID
-	alert.ResolvedDate = time.Now().Format(time.RFC3339)
+	alert.ResolvedDate = now.Format(time.RFC3339)
 	alert.Resolution = resolution
 
 	// If not acknowledged yet, acknowledge it automatically
@@ -309,6 +374,7 @@ func (c *HerbalTraceContract) ResolveAlert(ctx contractapi.TransactionContextInt
 		alert.AcknowledgedBy = userID
 		alert.AcknowledgedDate = alert.ResolvedDate
 	}
+	recordAlertChange(alert, now, "resolved", userID, oldStatus, alert.Status, resolution)
 
 	// Save updated alert
 	alertBytes, err := json.Marshal(alert)
@@ -335,68 +401,38 @@ func (c *HerbalTraceContract) ResolveAlert(ctx contractapi.TransactionContextInt
 	return nil
 }
 
+var alertsBySeverityAndStatusQuery = defineQuery("alertsBySeverityAndStatus",
+	`{"selector":{"type":"Alert","severity":"%s","status":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "severity", "status", "timestamp")
+
 // GetCriticalAlerts retrieves all active critical alerts
 func (c *HerbalTraceContract) GetCriticalAlerts(ctx contractapi.TransactionContextInterface) ([]*Alert, error) {
-	queryString := `{
-		"selector": {
-			"type": "Alert",
-			"severity": "critical",
-			"status": "active"
-		},
-		"sort": [{"timestamp": "desc"}]
-	}`
-
-	return c.queryAlerts(ctx, queryString)
+	return c.queryAlerts(ctx, alertsBySeverityAndStatusQuery.format("critical", "active"))
 }
 
-// GetAlertStatistics retrieves statistics about alerts
+// GetAlertStatistics retrieves statistics about alerts, reading them page by page
 func (c *HerbalTraceContract) GetAlertStatistics(ctx contractapi.TransactionContextInterface) (map[string]interface{}, error) {
-	// Get all alerts
-	allAlerts, err := c.GetAlerts(ctx)
+	counts := newAlertCounts()
+	_, err := queryRecordsPaged(ctx, alertsQuery.format(), alertQueryPageSize, func(value []byte) error {
+		var alert Alert
+		if json.Unmarshal(value, &alert) == nil {
+			counts.add(&alert)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	counts.finish()
 
-	// Initialize counters
 	stats := map[string]interface{}{
-		"total": len(allAlerts),
-		"byStatus": map[string]int{
-			"active":       0,
-			"acknowledged": 0,
-			"resolved":     0,
-		},
-		"bySeverity": map[string]int{
-			"low":      0,
-			"medium":   0,
-			"high":     0,
-			"critical": 0,
-		},
-		"byType": map[string]int{
-			"over_harvest":     0,
-			"quality_failure":  0,
-			"zone_violation":   0,
-			"season_violation": 0,
-			"compliance":       0,
-			"system":           0,
-		},
-	}
-
-	// Count alerts
-	for _, alert := range allAlerts {
-		// Count by status
-		if statusMap, ok := stats["byStatus"].(map[string]int); ok {
-			statusMap[alert.Status]++
-		}
-
-		// Count by severity
-		if severityMap, ok := stats["bySeverity"].(map[string]int); ok {
-			severityMap[alert.Severity]++
-		}
-
-		// Count by type
-		if typeMap, ok := stats["byType"].(map[string]int); ok {
-			typeMap[alert.AlertType]++
-		}
+		"total":                      counts.Total,
+		"byStatus":                   counts.ByStatus,
+		"bySeverity":                 counts.BySeverity,
+		"byType":                     counts.ByType,
+		"occurrences":                counts.Occurrences,
+		"meanTimeToAcknowledgeHours": counts.MeanTimeToAcknowledgeHours,
+		"meanTimeToResolveHours":     counts.MeanTimeToResolveHours,
 	}
 
 	return stats, nil
@@ -427,3 +463,101 @@ func (c *HerbalTraceContract) queryAlerts(ctx contractapi.TransactionContextInte
 
 	return alerts, nil
 }
+
+// recordAlertOccurrence folds a repeat of an alert's rule and scope into the alert. The latest message
+// and details replace the earlier ones, a higher severity is kept, and a resolved alert is reopened.
+func (c *HerbalTraceContract) recordAlertOccurrence(ctx contractapi.TransactionContextInterface, alert *Alert, occurrence *Alert) error {
+	if occurrence.AlertType != alert.AlertType {
+		return fmt.Errorf("alert %s is of type %s, not %s", alert.ID, alert.AlertType, occurrence.AlertType)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if alert.OccurrenceCount == 0 {
+		alert.OccurrenceCount = 1
+	}
+	if alert.FirstSeen == "" {
+		alert.FirstSeen = alert.Timestamp
+	}
+	if alert.DedupKey == "" {
+		alert.DedupKey = occurrence.DedupKey
+	}
+
+	alert.OccurrenceCount++
+	alert.LastSeen = now.Format(time.RFC3339)
+	alert.LastEntityID = occurrence.EntityID
+	alert.Message = occurrence.Message
+	alert.Details = occurrence.Details
+
+	if alertSeverityRank[occurrence.Severity] > alertSeverityRank[alert.Severity] {
+		recordAlertChange(alert, now, "escalated", occurrence.CreatedBy, alert.Severity, occurrence.Severity, "raised by a repeat occurrence")
+		alert.Severity = occurrence.Severity
+		alert.DueDate = alertDueDate(alert.Severity, now)
+	}
+	if alert.Status == "resolved" {
+		reopenAlert(alert, occurrence.CreatedBy, "the alert condition occurred again", now)
+	}
+
+	err = putAlert(ctx, alert)
+	if err != nil {
+		return err
+	}
+	err = putAlertDedupIndex(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":       "AlertRecurred",
+		"alertId":         alert.ID,
+		"alertType":       alert.AlertType,
+		"severity":        alert.Severity,
+		"status":          alert.Status,
+		"entityId":        occurrence.EntityID,
+		"dedupKey":        alert.DedupKey,
+		"occurrenceCount": alert.OccurrenceCount,
+		"timestamp":       alert.LastSeen,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("AlertRecurred", eventBytes)
+
+	return nil
+}
+
+// getAlertByDedupKey returns the alert raised for a rule and scope, or nil if there is none
+func (c *HerbalTraceContract) getAlertByDedupKey(ctx contractapi.TransactionContextInterface, dedupKey string) (*Alert, error) {
+	indexKey, err := ctx.GetStub().CreateCompositeKey(alertDedupObjectType, []string{dedupKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create alert dedup key: %v", err)
+	}
+	alertID, err := ctx.GetStub().GetState(indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert dedup index: %v", err)
+	}
+	if alertID == nil {
+		return nil, nil
+	}
+
+	return c.GetAlert(ctx, string(alertID))
+}
+
+// putAlertDedupIndex points an alert's dedup key at the alert
+func putAlertDedupIndex(ctx contractapi.TransactionContextInterface, alert *Alert) error {
+	indexKey, err := ctx.GetStub().CreateCompositeKey(alertDedupObjectType, []string{alert.DedupKey})
+	if err != nil {
+		return fmt.Errorf("failed to create alert dedup key: %v", err)
+	}
+	err = ctx.GetStub().PutState(indexKey, []byte(alert.ID))
+	if err != nil {
+		return fmt.Errorf("failed to save alert dedup index: %v", err)
+	}
+
+	return nil
+}
+
+// alertDedupKey joins an alert rule and the parts of its scope into a dedup key
+func alertDedupKey(rule string, scope ...string) string {
+	return strings.Join(append([]string{rule}, scope...), "|")
+}
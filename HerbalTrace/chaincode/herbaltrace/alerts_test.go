@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCreateAlertDerivesTheDedupKey(t *testing.T) {
+	ledger := newTestLedger()
+	contract := new(HerbalTraceContract)
+
+	tx := ledger.begin("rule")
+	ruleAlert := Alert{ID: "ALERT-1", AlertType: "over_harvest", Severity: "high", Message: "harvest limit exceeded", EntityID: "FARMER-1", DedupKey: "rule:harvest-limit|FARMER-1"}
+	if err := contract.createAlert(tx.context(testAlertManager), &ruleAlert); err != nil {
+		t.Fatalf("rule alert was rejected: %v", err)
+	}
+	if err := ledger.commit(tx); err != nil {
+		t.Fatalf("rule alert did not commit: %v", err)
+	}
+
+	// A client naming the rule alert's dedup key must not fold its alert into it
+	tx = ledger.begin("client")
+	err := contract.CreateAlert(tx.context(testAlertManager), `{"id":"ALERT-2","alertType":"compliance","severity":"critical","message":"spoofed","dedupKey":"rule:harvest-limit|FARMER-1"}`)
+	if err != nil {
+		t.Fatalf("client alert was rejected: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("client alert did not commit: %v", err)
+	}
+
+	var alert Alert
+	ledger.get(t, "ALERT-1", &alert)
+	if alert.OccurrenceCount != 1 || alert.Severity != "high" || alert.Message != "harvest limit exceeded" {
+		t.Errorf("rule alert was changed by a client alert: %+v", alert)
+	}
+	ledger.get(t, "ALERT-2", &alert)
+	if alert.DedupKey != alertDedupKey("compliance", "", "ALERT-2") {
+		t.Errorf("client alert dedup key = %q, want it derived from its type and entity", alert.DedupKey)
+	}
+}
+
+func TestRecordAlertOccurrenceRequiresTheSameType(t *testing.T) {
+	ledger := newTestLedger()
+	tx := ledger.begin("repeat")
+	alert := &Alert{ID: "ALERT-1", Type: "Alert", AlertType: "over_harvest", Severity: "low", Status: "active", OccurrenceCount: 1}
+	occurrence := &Alert{AlertType: "quality_failure", Severity: "critical"}
+	if err := new(HerbalTraceContract).recordAlertOccurrence(tx.context(testAlertManager), alert, occurrence); err == nil {
+		t.Errorf("a quality failure was recorded as a repeat of an over-harvest alert")
+	}
+}
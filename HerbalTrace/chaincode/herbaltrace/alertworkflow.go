@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxAlertsPerSweep bounds the write set of a single EscalateOverdueAlerts call
+const maxAlertsPerSweep = 200
+
+// roleAlertManager triages alerts: assigns, reopens and escalates them
+const roleAlertManager = "alert_manager"
+
+// alertSLA is the time allowed to resolve an alert of each severity
+var alertSLA = map[string]time.Duration{
+	"critical": 4 * time.Hour,
+	"high":     24 * time.Hour,
+	"medium":   72 * time.Hour,
+	"low":      7 * 24 * time.Hour,
+}
+
+// alertEscalation lists the severity an overdue alert is raised to
+var alertEscalation = map[string]string{
+	"low":      "medium",
+	"medium":   "high",
+	"high":     "critical",
+	"critical": "critical",
+}
+
+// alertSeverityRank orders severities from least to most severe
+var alertSeverityRank = map[string]int{
+	"low":      1,
+	"medium":   2,
+	"high":     3,
+	"critical": 4,
+}
+
+// alertOrganizations lists the organisations alerts can be assigned to
+var alertOrganizations = map[string]bool{
+	"FarmersCoopMSP":   true,
+	"TestingLabsMSP":   true,
+	"ProcessorsMSP":    true,
+	"ManufacturersMSP": true,
+}
+
+// AlertComment is an entry in an alert's append-only comment thread
+type AlertComment struct {
+	Author    string `json:"author"`
+	AuthorMSP string `json:"authorMsp"`
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+}
+
+// AlertChange records one change to an alert's workflow state
+type AlertChange struct {
+	Action    string `json:"action"` // "created", "assigned", "acknowledged", "resolved", "reopened", "escalated"
+	By        string `json:"by"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	Note      string `json:"note,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// AssignAlert assigns an open alert to a user or an organisation (assigneeType "user" or "org")
+func (c *HerbalTraceContract) AssignAlert(ctx contractapi.TransactionContextInterface, alertID string, assignee string, assigneeType string) error {
+	if err := requireRole(ctx, roleAlertManager, roleRegistryAdmin); err != nil {
+		return err
+	}
+	if assignee == "" {
+		return fmt.Errorf("assignee is required")
+	}
+	switch assigneeType {
+	case "user":
+	case "org":
+		if !alertOrganizations[assignee] {
+			return fmt.Errorf("unknown organisation: %s", assignee)
+		}
+	default:
+		return fmt.Errorf("invalid assignee type: %s. Valid types: user, org", assigneeType)
+	}
+
+	alert, err := c.GetAlert(ctx, alertID)
+	if err != nil {
+		return err
+	}
+	if alert.Status == "resolved" {
+		return fmt.Errorf("alert %s is resolved and must be reopened before it can be assigned", alertID)
+	}
+
+	assignedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	previous := alert.AssignedTo
+	alert.AssignedTo = assignee
+	alert.AssigneeType = assigneeType
+	recordAlertChange(alert, now, "assigned", assignedBy, previous, assignee, assigneeType)
+
+	err = putAlert(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":    "AlertAssigned",
+		"alertId":      alert.ID,
+		"assignedTo":   assignee,
+		"assigneeType": assigneeType,
+		"assignedBy":   assignedBy,
+		"dueDate":      alert.DueDate,
+		"timestamp":    now.Format(time.RFC3339),
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("AlertAssigned", eventBytes)
+
+	return nil
+}
+
+// checkAlertHandler allows alert managers and an alert's assignee, the user or any member of the
+// organisation it is assigned to, to work on the alert. It returns the caller's identity.
+func checkAlertHandler(ctx contractapi.TransactionContextInterface, alert *Alert) (string, error) {
+	callerID, callerMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+	if (alert.AssigneeType == "user" && alert.AssignedTo == callerID) ||
+		(alert.AssigneeType == "org" && alert.AssignedTo == callerMSP) {
+		return callerID, nil
+	}
+
+	err = requireRole(ctx, roleAlertManager)
+	if err != nil {
+		return "", fmt.Errorf("alert %s can only be handled by an alert manager or its assignee: %v", alert.ID, err)
+	}
+	return callerID, nil
+}
+
+// AddAlertComment appends a comment to an alert's thread (alert manager or assignee only).
+// Comments cannot be edited or removed.
+func (c *HerbalTraceContract) AddAlertComment(ctx contractapi.TransactionContextInterface, alertID string, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("comment text is required")
+	}
+
+	alert, err := c.GetAlert(ctx, alertID)
+	if err != nil {
+		return err
+	}
+	author, err := checkAlertHandler(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	_, authorMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	comment := AlertComment{
+		Author:    author,
+		AuthorMSP: authorMSP,
+		Text:      text,
+		Timestamp: now.Format(time.RFC3339),
+	}
+	alert.Comments = append(alert.Comments, comment)
+
+	err = putAlert(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":    "AlertCommentAdded",
+		"alertId":      alert.ID,
+		"author":       author,
+		"authorMsp":    authorMSP,
+		"commentIndex": len(alert.Comments) - 1,
+		"timestamp":    comment.Timestamp,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("AlertCommentAdded", eventBytes)
+
+	return nil
+}
+
+// ReopenAlert returns a resolved alert to active with a fresh SLA due date
+func (c *HerbalTraceContract) ReopenAlert(ctx contractapi.TransactionContextInterface, alertID string, reason string) error {
+	if err := requireRole(ctx, roleAlertManager, roleRegistryAdmin); err != nil {
+		return err
+	}
+	if reason == "" {
+		return fmt.Errorf("a reason is required to reopen an alert")
+	}
+
+	alert, err := c.GetAlert(ctx, alertID)
+	if err != nil {
+		return err
+	}
+	if alert.Status != "resolved" {
+		return fmt.Errorf("alert %s is %s, only resolved alerts can be reopened", alertID, alert.Status)
+	}
+
+	reopenedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	reopenAlert(alert, reopenedBy, reason, now)
+
+	err = putAlert(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":   "AlertReopened",
+		"alertId":     alert.ID,
+		"reopenedBy":  reopenedBy,
+		"reason":      reason,
+		"reopenCount": alert.ReopenCount,
+		"dueDate":     alert.DueDate,
+		"timestamp":   now.Format(time.RFC3339),
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("AlertReopened", eventBytes)
+
+	return nil
+}
+
+var overdueAlertsQuery = defineQuery("overdueAlerts",
+	`{"selector":{"type":"Alert","status":{"$in":["active","acknowledged"]},"dueDate":{"$lt":"%s"}},"sort":[{"dueDate":"asc"}],"limit":%d}`,
+	"type", "dueDate", "status")
+
+// GetOverdueAlerts lists the IDs of open alerts past their SLA due date, most overdue first, for
+// a sweeper to pass to EscalateOverdueAlerts
+func (c *HerbalTraceContract) GetOverdueAlerts(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := c.queryAlerts(ctx, overdueAlertsQuery.format(now.Format(time.RFC3339), maxAlertsPerSweep))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].DueDate < alerts[j].DueDate
+	})
+
+	alertIDs := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		alertIDs = append(alertIDs, alert.ID)
+	}
+	return alertIDs, nil
+}
+
+// EscalateOverdueAlerts raises the severity of the given open alerts that are past their SLA due
+// date and starts a new SLA at the raised severity. Alerts are read by ID and checked against the
+// transaction time, so every endorser reaches the same result. It is meant to be submitted
+// periodically with the IDs from GetOverdueAlerts and returns the escalated alert IDs.
+func (c *HerbalTraceContract) EscalateOverdueAlerts(ctx contractapi.TransactionContextInterface, alertIDsJSON string) ([]string, error) {
+	if err := requireRole(ctx, roleAlertManager, roleRegistryAdmin); err != nil {
+		return nil, err
+	}
+
+	var alertIDs []string
+	err := json.Unmarshal([]byte(alertIDsJSON), &alertIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alert IDs: %v", err)
+	}
+	if len(alertIDs) > maxAlertsPerSweep {
+		return nil, fmt.Errorf("cannot escalate more than %d alerts in one call", maxAlertsPerSweep)
+	}
+
+	sweptBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	escalated := []string{}
+	seen := make(map[string]bool)
+	for _, alertID := range alertIDs {
+		if seen[alertID] {
+			continue
+		}
+		seen[alertID] = true
+
+		alert, err := c.GetAlert(ctx, alertID)
+		if err != nil {
+			return nil, err
+		}
+		if alert.Status != "active" && alert.Status != "acknowledged" {
+			continue
+		}
+		dueDate, err := time.Parse(time.RFC3339, alert.DueDate)
+		if err != nil || !dueDate.Before(now) {
+			continue
+		}
+
+		oldSeverity := alert.Severity
+		alert.Severity = alertEscalation[oldSeverity]
+		if alert.Severity == "" {
+			alert.Severity = "critical"
+		}
+		alert.EscalationLevel++
+		alert.DueDate = alertDueDate(alert.Severity, now)
+		recordAlertChange(alert, now, "escalated", sweptBy, oldSeverity, alert.Severity, fmt.Sprintf("overdue since %s", dueDate.Format(time.RFC3339)))
+
+		err = putAlert(ctx, alert)
+		if err != nil {
+			return nil, err
+		}
+		escalated = append(escalated, alert.ID)
+	}
+
+	if len(escalated) > 0 {
+		// Emit event
+		eventPayload := map[string]interface{}{
+			"eventType": "AlertsEscalated",
+			"alertIds":  escalated,
+			"count":     len(escalated),
+			"timestamp": now.Format(time.RFC3339),
+		}
+		eventBytes, _ := json.Marshal(eventPayload)
+		ctx.GetStub().SetEvent("AlertsEscalated", eventBytes)
+	}
+
+	return escalated, nil
+}
+
+var alertsByAssigneeQuery = defineQuery("alertsByAssignee",
+	`{"selector":{"type":"Alert","assignedTo":"%s"},"sort":[{"timestamp":"desc"}]}`,
+	"type", "assignedTo", "timestamp")
+
+// GetAlertsByAssignee retrieves all alerts assigned to a user or organisation
+func (c *HerbalTraceContract) GetAlertsByAssignee(ctx contractapi.TransactionContextInterface, assignee string) ([]*Alert, error) {
+	if assignee == "" {
+		return nil, fmt.Errorf("assignee is required")
+	}
+
+	return c.queryAlerts(ctx, alertsByAssigneeQuery.format(assignee))
+}
+
+// alertDueDate returns the SLA due date of an alert of the given severity raised at from
+func alertDueDate(severity string, from time.Time) string {
+	sla, found := alertSLA[severity]
+	if !found {
+		sla = alertSLA["low"]
+	}
+	return from.Add(sla).UTC().Format(time.RFC3339)
+}
+
+// reopenAlert returns a resolved alert to active. The earlier acknowledgement and resolution
+// remain in the history.
+func reopenAlert(alert *Alert, by string, reason string, now time.Time) {
+	alert.Status = "active"
+	alert.AcknowledgedBy = ""
+	alert.AcknowledgedDate = ""
+	alert.ResolvedBy = ""
+	alert.ResolvedDate = ""
+	alert.Resolution = ""
+	alert.ReopenCount++
+	alert.DueDate = alertDueDate(alert.Severity, now)
+	recordAlertChange(alert, now, "reopened", by, "resolved", alert.Status, reason)
+}
+
+// recordAlertChange appends a workflow change made at the given time to an alert's history
+func recordAlertChange(alert *Alert, at time.Time, action string, by string, from string, to string, note string) {
+	alert.History = append(alert.History, AlertChange{
+		Action:    action,
+		By:        by,
+		From:      from,
+		To:        to,
+		Note:      note,
+		Timestamp: at.UTC().Format(time.RFC3339),
+	})
+}
+
+// txTime returns the transaction timestamp, which is the same on every endorsing peer
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	return txTimestamp.AsTime().UTC(), nil
+}
+
+// putAlert saves an alert to the ledger
+func putAlert(ctx contractapi.TransactionContextInterface, alert *Alert) error {
+	alertBytes, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(alert.ID, alertBytes)
+	if err != nil {
+		return fmt.Errorf("failed to update alert: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testAlertManager = testIdentity{id: "alert-manager-1", mspID: regulatorMSP, attributes: map[string]string{"role": roleAlertManager}}
+
+// newAlertLedger returns a ledger holding an alert that fell due an hour before the test time
+// and one that falls due an hour after it
+func newAlertLedger(t *testing.T) *testLedger {
+	ledger := newTestLedger()
+	ledger.put(t, "ALERT-OVERDUE", Alert{ID: "ALERT-OVERDUE", Type: "Alert", AlertType: "quality_failure", Severity: "medium", Status: "active", DueDate: testTime.Add(-time.Hour).Format(time.RFC3339)})
+	ledger.put(t, "ALERT-PENDING", Alert{ID: "ALERT-PENDING", Type: "Alert", AlertType: "quality_failure", Severity: "medium", Status: "active", DueDate: testTime.Add(time.Hour).Format(time.RFC3339)})
+	return ledger
+}
+
+func TestEscalateOverdueAlertsUsesTransactionTime(t *testing.T) {
+	ledger := newAlertLedger(t)
+	contract := new(HerbalTraceContract)
+
+	tx := ledger.begin("sweep")
+	escalated, err := contract.EscalateOverdueAlerts(tx.context(testAlertManager), `["ALERT-OVERDUE","ALERT-PENDING"]`)
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if len(tx.queries) != 0 {
+		t.Errorf("sweep ran rich queries: %v", tx.queries)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("sweep did not commit: %v", err)
+	}
+
+	if len(escalated) != 1 || escalated[0] != "ALERT-OVERDUE" {
+		t.Fatalf("escalated %v, want [ALERT-OVERDUE]", escalated)
+	}
+	var alert Alert
+	ledger.get(t, "ALERT-OVERDUE", &alert)
+	if alert.Severity != "high" || alert.EscalationLevel != 1 {
+		t.Errorf("alert escalated to %s at level %d, want high at level 1", alert.Severity, alert.EscalationLevel)
+	}
+	if want := alertDueDate("high", testTime); alert.DueDate != want {
+		t.Errorf("new due date = %s, want %s", alert.DueDate, want)
+	}
+	if len(alert.History) != 1 || alert.History[0].Timestamp != testTime.Format(time.RFC3339) {
+		t.Errorf("history %+v is not stamped with the transaction time", alert.History)
+	}
+}
+
+func TestAlertWorkflowRequiresAlertManager(t *testing.T) {
+	ledger := newAlertLedger(t)
+	contract := new(HerbalTraceContract)
+
+	tx := ledger.begin("unauthorised")
+	ctx := tx.context(testFarmer)
+	if _, err := contract.EscalateOverdueAlerts(ctx, `["ALERT-OVERDUE"]`); err == nil {
+		t.Errorf("a farmer escalated alerts")
+	}
+	if err := contract.AssignAlert(ctx, "ALERT-OVERDUE", "FarmersCoopMSP", "org"); err == nil {
+		t.Errorf("a farmer assigned an alert")
+	}
+	if err := contract.ReopenAlert(ctx, "ALERT-OVERDUE", "not fixed"); err == nil {
+		t.Errorf("a farmer reopened an alert")
+	}
+
+	tx = ledger.begin("assign")
+	if err := contract.AssignAlert(tx.context(testAlertManager), "ALERT-OVERDUE", "FarmersCoopMSP", "org"); err != nil {
+		t.Errorf("alert manager could not assign an alert: %v", err)
+	}
+}
+
+func TestAlertHandlingRequiresManagerOrAssignee(t *testing.T) {
+	ledger := newAlertLedger(t)
+	ledger.put(t, "ALERT-ASSIGNED", Alert{ID: "ALERT-ASSIGNED", Type: "Alert", AlertType: "quality_failure", Severity: "medium", Status: "active", AssignedTo: "FarmersCoopMSP", AssigneeType: "org"})
+	contract := new(HerbalTraceContract)
+	outsider := testIdentity{id: "processor-1", mspID: "ProcessorsMSP", attributes: map[string]string{"role": "processor"}}
+
+	tx := ledger.begin("outsider")
+	ctx := tx.context(outsider)
+	if err := contract.AcknowledgeAlert(ctx, "ALERT-ASSIGNED"); err == nil {
+		t.Errorf("an outsider acknowledged an alert")
+	}
+	if err := contract.ResolveAlert(ctx, "ALERT-ASSIGNED", "nothing to see"); err == nil {
+		t.Errorf("an outsider resolved an alert")
+	}
+	if err := contract.AddAlertComment(ctx, "ALERT-ASSIGNED", "spam"); err == nil {
+		t.Errorf("an outsider commented on an alert")
+	}
+
+	// Members of the assigned organisation handle the alert, recorded under their own identity
+	tx = ledger.begin("assignee")
+	if err := contract.AcknowledgeAlert(tx.context(testFarmer), "ALERT-ASSIGNED"); err != nil {
+		t.Fatalf("assignee could not acknowledge the alert: %v", err)
+	}
+	if err := ledger.commit(tx); err != nil {
+		t.Fatalf("acknowledgement did not commit: %v", err)
+	}
+	var alert Alert
+	ledger.get(t, "ALERT-ASSIGNED", &alert)
+	if alert.AcknowledgedBy != testFarmer.id {
+		t.Errorf("alert acknowledged by %q, want the caller %q", alert.AcknowledgedBy, testFarmer.id)
+	}
+
+	tx = ledger.begin("manager")
+	if err := contract.ResolveAlert(tx.context(testAlertManager), "ALERT-OVERDUE", "false positive"); err != nil {
+		t.Errorf("alert manager could not resolve an unassigned alert: %v", err)
+	}
+}
@@ -16,6 +16,7 @@ type Batch struct {
 	TotalQuantity      float64  `json:"totalQuantity"`
 	Unit               string   `json:"unit"`
 	CollectionEventIDs []string `json:"collectionEventIds"`
+	EventQuantities    map[string]float64 `json:"eventQuantities,omitempty"` // Quantity drawn from each collection event, in Unit
 	AssignedProcessor  string   `json:"assignedProcessor,omitempty"`
 	ProcessorName      string   `json:"processorName,omitempty"`
 	Status             string   `json:"status"` // "collected", "assigned", "testing", "processing", "manufactured"
@@ -23,6 +24,7 @@ type Batch struct {
 	CreatedBy          string   `json:"createdBy"` // Farmer ID
 	AssignedDate       string   `json:"assignedDate,omitempty"`
 	AssignedBy         string   `json:"assignedBy,omitempty"` // Admin ID
+	QCHold             string   `json:"qcHold,omitempty"` // Set by RevokeCertificate while the batch's QC certificate is revoked
 	Timestamp          string   `json:"timestamp"`
 }
 
@@ -58,6 +60,17 @@ func (c *HerbalTraceContract) CreateBatch(ctx contractapi.TransactionContextInte
 	if batch.CreatedBy == "" {
 		return fmt.Errorf("created by (farmer ID) is required")
 	}
+	batch.TotalQuantity, batch.Unit, err = canonicalQuantity(batch.TotalQuantity, batch.Unit)
+	if err != nil {
+		return err
+	}
+
+	// Only verified collection events can be batched, and a batch cannot hold
+	// more than its collection events have left after earlier batches
+	events, err := c.checkBatchMassBalance(ctx, &batch)
+	if err != nil {
+		return err
+	}
 
 	// Check if batch already exists
 	existingBatch, err := ctx.GetStub().GetState(batch.ID)
@@ -74,9 +87,16 @@ func (c *HerbalTraceContract) CreateBatch(ctx contractapi.TransactionContextInte
 	batch.CreatedDate = time.Now().Format(time.RFC3339)
 	batch.Timestamp = time.Now().Format(time.RFC3339)
 
-	// Initialize collection event IDs if not provided
-	if batch.CollectionEventIDs == nil {
-		batch.CollectionEventIDs = []string{}
+	// Record what the batch drew from each collection event
+	for _, event := range events {
+		eventBytes, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal collection event: %v", err)
+		}
+		err = ctx.GetStub().PutState(event.ID, eventBytes)
+		if err != nil {
+			return fmt.Errorf("failed to update collection event %s: %v", event.ID, err)
+		}
 	}
 
 	// Save batch to ledger
@@ -106,6 +126,66 @@ func (c *HerbalTraceContract) CreateBatch(ctx contractapi.TransactionContextInte
 	return nil
 }
 
+// checkBatchMassBalance verifies that every collection event is verified and that the batch
+// quantity does not exceed the weight they have left unbatched. The batch draws from its events
+// in proportion to what each has left; the drawn quantities are recorded on the batch and added
+// to the batched quantity of the returned events, which the caller saves.
+func (c *HerbalTraceContract) checkBatchMassBalance(ctx contractapi.TransactionContextInterface, batch *Batch) ([]*CollectionEvent, error) {
+	if len(batch.CollectionEventIDs) == 0 {
+		return nil, fmt.Errorf("at least one collection event is required")
+	}
+
+	var events []*CollectionEvent
+	available := make(map[string]float64)
+	collected := 0.0
+	for _, eventID := range batch.CollectionEventIDs {
+		if _, listed := available[eventID]; listed {
+			return nil, fmt.Errorf("collection event %s is listed more than once", eventID)
+		}
+		event, err := c.GetCollectionEvent(ctx, eventID)
+		if err != nil {
+			return nil, fmt.Errorf("collection event %s cannot be batched: %v", eventID, err)
+		}
+		if event.Status != "verified" {
+			return nil, fmt.Errorf("collection event %s cannot be batched: status is %s, must be verified", eventID, event.Status)
+		}
+
+		// Prefer the weight received at the collection centre over the declared quantity
+		eventQuantity := event.Quantity
+		if event.ReceivedQuantity > 0 {
+			eventQuantity = event.ReceivedQuantity
+		}
+		quantity, err := convertQuantity(eventQuantity-event.BatchedQuantity, event.Unit, batch.Unit)
+		if err != nil {
+			return nil, fmt.Errorf("collection event %s does not match batch unit: %v", eventID, err)
+		}
+		if quantity <= harvestEpsilon {
+			return nil, fmt.Errorf("collection event %s cannot be batched: its quantity is already batched", eventID)
+		}
+		available[eventID] = quantity
+		collected += quantity
+		events = append(events, event)
+	}
+
+	if batch.TotalQuantity > collected+harvestEpsilon {
+		return nil, fmt.Errorf("batch quantity %.3f %s exceeds unbatched collected quantity %.3f %s", batch.TotalQuantity, batch.Unit, collected, batch.Unit)
+	}
+
+	batch.EventQuantities = make(map[string]float64)
+	for _, event := range events {
+		drawn := available[event.ID] * batch.TotalQuantity / collected
+		batch.EventQuantities[event.ID] = drawn
+
+		drawnInEventUnit, err := convertQuantity(drawn, batch.Unit, event.Unit)
+		if err != nil {
+			return nil, fmt.Errorf("collection event %s does not match batch unit: %v", event.ID, err)
+		}
+		event.BatchedQuantity += drawnInEventUnit
+	}
+
+	return events, nil
+}
+
 // GetBatch retrieves a batch by ID
 func (c *HerbalTraceContract) GetBatch(ctx contractapi.TransactionContextInterface, batchID string) (*Batch, error) {
 	if batchID == "" {
@@ -188,6 +268,12 @@ func (c *HerbalTraceContract) AssignBatchToProcessor(ctx contractapi.Transaction
 
 // UpdateBatchStatus updates the status of a batch
 func (c *HerbalTraceContract) UpdateBatchStatus(ctx contractapi.TransactionContextInterface, batchID string, newStatus string) error {
+	return c.updateBatchStatus(ctx, batchID, newStatus, false)
+}
+
+// updateBatchStatus updates the status of a batch, releasing its QC hold when releaseQCHold is set.
+// Batches on QC hold cannot move on to processing or manufacture.
+func (c *HerbalTraceContract) updateBatchStatus(ctx contractapi.TransactionContextInterface, batchID string, newStatus string, releaseQCHold bool) error {
 	if batchID == "" {
 		return fmt.Errorf("batch ID is required")
 	}
@@ -197,14 +283,15 @@ func (c *HerbalTraceContract) UpdateBatchStatus(ctx contractapi.TransactionConte
 
 	// Validate status
 	validStatuses := map[string]bool{
-		"collected":    true,
-		"assigned":     true,
-		"testing":      true,
-		"processing":   true,
-		"manufactured": true,
+		"collected":      true,
+		"assigned":       true,
+		"testing":        true,
+		"quality_tested": true,
+		"processing":     true,
+		"manufactured":   true,
 	}
 	if !validStatuses[newStatus] {
-		return fmt.Errorf("invalid status: %s. Valid statuses: collected, assigned, testing, processing, manufactured", newStatus)
+		return fmt.Errorf("invalid status: %s. Valid statuses: collected, assigned, testing, quality_tested, processing, manufactured", newStatus)
 	}
 
 	// Get existing batch
@@ -213,6 +300,13 @@ func (c *HerbalTraceContract) UpdateBatchStatus(ctx contractapi.TransactionConte
 		return err
 	}
 
+	if releaseQCHold {
+		batch.QCHold = ""
+	}
+	if batch.QCHold != "" && (newStatus == "processing" || newStatus == "manufactured") {
+		return fmt.Errorf("batch %s is on QC hold: %s", batchID, batch.QCHold)
+	}
+
 	// Update status
 	oldStatus := batch.Status
 	batch.Status = newStatus
@@ -303,51 +397,39 @@ func (c *HerbalTraceContract) GetBatchHistory(ctx contractapi.TransactionContext
 	return batchHistory, nil
 }
 
+var batchesByStatusQuery = defineQuery("batchesByStatus",
+	`{"selector":{"type":"Batch","status":"%s"}}`,
+	"type", "status")
+
 // QueryBatchesByStatus retrieves all batches with a specific status
 func (c *HerbalTraceContract) QueryBatchesByStatus(ctx contractapi.TransactionContextInterface, status string) ([]*Batch, error) {
 	if status == "" {
 		return nil, fmt.Errorf("status is required")
 	}
 
-	// Build query
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "Batch",
-			"status": "%s"
-		}
-	}`, status)
-
-	return c.queryBatches(ctx, queryString)
+	return c.queryBatches(ctx, batchesByStatusQuery.format(status))
 }
 
+var batchesByProcessorQuery = defineQuery("batchesByProcessor",
+	`{"selector":{"type":"Batch","assignedProcessor":"%s"}}`,
+	"type", "assignedProcessor")
+
 // QueryBatchesByProcessor retrieves all batches assigned to a specific processor
 func (c *HerbalTraceContract) QueryBatchesByProcessor(ctx contractapi.TransactionContextInterface, processorID string) ([]*Batch, error) {
 	if processorID == "" {
 		return nil, fmt.Errorf("processor ID is required")
 	}
 
-	// Build query
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "Batch",
-			"assignedProcessor": "%s"
-		}
-	}`, processorID)
-
-	return c.queryBatches(ctx, queryString)
+	return c.queryBatches(ctx, batchesByProcessorQuery.format(processorID))
 }
 
+var unassignedBatchesQuery = defineQuery("unassignedBatches",
+	`{"selector":{"type":"Batch","status":"%s","assignedProcessor":{"$exists":false}}}`,
+	"type", "status")
+
 // GetPendingBatches retrieves all batches that are pending assignment (status = "collected")
 func (c *HerbalTraceContract) GetPendingBatches(ctx contractapi.TransactionContextInterface) ([]*Batch, error) {
-	queryString := `{
-		"selector": {
-			"type": "Batch",
-			"status": "collected",
-			"assignedProcessor": {"$exists": false}
-		}
-	}`
-
-	return c.queryBatches(ctx, queryString)
+	return c.queryBatches(ctx, unassignedBatchesQuery.format("collected"))
 }
 
 // queryBatches is a helper function to execute rich queries for batches
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Certification represents a third-party certification such as organic or FairWild
+type Certification struct {
+	ID                string   `json:"id"`
+	Type              string   `json:"type"`   // "Certification"
+	Scheme            string   `json:"scheme"` // "organic", "fair_trade", "fairwild", "ayush_mark"
+	CertificateNumber string   `json:"certificateNumber"`
+	IssuerName        string   `json:"issuerName"`
+	IssuerID          string   `json:"issuerId"` // Identity of the certification body that recorded it
+	IssuerMSP         string   `json:"issuerMsp"`
+	HolderID          string   `json:"holderId"`               // Farmer, processor or manufacturer ID
+	HolderType        string   `json:"holderType"`             // "Farmer", "Processor", "Manufacturer"
+	ScopeSpecies      []string `json:"scopeSpecies,omitempty"` // Scientific names, empty for all species
+	ScopeSites        []string `json:"scopeSites,omitempty"`   // Zones or site IDs, empty for all sites
+	ValidFrom         string   `json:"validFrom"`
+	ValidUntil        string   `json:"validUntil"`
+	Status            string   `json:"status"` // "active", "revoked"
+	RevokedBy         string   `json:"revokedBy,omitempty"`
+	RevokedDate       string   `json:"revokedDate,omitempty"`
+	RevocationReason  string   `json:"revocationReason,omitempty"`
+	CreatedAt         string   `json:"createdAt"`
+	UpdatedAt         string   `json:"updatedAt"`
+}
+
+const roleCertificationBody = "certification_body"
+
+// certificationSchemes lists the certification schemes accepted by the registry
+var certificationSchemes = map[string]bool{
+	"organic":    true,
+	"fair_trade": true,
+	"fairwild":   true,
+	"ayush_mark": true,
+}
+
+// certificationHolderTypes lists the kinds of participants a certification can be held by
+var certificationHolderTypes = map[string]bool{
+	"Farmer":       true,
+	"Processor":    true,
+	"Manufacturer": true,
+}
+
+// IssueCertification records a certification issued by the calling certification body
+func (c *HerbalTraceContract) IssueCertification(ctx contractapi.TransactionContextInterface, certificationJSON string) error {
+	if err := requireRole(ctx, roleCertificationBody); err != nil {
+		return err
+	}
+
+	var certification Certification
+	err := json.Unmarshal([]byte(certificationJSON), &certification)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal certification JSON: %v", err)
+	}
+
+	// Validate required fields
+	if certification.ID == "" {
+		return fmt.Errorf("certification ID is required")
+	}
+	if !certificationSchemes[certification.Scheme] {
+		return fmt.Errorf("invalid certification scheme: %s", certification.Scheme)
+	}
+	if certification.CertificateNumber == "" {
+		return fmt.Errorf("certificate number is required")
+	}
+	if certification.HolderID == "" {
+		return fmt.Errorf("holder ID is required")
+	}
+	if !certificationHolderTypes[certification.HolderType] {
+		return fmt.Errorf("invalid holder type: %s", certification.HolderType)
+	}
+	validFrom, err := time.Parse(time.RFC3339, certification.ValidFrom)
+	if err != nil {
+		return fmt.Errorf("invalid valid from date: %v", err)
+	}
+	validUntil, err := time.Parse(time.RFC3339, certification.ValidUntil)
+	if err != nil {
+		return fmt.Errorf("invalid valid until date: %v", err)
+	}
+	if !validUntil.After(validFrom) {
+		return fmt.Errorf("valid until must be after valid from")
+	}
+
+	// Scope species are stored under their registry scientific names
+	for i, name := range certification.ScopeSpecies {
+		species, err := c.ResolveSpecies(ctx, name)
+		if err != nil {
+			return err
+		}
+		certification.ScopeSpecies[i] = species.ScientificName
+	}
+
+	// Check if certification already exists
+	existingCertification, err := ctx.GetStub().GetState(certification.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if certification exists: %v", err)
+	}
+	if existingCertification != nil {
+		return fmt.Errorf("certification with ID %s already exists", certification.ID)
+	}
+
+	issuerID, issuerMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Set default values
+	certification.Type = "Certification"
+	certification.Status = "active"
+	certification.IssuerID = issuerID
+	certification.IssuerMSP = issuerMSP
+	certification.CreatedAt = time.Now().Format(time.RFC3339)
+	certification.UpdatedAt = certification.CreatedAt
+
+	err = c.putCertification(ctx, &certification)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":       "CertificationIssued",
+		"certificationId": certification.ID,
+		"scheme":          certification.Scheme,
+		"holderId":        certification.HolderID,
+		"validUntil":      certification.ValidUntil,
+		"timestamp":       certification.CreatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("CertificationIssued", eventBytes)
+
+	return nil
+}
+
+// GetCertification retrieves a certification by ID
+func (c *HerbalTraceContract) GetCertification(ctx contractapi.TransactionContextInterface, certificationID string) (*Certification, error) {
+	if certificationID == "" {
+		return nil, fmt.Errorf("certification ID is required")
+	}
+
+	certificationBytes, err := ctx.GetStub().GetState(certificationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certification from ledger: %v", err)
+	}
+	if certificationBytes == nil {
+		return nil, fmt.Errorf("certification with ID %s does not exist", certificationID)
+	}
+
+	var certification Certification
+	err = json.Unmarshal(certificationBytes, &certification)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certification: %v", err)
+	}
+	if certification.Type != "Certification" {
+		return nil, fmt.Errorf("%s is not a certification", certificationID)
+	}
+
+	return &certification, nil
+}
+
+// RevokeCertification revokes a certification (only the issuing certification body)
+func (c *HerbalTraceContract) RevokeCertification(ctx contractapi.TransactionContextInterface, certificationID string, reason string) error {
+	if err := requireRole(ctx, roleCertificationBody); err != nil {
+		return err
+	}
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	certification, err := c.GetCertification(ctx, certificationID)
+	if err != nil {
+		return err
+	}
+	if certification.Status == "revoked" {
+		return fmt.Errorf("certification %s is already revoked", certificationID)
+	}
+
+	callerID, callerMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if callerID != certification.IssuerID || callerMSP != certification.IssuerMSP {
+		return fmt.Errorf("certification %s can only be revoked by its issuer", certificationID)
+	}
+
+	certification.Status = "revoked"
+	certification.RevokedBy = callerID
+	certification.RevokedDate = time.Now().Format(time.RFC3339)
+	certification.RevocationReason = reason
+	certification.UpdatedAt = certification.RevokedDate
+
+	err = c.putCertification(ctx, certification)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":       "CertificationRevoked",
+		"certificationId": certificationID,
+		"holderId":        certification.HolderID,
+		"reason":          reason,
+		"timestamp":       certification.RevokedDate,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("CertificationRevoked", eventBytes)
+
+	return nil
+}
+
+var certificationsByHolderQuery = defineQuery("certificationsByHolder",
+	`{"selector":{"type":"Certification","holderId":"%s"}}`,
+	"type", "holderId")
+
+// QueryCertificationsByHolder retrieves all certifications held by a participant
+func (c *HerbalTraceContract) QueryCertificationsByHolder(ctx contractapi.TransactionContextInterface, holderID string) ([]*Certification, error) {
+	if holderID == "" {
+		return nil, fmt.Errorf("holder ID is required")
+	}
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(certificationsByHolderQuery.format(holderID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query certifications: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var certifications []*Certification
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate query results: %v", err)
+		}
+
+		var certification Certification
+		err = json.Unmarshal(queryResponse.Value, &certification)
+		if err != nil {
+			continue
+		}
+		certifications = append(certifications, &certification)
+	}
+
+	return certifications, nil
+}
+
+// checkCertification verifies that a certification is active, held by the holder, valid at
+// the given time and covers the species and site. An empty species or site skips that check.
+func (c *HerbalTraceContract) checkCertification(ctx contractapi.TransactionContextInterface, certificationID string, holderID string, species string, site string, at time.Time) (*Certification, error) {
+	certification, err := c.GetCertification(ctx, certificationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if certification.Status != "active" {
+		return nil, fmt.Errorf("certification %s is %s", certificationID, certification.Status)
+	}
+	if certification.HolderID != holderID {
+		return nil, fmt.Errorf("certification %s is not held by %s", certificationID, holderID)
+	}
+
+	validFrom, err := time.Parse(time.RFC3339, certification.ValidFrom)
+	if err != nil {
+		return nil, fmt.Errorf("certification %s has an invalid valid from date: %v", certificationID, err)
+	}
+	validUntil, err := time.Parse(time.RFC3339, certification.ValidUntil)
+	if err != nil {
+		return nil, fmt.Errorf("certification %s has an invalid valid until date: %v", certificationID, err)
+	}
+	if at.Before(validFrom) || at.After(validUntil) {
+		return nil, fmt.Errorf("certification %s is not valid on %s", certificationID, at.Format(time.RFC3339))
+	}
+
+	if species != "" && !inScope(certification.ScopeSpecies, species) {
+		return nil, fmt.Errorf("certification %s does not cover species %s", certificationID, species)
+	}
+	if site != "" && !inScope(certification.ScopeSites, site) {
+		return nil, fmt.Errorf("certification %s does not cover site %s", certificationID, site)
+	}
+
+	return certification, nil
+}
+
+// provenanceCertifications collects the product and collection certifications that are still
+// valid for the activity they were attached to. Revoked or out-of-scope certifications are skipped.
+func (c *HerbalTraceContract) provenanceCertifications(ctx contractapi.TransactionContextInterface, prov *Provenance) []Certification {
+	var certifications []Certification
+	seen := map[string]bool{}
+	add := func(certification *Certification, err error) {
+		if err != nil || seen[certification.ID] {
+			return
+		}
+		seen[certification.ID] = true
+		certifications = append(certifications, *certification)
+	}
+
+	species, speciesErr := c.productSpecies(ctx, &prov.Product)
+	for _, certificationID := range prov.Product.Certifications {
+		add(c.checkProductCertification(ctx, certificationID, &prov.Product, species, speciesErr))
+	}
+	for _, event := range prov.CollectionEvents {
+		for _, certificationID := range event.CertificationIDs {
+			add(c.checkCertification(ctx, certificationID, event.FarmerID, event.Species, event.ZoneName, activityTime(event.HarvestDate)))
+		}
+	}
+
+	return certifications
+}
+
+// productSpecies returns the registry scientific name of a product's batch species, or an error
+// when the product has no batch or its batch or species cannot be resolved
+func (c *HerbalTraceContract) productSpecies(ctx contractapi.TransactionContextInterface, product *Product) (string, error) {
+	if product.BatchID == "" {
+		return "", fmt.Errorf("product %s has no batch", product.ID)
+	}
+	batch, err := c.GetBatch(ctx, product.BatchID)
+	if err != nil {
+		return "", err
+	}
+	species, err := c.ResolveSpecies(ctx, batch.Species)
+	if err != nil {
+		return "", err
+	}
+	return species.ScientificName, nil
+}
+
+// checkProductCertification verifies a certification attached to a product against its batch
+// species. A certification limited to some species is rejected when the species is unknown.
+func (c *HerbalTraceContract) checkProductCertification(ctx contractapi.TransactionContextInterface, certificationID string, product *Product, species string, speciesErr error) (*Certification, error) {
+	certification, err := c.checkCertification(ctx, certificationID, product.ManufacturerID, species, "", activityTime(product.ManufactureDate))
+	if err != nil {
+		return nil, err
+	}
+	if speciesErr != nil && len(certification.ScopeSpecies) > 0 {
+		return nil, fmt.Errorf("certification %s only covers species %v and the product species is unknown: %v", certificationID, certification.ScopeSpecies, speciesErr)
+	}
+	return certification, nil
+}
+
+// inScope reports whether a value is covered by a scope list, where an empty list covers everything
+func inScope(scope []string, value string) bool {
+	if len(scope) == 0 {
+		return true
+	}
+	for _, entry := range scope {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// activityTime parses the date an activity happened, falling back to the current time
+func activityTime(date string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return time.Now()
+	}
+	return parsed
+}
+
+// putCertification saves a certification to the ledger
+func (c *HerbalTraceContract) putCertification(ctx contractapi.TransactionContextInterface, certification *Certification) error {
+	certificationBytes, err := json.Marshal(certification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certification: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(certification.ID, certificationBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save certification to ledger: %v", err)
+	}
+
+	return nil
+}
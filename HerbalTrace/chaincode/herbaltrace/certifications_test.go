@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// newCertifiedProductLedger returns the provenance ledger with certifications held by MFR-1:
+// one for the test species, one for another species and one for every species
+func newCertifiedProductLedger(t *testing.T, speciesRegistered bool) *testLedger {
+	ledger := newProvenanceLedger(t)
+	if speciesRegistered {
+		registerTestSpecies(t, ledger)
+	}
+	for id, scope := range map[string][]string{
+		"CERT-WS":    {testSpecies},
+		"CERT-NEEM":  {"Azadirachta indica"},
+		"CERT-EVERY": nil,
+	} {
+		ledger.put(t, id, Certification{ID: id, Type: "Certification", Scheme: "organic", HolderID: "MFR-1", HolderType: "Manufacturer", ScopeSpecies: scope,
+			ValidFrom: "2025-01-01T00:00:00Z", ValidUntil: "2026-01-01T00:00:00Z", Status: "active"})
+	}
+	return ledger
+}
+
+func TestProductCertificationsCoverTheBatchSpecies(t *testing.T) {
+	tests := []struct {
+		name              string
+		speciesRegistered bool
+		batchID           string
+		certificationID   string
+		wantErr           bool
+	}{
+		{"species in scope", true, "BATCH-1", "CERT-WS", false},
+		{"species out of scope", true, "BATCH-1", "CERT-NEEM", true},
+		{"unscoped", true, "BATCH-1", "CERT-EVERY", false},
+		{"scoped with unregistered species", false, "BATCH-1", "CERT-WS", true},
+		{"unscoped with unregistered species", false, "BATCH-1", "CERT-EVERY", false},
+		{"scoped with missing batch", true, "BATCH-9", "CERT-WS", true},
+		{"scoped without batch", true, "", "CERT-WS", true},
+		{"unscoped without batch", true, "", "CERT-EVERY", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newCertifiedProductLedger(t, tt.speciesRegistered)
+			tx := ledger.begin("product")
+			productJSON := `{"id":"PROD-1","productName":"Ashwagandha powder","batchId":"` + tt.batchID + `","manufacturerId":"MFR-1",` +
+				`"manufactureDate":"2025-04-15T00:00:00Z","certifications":["` + tt.certificationID + `"]}`
+			err := new(HerbalTraceContract).CreateProduct(tx.context(testManufacturer), productJSON)
+			if (err != nil) != tt.wantErr || (err != nil && !strings.Contains(err.Error(), "certification validation error")) {
+				t.Errorf("CreateProduct error = %v, want certification error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ProvenanceIssue describes a reference that could not be followed or an entity in a bad state
+type ProvenanceIssue struct {
+	EntityType string `json:"entityType"`
+	EntityID   string `json:"entityId"`
+	Problem    string `json:"problem"` // "missing", "unreadable", "query_failed", "wrong_type", "rejected", "failed"
+	Detail     string `json:"detail"`
+}
+
+// ProvenanceCompleteness reports how much of a product's declared history could be traced
+type ProvenanceCompleteness struct {
+	Complete          bool              `json:"complete"`
+	ReferencedCount   int               `json:"referencedCount"`
+	ResolvedCount     int               `json:"resolvedCount"`
+	CoveragePercent   float64           `json:"coveragePercent"` // Resolved references as a share of referenced ones
+	MissingReferences []ProvenanceIssue `json:"missingReferences"`
+	FlaggedEntities   []ProvenanceIssue `json:"flaggedEntities"`
+}
+
+// resolveProvenanceRecord loads a referenced record into record, noting missing, unreadable or
+// mistyped references in the completeness report. It returns false if the record is unusable.
+func (c *HerbalTraceContract) resolveProvenanceRecord(ctx contractapi.TransactionContextInterface, completeness *ProvenanceCompleteness, entityType string, id string, record interface{}) bool {
+	completeness.ReferencedCount++
+
+	recordBytes, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		completeness.addMissing(entityType, id, "unreadable", fmt.Sprintf("failed to read from ledger: %v", err))
+		return false
+	}
+	if recordBytes == nil {
+		completeness.addMissing(entityType, id, "missing", "no record with this ID exists on the ledger")
+		return false
+	}
+
+	// Records written before types were enforced may have an empty type
+	var header struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(recordBytes, &header) == nil && header.Type != "" && header.Type != entityType {
+		completeness.addMissing(entityType, id, "wrong_type", fmt.Sprintf("ID refers to a %s", header.Type))
+		return false
+	}
+
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil {
+		completeness.addMissing(entityType, id, "unreadable", fmt.Sprintf("failed to unmarshal: %v", err))
+		return false
+	}
+
+	completeness.ResolvedCount++
+	return true
+}
+
+// checkProvenanceCompleteness flags rejected or failed entities and computes coverage
+func checkProvenanceCompleteness(prov *Provenance) {
+	completeness := &prov.Completeness
+
+	for _, event := range prov.CollectionEvents {
+		if event.Status == "rejected" {
+			completeness.addFlagged("CollectionEvent", event.ID, "rejected", firstNonEmpty(event.RejectionReason, "collection event was rejected"))
+		}
+	}
+	for _, test := range prov.QualityTests {
+		if test.OverallResult == "fail" || test.Status == "rejected" {
+			completeness.addFlagged("QualityTest", test.ID, "failed", fmt.Sprintf("overall result %s, status %s", test.OverallResult, test.Status))
+		}
+	}
+	for _, step := range prov.ProcessingSteps {
+		if step.Status == "failed" {
+			completeness.addFlagged("ProcessingStep", step.ID, "failed", fmt.Sprintf("%s step failed", step.ProcessType))
+		}
+	}
+	for _, certificate := range prov.QCCertificates {
+		if certificate.Status == "revoked" {
+			completeness.addFlagged("QCCertificate", certificate.ID, "revoked", fmt.Sprintf("QC certificate was revoked: %s", certificate.RevocationReason))
+		} else if strings.EqualFold(certificate.OverallResult, "fail") {
+			completeness.addFlagged("QCCertificate", certificate.ID, "failed", "QC certificate result is FAIL")
+		}
+	}
+
+	if completeness.ReferencedCount > 0 {
+		completeness.CoveragePercent = roundScore(100 * float64(completeness.ResolvedCount) / float64(completeness.ReferencedCount))
+	}
+	if completeness.MissingReferences == nil {
+		completeness.MissingReferences = []ProvenanceIssue{}
+	}
+	if completeness.FlaggedEntities == nil {
+		completeness.FlaggedEntities = []ProvenanceIssue{}
+	}
+	completeness.Complete = len(completeness.MissingReferences) == 0 && len(completeness.FlaggedEntities) == 0
+}
+
+// addMissing records a reference that could not be followed
+func (p *ProvenanceCompleteness) addMissing(entityType string, id string, problem string, detail string) {
+	p.MissingReferences = append(p.MissingReferences, ProvenanceIssue{EntityType: entityType, EntityID: id, Problem: problem, Detail: detail})
+}
+
+// addResolved counts records found by query rather than by explicit reference
+func (p *ProvenanceCompleteness) addResolved(count int) {
+	p.ReferencedCount += count
+	p.ResolvedCount += count
+}
+
+// addFlagged records a resolved entity in a rejected or failed state
+func (p *ProvenanceCompleteness) addFlagged(entityType string, id string, problem string, detail string) {
+	p.FlaggedEntities = append(p.FlaggedEntities, ProvenanceIssue{EntityType: entityType, EntityID: id, Problem: problem, Detail: detail})
+}
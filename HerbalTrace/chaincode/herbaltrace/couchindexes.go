@@ -0,0 +1,35 @@
+package main
+
+//go:generate go test -run TestCouchIndexes -update
+
+import (
+	"fmt"
+	"log"
+)
+
+// couchQuery is a rich query template together with the fields of the CouchDB index serving it.
+// Queries are defined next to the transactions that run them, and the index files under
+// META-INF are generated from these definitions with go generate, see couchindexes_test.go.
+type couchQuery struct {
+	Name     string
+	Template string   // Arguments are filled in with fmt verbs
+	Index    []string // Equality fields first, then sort fields, then range fields
+}
+
+// couchQueries holds every defined rich query by name
+var couchQueries = map[string]*couchQuery{}
+
+// defineQuery registers a rich query and the index serving it
+func defineQuery(name string, template string, index ...string) *couchQuery {
+	if _, exists := couchQueries[name]; exists {
+		log.Panicf("rich query %s is defined twice", name)
+	}
+	query := &couchQuery{Name: name, Template: template, Index: index}
+	couchQueries[name] = query
+	return query
+}
+
+// format fills in the arguments of a query template
+func (q *couchQuery) format(args ...interface{}) string {
+	return fmt.Sprintf(q.Template, args...)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// couchIndexDir is where Fabric picks up CouchDB indexes when the chaincode is installed
+const couchIndexDir = "META-INF/statedb/couchdb/indexes"
+
+// updateCouchIndexes makes TestCouchIndexes rewrite the index files instead of checking them
+var updateCouchIndexes = flag.Bool("update", false, "regenerate the CouchDB index files under META-INF")
+
+func TestCouchIndexes(t *testing.T) {
+	if problems := checkQueryCoverage(); len(problems) > 0 {
+		t.Fatalf("rich queries not covered by their index:\n%s", strings.Join(problems, "\n"))
+	}
+
+	if *updateCouchIndexes {
+		if err := generateCouchIndexes(couchIndexDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkCouchIndexes(couchIndexDir); err != nil {
+		t.Error(err)
+	}
+}
+
+// couchIndexName names an index after its fields, so queries needing the same index share it
+func couchIndexName(fields []string) string {
+	name := "index"
+	for _, field := range fields {
+		for _, part := range strings.Split(field, ".") {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return name
+}
+
+// couchIndexFiles renders the index file of every defined query, keyed by file name
+func couchIndexFiles() map[string][]byte {
+	files := make(map[string][]byte)
+	for _, query := range couchQueries {
+		name := couchIndexName(query.Index)
+		fieldsJSON, _ := json.Marshal(query.Index)
+		files[name+".json"] = []byte(fmt.Sprintf(`{
+  "index": {
+    "fields": %s
+  },
+  "ddoc": "%sDoc",
+  "name": "%s",
+  "type": "json"
+}
+`, strings.ReplaceAll(string(fieldsJSON), `","`, `", "`), name, name))
+	}
+	return files
+}
+
+// checkQueryCoverage reports every query that CouchDB could not serve from its index. An index is
+// only used if its fields are required by the selector, except sort fields; it can only sort if the
+// fields before the sort fields are matched by equality. Every selector and sort field must be indexed,
+// except fields required to be absent, which an index cannot hold.
+func checkQueryCoverage() []string {
+	var problems []string
+	for _, name := range sortedKeys(couchQueries) {
+		query := couchQueries[name]
+		selector, sortFields, err := parseQueryTemplate(query.Template)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+
+		indexed := make(map[string]bool)
+		for _, field := range query.Index {
+			indexed[field] = true
+		}
+		sorted := make(map[string]bool)
+		for _, field := range sortFields {
+			sorted[field] = true
+			if !indexed[field] {
+				problems = append(problems, fmt.Sprintf("%s: sort field %s is not indexed", name, field))
+			}
+		}
+		for _, field := range sortedKeys(selector) {
+			condition := selector[field]
+			if condition == "absent" {
+				if indexed[field] {
+					problems = append(problems, fmt.Sprintf("%s: field %s must be absent and cannot be indexed", name, field))
+				}
+				continue
+			}
+			if !indexed[field] {
+				problems = append(problems, fmt.Sprintf("%s: selector field %s is not indexed", name, field))
+			}
+		}
+		for _, field := range query.Index {
+			condition, selected := selector[field]
+			if !sorted[field] && (!selected || condition == "absent") {
+				problems = append(problems, fmt.Sprintf("%s: index field %s is not required by the selector", name, field))
+			}
+		}
+
+		if len(sortFields) > 0 {
+			position := 0
+			for position < len(query.Index) && query.Index[position] != sortFields[0] {
+				if selector[query.Index[position]] != "equal" {
+					problems = append(problems, fmt.Sprintf("%s: index field %s precedes the sort fields but is not matched by equality", name, query.Index[position]))
+				}
+				position++
+			}
+			tail := query.Index[position:]
+			if len(tail) < len(sortFields) || strings.Join(tail[:len(sortFields)], ",") != strings.Join(sortFields, ",") {
+				problems = append(problems, fmt.Sprintf("%s: sort fields %v are not in index order %v", name, sortFields, query.Index))
+			}
+		}
+	}
+	return problems
+}
+
+// queryTemplateArgs matches the fmt verbs of a query template, quoted or not
+var queryTemplateArgs = regexp.MustCompile(`"%[sv]"|%[sv]|%d`)
+
+// parseQueryTemplate fills a template with placeholder arguments and returns how each selector field
+// is matched ("equal", "absent" or "other") and the sort fields
+func parseQueryTemplate(template string) (map[string]string, []string, error) {
+	filled := queryTemplateArgs.ReplaceAllStringFunc(template, func(verb string) string {
+		switch verb {
+		case `"%s"`, `"%v"`:
+			return `"x"`
+		case "%d":
+			return "0"
+		}
+		return "null"
+	})
+
+	var query struct {
+		Selector map[string]json.RawMessage `json:"selector"`
+		Sort     []map[string]string        `json:"sort"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(filled)))
+	decoder.UseNumber()
+	err := decoder.Decode(&query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid query template: %v", err)
+	}
+
+	selector := make(map[string]string)
+	for field, raw := range query.Selector {
+		if strings.HasPrefix(field, "$") {
+			return nil, nil, fmt.Errorf("top-level operator %s is not supported", field)
+		}
+		var operators map[string]interface{}
+		if json.Unmarshal(raw, &operators) != nil {
+			selector[field] = "equal"
+			continue
+		}
+		switch {
+		case len(operators) == 1 && operators["$eq"] != nil:
+			selector[field] = "equal"
+		case len(operators) == 1 && operators["$exists"] == false:
+			selector[field] = "absent"
+		default:
+			selector[field] = "other"
+		}
+	}
+
+	var sortFields []string
+	directions := make(map[string]bool)
+	for _, entry := range query.Sort {
+		for field, direction := range entry {
+			sortFields = append(sortFields, field)
+			directions[direction] = true
+		}
+	}
+	if len(directions) > 1 {
+		return nil, nil, fmt.Errorf("sort fields must all use the same direction")
+	}
+
+	return selector, sortFields, nil
+}
+
+// generateCouchIndexes writes the index files of every defined query to dir and removes index files
+// no query needs. It refuses to write anything while a query is not covered by its index.
+func generateCouchIndexes(dir string) error {
+	problems := checkQueryCoverage()
+	if len(problems) > 0 {
+		return fmt.Errorf("rich queries not covered by their index:\n%s", strings.Join(problems, "\n"))
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create index directory: %v", err)
+	}
+	files := couchIndexFiles()
+
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to list index files: %v", err)
+	}
+	for _, path := range existing {
+		if _, needed := files[filepath.Base(path)]; !needed {
+			err = os.Remove(path)
+			if err != nil {
+				return fmt.Errorf("failed to remove stale index %s: %v", path, err)
+			}
+		}
+	}
+	for _, name := range sortedKeys(files) {
+		err = os.WriteFile(filepath.Join(dir, name), files[name], 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write index %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkCouchIndexes fails if a query is not covered by its index or the index files in dir differ
+// from the generated ones, so CI can catch queries that would fail on CouchDB
+func checkCouchIndexes(dir string) error {
+	problems := checkQueryCoverage()
+
+	files := couchIndexFiles()
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to list index files: %v", err)
+	}
+	onDisk := make(map[string]bool)
+	for _, path := range existing {
+		name := filepath.Base(path)
+		onDisk[name] = true
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read index %s: %v", path, err)
+		}
+		expected, needed := files[name]
+		switch {
+		case !needed:
+			problems = append(problems, fmt.Sprintf("%s is not used by any query", name))
+		case !bytes.Equal(content, expected):
+			problems = append(problems, fmt.Sprintf("%s is out of date", name))
+		}
+	}
+	for _, name := range sortedKeys(files) {
+		if !onDisk[name] {
+			problems = append(problems, fmt.Sprintf("%s is missing", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("CouchDB indexes do not match the rich queries, run go generate:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
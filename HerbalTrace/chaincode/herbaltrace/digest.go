@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ProvenanceDigestAlgorithm identifies how provenance digests are computed
+const ProvenanceDigestAlgorithm = "sha256-canonical-json"
+
+// provenanceDigestVolatileFields are fields left out of record digests. The batch moves to
+// "manufactured" in the same transaction that anchors the digest, which cannot read its own writes,
+// and personal data may later be erased at the farmer's request.
+var provenanceDigestVolatileFields = map[string][]string{
+	"Batch":           {"status", "timestamp"},
+	"CollectionEvent": {"farmerName", "altitude", "accuracy", "personalDataErased"},
+}
+
+// ProvenanceRecordDigest is the digest of one upstream record at the time a product was created
+type ProvenanceRecordDigest struct {
+	EntityType string `json:"entityType"`
+	EntityID   string `json:"entityId"`
+	Digest     string `json:"digest"`
+}
+
+// ProvenanceRecordChange describes an upstream record that differs from the anchored provenance
+type ProvenanceRecordChange struct {
+	EntityType     string `json:"entityType"`
+	EntityID       string `json:"entityId"`
+	Change         string `json:"change"` // "modified", "added", "removed"
+	AnchoredDigest string `json:"anchoredDigest,omitempty"`
+	CurrentDigest  string `json:"currentDigest,omitempty"`
+}
+
+// ProvenanceVerification is the result of comparing current provenance against the anchored digest
+type ProvenanceVerification struct {
+	ProductID      string                   `json:"productId"`
+	Verified       bool                     `json:"verified"`
+	Algorithm      string                   `json:"algorithm"`
+	AnchoredDigest string                   `json:"anchoredDigest"`
+	AnchoredAt     string                   `json:"anchoredAt"`
+	CurrentDigest  string                   `json:"currentDigest"`
+	ChangedRecords []ProvenanceRecordChange `json:"changedRecords"`
+	Message        string                   `json:"message"`
+	VerifiedAt     string                   `json:"verifiedAt"`
+}
+
+// VerifyProvenance recomputes a product's provenance digest and reports upstream records changed since creation
+func (c *HerbalTraceContract) VerifyProvenance(ctx contractapi.TransactionContextInterface, productID string) (*ProvenanceVerification, error) {
+	product, err := c.GetProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	verification := &ProvenanceVerification{
+		ProductID:      productID,
+		Algorithm:      ProvenanceDigestAlgorithm,
+		AnchoredDigest: product.ProvenanceDigest,
+		AnchoredAt:     product.ProvenanceAnchoredAt,
+		ChangedRecords: []ProvenanceRecordChange{},
+		VerifiedAt:     time.Now().Format(time.RFC3339),
+	}
+
+	currentDigest, currentRecords, err := c.computeProvenanceDigest(ctx, product)
+	if err != nil {
+		return nil, err
+	}
+	verification.CurrentDigest = currentDigest
+
+	if product.ProvenanceDigest == "" {
+		verification.Message = "no provenance digest was anchored when this product was created"
+		return verification, nil
+	}
+
+	verification.ChangedRecords = diffProvenanceRecords(product.ProvenanceRecords, currentRecords)
+	verification.Verified = currentDigest == product.ProvenanceDigest && len(verification.ChangedRecords) == 0
+	if verification.Verified {
+		verification.Message = "provenance is unchanged since the product was created"
+	} else {
+		verification.Message = fmt.Sprintf("%d upstream records changed since the product was created", len(verification.ChangedRecords))
+	}
+
+	return verification, nil
+}
+
+// anchorProvenanceDigest computes the provenance digest of a product that is about to be created
+func (c *HerbalTraceContract) anchorProvenanceDigest(ctx contractapi.TransactionContextInterface, product *Product) error {
+	digest, records, err := c.computeProvenanceDigest(ctx, product)
+	if err != nil {
+		return err
+	}
+
+	product.ProvenanceDigest = digest
+	product.ProvenanceRecords = records
+	product.ProvenanceAnchoredAt = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+// computeProvenanceDigest digests every upstream record of a product. Each record is hashed in
+// canonical JSON form as stored on the ledger, and the bundle digest covers the sorted record digests.
+// The product itself and alerts are excluded, as they legitimately change after creation.
+func (c *HerbalTraceContract) computeProvenanceDigest(ctx contractapi.TransactionContextInterface, product *Product) (string, []ProvenanceRecordDigest, error) {
+	refs, err := c.provenanceDigestRefs(ctx, product)
+	if err != nil {
+		return "", nil, err
+	}
+
+	records := []ProvenanceRecordDigest{}
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		key := ref.EntityType + "/" + ref.EntityID
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		recordBytes, err := ctx.GetStub().GetState(ref.EntityID)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read %s %s: %v", ref.EntityType, ref.EntityID, err)
+		}
+		if recordBytes == nil {
+			continue
+		}
+
+		digest, err := provenanceRecordDigest(ref.EntityType, recordBytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to digest %s %s: %v", ref.EntityType, ref.EntityID, err)
+		}
+		ref.Digest = digest
+		records = append(records, ref)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].EntityType != records[j].EntityType {
+			return records[i].EntityType < records[j].EntityType
+		}
+		return records[i].EntityID < records[j].EntityID
+	})
+
+	bundle := map[string]interface{}{
+		"algorithm": ProvenanceDigestAlgorithm,
+		"productId": product.ID,
+		"records":   records,
+	}
+	bundleBytes, err := json.Marshal(bundle)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal provenance bundle: %v", err)
+	}
+	canonical, err := canonicalJSON(bundleBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to canonicalize provenance bundle: %v", err)
+	}
+
+	return sha256Hex(canonical), records, nil
+}
+
+// provenanceRecordDigest hashes a stored record in canonical JSON form, without its volatile fields
+func provenanceRecordDigest(entityType string, recordBytes []byte) (string, error) {
+	var record map[string]interface{}
+	err := json.Unmarshal(recordBytes, &record)
+	if err != nil {
+		return "", err
+	}
+	for _, field := range provenanceDigestVolatileFields[entityType] {
+		delete(record, field)
+	}
+
+	strippedBytes, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := canonicalJSON(strippedBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return sha256Hex(canonical), nil
+}
+
+// provenanceDigestRefs lists the upstream records of a product with keyed reads only, so the
+// digest anchored by CreateProduct is covered by the MVCC and phantom read checks. Records are
+// derived from the batch the way gatherProvenanceRecords derives them, with the batch's tests,
+// steps and certificates taken from the batch record index.
+func (c *HerbalTraceContract) provenanceDigestRefs(ctx contractapi.TransactionContextInterface, product *Product) ([]ProvenanceRecordDigest, error) {
+	refs := []ProvenanceRecordDigest{}
+
+	var batch *Batch
+	if product.BatchID != "" {
+		batchBytes, err := ctx.GetStub().GetState(product.BatchID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read batch %s: %v", product.BatchID, err)
+		}
+		if batchBytes != nil {
+			batch = &Batch{}
+			err = json.Unmarshal(batchBytes, batch)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal batch %s: %v", product.BatchID, err)
+			}
+			refs = append(refs, ProvenanceRecordDigest{EntityType: "Batch", EntityID: batch.ID})
+		}
+	}
+
+	eventIDs := product.CollectionEventIDs
+	if batch != nil && len(batch.CollectionEventIDs) > 0 {
+		eventIDs = batch.CollectionEventIDs
+	}
+	for _, eventID := range eventIDs {
+		refs = append(refs, ProvenanceRecordDigest{EntityType: "CollectionEvent", EntityID: eventID})
+	}
+
+	fallbackIDs := map[string][]string{
+		"QualityTest":    product.QualityTestIDs,
+		"ProcessingStep": product.ProcessingStepIDs,
+	}
+	for _, entityType := range []string{"QualityTest", "ProcessingStep", "QCCertificate"} {
+		var ids []string
+		if batch != nil {
+			var err error
+			ids, err = batchRecordIDs(ctx, batch.ID, entityType)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(ids) == 0 {
+			ids = fallbackIDs[entityType]
+		}
+		for _, id := range ids {
+			refs = append(refs, ProvenanceRecordDigest{EntityType: entityType, EntityID: id})
+		}
+	}
+
+	return refs, nil
+}
+
+// diffProvenanceRecords compares anchored record digests with current ones
+func diffProvenanceRecords(anchored []ProvenanceRecordDigest, current []ProvenanceRecordDigest) []ProvenanceRecordChange {
+	currentByKey := make(map[string]ProvenanceRecordDigest)
+	for _, record := range current {
+		currentByKey[record.EntityType+"/"+record.EntityID] = record
+	}
+
+	changes := []ProvenanceRecordChange{}
+	anchoredKeys := make(map[string]bool)
+	for _, record := range anchored {
+		key := record.EntityType + "/" + record.EntityID
+		anchoredKeys[key] = true
+
+		now, ok := currentByKey[key]
+		if !ok {
+			changes = append(changes, ProvenanceRecordChange{EntityType: record.EntityType, EntityID: record.EntityID, Change: "removed", AnchoredDigest: record.Digest})
+		} else if now.Digest != record.Digest {
+			changes = append(changes, ProvenanceRecordChange{EntityType: record.EntityType, EntityID: record.EntityID, Change: "modified", AnchoredDigest: record.Digest, CurrentDigest: now.Digest})
+		}
+	}
+	for _, record := range current {
+		if !anchoredKeys[record.EntityType+"/"+record.EntityID] {
+			changes = append(changes, ProvenanceRecordChange{EntityType: record.EntityType, EntityID: record.EntityID, Change: "added", CurrentDigest: record.Digest})
+		}
+	}
+
+	return changes
+}
+
+// canonicalJSON re-encodes a JSON document with sorted object keys, no insignificant whitespace
+// and no HTML escaping, so equal documents always produce identical bytes
+func canonicalJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// sha256Hex returns the hex-encoded SHA-256 digest of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
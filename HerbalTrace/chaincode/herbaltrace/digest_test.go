@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testManufacturer = testIdentity{id: "manufacturer-1", mspID: "ManufacturersMSP", attributes: map[string]string{"role": "manufacturer"}}
+
+// newProvenanceLedger returns a ledger holding a batch with one collection event and one quality test
+func newProvenanceLedger(t *testing.T) *testLedger {
+	ledger := newTestLedger()
+	ledger.put(t, "COL-1", CollectionEvent{ID: "COL-1", Type: "CollectionEvent", Species: testSpecies, Quantity: 50, Unit: "kg"})
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, TotalQuantity: 50, Unit: "kg", CollectionEventIDs: []string{"COL-1"}, Status: "testing"})
+	recordAgainstBatch(t, ledger, "record-QT-1", "QT-1")
+	return ledger
+}
+
+// recordAgainstBatch commits a quality test recorded against BATCH-1, as CreateQualityTest stores it
+func recordAgainstBatch(t *testing.T, ledger *testLedger, txID string, testID string) {
+	t.Helper()
+	tx := ledger.begin(txID)
+	ctx := tx.context(testManufacturer)
+	err := ctx.GetStub().PutState(testID, []byte(`{"id":"`+testID+`","type":"QualityTest","batchId":"BATCH-1"}`))
+	if err != nil {
+		t.Fatalf("failed to save quality test: %v", err)
+	}
+	err = putBatchRecordIndex(ctx, "BATCH-1", "QualityTest", testID)
+	if err != nil {
+		t.Fatalf("failed to index quality test: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("quality test did not commit: %v", err)
+	}
+}
+
+// endorseProduct simulates CreateProduct for a product made from BATCH-1
+func endorseProduct(t *testing.T, ledger *testLedger, txID string) *testTx {
+	t.Helper()
+	tx := ledger.begin(txID)
+	contract := new(HerbalTraceContract)
+	err := contract.CreateProduct(tx.context(testManufacturer), `{"id":"PROD-1","productName":"Ashwagandha powder","batchId":"BATCH-1","manufacturerId":"MFR-1"}`)
+	if err != nil {
+		t.Fatalf("product was rejected: %v", err)
+	}
+	return tx
+}
+
+func TestProvenanceDigestUsesKeyedReads(t *testing.T) {
+	ledger := newProvenanceLedger(t)
+
+	tx := endorseProduct(t, ledger, "product")
+	if len(tx.queries) != 0 {
+		t.Errorf("CreateProduct ran rich queries: %v", tx.queries)
+	}
+	if err := ledger.commit(tx); err != nil {
+		t.Fatalf("product did not commit: %v", err)
+	}
+
+	var product Product
+	ledger.get(t, "PROD-1", &product)
+	anchored := map[string]bool{}
+	for _, record := range product.ProvenanceRecords {
+		anchored[record.EntityType+"/"+record.EntityID] = true
+	}
+	for _, want := range []string{"Batch/BATCH-1", "CollectionEvent/COL-1", "QualityTest/QT-1"} {
+		if !anchored[want] {
+			t.Errorf("anchored records %v do not include %s", product.ProvenanceRecords, want)
+		}
+	}
+}
+
+func TestProvenanceDigestConflictsWithConcurrentBatchRecord(t *testing.T) {
+	ledger := newProvenanceLedger(t)
+
+	// A quality test for the batch commits between endorsement and commit of the product
+	tx := endorseProduct(t, ledger, "product")
+	recordAgainstBatch(t, ledger, "record-QT-2", "QT-2")
+
+	if err := ledger.commit(tx); err == nil {
+		t.Errorf("product committed with a digest that misses quality test QT-2")
+	}
+}
+
+func TestCreateProductRejectsExistingID(t *testing.T) {
+	ledger := newProvenanceLedger(t)
+	if err := ledger.commit(endorseProduct(t, ledger, "product")); err != nil {
+		t.Fatalf("product did not commit: %v", err)
+	}
+
+	tx := ledger.begin("resubmit")
+	contract := new(HerbalTraceContract)
+	err := contract.CreateProduct(tx.context(testManufacturer), `{"id":"PROD-1","productName":"Replacement","batchId":"BATCH-1","manufacturerId":"MFR-2"}`)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("resubmitted product was not rejected, got %v", err)
+	}
+}
+
+func TestCreateProductRequiresManufacturer(t *testing.T) {
+	ledger := newProvenanceLedger(t)
+	tx := ledger.begin("product")
+	contract := new(HerbalTraceContract)
+	err := contract.CreateProduct(tx.context(testFarmer), `{"id":"PROD-1","productName":"Ashwagandha powder","batchId":"BATCH-1","manufacturerId":"MFR-1"}`)
+	if err == nil {
+		t.Errorf("product created by a %s identity", testFarmer.mspID)
+	}
+}
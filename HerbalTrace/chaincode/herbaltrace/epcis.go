@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/herbaltrace/chaincode/epcis"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Supply chain records are exported as GS1 EPCIS 2.0 JSON-LD documents, see package epcis
+// for the mapping.
+
+// ExportEPCISByProduct returns the EPCIS 2.0 events for a product and its batch
+func (c *HerbalTraceContract) ExportEPCISByProduct(ctx contractapi.TransactionContextInterface, productID string) (string, error) {
+	provenance, err := c.GenerateProvenance(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	trace := epcisTrace(provenance.Batch, provenance.CollectionEvents, provenance.QualityTests, provenance.ProcessingSteps, []Product{provenance.Product})
+	return marshalEPCISDocument(epcis.BuildDocument([]epcis.Trace{trace}, time.Now()))
+}
+
+// ExportEPCISByBatch returns the EPCIS 2.0 events for a batch, its collection events and
+// every quality test, processing step and product recorded against it
+func (c *HerbalTraceContract) ExportEPCISByBatch(ctx contractapi.TransactionContextInterface, batchID string) (string, error) {
+	batch, err := c.GetBatch(ctx, batchID)
+	if err != nil {
+		return "", err
+	}
+
+	var collections []CollectionEvent
+	for _, eventID := range batch.CollectionEventIDs {
+		event, err := c.GetCollectionEvent(ctx, eventID)
+		if err == nil {
+			collections = append(collections, *event)
+		}
+	}
+
+	tests, err := c.queryQualityTestsByBatch(ctx, batchID)
+	if err != nil {
+		return "", err
+	}
+
+	steps, err := c.queryProcessingStepsByBatch(ctx, batchID)
+	if err != nil {
+		return "", err
+	}
+
+	products, err := c.queryProductsByBatch(ctx, batchID)
+	if err != nil {
+		return "", err
+	}
+
+	trace := epcisTrace(batch, collections, tests, steps, products)
+	return marshalEPCISDocument(epcis.BuildDocument([]epcis.Trace{trace}, time.Now()))
+}
+
+// epcisTrace converts ledger records to the input of the EPCIS mapping, with canonical unit symbols
+func epcisTrace(batch *Batch, collections []CollectionEvent, tests []QualityTest, steps []ProcessingStep, products []Product) epcis.Trace {
+	var trace epcis.Trace
+	if batch != nil {
+		trace.Batch = &epcis.Batch{
+			ID:                batch.ID,
+			Species:           batch.Species,
+			TotalQuantity:     batch.TotalQuantity,
+			Unit:              epcisUnit(batch.Unit),
+			CreatedBy:         batch.CreatedBy,
+			CreatedDate:       batch.CreatedDate,
+			AssignedProcessor: batch.AssignedProcessor,
+			AssignedDate:      batch.AssignedDate,
+			Timestamp:         batch.Timestamp,
+		}
+	}
+	for _, collection := range collections {
+		trace.CollectionEvents = append(trace.CollectionEvents, epcis.CollectionEvent{
+			ID:               collection.ID,
+			FarmerID:         collection.FarmerID,
+			Species:          collection.Species,
+			Quantity:         collection.Quantity,
+			ReceivedQuantity: collection.ReceivedQuantity,
+			Unit:             epcisUnit(collection.Unit),
+			Latitude:         collection.Latitude,
+			Longitude:        collection.Longitude,
+			HarvestDate:      collection.HarvestDate,
+			Timestamp:        collection.Timestamp,
+			Status:           collection.Status,
+			VerificationDate: collection.VerificationDate,
+		})
+	}
+	for _, test := range tests {
+		trace.QualityTests = append(trace.QualityTests, epcis.QualityTest{
+			ID:                test.ID,
+			CollectionEventID: test.CollectionEventID,
+			BatchID:           test.BatchID,
+			LabID:             test.LabID,
+			TestDate:          test.TestDate,
+			Timestamp:         test.Timestamp,
+			OverallResult:     test.OverallResult,
+		})
+	}
+	for _, step := range steps {
+		trace.ProcessingSteps = append(trace.ProcessingSteps, epcis.ProcessingStep{
+			ID:             step.ID,
+			ProcessType:    step.ProcessType,
+			ProcessorID:    step.ProcessorID,
+			ProcessDate:    step.ProcessDate,
+			InputQuantity:  step.InputQuantity,
+			OutputQuantity: step.OutputQuantity,
+			Unit:           epcisUnit(step.Unit),
+			OutputUnit:     epcisUnit(outputUnit(step)),
+			Latitude:       step.Latitude,
+			Longitude:      step.Longitude,
+			Timestamp:      step.Timestamp,
+		})
+	}
+	for _, product := range products {
+		trace.Products = append(trace.Products, epcis.Product{
+			ID:              product.ID,
+			GTIN:            product.GTIN,
+			BatchID:         product.BatchID,
+			ManufacturerID:  product.ManufacturerID,
+			Quantity:        product.Quantity,
+			Unit:            epcisUnit(product.Unit),
+			ManufactureDate: product.ManufactureDate,
+			ExpiryDate:      product.ExpiryDate,
+			SiteLatitude:    product.SiteLatitude,
+			SiteLongitude:   product.SiteLongitude,
+			Status:          product.Status,
+			Timestamp:       product.Timestamp,
+		})
+	}
+	return trace
+}
+
+// epcisUnit returns the canonical symbol of a unit, or the unit itself when it is not known
+func epcisUnit(unit string) string {
+	if definition, err := lookupUnit(unit); err == nil {
+		return definition.Symbol
+	}
+	return unit
+}
+
+// marshalEPCISDocument serialises an EPCIS document for a chaincode response
+func marshalEPCISDocument(document *epcis.Document) (string, error) {
+	documentBytes, err := json.Marshal(document)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal EPCIS document: %v", err)
+	}
+	return string(documentBytes), nil
+}
+
+var qualityTestsByBatchQuery = defineQuery("qualityTestsByBatch",
+	`{"selector":{"type":"QualityTest","batchId":"%s"}}`,
+	"type", "batchId")
+
+// queryQualityTestsByBatch retrieves the quality tests recorded against a batch
+func (c *HerbalTraceContract) queryQualityTestsByBatch(ctx contractapi.TransactionContextInterface, batchID string) ([]QualityTest, error) {
+	queryString := qualityTestsByBatchQuery.format(batchID)
+	var tests []QualityTest
+	err := queryRecords(ctx, queryString, func(value []byte) error {
+		var test QualityTest
+		err := json.Unmarshal(value, &test)
+		if err == nil {
+			tests = append(tests, test)
+		}
+		return err
+	})
+	return tests, err
+}
+
+var processingStepsByBatchQuery = defineQuery("processingStepsByBatch",
+	`{"selector":{"type":"ProcessingStep","batchId":"%s"}}`,
+	"type", "batchId")
+
+// queryProcessingStepsByBatch retrieves the processing steps recorded against a batch
+func (c *HerbalTraceContract) queryProcessingStepsByBatch(ctx contractapi.TransactionContextInterface, batchID string) ([]ProcessingStep, error) {
+	queryString := processingStepsByBatchQuery.format(batchID)
+	var steps []ProcessingStep
+	err := queryRecords(ctx, queryString, func(value []byte) error {
+		var step ProcessingStep
+		err := json.Unmarshal(value, &step)
+		if err == nil {
+			steps = append(steps, step)
+		}
+		return err
+	})
+	return steps, err
+}
+
+var productsByBatchQuery = defineQuery("productsByBatch",
+	`{"selector":{"type":"Product","batchId":"%s"}}`,
+	"type", "batchId")
+
+// queryProductsByBatch retrieves the products made from a batch
+func (c *HerbalTraceContract) queryProductsByBatch(ctx contractapi.TransactionContextInterface, batchID string) ([]Product, error) {
+	queryString := productsByBatchQuery.format(batchID)
+	var products []Product
+	err := queryRecords(ctx, queryString, func(value []byte) error {
+		var product Product
+		err := json.Unmarshal(value, &product)
+		if err == nil {
+			products = append(products, product)
+		}
+		return err
+	})
+	return products, err
+}
+
+// queryRecords runs a rich query and hands each record to collect
+func queryRecords(ctx contractapi.TransactionContextInterface, queryString string, collect func([]byte) error) error {
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return fmt.Errorf("failed to query: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to iterate query results: %v", err)
+		}
+		err = collect(queryResponse.Value)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal query result: %v", err)
+		}
+	}
+
+	return nil
+}
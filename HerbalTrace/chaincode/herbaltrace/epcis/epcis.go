@@ -0,0 +1,449 @@
+// Package epcis maps HerbalTrace supply chain records to GS1 EPCIS 2.0 JSON-LD documents. Lots
+// without a GTIN are identified in the urn:herbaltrace namespace; products with a GTIN use GS1
+// Digital Link. The record types carry the JSON names of the ledger records, so records read
+// from the ledger can be unmarshalled into them directly.
+package epcis
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	contextURL    = "https://ref.gs1.org/standards/epcis/2.0.0/epcis-context.jsonld"
+	extensionNS   = "urn:herbaltrace:epcis:"
+	digitalLinkID = "https://id.gs1.org"
+	uuidNamespace = "urn:herbaltrace:" // Shared with the chaincode's FHIR identifiers, so event IDs stay stable
+)
+
+// uomCodes maps canonical unit symbols to UN/CEFACT Rec 20 codes
+var uomCodes = map[string]string{"g": "GRM", "kg": "KGM", "quintal": "DTN", "tonne": "TNE", "ml": "MLT", "l": "LTR"}
+
+// Document is an EPCIS 2.0 document
+type Document struct {
+	Context       []interface{} `json:"@context"`
+	Type          string        `json:"type"` // "EPCISDocument"
+	SchemaVersion string        `json:"schemaVersion"`
+	CreationDate  string        `json:"creationDate"`
+	EPCISBody     Body          `json:"epcisBody"`
+}
+
+// Body holds the event list of an EPCIS document
+type Body struct {
+	EventList []Event `json:"eventList"`
+}
+
+// Quantity is a quantity of a lot-level class identifier
+type Quantity struct {
+	EPCClass string  `json:"epcClass"`
+	Quantity float64 `json:"quantity,omitempty"`
+	UOM      string  `json:"uom,omitempty"` // UN/CEFACT Rec 20 code
+}
+
+// Location is a read point or business location
+type Location struct {
+	ID string `json:"id"`
+}
+
+// Source is a party or location an object moved from
+type Source struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+}
+
+// Destination is a party or location an object moved to
+type Destination struct {
+	Type        string `json:"type"`
+	Destination string `json:"destination"`
+}
+
+// Event is an ObjectEvent, AggregationEvent or TransformationEvent. Fields that do not
+// apply to an event type are left empty.
+type Event struct {
+	Type                string                 `json:"type"`
+	EventID             string                 `json:"eventID"`
+	EventTime           string                 `json:"eventTime"`
+	EventTimeZoneOffset string                 `json:"eventTimeZoneOffset"`
+	Action              string                 `json:"action,omitempty"`   // Not used by TransformationEvent
+	ParentID            string                 `json:"parentID,omitempty"` // AggregationEvent only
+	QuantityList        []Quantity             `json:"quantityList,omitempty"`
+	ChildQuantityList   []Quantity             `json:"childQuantityList,omitempty"`
+	InputQuantityList   []Quantity             `json:"inputQuantityList,omitempty"`
+	OutputQuantityList  []Quantity             `json:"outputQuantityList,omitempty"`
+	TransformationID    string                 `json:"transformationID,omitempty"`
+	BizStep             string                 `json:"bizStep,omitempty"`
+	Disposition         string                 `json:"disposition,omitempty"`
+	ReadPoint           *Location              `json:"readPoint,omitempty"`
+	BizLocation         *Location              `json:"bizLocation,omitempty"`
+	SourceList          []Source               `json:"sourceList,omitempty"`
+	DestinationList     []Destination          `json:"destinationList,omitempty"`
+	ILMD                map[string]interface{} `json:"ilmd,omitempty"`
+	RecordID            string                 `json:"ht:recordId,omitempty"` // Ledger key of the source record
+	RecordType          string                 `json:"ht:recordType,omitempty"`
+	Species             string                 `json:"ht:species,omitempty"`
+	ProcessType         string                 `json:"ht:processType,omitempty"`
+
+	sortTime time.Time
+}
+
+// CollectionEvent is the part of a collection event record used for EPCIS
+type CollectionEvent struct {
+	ID               string  `json:"id"`
+	FarmerID         string  `json:"farmerId"`
+	Species          string  `json:"species"`
+	Quantity         float64 `json:"quantity"`
+	ReceivedQuantity float64 `json:"receivedQuantity,omitempty"`
+	Unit             string  `json:"unit"` // Canonical unit symbol, e.g. "kg"
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	HarvestDate      string  `json:"harvestDate"`
+	Timestamp        string  `json:"timestamp"`
+	Status           string  `json:"status"`
+	VerificationDate string  `json:"verificationDate,omitempty"`
+}
+
+// Batch is the part of a batch record used for EPCIS
+type Batch struct {
+	ID                string  `json:"id"`
+	Species           string  `json:"species"`
+	TotalQuantity     float64 `json:"totalQuantity"`
+	Unit              string  `json:"unit"`
+	CreatedBy         string  `json:"createdBy"`
+	CreatedDate       string  `json:"createdDate"`
+	AssignedProcessor string  `json:"assignedProcessor,omitempty"`
+	AssignedDate      string  `json:"assignedDate,omitempty"`
+	Timestamp         string  `json:"timestamp"`
+}
+
+// QualityTest is the part of a quality test record used for EPCIS
+type QualityTest struct {
+	ID                string `json:"id"`
+	CollectionEventID string `json:"collectionEventId"`
+	BatchID           string `json:"batchId"`
+	LabID             string `json:"labId"`
+	TestDate          string `json:"testDate"`
+	Timestamp         string `json:"timestamp"`
+	OverallResult     string `json:"overallResult"` // "pass", "fail"
+}
+
+// ProcessingStep is the part of a processing step record used for EPCIS
+type ProcessingStep struct {
+	ID             string  `json:"id"`
+	ProcessType    string  `json:"processType"`
+	ProcessorID    string  `json:"processorId"`
+	ProcessDate    string  `json:"processDate"`
+	InputQuantity  float64 `json:"inputQuantity"`
+	OutputQuantity float64 `json:"outputQuantity"`
+	Unit           string  `json:"unit"`
+	OutputUnit     string  `json:"outputUnit,omitempty"` // Defaults to Unit
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	Timestamp      string  `json:"timestamp"`
+}
+
+// Product is the part of a product record used for EPCIS
+type Product struct {
+	ID              string  `json:"id"`
+	GTIN            string  `json:"gtin,omitempty"`
+	BatchID         string  `json:"batchId"`
+	ManufacturerID  string  `json:"manufacturerId"`
+	Quantity        float64 `json:"quantity"`
+	Unit            string  `json:"unit"`
+	ManufactureDate string  `json:"manufactureDate"`
+	ExpiryDate      string  `json:"expiryDate"`
+	SiteLatitude    float64 `json:"siteLatitude,omitempty"`
+	SiteLongitude   float64 `json:"siteLongitude,omitempty"`
+	Status          string  `json:"status"`
+	Timestamp       string  `json:"timestamp"`
+}
+
+// Trace is the set of ledger records exported together for one batch or product
+type Trace struct {
+	Batch            *Batch
+	CollectionEvents []CollectionEvent
+	QualityTests     []QualityTest
+	ProcessingSteps  []ProcessingStep
+	Products         []Product
+}
+
+// BuildDocument converts traces into one EPCIS 2.0 document for bulk export. Events shared
+// between traces are emitted once and the event list is ordered by event time. Records without
+// a usable date are dated at creationDate.
+func BuildDocument(traces []Trace, creationDate time.Time) *Document {
+	seen := map[string]bool{}
+	var events []Event
+	for _, trace := range traces {
+		for _, event := range traceEvents(trace, creationDate) {
+			if seen[event.EventID] {
+				continue
+			}
+			seen[event.EventID] = true
+			events = append(events, event)
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].sortTime.Equal(events[j].sortTime) {
+			return events[i].sortTime.Before(events[j].sortTime)
+		}
+		return events[i].EventID < events[j].EventID
+	})
+	if events == nil {
+		events = []Event{}
+	}
+
+	return &Document{
+		Context:       []interface{}{contextURL, map[string]string{"ht": extensionNS}},
+		Type:          "EPCISDocument",
+		SchemaVersion: "2.0",
+		CreationDate:  creationDate.UTC().Format(time.RFC3339),
+		EPCISBody:     Body{EventList: events},
+	}
+}
+
+// traceEvents maps one trace to EPCIS events
+func traceEvents(trace Trace, fallback time.Time) []Event {
+	var events []Event
+
+	// Harvest commissions a raw material lot at the collection point
+	var collectionLots []Quantity
+	for _, collection := range trace.CollectionEvents {
+		lot := newQuantity(lotClass("collection", collection.ID), collection.Quantity, collection.Unit)
+		collectionLots = append(collectionLots, lot)
+
+		event := newEvent("ObjectEvent", "CollectionEvent", collection.ID, "commissioning", firstNonEmpty(collection.HarvestDate, collection.Timestamp), fallback)
+		event.Action = "ADD"
+		event.Disposition = "active"
+		event.QuantityList = []Quantity{lot}
+		event.ReadPoint = geoLocation(collection.Latitude, collection.Longitude)
+		event.SourceList = party(collection.FarmerID, "farmer")
+		event.Species = collection.Species
+		event.ILMD = map[string]interface{}{"cbvmda:lotNumber": collection.ID}
+		if collection.HarvestDate != "" {
+			event.ILMD["cbvmda:harvestStartDate"] = collection.HarvestDate
+		}
+		events = append(events, event)
+
+		// Verification at the collection centre accepts or rejects the lot
+		if collection.VerificationDate != "" && (collection.Status == "verified" || collection.Status == "rejected") {
+			bizStep, disposition := "receiving", "in_progress"
+			if collection.Status == "rejected" {
+				bizStep, disposition = "inspecting", "non_conformant"
+			}
+			decision := newEvent("ObjectEvent", "CollectionEvent", collection.ID, bizStep, collection.VerificationDate, fallback)
+			decision.Action = "OBSERVE"
+			decision.Disposition = disposition
+			quantity := collection.Quantity
+			if collection.ReceivedQuantity > 0 {
+				quantity = collection.ReceivedQuantity
+			}
+			decision.QuantityList = []Quantity{newQuantity(lot.EPCClass, quantity, collection.Unit)}
+			decision.Species = collection.Species
+			events = append(events, decision)
+		}
+	}
+
+	// Collection lots are pooled into the batch, which is later handed to a processor
+	currentLots := collectionLots
+	if batch := trace.Batch; batch != nil {
+		batchLot := newQuantity(lotClass("batch", batch.ID), batch.TotalQuantity, batch.Unit)
+
+		event := newEvent("AggregationEvent", "Batch", batch.ID, "packing", firstNonEmpty(batch.CreatedDate, batch.Timestamp), fallback)
+		event.Action = "ADD"
+		event.Disposition = "in_progress"
+		event.ParentID = lotInstance("batch", batch.ID)
+		event.ChildQuantityList = collectionLots
+		event.Species = batch.Species
+		if len(event.ChildQuantityList) == 0 {
+			event.ChildQuantityList = []Quantity{batchLot}
+		}
+		events = append(events, event)
+
+		if batch.AssignedProcessor != "" {
+			transfer := newEvent("ObjectEvent", "Batch", batch.ID, "shipping", firstNonEmpty(batch.AssignedDate, batch.Timestamp), fallback)
+			transfer.Action = "OBSERVE"
+			transfer.Disposition = "in_transit"
+			transfer.QuantityList = []Quantity{batchLot}
+			transfer.SourceList = party(batch.CreatedBy, "farmer")
+			for _, destination := range party(batch.AssignedProcessor, "processor") {
+				transfer.DestinationList = append(transfer.DestinationList, Destination{Type: destination.Type, Destination: destination.Source})
+			}
+			transfer.Species = batch.Species
+			events = append(events, transfer)
+		}
+		currentLots = []Quantity{batchLot}
+	}
+
+	// Quality tests inspect the lot they sampled
+	for _, test := range trace.QualityTests {
+		event := newEvent("ObjectEvent", "QualityTest", test.ID, "inspecting", firstNonEmpty(test.TestDate, test.Timestamp), fallback)
+		event.Action = "OBSERVE"
+		event.Disposition = "conformant"
+		if test.OverallResult == "fail" {
+			event.Disposition = "non_conformant"
+		}
+		switch {
+		case test.CollectionEventID != "":
+			event.QuantityList = []Quantity{{EPCClass: lotClass("collection", test.CollectionEventID)}}
+		case test.BatchID != "":
+			event.QuantityList = []Quantity{{EPCClass: lotClass("batch", test.BatchID)}}
+		}
+		event.SourceList = party(test.LabID, "lab")
+		events = append(events, event)
+	}
+
+	// Each processing step transforms its input lot into a new intermediate lot
+	steps := append([]ProcessingStep{}, trace.ProcessingSteps...)
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].ProcessDate != steps[j].ProcessDate {
+			return steps[i].ProcessDate < steps[j].ProcessDate
+		}
+		return steps[i].ID < steps[j].ID
+	})
+	for _, step := range steps {
+		output := newQuantity(lotClass("step", step.ID), step.OutputQuantity, firstNonEmpty(step.OutputUnit, step.Unit))
+
+		event := newEvent("TransformationEvent", "ProcessingStep", step.ID, "commissioning", firstNonEmpty(step.ProcessDate, step.Timestamp), fallback)
+		event.Disposition = "in_progress"
+		event.InputQuantityList = inputs(currentLots, step.InputQuantity, step.Unit)
+		event.OutputQuantityList = []Quantity{output}
+		event.TransformationID = lotInstance("transformation", step.ID)
+		event.ReadPoint = geoLocation(step.Latitude, step.Longitude)
+		event.SourceList = party(step.ProcessorID, "processor")
+		event.ProcessType = step.ProcessType
+		events = append(events, event)
+
+		currentLots = []Quantity{output}
+	}
+
+	// Manufacture turns the processed material into the finished product lot
+	for _, product := range trace.Products {
+		productClass := productClass(product)
+
+		event := newEvent("TransformationEvent", "Product", product.ID, "commissioning", firstNonEmpty(product.ManufactureDate, product.Timestamp), fallback)
+		event.Disposition = "active"
+		event.InputQuantityList = currentLots
+		event.OutputQuantityList = []Quantity{newQuantity(productClass, product.Quantity, product.Unit)}
+		event.TransformationID = lotInstance("transformation", product.ID)
+		event.ReadPoint = geoLocation(product.SiteLatitude, product.SiteLongitude)
+		event.SourceList = party(product.ManufacturerID, "manufacturer")
+		event.ILMD = map[string]interface{}{"cbvmda:lotNumber": firstNonEmpty(product.BatchID, product.ID)}
+		if product.ExpiryDate != "" {
+			event.ILMD["cbvmda:itemExpirationDate"] = product.ExpiryDate
+		}
+		events = append(events, event)
+
+		// Distribution and sale are recorded as status changes on the product
+		if product.Status == "distributed" || product.Status == "sold" {
+			bizStep, disposition := "shipping", "in_transit"
+			if product.Status == "sold" {
+				bizStep, disposition = "retail_selling", "retail_sold"
+			}
+			transfer := newEvent("ObjectEvent", "Product", product.ID, bizStep, product.Timestamp, fallback)
+			transfer.Action = "OBSERVE"
+			transfer.Disposition = disposition
+			transfer.QuantityList = []Quantity{{EPCClass: productClass}}
+			events = append(events, transfer)
+		}
+	}
+
+	return events
+}
+
+// newEvent creates an event with a stable ID derived from the ledger record and business step
+func newEvent(eventType string, recordType string, recordID string, bizStep string, eventTime string, fallback time.Time) Event {
+	parsed, err := time.Parse(time.RFC3339, eventTime)
+	if err != nil {
+		// Dates without a time are recorded at midnight UTC
+		parsed, err = time.Parse("2006-01-02", eventTime)
+		if err != nil {
+			parsed = fallback
+		}
+	}
+
+	return Event{
+		Type:                eventType,
+		EventID:             nameBasedUUID("epcis/" + eventType + "/" + recordType + "/" + recordID + "/" + bizStep),
+		EventTime:           parsed.Format(time.RFC3339),
+		EventTimeZoneOffset: parsed.Format("-07:00"),
+		BizStep:             bizStep,
+		RecordID:            recordID,
+		RecordType:          recordType,
+		sortTime:            parsed,
+	}
+}
+
+// inputs scales the current lots to the quantity a step consumed. A single input lot
+// takes the step's input quantity; several lots are listed without quantities.
+func inputs(lots []Quantity, quantity float64, unit string) []Quantity {
+	if len(lots) == 1 && quantity > 0 {
+		return []Quantity{newQuantity(lots[0].EPCClass, quantity, unit)}
+	}
+	listed := make([]Quantity, 0, len(lots))
+	for _, lot := range lots {
+		listed = append(listed, Quantity{EPCClass: lot.EPCClass})
+	}
+	return listed
+}
+
+// newQuantity builds a quantity with the UN/CEFACT code of its canonical unit
+func newQuantity(class string, quantity float64, unit string) Quantity {
+	return Quantity{EPCClass: class, Quantity: quantity, UOM: uomCodes[strings.ToLower(strings.TrimSpace(unit))]}
+}
+
+// lotClass identifies a lot of material by the ledger record that created it
+func lotClass(kind string, id string) string {
+	return fmt.Sprintf("urn:herbaltrace:class:lot:%s:%s", kind, url.PathEscape(id))
+}
+
+// lotInstance identifies a single physical instance, such as a batch container
+func lotInstance(kind string, id string) string {
+	return fmt.Sprintf("urn:herbaltrace:id:%s:%s", kind, url.PathEscape(id))
+}
+
+// productClass identifies a product lot, using GS1 Digital Link when a GTIN is known
+func productClass(product Product) string {
+	lot := firstNonEmpty(product.BatchID, product.ID)
+	if product.GTIN != "" {
+		return fmt.Sprintf("%s/01/%s/10/%s", digitalLinkID, product.GTIN, url.PathEscape(lot))
+	}
+	return lotClass("product", product.ID)
+}
+
+// geoLocation builds a geo URI read point, or nil when no position was recorded
+func geoLocation(lat, lon float64) *Location {
+	if (lat == 0 && lon == 0) || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil
+	}
+	return &Location{ID: fmt.Sprintf("geo:%.6f,%.6f", lat, lon)}
+}
+
+// party identifies the owning party of a source or destination
+func party(id string, kind string) []Source {
+	if id == "" {
+		return nil
+	}
+	return []Source{{Type: "owning_party", Source: fmt.Sprintf("urn:herbaltrace:party:%s:%s", kind, url.PathEscape(id))}}
+}
+
+// nameBasedUUID returns a version 5 style UUID for a key in the HerbalTrace namespace
+func nameBasedUUID(key string) string {
+	sum := sha1.Sum([]byte(uuidNamespace + key))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// firstNonEmpty returns the first non-empty value
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package epcis
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var testCreation = time.Date(2025, 4, 15, 10, 0, 0, 0, time.UTC)
+
+// testTrace is a product made from one verified collection, pooled into a batch, tested, dried and packed
+func testTrace() Trace {
+	return Trace{
+		CollectionEvents: []CollectionEvent{{
+			ID: "COL-1", FarmerID: "FARMER-1", Species: "Withania somnifera", Quantity: 50, ReceivedQuantity: 48, Unit: "kg",
+			Latitude: 26.9124, Longitude: 75.7873, HarvestDate: "2025-01-10", Status: "verified", VerificationDate: "2025-01-11T09:00:00Z",
+		}},
+		Batch: &Batch{
+			ID: "BATCH-1", Species: "Withania somnifera", TotalQuantity: 0.048, Unit: "tonne",
+			CreatedBy: "FARMER-1", CreatedDate: "2025-01-12T09:00:00Z", AssignedProcessor: "PROC-1", AssignedDate: "2025-01-13T09:00:00Z",
+		},
+		QualityTests: []QualityTest{{ID: "QT-1", BatchID: "BATCH-1", LabID: "LAB-1", TestDate: "2025-01-14T09:00:00Z", OverallResult: "fail"}},
+		ProcessingSteps: []ProcessingStep{
+			{ID: "STEP-2", ProcessType: "grinding", ProcessorID: "PROC-1", ProcessDate: "2025-01-16T09:00:00Z", InputQuantity: 40, OutputQuantity: 38, Unit: "kg"},
+			{ID: "STEP-1", ProcessType: "drying", ProcessorID: "PROC-1", ProcessDate: "2025-01-15T09:00:00Z", InputQuantity: 48, OutputQuantity: 40, Unit: "kg"},
+		},
+		Products: []Product{{
+			ID: "PROD-1", GTIN: "08901234567890", BatchID: "BATCH 1", ManufacturerID: "MFR-1", Quantity: 38, Unit: "kg",
+			ManufactureDate: "2025-01-20T09:00:00Z", ExpiryDate: "2027-01-20", Status: "sold", Timestamp: "2025-02-01T09:00:00Z",
+		}},
+	}
+}
+
+func TestBuildDocumentMapsTheTrace(t *testing.T) {
+	document := BuildDocument([]Trace{testTrace()}, testCreation)
+
+	want := []struct {
+		eventType   string
+		recordID    string
+		bizStep     string
+		disposition string
+	}{
+		{"ObjectEvent", "COL-1", "commissioning", "active"},
+		{"ObjectEvent", "COL-1", "receiving", "in_progress"},
+		{"AggregationEvent", "BATCH-1", "packing", "in_progress"},
+		{"ObjectEvent", "BATCH-1", "shipping", "in_transit"},
+		{"ObjectEvent", "QT-1", "inspecting", "non_conformant"},
+		{"TransformationEvent", "STEP-1", "commissioning", "in_progress"},
+		{"TransformationEvent", "STEP-2", "commissioning", "in_progress"},
+		{"TransformationEvent", "PROD-1", "commissioning", "active"},
+		{"ObjectEvent", "PROD-1", "retail_selling", "retail_sold"},
+	}
+	events := document.EPCISBody.EventList
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		got := events[i]
+		if got.Type != w.eventType || got.RecordID != w.recordID || got.BizStep != w.bizStep || got.Disposition != w.disposition {
+			t.Errorf("event %d = %s %s %s %s, want %s %s %s %s", i, got.Type, got.RecordID, got.BizStep, got.Disposition, w.eventType, w.recordID, w.bizStep, w.disposition)
+		}
+	}
+
+	// Event IDs are stable across exports and releases
+	if id := events[0].EventID; id != "urn:uuid:dd2fc3c5-54c8-5c7c-aa17-4ad377fe6914" {
+		t.Errorf("harvest event ID = %s", id)
+	}
+
+	harvest, received, batch, drying, grinding, product := events[0], events[1], events[2], events[5], events[6], events[7]
+	if harvest.ReadPoint == nil || harvest.ReadPoint.ID != "geo:26.912400,75.787300" {
+		t.Errorf("harvest read point = %+v", harvest.ReadPoint)
+	}
+	if harvest.EventTime != "2025-01-10T00:00:00Z" {
+		t.Errorf("date-only harvest date mapped to %s, want midnight UTC", harvest.EventTime)
+	}
+	if q := received.QuantityList[0]; q.Quantity != 48 || q.UOM != "KGM" {
+		t.Errorf("received quantity = %+v, want the received 48 KGM", q)
+	}
+	if batch.ParentID != "urn:herbaltrace:id:batch:BATCH-1" || batch.ChildQuantityList[0].EPCClass != "urn:herbaltrace:class:lot:collection:COL-1" {
+		t.Errorf("batch aggregates %+v into %s", batch.ChildQuantityList, batch.ParentID)
+	}
+	if q := drying.InputQuantityList[0]; q.EPCClass != "urn:herbaltrace:class:lot:batch:BATCH-1" || q.Quantity != 48 {
+		t.Errorf("drying input = %+v, want 48 of the batch lot", q)
+	}
+	if q := grinding.InputQuantityList[0]; q.EPCClass != drying.OutputQuantityList[0].EPCClass {
+		t.Errorf("grinding input %s is not the drying output %s", q.EPCClass, drying.OutputQuantityList[0].EPCClass)
+	}
+	if q := product.OutputQuantityList[0]; q.EPCClass != "https://id.gs1.org/01/08901234567890/10/BATCH%201" {
+		t.Errorf("product class = %s, want a GS1 Digital Link", q.EPCClass)
+	}
+	if product.ILMD["cbvmda:itemExpirationDate"] != "2027-01-20" {
+		t.Errorf("product ILMD = %v", product.ILMD)
+	}
+}
+
+func TestBuildDocumentUnitCodes(t *testing.T) {
+	tests := []struct {
+		unit string
+		want string
+	}{
+		{"g", "GRM"},
+		{"kg", "KGM"},
+		{"quintal", "DTN"},
+		{"tonne", "TNE"},
+		{"ml", "MLT"},
+		{"l", "LTR"},
+		{" KG ", "KGM"},
+		{"bundle", ""},
+	}
+
+	for _, tt := range tests {
+		if got := newQuantity("class", 1, tt.unit).UOM; got != tt.want {
+			t.Errorf("UOM of %q = %q, want %q", tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDocumentMergesTraces(t *testing.T) {
+	first := testTrace()
+	second := testTrace()
+	second.Products = []Product{{ID: "PROD-2", BatchID: "BATCH-1", ManufacturerID: "MFR-1", Quantity: 10, Unit: "kg"}}
+
+	document := BuildDocument([]Trace{first, second}, testCreation)
+	seen := map[string]bool{}
+	for _, event := range document.EPCISBody.EventList {
+		if seen[event.EventID] {
+			t.Errorf("event %s %s %s exported twice", event.Type, event.RecordID, event.BizStep)
+		}
+		seen[event.EventID] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("got %d events, want the 9 of the first trace and the second product", len(seen))
+	}
+
+	// Records without a date are dated at the export and sort last
+	events := document.EPCISBody.EventList
+	last := events[len(events)-1]
+	if last.RecordID != "PROD-2" || last.EventTime != testCreation.Format(time.RFC3339) {
+		t.Errorf("undated product is %s at %s, want PROD-2 at the creation date", last.RecordID, last.EventTime)
+	}
+}
+
+func TestBuildDocumentWithoutRecords(t *testing.T) {
+	documentBytes, err := json.Marshal(BuildDocument(nil, testCreation))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document map[string]interface{}
+	if err = json.Unmarshal(documentBytes, &document); err != nil {
+		t.Fatal(err)
+	}
+	body := document["epcisBody"].(map[string]interface{})
+	if list, ok := body["eventList"].([]interface{}); !ok || len(list) != 0 {
+		t.Errorf("eventList = %v, want an empty list", body["eventList"])
+	}
+	if document["type"] != "EPCISDocument" || document["schemaVersion"] != "2.0" {
+		t.Errorf("document header = %v %v", document["type"], document["schemaVersion"])
+	}
+}
+
+func TestRecordsUnmarshalFromLedgerJSON(t *testing.T) {
+	record := `{"id":"COL-1","type":"CollectionEvent","farmerId":"FARMER-1","species":"Withania somnifera","quantity":50,"receivedQuantity":48,"unit":"kg","harvestDate":"2025-01-10","status":"verified","verificationDate":"2025-01-11T09:00:00Z"}`
+
+	var collection CollectionEvent
+	if err := json.Unmarshal([]byte(record), &collection); err != nil {
+		t.Fatal(err)
+	}
+	if collection.FarmerID != "FARMER-1" || collection.ReceivedQuantity != 48 || collection.VerificationDate == "" {
+		t.Errorf("ledger record unmarshalled as %+v", collection)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/herbaltrace/chaincode/epcis"
+)
+
+func TestExportEPCISByBatchCanonicalisesUnits(t *testing.T) {
+	ledger := newTestLedger()
+	ledger.put(t, "COL-1", CollectionEvent{ID: "COL-1", Type: "CollectionEvent", Species: testSpecies, Quantity: 50, Unit: "Kilograms", HarvestDate: "2025-01-10"})
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, TotalQuantity: 0.5, Unit: "qtl", CollectionEventIDs: []string{"COL-1"}, AssignedProcessor: "PROC-1", CreatedDate: "2025-01-12", AssignedDate: "2025-01-13"})
+
+	tx := ledger.begin("export")
+	documentJSON, err := new(HerbalTraceContract).ExportEPCISByBatch(tx.context(testFarmer), "BATCH-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document epcis.Document
+	if err = json.Unmarshal([]byte(documentJSON), &document); err != nil {
+		t.Fatal(err)
+	}
+	units := map[string]string{}
+	for _, event := range document.EPCISBody.EventList {
+		for _, quantity := range append(event.QuantityList, event.ChildQuantityList...) {
+			units[event.RecordID] = quantity.UOM
+		}
+	}
+	if units["COL-1"] != "KGM" || units["BATCH-1"] != "DTN" {
+		t.Errorf("units = %v, want KGM for the harvest and DTN for the shipped batch", units)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// redactedValue replaces erased personal data wherever it would otherwise be rendered
+const redactedValue = "redacted"
+
+// EraseFarmerPersonalData purges a farmer's personal data on request (cooperative or registry admin only).
+// Private details of the farmer, their collection events and their permits are purged from the collection,
+// including peers' private data history, which requires Fabric 2.5. The pseudonymous farmer ID, quantities
+// and compliance facts stay on the public records, and the farmer can no longer submit collections.
+func (c *HerbalTraceContract) EraseFarmerPersonalData(ctx contractapi.TransactionContextInterface, farmerID string) error {
+	if err := requireRole(ctx, roleCooperativeAdmin, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	farmer, err := c.GetFarmer(ctx, farmerID)
+	if err != nil {
+		return err
+	}
+	if farmer.Status == "erased" {
+		return fmt.Errorf("personal data of farmer %s has already been erased", farmerID)
+	}
+
+	erasedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Collection events carry the farmer's name and exact harvest location
+	events, err := c.QueryCollectionsByFarmer(ctx, farmerID)
+	if err != nil {
+		return fmt.Errorf("failed to find collection events of farmer: %v", err)
+	}
+	for _, event := range events {
+		err = eraseCollectionEventPersonalData(ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Permits carry the holder's name
+	permits, err := c.QueryPermitsByHolder(ctx, farmerID)
+	if err != nil {
+		return fmt.Errorf("failed to find permits of farmer: %v", err)
+	}
+	for _, permit := range permits {
+		err = c.erasePermitPersonalData(ctx, permit)
+		if err != nil {
+			return err
+		}
+	}
+
+	if farmer.PrivateCollection != "" {
+		err = ctx.GetStub().PurgePrivateData(farmer.PrivateCollection, farmer.ID)
+		if err != nil {
+			return fmt.Errorf("failed to purge private data of farmer: %v", err)
+		}
+	}
+
+	// The government ID index entry would tie the farmer ID to their government ID
+	err = purgeGovernmentIDIndex(ctx, farmer)
+	if err != nil {
+		return err
+	}
+
+	// Farmers registered before the private index still have the unsalted hash in public state
+	if farmer.GovernmentIDHash != "" {
+		govIDKey, err := ctx.GetStub().CreateCompositeKey(farmerGovIDObjectType, []string{farmer.GovernmentIDHash})
+		if err != nil {
+			return fmt.Errorf("failed to create government ID key: %v", err)
+		}
+		err = ctx.GetStub().DelState(govIDKey)
+		if err != nil {
+			return fmt.Errorf("failed to delete government ID index: %v", err)
+		}
+	}
+
+	farmer.Name = ""
+	farmer.GovernmentIDHash = ""
+	farmer.Village = ""
+	farmer.Status = "erased"
+	farmer.SuspensionReason = ""
+	farmer.ErasedBy = erasedBy
+	farmer.ErasedAt = time.Now().Format(time.RFC3339)
+	farmer.UpdatedAt = farmer.ErasedAt
+
+	err = c.putFarmer(ctx, farmer)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":        "FarmerPersonalDataErased",
+		"farmerId":         farmer.ID,
+		"collectionEvents": len(events),
+		"permits":          len(permits),
+		"timestamp":        farmer.ErasedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("FarmerPersonalDataErased", eventBytes)
+
+	return nil
+}
+
+// eraseCollectionEventPersonalData purges the private details of a collection event and clears
+// personal fields that older events still carry on the public record
+func eraseCollectionEventPersonalData(ctx contractapi.TransactionContextInterface, event *CollectionEvent) error {
+	if event.PrivateCollection != "" {
+		err := ctx.GetStub().PurgePrivateData(event.PrivateCollection, event.ID)
+		if err != nil {
+			return fmt.Errorf("failed to purge private data of collection event %s: %v", event.ID, err)
+		}
+	}
+
+	event.FarmerName = ""
+	event.Latitude = roundCoordinate(event.Latitude)
+	event.Longitude = roundCoordinate(event.Longitude)
+	event.Altitude = 0
+	event.Accuracy = 0
+	event.PersonalDataErased = true
+
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	err = ctx.GetStub().PutState(event.ID, eventBytes)
+	if err != nil {
+		return fmt.Errorf("failed to update collection event: %v", err)
+	}
+
+	return nil
+}
+
+// redactCollectionEvent marks erased personal data on an event being rendered
+func redactCollectionEvent(event *CollectionEvent) {
+	if event.PersonalDataErased {
+		event.FarmerName = redactedValue
+	}
+}
+
+// purgeGovernmentIDIndex purges a farmer's entry from the private government ID index. The entry
+// is keyed by the government ID, which is not kept, so it is found through the farmer's reference.
+// Farmers indexed before the reference was kept need their government ID in the transient map.
+func purgeGovernmentIDIndex(ctx contractapi.TransactionContextInterface, farmer *Farmer) error {
+	collection := privateCollections["Farmer"]
+	refKey, err := ctx.GetStub().CreateCompositeKey(farmerGovIDRefObjectType, []string{farmer.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create government ID reference key: %v", err)
+	}
+	indexKey, err := ctx.GetStub().GetPrivateData(collection, refKey)
+	if err != nil {
+		return fmt.Errorf("failed to read government ID reference: %v", err)
+	}
+
+	if indexKey == nil {
+		// Farmers that were never migrated are only indexed by the public hash
+		if farmer.GovernmentIDHash != "" {
+			return nil
+		}
+		transient, err := ctx.GetStub().GetTransient()
+		if err != nil {
+			return fmt.Errorf("failed to read transient data: %v", err)
+		}
+		governmentID := string(transient[transientGovernmentID])
+		if governmentID == "" {
+			return fmt.Errorf("farmer %s has no government ID reference, pass their government ID in the transient map under %q", farmer.ID, transientGovernmentID)
+		}
+		key, err := governmentIDIndexKey(ctx, governmentID)
+		if err != nil {
+			return err
+		}
+		indexKey = []byte(key)
+	} else {
+		err = ctx.GetStub().PurgePrivateData(collection, refKey)
+		if err != nil {
+			return fmt.Errorf("failed to purge government ID reference: %v", err)
+		}
+	}
+
+	registeredID, err := ctx.GetStub().GetPrivateData(collection, string(indexKey))
+	if err != nil {
+		return fmt.Errorf("failed to read government ID index: %v", err)
+	}
+	if string(registeredID) != farmer.ID {
+		return fmt.Errorf("government ID is not registered to farmer %s", farmer.ID)
+	}
+	err = ctx.GetStub().PurgePrivateData(collection, string(indexKey))
+	if err != nil {
+		return fmt.Errorf("failed to purge government ID index: %v", err)
+	}
+
+	return nil
+}
+
+// erasePermitPersonalData purges the private details of a permit and clears the holder name that
+// older permits still carry on the public record
+func (c *HerbalTraceContract) erasePermitPersonalData(ctx contractapi.TransactionContextInterface, permit *Permit) error {
+	if permit.PrivateCollection != "" {
+		err := ctx.GetStub().PurgePrivateData(permit.PrivateCollection, permit.ID)
+		if err != nil {
+			return fmt.Errorf("failed to purge private data of permit %s: %v", permit.ID, err)
+		}
+	}
+
+	permit.HolderName = ""
+	return c.putPermit(ctx, permit)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var testCooperativeAdmin = testIdentity{id: "coop-admin-1", mspID: "FarmersCoopMSP", attributes: map[string]string{"role": roleCooperativeAdmin}}
+
+func TestEraseFarmerPersonalDataPurgesPermitsAndGovernmentID(t *testing.T) {
+	collection := privateCollections["Farmer"]
+	ledger := newTestLedger()
+	ledger.put(t, "FARMER-1", Farmer{ID: "FARMER-1", Type: "Farmer", Status: "active", PrivateCollection: collection})
+	ledger.put(t, "PERMIT-1", Permit{ID: "PERMIT-1", Type: "Permit", HolderID: "FARMER-1", PrivateCollection: collection})
+	ledger.put(t, "PERMIT-0", Permit{ID: "PERMIT-0", Type: "Permit", HolderID: "FARMER-1", HolderName: "Asha Devi"})
+
+	tx := ledger.begin("erase")
+	ctx := tx.context(testCooperativeAdmin)
+	tx.PutPrivateData(collection, "FARMER-1", []byte(`{"name":"Asha Devi"}`))
+	tx.PutPrivateData(collection, "PERMIT-1", []byte(`{"holderName":"Asha Devi"}`))
+	for _, farmerID := range []string{"FARMER-1", "FARMER-2"} {
+		if err := putGovernmentIDIndex(ctx, "govid-of-"+farmerID, farmerID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := new(HerbalTraceContract).EraseFarmerPersonalData(ctx, "FARMER-1"); err != nil {
+		t.Fatalf("erasure failed: %v", err)
+	}
+
+	for _, key := range []string{"FARMER-1", "PERMIT-1", "govid-of-FARMER-1"} {
+		if value, _ := tx.GetPrivateData(collection, key); value != nil {
+			t.Errorf("private key %s was not purged", key)
+		}
+	}
+	if value, _ := tx.GetPrivateData(collection, "govid-of-FARMER-2"); string(value) != "FARMER-2" {
+		t.Errorf("government ID index entry of another farmer was purged")
+	}
+
+	var permit Permit
+	if err := json.Unmarshal(tx.writes["PERMIT-0"], &permit); err != nil || permit.HolderName != "" {
+		t.Errorf("legacy permit still names its holder: %s", tx.writes["PERMIT-0"])
+	}
+}
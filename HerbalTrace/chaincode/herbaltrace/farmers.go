@@ -0,0 +1,536 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Farmer represents a registered farmer or wild collector
+type Farmer struct {
+	ID                string            `json:"id"`
+	Type              string            `json:"type"`                       // "Farmer"
+	Name              string            `json:"name,omitempty"`             // Only on records registered before names moved to farmersCoopPrivate
+	GovernmentIDHash  string            `json:"governmentIdHash,omitempty"` // Legacy; unsalted SHA-256 of the government ID, see MigrateGovernmentIDIndex
+	Village           string            `json:"village"`
+	District          string            `json:"district"`
+	State             string            `json:"state,omitempty"`
+	CooperativeID     string            `json:"cooperativeId,omitempty"`
+	CertificationIDs  []string          `json:"certificationIds,omitempty"`
+	Status            string            `json:"status"` // "active", "suspended", "erased"
+	SuspensionReason  string            `json:"suspensionReason,omitempty"`
+	PrivateCollection string            `json:"privateCollection,omitempty"` // Holds FarmerPrivateDetails
+	PrivateDataHashes map[string]string `json:"privateDataHashes,omitempty"` // Salted hash per private field
+	ErasedBy          string            `json:"erasedBy,omitempty"`          // Set by EraseFarmerPersonalData
+	ErasedAt          string            `json:"erasedAt,omitempty"`
+	RegisteredBy      string            `json:"registeredBy"`
+	CreatedAt         string            `json:"createdAt"`
+	UpdatedAt         string            `json:"updatedAt"`
+}
+
+// FarmerCollectionSummary aggregates a farmer's collection events
+type FarmerCollectionSummary struct {
+	TotalEvents       int                `json:"totalEvents"`
+	ByStatus          map[string]int     `json:"byStatus"`
+	QuantityByUnit    map[string]float64 `json:"quantityByUnit"` // Canonical units, see units.go
+	QuantityBySpecies map[string]float64 `json:"quantityBySpecies"`
+	FirstHarvestDate  string             `json:"firstHarvestDate,omitempty"`
+	LastHarvestDate   string             `json:"lastHarvestDate,omitempty"`
+}
+
+// FarmerProfile combines a farmer record with a summary of their collections
+type FarmerProfile struct {
+	Farmer  *Farmer                  `json:"farmer"`
+	Summary *FarmerCollectionSummary `json:"summary"`
+}
+
+const (
+	roleCooperativeAdmin     = "cooperative_admin"
+	farmerGovIDObjectType    = "farmerGovId"
+	farmerGovIDRefObjectType = "farmerGovIdRef" // Farmer ID -> their government ID index key
+	farmerGovIDSecretKey     = "farmerGovIdSecret"
+	transientGovernmentID    = "governmentId"
+	transientGovernmentIDKey = "governmentIdKey"
+	minGovernmentIDKeyLength = 32
+)
+
+// normalizeGovernmentID folds case and whitespace so the same ID is always indexed the same way
+func normalizeGovernmentID(governmentID string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(governmentID), ""))
+}
+
+// hashGovernmentID is the unsalted hash that farmers registered before the private index carry
+// on their public record. It is only used to check those records during migration.
+func hashGovernmentID(governmentID string) string {
+	sum := sha256.Sum256([]byte(normalizeGovernmentID(governmentID)))
+	return hex.EncodeToString(sum[:])
+}
+
+// governmentIDIndexKey returns the key of a government ID in the private registration index.
+// The key is an HMAC under a secret held in the farmers' collection, so the channel only ever
+// sees hashes that cannot be brute-forced from the small space of government IDs.
+func governmentIDIndexKey(ctx contractapi.TransactionContextInterface, governmentID string) (string, error) {
+	secret, err := ctx.GetStub().GetPrivateData(privateCollections["Farmer"], farmerGovIDSecretKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read government ID key: %v", err)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("government ID key is not set, see SetGovernmentIDKey")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(normalizeGovernmentID(governmentID)))
+	indexKey, err := ctx.GetStub().CreateCompositeKey(farmerGovIDObjectType, []string{hex.EncodeToString(mac.Sum(nil))})
+	if err != nil {
+		return "", fmt.Errorf("failed to create government ID key: %v", err)
+	}
+	return indexKey, nil
+}
+
+// putGovernmentIDIndex indexes a farmer under their government ID, and keeps the index key under
+// the farmer so erasure can find the entry without the government ID
+func putGovernmentIDIndex(ctx contractapi.TransactionContextInterface, indexKey string, farmerID string) error {
+	collection := privateCollections["Farmer"]
+	err := ctx.GetStub().PutPrivateData(collection, indexKey, []byte(farmerID))
+	if err != nil {
+		return fmt.Errorf("failed to save government ID index: %v", err)
+	}
+
+	refKey, err := ctx.GetStub().CreateCompositeKey(farmerGovIDRefObjectType, []string{farmerID})
+	if err != nil {
+		return fmt.Errorf("failed to create government ID reference key: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collection, refKey, []byte(indexKey))
+	if err != nil {
+		return fmt.Errorf("failed to save government ID reference: %v", err)
+	}
+
+	return nil
+}
+
+// SetGovernmentIDKey stores the secret that keys the government ID index (cooperative or registry
+// admin only). The secret is passed in the transient map under "governmentIdKey" and kept in the
+// farmers' collection. It can only be set once, as changing it would orphan the index.
+func (c *HerbalTraceContract) SetGovernmentIDKey(ctx contractapi.TransactionContextInterface) error {
+	if err := requireRole(ctx, roleCooperativeAdmin, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient data: %v", err)
+	}
+	secret := transient[transientGovernmentIDKey]
+	if len(secret) < minGovernmentIDKeyLength {
+		return fmt.Errorf("government ID key of at least %d random bytes is required in the transient map", minGovernmentIDKeyLength)
+	}
+
+	collection := privateCollections["Farmer"]
+	existing, err := ctx.GetStub().GetPrivateData(collection, farmerGovIDSecretKey)
+	if err != nil {
+		return fmt.Errorf("failed to read government ID key: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("government ID key is already set")
+	}
+
+	err = ctx.GetStub().PutPrivateData(collection, farmerGovIDSecretKey, secret)
+	if err != nil {
+		return fmt.Errorf("failed to save government ID key: %v", err)
+	}
+
+	return nil
+}
+
+// MigrateGovernmentIDIndex moves a farmer registered before the private index into it and drops
+// the unsalted hash from the public record (cooperative or registry admin only). The farmer's
+// government ID is passed in the transient map under "governmentId" and must match that hash.
+func (c *HerbalTraceContract) MigrateGovernmentIDIndex(ctx contractapi.TransactionContextInterface, farmerID string) error {
+	if err := requireRole(ctx, roleCooperativeAdmin, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	farmer, err := c.GetFarmer(ctx, farmerID)
+	if err != nil {
+		return err
+	}
+	if farmer.GovernmentIDHash == "" {
+		return fmt.Errorf("farmer %s has no public government ID hash", farmerID)
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient data: %v", err)
+	}
+	governmentID := string(transient[transientGovernmentID])
+	if hashGovernmentID(governmentID) != farmer.GovernmentIDHash {
+		return fmt.Errorf("government ID does not match the one registered for farmer %s", farmerID)
+	}
+
+	indexKey, err := governmentIDIndexKey(ctx, governmentID)
+	if err != nil {
+		return err
+	}
+	err = putGovernmentIDIndex(ctx, indexKey, farmer.ID)
+	if err != nil {
+		return err
+	}
+
+	legacyKey, err := ctx.GetStub().CreateCompositeKey(farmerGovIDObjectType, []string{farmer.GovernmentIDHash})
+	if err != nil {
+		return fmt.Errorf("failed to create government ID key: %v", err)
+	}
+	err = ctx.GetStub().DelState(legacyKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete government ID index: %v", err)
+	}
+
+	farmer.GovernmentIDHash = ""
+	farmer.UpdatedAt = time.Now().Format(time.RFC3339)
+	return c.putFarmer(ctx, farmer)
+}
+
+// RegisterFarmer registers a farmer (cooperative or registry admin only). The raw government
+// ID is passed in the transient map under "governmentId" so it never reaches the ledger, and
+// personal data under "privateData" so it is only kept in the farmersCoopPrivate collection.
+func (c *HerbalTraceContract) RegisterFarmer(ctx contractapi.TransactionContextInterface, farmerJSON string) error {
+	if err := requireRole(ctx, roleCooperativeAdmin, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	var farmer Farmer
+	err := json.Unmarshal([]byte(farmerJSON), &farmer)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal farmer JSON: %v", err)
+	}
+
+	// Validate required fields
+	if farmer.ID == "" {
+		return fmt.Errorf("farmer ID is required")
+	}
+	if err := sensitiveFieldError(map[string]bool{"name": farmer.Name != ""}); err != nil {
+		return err
+	}
+	if farmer.Village == "" || farmer.District == "" {
+		return fmt.Errorf("village and district are required")
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient data: %v", err)
+	}
+	governmentID := string(transient[transientGovernmentID])
+	if strings.TrimSpace(governmentID) == "" {
+		return fmt.Errorf("government ID is required in the transient map")
+	}
+	var details FarmerPrivateDetails
+	found, err := readPrivateDetails(ctx, &details)
+	if err != nil {
+		return err
+	}
+	if !found || strings.TrimSpace(details.Name) == "" {
+		return fmt.Errorf("name is required in the transient private data")
+	}
+
+	// Check if farmer already exists
+	existingFarmer, err := ctx.GetStub().GetState(farmer.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if farmer exists: %v", err)
+	}
+	if existingFarmer != nil {
+		return fmt.Errorf("farmer with ID %s already exists", farmer.ID)
+	}
+
+	// Only current certifications held by this farmer can be linked
+	for _, certificationID := range farmer.CertificationIDs {
+		_, err := c.checkCertification(ctx, certificationID, farmer.ID, "", "", time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	// One registration per government ID, indexed in the farmers' collection
+	farmer.GovernmentIDHash = ""
+	govIDKey, err := governmentIDIndexKey(ctx, governmentID)
+	if err != nil {
+		return err
+	}
+	registeredID, err := ctx.GetStub().GetPrivateData(privateCollections["Farmer"], govIDKey)
+	if err != nil {
+		return fmt.Errorf("failed to check government ID: %v", err)
+	}
+	if registeredID != nil {
+		return fmt.Errorf("government ID is already registered to farmer %s", string(registeredID))
+	}
+
+	registeredBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Set default values
+	farmer.Type = "Farmer"
+	farmer.Status = "active"
+	farmer.SuspensionReason = ""
+	farmer.RegisteredBy = registeredBy
+	farmer.CreatedAt = time.Now().Format(time.RFC3339)
+	farmer.UpdatedAt = farmer.CreatedAt
+
+	err = putGovernmentIDIndex(ctx, govIDKey, farmer.ID)
+	if err != nil {
+		return err
+	}
+
+	farmer.PrivateCollection, farmer.PrivateDataHashes, err = putPrivateDetails(ctx, "Farmer", farmer.ID, &details)
+	if err != nil {
+		return err
+	}
+
+	err = c.putFarmer(ctx, &farmer)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":     "FarmerRegistered",
+		"farmerId":      farmer.ID,
+		"district":      farmer.District,
+		"cooperativeId": farmer.CooperativeID,
+		"timestamp":     farmer.CreatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("FarmerRegistered", eventBytes)
+
+	return nil
+}
+
+// GetFarmer retrieves a farmer by ID
+func (c *HerbalTraceContract) GetFarmer(ctx contractapi.TransactionContextInterface, farmerID string) (*Farmer, error) {
+	if farmerID == "" {
+		return nil, fmt.Errorf("farmer ID is required")
+	}
+
+	farmerBytes, err := ctx.GetStub().GetState(farmerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read farmer from ledger: %v", err)
+	}
+	if farmerBytes == nil {
+		return nil, fmt.Errorf("farmer with ID %s does not exist", farmerID)
+	}
+
+	var farmer Farmer
+	err = json.Unmarshal(farmerBytes, &farmer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal farmer: %v", err)
+	}
+	if farmer.Type != "Farmer" {
+		return nil, fmt.Errorf("%s is not a registered farmer", farmerID)
+	}
+
+	return &farmer, nil
+}
+
+// UpdateFarmer updates a farmer's location, cooperative and certifications (cooperative or registry admin only)
+func (c *HerbalTraceContract) UpdateFarmer(ctx contractapi.TransactionContextInterface, farmerID string, farmerJSON string) error {
+	if err := requireRole(ctx, roleCooperativeAdmin, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	farmer, err := c.GetFarmer(ctx, farmerID)
+	if err != nil {
+		return err
+	}
+	if farmer.Status == "erased" {
+		return fmt.Errorf("personal data of farmer %s has been erased", farmerID)
+	}
+
+	var update Farmer
+	err = json.Unmarshal([]byte(farmerJSON), &update)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal farmer JSON: %v", err)
+	}
+	if update.Village == "" || update.District == "" {
+		return fmt.Errorf("village and district are required")
+	}
+	if err := sensitiveFieldError(map[string]bool{"name": update.Name != ""}); err != nil {
+		return err
+	}
+
+	// Only current certifications held by this farmer can be linked
+	for _, certificationID := range update.CertificationIDs {
+		_, err := c.checkCertification(ctx, certificationID, farmerID, "", "", time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Personal data is replaced when new private details are supplied
+	var details FarmerPrivateDetails
+	found, err := readPrivateDetails(ctx, &details)
+	if err != nil {
+		return err
+	}
+	if found {
+		if strings.TrimSpace(details.Name) == "" {
+			return fmt.Errorf("name is required in the transient private data")
+		}
+		farmer.PrivateCollection, farmer.PrivateDataHashes, err = putPrivateDetails(ctx, "Farmer", farmer.ID, &details)
+		if err != nil {
+			return err
+		}
+		farmer.Name = ""
+	}
+
+	// Identity, government ID and status are not editable here
+	farmer.Village = update.Village
+	farmer.District = update.District
+	farmer.State = update.State
+	farmer.CooperativeID = update.CooperativeID
+	farmer.CertificationIDs = update.CertificationIDs
+	farmer.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	return c.putFarmer(ctx, farmer)
+}
+
+// SuspendFarmer suspends a farmer so new collections are rejected (cooperative or registry admin only)
+func (c *HerbalTraceContract) SuspendFarmer(ctx contractapi.TransactionContextInterface, farmerID string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+	return c.setFarmerStatus(ctx, farmerID, "suspended", reason)
+}
+
+// ReinstateFarmer returns a suspended farmer to active status (cooperative or registry admin only)
+func (c *HerbalTraceContract) ReinstateFarmer(ctx contractapi.TransactionContextInterface, farmerID string) error {
+	return c.setFarmerStatus(ctx, farmerID, "active", "")
+}
+
+// setFarmerStatus changes a farmer's status and emits FarmerStatusChanged
+func (c *HerbalTraceContract) setFarmerStatus(ctx contractapi.TransactionContextInterface, farmerID string, status string, reason string) error {
+	if err := requireRole(ctx, roleCooperativeAdmin, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	farmer, err := c.GetFarmer(ctx, farmerID)
+	if err != nil {
+		return err
+	}
+	if farmer.Status == "erased" {
+		return fmt.Errorf("personal data of farmer %s has been erased", farmerID)
+	}
+	if farmer.Status == status {
+		return fmt.Errorf("farmer %s is already %s", farmerID, status)
+	}
+
+	oldStatus := farmer.Status
+	farmer.Status = status
+	farmer.SuspensionReason = reason
+	farmer.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	err = c.putFarmer(ctx, farmer)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "FarmerStatusChanged",
+		"farmerId":  farmerID,
+		"oldStatus": oldStatus,
+		"newStatus": status,
+		"reason":    reason,
+		"timestamp": farmer.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("FarmerStatusChanged", eventBytes)
+
+	return nil
+}
+
+// GetFarmerProfile retrieves a farmer together with a summary of their collection events
+func (c *HerbalTraceContract) GetFarmerProfile(ctx contractapi.TransactionContextInterface, farmerID string) (*FarmerProfile, error) {
+	farmer, err := c.GetFarmer(ctx, farmerID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := c.QueryCollectionsByFarmer(ctx, farmerID)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &FarmerCollectionSummary{
+		TotalEvents:       len(events),
+		ByStatus:          map[string]int{},
+		QuantityByUnit:    map[string]float64{},
+		QuantityBySpecies: map[string]float64{},
+	}
+	for _, event := range events {
+		summary.ByStatus[event.Status]++
+		summary.QuantityByUnit[event.Unit] += event.Quantity
+		summary.QuantityBySpecies[event.Species] += event.Quantity
+
+		// RFC3339 dates in the same zone sort lexically
+		if summary.FirstHarvestDate == "" || event.HarvestDate < summary.FirstHarvestDate {
+			summary.FirstHarvestDate = event.HarvestDate
+		}
+		if event.HarvestDate > summary.LastHarvestDate {
+			summary.LastHarvestDate = event.HarvestDate
+		}
+	}
+
+	return &FarmerProfile{Farmer: farmer, Summary: summary}, nil
+}
+
+// requireActiveFarmer loads a farmer and rejects unknown or suspended farmers
+func (c *HerbalTraceContract) requireActiveFarmer(ctx contractapi.TransactionContextInterface, farmerID string) (*Farmer, error) {
+	farmer, err := c.GetFarmer(ctx, farmerID)
+	if err != nil {
+		return nil, err
+	}
+	if farmer.Status != "active" {
+		return nil, fmt.Errorf("farmer %s is %s", farmerID, farmer.Status)
+	}
+	return farmer, nil
+}
+
+// farmerName returns a farmer's name from the private collection, or from the public record for
+// farmers registered before names moved there. It is empty if the peer cannot read the collection.
+func farmerName(ctx contractapi.TransactionContextInterface, farmer *Farmer) string {
+	if farmer.Name != "" || farmer.PrivateCollection == "" {
+		return farmer.Name
+	}
+
+	detailsBytes, err := ctx.GetStub().GetPrivateData(farmer.PrivateCollection, farmer.ID)
+	if err != nil || detailsBytes == nil {
+		return ""
+	}
+	var details FarmerPrivateDetails
+	if json.Unmarshal(detailsBytes, &details) != nil {
+		return ""
+	}
+
+	return details.Name
+}
+
+// putFarmer saves a farmer to the ledger
+func (c *HerbalTraceContract) putFarmer(ctx contractapi.TransactionContextInterface, farmer *Farmer) error {
+	farmerBytes, err := json.Marshal(farmer)
+	if err != nil {
+		return fmt.Errorf("failed to marshal farmer: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(farmer.ID, farmerBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save farmer to ledger: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,925 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Provenance bundles are exported as HL7 FHIR R4 resources so that pharmacy and hospital
+// systems can consume them directly. Only the elements HerbalTrace populates are modelled.
+
+const (
+	fhirIdentifierPrefix       = "urn:herbaltrace:"
+	fhirUCUMSystem             = "http://unitsofmeasure.org"
+	fhirObservationCategory    = "http://terminology.hl7.org/CodeSystem/observation-category"
+	fhirInterpretationSystem   = "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation"
+	fhirParticipantTypeSystem  = "http://terminology.hl7.org/CodeSystem/provenance-participant-type"
+	fhirOrganizationTypeSystem = "http://terminology.hl7.org/CodeSystem/organization-type"
+)
+
+// FHIRIdentifier is an R4 Identifier
+type FHIRIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+// FHIRCoding is an R4 Coding
+type FHIRCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// FHIRCodeableConcept is an R4 CodeableConcept
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+// FHIRReference is an R4 Reference
+type FHIRReference struct {
+	Reference  string          `json:"reference,omitempty"`
+	Identifier *FHIRIdentifier `json:"identifier,omitempty"`
+	Display    string          `json:"display,omitempty"`
+}
+
+// FHIRQuantity is an R4 Quantity using UCUM codes
+type FHIRQuantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+// FHIRBundle is an R4 Bundle of type "collection"
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"` // "Bundle"
+	ID           string            `json:"id"`
+	Identifier   *FHIRIdentifier   `json:"identifier,omitempty"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry"`
+}
+
+// FHIRBundleEntry is one resource in a bundle
+type FHIRBundleEntry struct {
+	FullURL  string       `json:"fullUrl"`
+	Resource fhirResource `json:"resource"`
+}
+
+// fhirResource is implemented by every resource type the exporter emits
+type fhirResource interface {
+	resourceKey() string         // "Type/id", the local reference to the resource
+	references() []FHIRReference // References to other resources
+	validate() []string          // R4 cardinality and invariant violations
+}
+
+// FHIROrganization is an R4 Organization (laboratories, processors, manufacturers)
+type FHIROrganization struct {
+	ResourceType string                `json:"resourceType"` // "Organization"
+	ID           string                `json:"id"`
+	Identifier   []FHIRIdentifier      `json:"identifier,omitempty"`
+	Active       bool                  `json:"active"`
+	Type         []FHIRCodeableConcept `json:"type,omitempty"`
+	Name         string                `json:"name,omitempty"`
+}
+
+// FHIRPosition is the WGS84 position of an R4 Location
+type FHIRPosition struct {
+	Longitude float64  `json:"longitude"`
+	Latitude  float64  `json:"latitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// FHIRLocation is an R4 Location built from recorded GPS coordinates
+type FHIRLocation struct {
+	ResourceType         string           `json:"resourceType"` // "Location"
+	ID                   string           `json:"id"`
+	Identifier           []FHIRIdentifier `json:"identifier,omitempty"`
+	Status               string           `json:"status,omitempty"`
+	Name                 string           `json:"name,omitempty"`
+	Description          string           `json:"description,omitempty"`
+	Mode                 string           `json:"mode,omitempty"`
+	Position             *FHIRPosition    `json:"position,omitempty"`
+	ManagingOrganization *FHIRReference   `json:"managingOrganization,omitempty"`
+}
+
+// FHIRSubstanceInstance is a specific lot of an R4 Substance
+type FHIRSubstanceInstance struct {
+	Identifier *FHIRIdentifier `json:"identifier,omitempty"`
+	Quantity   *FHIRQuantity   `json:"quantity,omitempty"`
+}
+
+// FHIRSubstance is an R4 Substance representing harvested raw material
+type FHIRSubstance struct {
+	ResourceType string                  `json:"resourceType"` // "Substance"
+	ID           string                  `json:"id"`
+	Identifier   []FHIRIdentifier        `json:"identifier,omitempty"`
+	Status       string                  `json:"status,omitempty"`
+	Category     []FHIRCodeableConcept   `json:"category,omitempty"`
+	Code         FHIRCodeableConcept     `json:"code"`
+	Description  string                  `json:"description,omitempty"`
+	Instance     []FHIRSubstanceInstance `json:"instance,omitempty"`
+}
+
+// FHIRMedicationIngredient references a Substance used in a Medication
+type FHIRMedicationIngredient struct {
+	ItemReference FHIRReference `json:"itemReference"`
+}
+
+// FHIRMedicationBatch is the packaged lot of an R4 Medication
+type FHIRMedicationBatch struct {
+	LotNumber      string `json:"lotNumber,omitempty"`
+	ExpirationDate string `json:"expirationDate,omitempty"`
+}
+
+// FHIRMedication is an R4 Medication representing the finished product
+type FHIRMedication struct {
+	ResourceType string                     `json:"resourceType"` // "Medication"
+	ID           string                     `json:"id"`
+	Identifier   []FHIRIdentifier           `json:"identifier,omitempty"`
+	Code         *FHIRCodeableConcept       `json:"code,omitempty"`
+	Status       string                     `json:"status,omitempty"`
+	Manufacturer *FHIRReference             `json:"manufacturer,omitempty"`
+	Form         *FHIRCodeableConcept       `json:"form,omitempty"`
+	Ingredient   []FHIRMedicationIngredient `json:"ingredient,omitempty"`
+	Batch        *FHIRMedicationBatch       `json:"batch,omitempty"`
+}
+
+// FHIRObservation is an R4 Observation for a single quality test parameter
+type FHIRObservation struct {
+	ResourceType      string                `json:"resourceType"` // "Observation"
+	ID                string                `json:"id"`
+	Identifier        []FHIRIdentifier      `json:"identifier,omitempty"`
+	Status            string                `json:"status"`
+	Category          []FHIRCodeableConcept `json:"category,omitempty"`
+	Code              FHIRCodeableConcept   `json:"code"`
+	Focus             []FHIRReference       `json:"focus,omitempty"`
+	EffectiveDateTime string                `json:"effectiveDateTime,omitempty"`
+	Performer         []FHIRReference       `json:"performer,omitempty"`
+	ValueQuantity     *FHIRQuantity         `json:"valueQuantity,omitempty"`
+	ValueString       string                `json:"valueString,omitempty"`
+	ValueBoolean      *bool                 `json:"valueBoolean,omitempty"`
+	Interpretation    []FHIRCodeableConcept `json:"interpretation,omitempty"`
+}
+
+// FHIRProvenanceAgent is an actor in an R4 Provenance
+type FHIRProvenanceAgent struct {
+	Type *FHIRCodeableConcept `json:"type,omitempty"`
+	Who  FHIRReference        `json:"who"`
+}
+
+// FHIRProvenanceEntity is an input to the activity recorded by an R4 Provenance
+type FHIRProvenanceEntity struct {
+	Role string        `json:"role"`
+	What FHIRReference `json:"what"`
+}
+
+// FHIRProvenance is an R4 Provenance for one supply chain activity
+type FHIRProvenance struct {
+	ResourceType     string                 `json:"resourceType"` // "Provenance"
+	ID               string                 `json:"id"`
+	Target           []FHIRReference        `json:"target"`
+	OccurredDateTime string                 `json:"occurredDateTime,omitempty"`
+	Recorded         string                 `json:"recorded"`
+	Location         *FHIRReference         `json:"location,omitempty"`
+	Activity         *FHIRCodeableConcept   `json:"activity,omitempty"`
+	Agent            []FHIRProvenanceAgent  `json:"agent"`
+	Entity           []FHIRProvenanceEntity `json:"entity,omitempty"`
+}
+
+// ExportProvenanceFHIR returns a product's provenance as a FHIR R4 Bundle in JSON
+func (c *HerbalTraceContract) ExportProvenanceFHIR(ctx contractapi.TransactionContextInterface, productID string) (string, error) {
+	provenance, err := c.GenerateProvenance(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+
+	bundle, err := ProvenanceToFHIRBundle(provenance)
+	if err != nil {
+		return "", err
+	}
+
+	bundleBytes, err := json.Marshal(bundle)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal FHIR bundle: %v", err)
+	}
+
+	return string(bundleBytes), nil
+}
+
+// ProvenanceToFHIRBundle converts a provenance bundle into a validated FHIR R4 collection Bundle
+func ProvenanceToFHIRBundle(prov *Provenance) (*FHIRBundle, error) {
+	b := &fhirBundleBuilder{prov: prov, seen: map[string]bool{}}
+	b.build()
+
+	err := ValidateFHIRBundle(b.bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.bundle, nil
+}
+
+// fhirBundleBuilder accumulates resources while converting a provenance bundle
+type fhirBundleBuilder struct {
+	prov       *Provenance
+	bundle     *FHIRBundle
+	seen       map[string]bool
+	medication FHIRReference
+	substances map[string]FHIRReference // Collection event ID -> Substance
+}
+
+// build converts the provenance bundle resource by resource
+func (b *fhirBundleBuilder) build() {
+	prov := b.prov
+	product := prov.Product
+	recorded := fhirInstant(prov.GeneratedDate, time.Now().Format(time.RFC3339))
+
+	b.bundle = &FHIRBundle{
+		ResourceType: "Bundle",
+		ID:           fhirID(prov.ID),
+		Identifier:   fhirIdentifier("provenance", prov.ID),
+		Type:         "collection",
+		Timestamp:    recorded,
+	}
+
+	// Raw material harvested at each collection point
+	b.substances = map[string]FHIRReference{}
+	var sources []FHIRProvenanceEntity
+	for _, event := range prov.CollectionEvents {
+		substance := &FHIRSubstance{
+			ResourceType: "Substance",
+			ID:           fhirID("substance-" + event.ID),
+			Identifier:   fhirIdentifiers("collection-event", event.ID),
+			Status:       "active",
+			Category:     []FHIRCodeableConcept{{Text: "Raw herbal material"}},
+			Code:         FHIRCodeableConcept{Text: firstNonEmpty(event.Species, event.ScientificName, event.CommonName)},
+			Description:  strings.TrimSpace(fmt.Sprintf("%s %s", event.CommonName, event.PartCollected)),
+			Instance: []FHIRSubstanceInstance{{
+				Identifier: fhirIdentifier("collection-event", event.ID),
+				Quantity:   fhirQuantity(event.Quantity, event.Unit),
+			}},
+		}
+		ref := b.add(substance)
+		b.substances[event.ID] = ref
+		sources = append(sources, FHIRProvenanceEntity{Role: "source", What: ref})
+
+		provenance := &FHIRProvenance{
+			ResourceType:     "Provenance",
+			ID:               fhirID("provenance-" + event.ID),
+			Target:           []FHIRReference{ref},
+			OccurredDateTime: fhirDateTime(event.HarvestDate),
+			Recorded:         fhirInstant(event.Timestamp, fhirInstant(event.HarvestDate, recorded)),
+			Activity:         &FHIRCodeableConcept{Text: "harvest"},
+			Agent: []FHIRProvenanceAgent{{
+				Type: fhirParticipant("performer"),
+				Who: FHIRReference{
+					Identifier: fhirIdentifier("farmer", event.FarmerID),
+					Display:    event.FarmerName,
+				},
+			}},
+		}
+		if hasCoordinates(event.Latitude, event.Longitude) {
+			location := &FHIRLocation{
+				ResourceType: "Location",
+				ID:           fhirID("location-" + event.ID),
+				Status:       "active",
+				Name:         firstNonEmpty(event.ZoneName, "Collection site"),
+				Description:  "Collection site of " + event.ID,
+				Mode:         "instance",
+				Position:     fhirPosition(event.Latitude, event.Longitude, event.Altitude),
+			}
+			locationRef := b.add(location)
+			provenance.Location = &locationRef
+		}
+		b.add(provenance)
+	}
+
+	// The finished product
+	manufacturer := b.organization(product.ManufacturerID, product.ManufacturerName, "Manufacturer")
+	medication := &FHIRMedication{
+		ResourceType: "Medication",
+		ID:           fhirID("medication-" + product.ID),
+		Identifier:   fhirIdentifiers("product", product.ID),
+		Code:         &FHIRCodeableConcept{Text: firstNonEmpty(product.ProductName, product.ID)},
+		Status:       "active",
+		Manufacturer: manufacturer,
+	}
+	if product.QRCode != "" {
+		medication.Identifier = append(medication.Identifier, fhirIdentifiers("qr-code", product.QRCode)...)
+	}
+	if product.ProductType != "" {
+		medication.Form = &FHIRCodeableConcept{Text: product.ProductType}
+	}
+	for _, source := range sources {
+		medication.Ingredient = append(medication.Ingredient, FHIRMedicationIngredient{ItemReference: source.What})
+	}
+	if product.BatchID != "" || product.ExpiryDate != "" {
+		medication.Batch = &FHIRMedicationBatch{
+			LotNumber:      product.BatchID,
+			ExpirationDate: fhirDateTime(product.ExpiryDate),
+		}
+	}
+	b.medication = b.add(medication)
+
+	// Quality test parameters
+	for _, test := range prov.QualityTests {
+		b.observations(test)
+	}
+
+	// Processing steps transform the raw material into the product
+	for _, step := range prov.ProcessingSteps {
+		provenance := &FHIRProvenance{
+			ResourceType:     "Provenance",
+			ID:               fhirID("provenance-" + step.ID),
+			Target:           []FHIRReference{b.medication},
+			OccurredDateTime: fhirDateTime(step.ProcessDate),
+			Recorded:         fhirInstant(step.Timestamp, fhirInstant(step.ProcessDate, recorded)),
+			Activity:         &FHIRCodeableConcept{Text: firstNonEmpty(step.ProcessType, "processing")},
+			Entity:           sources,
+		}
+		processor := b.organization(step.ProcessorID, step.ProcessorName, "Processor")
+		if processor != nil {
+			provenance.Agent = append(provenance.Agent, FHIRProvenanceAgent{Type: fhirParticipant("performer"), Who: *processor})
+		}
+		if step.OperatorID != "" || step.OperatorName != "" {
+			provenance.Agent = append(provenance.Agent, FHIRProvenanceAgent{
+				Type: fhirParticipant("assembler"),
+				Who:  FHIRReference{Identifier: fhirIdentifier("operator", step.OperatorID), Display: step.OperatorName},
+			})
+		}
+		if len(provenance.Agent) == 0 {
+			provenance.Agent = []FHIRProvenanceAgent{{Type: fhirParticipant("performer"), Who: FHIRReference{Display: "Unknown processor"}}}
+		}
+		if hasCoordinates(step.Latitude, step.Longitude) {
+			location := &FHIRLocation{
+				ResourceType:         "Location",
+				ID:                   fhirID("location-" + step.ID),
+				Status:               "active",
+				Name:                 firstNonEmpty(step.Location, "Processing site"),
+				Mode:                 "instance",
+				Position:             fhirPosition(step.Latitude, step.Longitude, 0),
+				ManagingOrganization: processor,
+			}
+			locationRef := b.add(location)
+			provenance.Location = &locationRef
+		}
+		b.add(provenance)
+	}
+
+	// Manufacture of the finished product
+	provenance := &FHIRProvenance{
+		ResourceType:     "Provenance",
+		ID:               fhirID("provenance-" + product.ID),
+		Target:           []FHIRReference{b.medication},
+		OccurredDateTime: fhirDateTime(product.ManufactureDate),
+		Recorded:         fhirInstant(product.Timestamp, fhirInstant(product.ManufactureDate, recorded)),
+		Activity:         &FHIRCodeableConcept{Text: "manufacture"},
+		Entity:           sources,
+		Agent:            []FHIRProvenanceAgent{{Type: fhirParticipant("author"), Who: FHIRReference{Display: firstNonEmpty(product.ManufacturerName, "Unknown manufacturer")}}},
+	}
+	if manufacturer != nil {
+		provenance.Agent[0].Who = *manufacturer
+	}
+	if hasCoordinates(product.SiteLatitude, product.SiteLongitude) {
+		location := &FHIRLocation{
+			ResourceType:         "Location",
+			ID:                   fhirID("location-" + product.ID),
+			Status:               "active",
+			Name:                 firstNonEmpty(product.SiteName, "Manufacturing site"),
+			Mode:                 "instance",
+			Position:             fhirPosition(product.SiteLatitude, product.SiteLongitude, 0),
+			ManagingOrganization: manufacturer,
+		}
+		locationRef := b.add(location)
+		provenance.Location = &locationRef
+	}
+	b.add(provenance)
+}
+
+// observations adds one Observation per recorded quality test parameter
+func (b *fhirBundleBuilder) observations(test QualityTest) {
+	focus, ok := b.substances[test.CollectionEventID]
+	if !ok {
+		focus = b.medication
+	}
+	lab := b.organization(test.LabID, test.LabName, "Testing laboratory")
+
+	add := func(parameter string, observation *FHIRObservation) {
+		observation.ResourceType = "Observation"
+		observation.ID = fhirID("observation-" + test.ID + "-" + parameter)
+		observation.Identifier = fhirIdentifiers("quality-test", test.ID)
+		observation.Status = "final"
+		observation.Category = []FHIRCodeableConcept{{Coding: []FHIRCoding{{System: fhirObservationCategory, Code: "laboratory", Display: "Laboratory"}}}}
+		observation.Focus = []FHIRReference{focus}
+		observation.EffectiveDateTime = fhirDateTime(test.TestDate)
+		if lab != nil {
+			observation.Performer = []FHIRReference{*lab}
+		}
+		b.add(observation)
+	}
+
+	if test.MoistureContent > 0 || hasTestType(test, "moisture") {
+		add("moisture", &FHIRObservation{
+			Code:          FHIRCodeableConcept{Text: "Moisture content"},
+			ValueQuantity: &FHIRQuantity{Value: test.MoistureContent, Unit: "%", System: fhirUCUMSystem, Code: "%"},
+		})
+	}
+	if test.Aflatoxins > 0 {
+		add("aflatoxins", &FHIRObservation{
+			Code:          FHIRCodeableConcept{Text: "Aflatoxins"},
+			ValueQuantity: &FHIRQuantity{Value: test.Aflatoxins, Unit: "ppb", System: fhirUCUMSystem, Code: "[ppb]"},
+		})
+	}
+	if test.MicrobialLoad > 0 {
+		add("microbial-load", &FHIRObservation{
+			Code:          FHIRCodeableConcept{Text: "Total microbial load"},
+			ValueQuantity: &FHIRQuantity{Value: test.MicrobialLoad, Unit: "CFU/g", System: fhirUCUMSystem, Code: "{CFU}/g"},
+		})
+	}
+	for _, metal := range sortedKeys(test.HeavyMetals) {
+		add("metal-"+metal, &FHIRObservation{
+			Code:          FHIRCodeableConcept{Text: "Heavy metal: " + metal},
+			ValueQuantity: &FHIRQuantity{Value: test.HeavyMetals[metal], Unit: "ppm", System: fhirUCUMSystem, Code: "[ppm]"},
+		})
+	}
+	for _, pesticide := range sortedKeys(test.PesticideResults) {
+		result := test.PesticideResults[pesticide]
+		add("pesticide-"+pesticide, &FHIRObservation{
+			Code:           FHIRCodeableConcept{Text: "Pesticide residue: " + pesticide},
+			ValueString:    result,
+			Interpretation: fhirInterpretation(result == "pass"),
+		})
+	}
+	if hasTestType(test, "dna_barcode") {
+		match := test.DNABarcodeMatch
+		add("dna-barcode", &FHIRObservation{
+			Code:           FHIRCodeableConcept{Text: "DNA barcode species match"},
+			ValueBoolean:   &match,
+			Interpretation: fhirInterpretation(match),
+		})
+	}
+	if test.OverallResult != "" {
+		add("overall", &FHIRObservation{
+			Code:           FHIRCodeableConcept{Text: "Overall quality result"},
+			ValueString:    test.OverallResult,
+			Interpretation: fhirInterpretation(test.OverallResult != "fail"),
+		})
+	}
+}
+
+// organization adds an Organization once and returns a reference to it, or nil without an ID
+func (b *fhirBundleBuilder) organization(id string, name string, role string) *FHIRReference {
+	if id == "" {
+		return nil
+	}
+	organization := &FHIROrganization{
+		ResourceType: "Organization",
+		ID:           fhirID("organization-" + id),
+		Identifier:   fhirIdentifiers("organization", id),
+		Active:       true,
+		Type: []FHIRCodeableConcept{{
+			Coding: []FHIRCoding{{System: fhirOrganizationTypeSystem, Code: "bus", Display: "Non-Healthcare Business or Corporation"}},
+			Text:   role,
+		}},
+		Name: firstNonEmpty(name, id),
+	}
+	ref := b.add(organization)
+	ref.Display = organization.Name
+	return &ref
+}
+
+// add appends a resource once and returns a reference to its fullUrl. Resources have no
+// server address, so fullUrls are name-based UUIDs derived from the resource type and id.
+func (b *fhirBundleBuilder) add(resource fhirResource) FHIRReference {
+	key := resource.resourceKey()
+	fullURL := nameBasedUUID(key)
+	if !b.seen[key] {
+		b.seen[key] = true
+		b.bundle.Entry = append(b.bundle.Entry, FHIRBundleEntry{
+			FullURL:  fullURL,
+			Resource: resource,
+		})
+	}
+	return FHIRReference{Reference: fullURL}
+}
+
+// ValidateFHIRBundle checks a bundle against the FHIR R4 rules for the resources HerbalTrace
+// emits: required elements, value sets, id and date formats, and that local references resolve
+func ValidateFHIRBundle(bundle *FHIRBundle) error {
+	var problems []string
+	if bundle.ResourceType != "Bundle" {
+		problems = append(problems, "resourceType must be Bundle")
+	}
+	if !fhirBundleTypes[bundle.Type] {
+		problems = append(problems, fmt.Sprintf("invalid bundle type: %q", bundle.Type))
+	}
+	if bundle.ID != "" && !fhirIDPattern.MatchString(bundle.ID) {
+		problems = append(problems, fmt.Sprintf("invalid bundle id: %q", bundle.ID))
+	}
+	if bundle.Timestamp != "" && !fhirInstantPattern.MatchString(bundle.Timestamp) {
+		problems = append(problems, fmt.Sprintf("invalid bundle timestamp: %q", bundle.Timestamp))
+	}
+
+	keys := map[string]bool{}
+	fullURLs := map[string]bool{}
+	resolvable := map[string]bool{}
+	for i, entry := range bundle.Entry {
+		if entry.Resource == nil {
+			problems = append(problems, fmt.Sprintf("entry %d has no resource", i))
+			continue
+		}
+		key := entry.Resource.resourceKey()
+		if !fhirUUIDPattern.MatchString(entry.FullURL) {
+			problems = append(problems, fmt.Sprintf("%s has an invalid fullUrl: %q", key, entry.FullURL))
+		}
+		if fullURLs[entry.FullURL] {
+			problems = append(problems, fmt.Sprintf("duplicate fullUrl: %s", entry.FullURL))
+		}
+		if keys[key] {
+			problems = append(problems, fmt.Sprintf("duplicate resource: %s", key))
+		}
+		fullURLs[entry.FullURL] = true
+		keys[key] = true
+		resolvable[entry.FullURL] = true
+		resolvable[key] = true
+
+		id := key[strings.Index(key, "/")+1:]
+		if !fhirIDPattern.MatchString(id) {
+			problems = append(problems, fmt.Sprintf("%s has an invalid id", key))
+		}
+		for _, problem := range entry.Resource.validate() {
+			problems = append(problems, key+": "+problem)
+		}
+	}
+
+	// Local references must point at resources in the bundle
+	for _, entry := range bundle.Entry {
+		if entry.Resource == nil {
+			continue
+		}
+		for _, ref := range entry.Resource.references() {
+			if ref.Reference != "" && !resolvable[ref.Reference] {
+				problems = append(problems, fmt.Sprintf("%s references missing resource %s", entry.Resource.resourceKey(), ref.Reference))
+			}
+			if ref.Reference == "" && ref.Identifier == nil && ref.Display == "" {
+				problems = append(problems, fmt.Sprintf("%s has an empty reference", entry.Resource.resourceKey()))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid FHIR bundle: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+var (
+	fhirUUIDPattern     = regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	fhirIDPattern       = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+	fhirInstantPattern  = regexp.MustCompile(`^[0-9]{4}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|[+-]((0[0-9]|1[0-3]):[0-5][0-9]|14:00))$`)
+	fhirDateTimePattern = regexp.MustCompile(`^[0-9]{4}(-(0[1-9]|1[0-2])(-(0[1-9]|[12][0-9]|3[01])(T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|[+-]((0[0-9]|1[0-3]):[0-5][0-9]|14:00)))?)?)?$`)
+
+	fhirBundleTypes = map[string]bool{
+		"document": true, "message": true, "transaction": true, "transaction-response": true,
+		"batch": true, "batch-response": true, "history": true, "searchset": true, "collection": true,
+	}
+	fhirObservationStatuses = map[string]bool{
+		"registered": true, "preliminary": true, "final": true, "amended": true,
+		"corrected": true, "cancelled": true, "entered-in-error": true, "unknown": true,
+	}
+	fhirEntityRoles = map[string]bool{
+		"derivation": true, "revision": true, "quotation": true, "source": true, "removal": true,
+	}
+)
+
+func (r *FHIROrganization) resourceKey() string         { return "Organization/" + r.ID }
+func (r *FHIROrganization) references() []FHIRReference { return nil }
+func (r *FHIROrganization) validate() []string {
+	var problems []string
+	if r.ResourceType != "Organization" {
+		problems = append(problems, "resourceType must be Organization")
+	}
+	// org-1: the organization SHALL at least have a name or an identifier
+	if r.Name == "" && len(r.Identifier) == 0 {
+		problems = append(problems, "organization needs a name or an identifier")
+	}
+	return append(problems, validateConcepts("type", r.Type)...)
+}
+
+func (r *FHIRLocation) resourceKey() string { return "Location/" + r.ID }
+func (r *FHIRLocation) references() []FHIRReference {
+	if r.ManagingOrganization == nil {
+		return nil
+	}
+	return []FHIRReference{*r.ManagingOrganization}
+}
+func (r *FHIRLocation) validate() []string {
+	var problems []string
+	if r.ResourceType != "Location" {
+		problems = append(problems, "resourceType must be Location")
+	}
+	if r.Status != "" && r.Status != "active" && r.Status != "suspended" && r.Status != "inactive" {
+		problems = append(problems, fmt.Sprintf("invalid status: %q", r.Status))
+	}
+	if r.Mode != "" && r.Mode != "instance" && r.Mode != "kind" {
+		problems = append(problems, fmt.Sprintf("invalid mode: %q", r.Mode))
+	}
+	if r.Position != nil && (r.Position.Latitude < -90 || r.Position.Latitude > 90 || r.Position.Longitude < -180 || r.Position.Longitude > 180) {
+		problems = append(problems, "position is outside WGS84 bounds")
+	}
+	return problems
+}
+
+func (r *FHIRSubstance) resourceKey() string         { return "Substance/" + r.ID }
+func (r *FHIRSubstance) references() []FHIRReference { return nil }
+func (r *FHIRSubstance) validate() []string {
+	var problems []string
+	if r.ResourceType != "Substance" {
+		problems = append(problems, "resourceType must be Substance")
+	}
+	if r.Status != "" && r.Status != "active" && r.Status != "inactive" && r.Status != "entered-in-error" {
+		problems = append(problems, fmt.Sprintf("invalid status: %q", r.Status))
+	}
+	problems = append(problems, validateConcept("code", &r.Code, true)...)
+	for _, instance := range r.Instance {
+		problems = append(problems, validateQuantity("instance.quantity", instance.Quantity)...)
+	}
+	return append(problems, validateConcepts("category", r.Category)...)
+}
+
+func (r *FHIRMedication) resourceKey() string { return "Medication/" + r.ID }
+func (r *FHIRMedication) references() []FHIRReference {
+	var refs []FHIRReference
+	if r.Manufacturer != nil {
+		refs = append(refs, *r.Manufacturer)
+	}
+	for _, ingredient := range r.Ingredient {
+		refs = append(refs, ingredient.ItemReference)
+	}
+	return refs
+}
+func (r *FHIRMedication) validate() []string {
+	var problems []string
+	if r.ResourceType != "Medication" {
+		problems = append(problems, "resourceType must be Medication")
+	}
+	if r.Status != "" && r.Status != "active" && r.Status != "inactive" && r.Status != "entered-in-error" {
+		problems = append(problems, fmt.Sprintf("invalid status: %q", r.Status))
+	}
+	if r.Batch != nil && r.Batch.ExpirationDate != "" && !fhirDateTimePattern.MatchString(r.Batch.ExpirationDate) {
+		problems = append(problems, fmt.Sprintf("invalid batch.expirationDate: %q", r.Batch.ExpirationDate))
+	}
+	problems = append(problems, validateConcept("code", r.Code, false)...)
+	return append(problems, validateConcept("form", r.Form, false)...)
+}
+
+func (r *FHIRObservation) resourceKey() string { return "Observation/" + r.ID }
+func (r *FHIRObservation) references() []FHIRReference {
+	return append(append([]FHIRReference{}, r.Focus...), r.Performer...)
+}
+func (r *FHIRObservation) validate() []string {
+	var problems []string
+	if r.ResourceType != "Observation" {
+		problems = append(problems, "resourceType must be Observation")
+	}
+	if !fhirObservationStatuses[r.Status] {
+		problems = append(problems, fmt.Sprintf("invalid status: %q", r.Status))
+	}
+	problems = append(problems, validateConcept("code", &r.Code, true)...)
+	if r.EffectiveDateTime != "" && !fhirDateTimePattern.MatchString(r.EffectiveDateTime) {
+		problems = append(problems, fmt.Sprintf("invalid effectiveDateTime: %q", r.EffectiveDateTime))
+	}
+
+	// value[x] is a choice element, so at most one may be present
+	values := 0
+	if r.ValueQuantity != nil {
+		values++
+		problems = append(problems, validateQuantity("valueQuantity", r.ValueQuantity)...)
+	}
+	if r.ValueString != "" {
+		values++
+	}
+	if r.ValueBoolean != nil {
+		values++
+	}
+	if values > 1 {
+		problems = append(problems, "only one value[x] may be present")
+	}
+
+	problems = append(problems, validateConcepts("category", r.Category)...)
+	return append(problems, validateConcepts("interpretation", r.Interpretation)...)
+}
+
+func (r *FHIRProvenance) resourceKey() string { return "Provenance/" + r.ID }
+func (r *FHIRProvenance) references() []FHIRReference {
+	refs := append([]FHIRReference{}, r.Target...)
+	if r.Location != nil {
+		refs = append(refs, *r.Location)
+	}
+	for _, agent := range r.Agent {
+		refs = append(refs, agent.Who)
+	}
+	for _, entity := range r.Entity {
+		refs = append(refs, entity.What)
+	}
+	return refs
+}
+func (r *FHIRProvenance) validate() []string {
+	var problems []string
+	if r.ResourceType != "Provenance" {
+		problems = append(problems, "resourceType must be Provenance")
+	}
+	if len(r.Target) == 0 {
+		problems = append(problems, "at least one target is required")
+	}
+	if !fhirInstantPattern.MatchString(r.Recorded) {
+		problems = append(problems, fmt.Sprintf("recorded must be an instant: %q", r.Recorded))
+	}
+	if r.OccurredDateTime != "" && !fhirDateTimePattern.MatchString(r.OccurredDateTime) {
+		problems = append(problems, fmt.Sprintf("invalid occurredDateTime: %q", r.OccurredDateTime))
+	}
+	if len(r.Agent) == 0 {
+		problems = append(problems, "at least one agent is required")
+	}
+	for _, agent := range r.Agent {
+		problems = append(problems, validateConcept("agent.type", agent.Type, false)...)
+	}
+	for _, entity := range r.Entity {
+		if !fhirEntityRoles[entity.Role] {
+			problems = append(problems, fmt.Sprintf("invalid entity.role: %q", entity.Role))
+		}
+	}
+	return append(problems, validateConcept("activity", r.Activity, false)...)
+}
+
+// validateConcept checks a CodeableConcept carries text or a complete coding
+func validateConcept(element string, concept *FHIRCodeableConcept, required bool) []string {
+	if concept == nil {
+		if required {
+			return []string{element + " is required"}
+		}
+		return nil
+	}
+	var problems []string
+	if concept.Text == "" && len(concept.Coding) == 0 {
+		problems = append(problems, element+" needs text or a coding")
+	}
+	for _, coding := range concept.Coding {
+		if coding.System == "" || coding.Code == "" {
+			problems = append(problems, element+".coding needs a system and a code")
+		}
+	}
+	return problems
+}
+
+// validateConcepts checks a list of CodeableConcepts
+func validateConcepts(element string, concepts []FHIRCodeableConcept) []string {
+	var problems []string
+	for i := range concepts {
+		problems = append(problems, validateConcept(element, &concepts[i], true)...)
+	}
+	return problems
+}
+
+// validateQuantity checks qty-3: a coded unit needs a code system
+func validateQuantity(element string, quantity *FHIRQuantity) []string {
+	if quantity != nil && quantity.Code != "" && quantity.System == "" {
+		return []string{element + " has a code without a system"}
+	}
+	return nil
+}
+
+// fhirID turns a ledger ID into a valid FHIR resource id
+func fhirID(id string) string {
+	var sb strings.Builder
+	for _, r := range id {
+		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune('-')
+		}
+	}
+	result := sb.String()
+	if len(result) > 64 {
+		result = result[:64]
+	}
+	if result == "" {
+		result = "unknown"
+	}
+	return result
+}
+
+// nameBasedUUID derives a stable version 5 style UUID URN from a key, so the same
+// provenance always exports with the same fullUrls
+func nameBasedUUID(key string) string {
+	sum := sha1.Sum([]byte(fhirIdentifierPrefix + key))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// fhirIdentifier builds an identifier in the HerbalTrace URN namespace
+func fhirIdentifier(kind string, value string) *FHIRIdentifier {
+	if value == "" {
+		return nil
+	}
+	return &FHIRIdentifier{System: fhirIdentifierPrefix + kind, Value: value}
+}
+
+// fhirIdentifiers builds an identifier list, empty when there is no value
+func fhirIdentifiers(kind string, value string) []FHIRIdentifier {
+	identifier := fhirIdentifier(kind, value)
+	if identifier == nil {
+		return nil
+	}
+	return []FHIRIdentifier{*identifier}
+}
+
+// fhirQuantity converts a ledger quantity into a UCUM quantity
+func fhirQuantity(quantity float64, unit string) *FHIRQuantity {
+	ucum := map[string]string{"g": "g", "kg": "kg", "ml": "mL", "l": "L"}
+	if definition, err := lookupUnit(unit); err == nil {
+		if code, ok := ucum[definition.Symbol]; ok {
+			return &FHIRQuantity{Value: quantity, Unit: definition.Symbol, System: fhirUCUMSystem, Code: code}
+		}
+	}
+	return &FHIRQuantity{Value: quantity, Unit: unit}
+}
+
+// fhirPosition builds a Location position, omitting an unknown altitude
+func fhirPosition(lat, lon, altitude float64) *FHIRPosition {
+	position := &FHIRPosition{Latitude: lat, Longitude: lon}
+	if altitude != 0 {
+		position.Altitude = &altitude
+	}
+	return position
+}
+
+// fhirParticipant codes a Provenance agent type
+func fhirParticipant(code string) *FHIRCodeableConcept {
+	return &FHIRCodeableConcept{Coding: []FHIRCoding{{System: fhirParticipantTypeSystem, Code: code}}}
+}
+
+// fhirInterpretation codes a result as normal or abnormal
+func fhirInterpretation(normal bool) []FHIRCodeableConcept {
+	if normal {
+		return []FHIRCodeableConcept{{Coding: []FHIRCoding{{System: fhirInterpretationSystem, Code: "N", Display: "Normal"}}}}
+	}
+	return []FHIRCodeableConcept{{Coding: []FHIRCoding{{System: fhirInterpretationSystem, Code: "A", Display: "Abnormal"}}}}
+}
+
+// fhirInstant normalises an RFC3339 timestamp, falling back when it cannot be parsed
+func fhirInstant(value string, fallback string) string {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fallback
+	}
+	return parsed.Format(time.RFC3339)
+}
+
+// fhirDateTime passes through valid FHIR dates and drops anything else
+func fhirDateTime(value string) string {
+	if fhirDateTimePattern.MatchString(value) {
+		return value
+	}
+	return fhirInstant(value, "")
+}
+
+// hasTestType reports whether a quality test covered a test type
+func hasTestType(test QualityTest, testType string) bool {
+	for _, t := range test.TestTypes {
+		if t == testType {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns map keys in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// firstNonEmpty returns the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// The official FHIR R4 JSON schema is about 4 MB, so it is fetched rather than committed. The
+// bundle is always checked against a committed subset of it and also against the full schema
+// once it has been fetched.
+//go:generate sh -c "curl -sSfL -o testdata/fhir.schema.json.zip https://hl7.org/fhir/R4/fhir.schema.json.zip && unzip -o testdata/fhir.schema.json.zip fhir.schema.json -d testdata && rm testdata/fhir.schema.json.zip"
+
+// fhirSchemaPath is where go generate places the official FHIR R4 JSON schema
+var fhirSchemaPath = filepath.Join("testdata", "fhir.schema.json")
+
+// fhirSubsetSchemaPath is the committed subset of the FHIR R4 JSON schema covering the resources
+// and elements the exporter emits, with everything else rejected
+var fhirSubsetSchemaPath = filepath.Join("testdata", "fhir-r4-subset.schema.json")
+
+// fhirTestProvenance is a provenance bundle exercising every resource the exporter emits
+func fhirTestProvenance() *Provenance {
+	return &Provenance{
+		ID:            "PROV-P1",
+		ProductID:     "P1",
+		GeneratedDate: "2025-03-01T09:30:00Z",
+		CollectionEvents: []CollectionEvent{{
+			ID:             "COL-1",
+			Type:           "CollectionEvent",
+			FarmerID:       "FARMER-1",
+			Species:        "Azadirachta indica",
+			CommonName:     "Neem",
+			ScientificName: "Azadirachta indica",
+			Quantity:       100,
+			Unit:           "kg",
+			Latitude:       30.27,
+			Longitude:      77.99,
+			HarvestDate:    "2025-01-02T10:00:00Z",
+			Timestamp:      "2025-01-02T10:05:00Z",
+			PartCollected:  "leaf",
+			ZoneName:       "Dehradun",
+			ApprovedZone:   true,
+			Status:         "verified",
+		}},
+		QualityTests: []QualityTest{{
+			ID:                "QT-1",
+			Type:              "QualityTest",
+			CollectionEventID: "COL-1",
+			LabID:             "LAB-1",
+			LabName:           "Herbal Testing Lab",
+			TestDate:          "2025-01-05",
+			TestTypes:         []string{"moisture", "pesticide", "heavy_metals", "dna_barcode"},
+			MoistureContent:   8.5,
+			PesticideResults:  map[string]string{"ddt": "pass"},
+			HeavyMetals:       map[string]float64{"lead": 0.4, "arsenic": 0.1},
+			DNABarcodeMatch:   true,
+			MicrobialLoad:     1200,
+			Aflatoxins:        2,
+			OverallResult:     "pass",
+		}},
+		ProcessingSteps: []ProcessingStep{{
+			ID:             "STEP-1",
+			Type:           "ProcessingStep",
+			ProcessorID:    "PROC-1",
+			ProcessorName:  "Valley Processors",
+			ProcessType:    "drying",
+			ProcessDate:    "2025-02-01T00:00:00Z",
+			InputQuantity:  100,
+			OutputQuantity: 80,
+			Unit:           "kg",
+			Location:       "Haridwar",
+			Latitude:       29.95,
+			Longitude:      78.16,
+			Status:         "completed",
+		}},
+		Product: Product{
+			ID:                 "P1",
+			Type:               "Product",
+			ProductName:        "Neem leaf powder",
+			ProductType:        "powder",
+			ManufacturerID:     "MFR-1",
+			ManufacturerName:   "Ayur Manufacturing",
+			ManufactureDate:    "2025-02-20",
+			ExpiryDate:         "2027-02-20",
+			Quantity:           75,
+			Unit:               "kg",
+			QRCode:             "QR-P1",
+			CollectionEventIDs: []string{"COL-1"},
+			QualityTestIDs:     []string{"QT-1"},
+			ProcessingStepIDs:  []string{"STEP-1"},
+			SiteName:           "Mumbai plant",
+			SiteLatitude:       19.07,
+			SiteLongitude:      72.88,
+			Status:             "manufactured",
+		},
+		DerivedFrom: "product",
+	}
+}
+
+// fhirTestBundleJSON converts the test provenance and returns the bundle as generic JSON
+func fhirTestBundleJSON(t *testing.T) ([]byte, map[string]interface{}) {
+	t.Helper()
+	bundle, err := ProvenanceToFHIRBundle(fhirTestProvenance())
+	if err != nil {
+		t.Fatalf("failed to convert provenance: %v", err)
+	}
+	bundleBytes, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatalf("failed to marshal bundle: %v", err)
+	}
+	var document map[string]interface{}
+	err = json.Unmarshal(bundleBytes, &document)
+	if err != nil {
+		t.Fatalf("failed to unmarshal bundle: %v", err)
+	}
+	return bundleBytes, document
+}
+
+// loadFHIRSchema compiles the JSON schema at path
+func loadFHIRSchema(t *testing.T, path string) *gojsonschema.Schema {
+	t.Helper()
+	schemaPath, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatalf("failed to resolve schema path: %v", err)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(schemaPath)))
+	if err != nil {
+		t.Fatalf("failed to load FHIR schema %s: %v", path, err)
+	}
+	return schema
+}
+
+func TestFHIRBundleMatchesR4Schema(t *testing.T) {
+	schemaPaths := []string{fhirSubsetSchemaPath}
+	if _, err := os.Stat(fhirSchemaPath); err == nil {
+		schemaPaths = append(schemaPaths, fhirSchemaPath)
+	} else if os.Getenv("FHIR_SCHEMA_REQUIRED") != "" {
+		t.Fatalf("official FHIR R4 schema not found at %s, run go generate to fetch it", fhirSchemaPath)
+	}
+
+	bundleBytes, _ := fhirTestBundleJSON(t)
+	for _, schemaPath := range schemaPaths {
+		t.Run(filepath.Base(schemaPath), func(t *testing.T) {
+			result, err := loadFHIRSchema(t, schemaPath).Validate(gojsonschema.NewBytesLoader(bundleBytes))
+			if err != nil {
+				t.Fatalf("failed to validate bundle: %v", err)
+			}
+			for _, problem := range result.Errors() {
+				t.Errorf("%s", problem)
+			}
+		})
+	}
+}
+
+func TestFHIRSubsetSchemaRejectsInvalidResources(t *testing.T) {
+	schema := loadFHIRSchema(t, fhirSubsetSchemaPath)
+	_, document := fhirTestBundleJSON(t)
+	bundleBytes, _ := json.Marshal(document)
+
+	tests := []struct {
+		name   string
+		mutate func(resource map[string]interface{}) bool
+	}{
+		{"unknown observation status", func(resource map[string]interface{}) bool {
+			if resource["resourceType"] != "Observation" {
+				return false
+			}
+			resource["status"] = "done"
+			return true
+		}},
+		{"observation without code", func(resource map[string]interface{}) bool {
+			if resource["resourceType"] != "Observation" {
+				return false
+			}
+			delete(resource, "code")
+			return true
+		}},
+		{"provenance recorded without time zone", func(resource map[string]interface{}) bool {
+			if resource["resourceType"] != "Provenance" {
+				return false
+			}
+			resource["recorded"] = "2025-03-01T09:30:00"
+			return true
+		}},
+		{"unknown location element", func(resource map[string]interface{}) bool {
+			if resource["resourceType"] != "Location" {
+				return false
+			}
+			resource["latitude"] = 30.27
+			return true
+		}},
+		{"unknown resource type", func(resource map[string]interface{}) bool {
+			if resource["resourceType"] != "Substance" {
+				return false
+			}
+			resource["resourceType"] = "Herb"
+			return true
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bundle map[string]interface{}
+			if err := json.Unmarshal(bundleBytes, &bundle); err != nil {
+				t.Fatalf("failed to copy bundle: %v", err)
+			}
+			mutated := false
+			for _, entry := range bundle["entry"].([]interface{}) {
+				resource := entry.(map[string]interface{})["resource"].(map[string]interface{})
+				if tt.mutate(resource) {
+					mutated = true
+					break
+				}
+			}
+			if !mutated {
+				t.Fatalf("bundle has no resource to mutate")
+			}
+			result, err := schema.Validate(gojsonschema.NewGoLoader(bundle))
+			if err != nil {
+				t.Fatalf("failed to validate bundle: %v", err)
+			}
+			if result.Valid() {
+				t.Errorf("invalid bundle passed the schema")
+			}
+		})
+	}
+}
+
+func TestFHIRBundleResources(t *testing.T) {
+	_, document := fhirTestBundleJSON(t)
+
+	fullURLs := map[string]bool{}
+	counts := map[string]int{}
+	entries, _ := document["entry"].([]interface{})
+	for _, entry := range entries {
+		entryMap := entry.(map[string]interface{})
+		fullURL, _ := entryMap["fullUrl"].(string)
+		if !strings.HasPrefix(fullURL, "urn:uuid:") {
+			t.Errorf("entry fullUrl %q is not a urn:uuid", fullURL)
+		}
+		fullURLs[fullURL] = true
+		resource := entryMap["resource"].(map[string]interface{})
+		counts[resource["resourceType"].(string)]++
+	}
+
+	for _, resourceType := range []string{"Provenance", "Substance", "Medication", "Location", "Organization", "Observation"} {
+		if counts[resourceType] == 0 {
+			t.Errorf("bundle has no %s resource", resourceType)
+		}
+	}
+	// One observation per recorded parameter: moisture, aflatoxins, microbial load, two metals,
+	// one pesticide, DNA barcode and the overall result
+	if counts["Observation"] != 8 {
+		t.Errorf("bundle has %d observations, want 8", counts["Observation"])
+	}
+
+	// Every local reference resolves to an entry in the bundle
+	var checkReferences func(value interface{})
+	checkReferences = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if reference, ok := v["reference"].(string); ok && !fullURLs[reference] {
+				t.Errorf("reference %s does not resolve", reference)
+			}
+			for _, child := range v {
+				checkReferences(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				checkReferences(child)
+			}
+		}
+	}
+	checkReferences(entries)
+}
+
+func TestValidateFHIRBundleRejectsDanglingReference(t *testing.T) {
+	bundle, err := ProvenanceToFHIRBundle(fhirTestProvenance())
+	if err != nil {
+		t.Fatalf("failed to convert provenance: %v", err)
+	}
+
+	for _, entry := range bundle.Entry {
+		if provenance, ok := entry.Resource.(*FHIRProvenance); ok {
+			provenance.Target = []FHIRReference{{Reference: "urn:uuid:00000000-0000-5000-8000-000000000000"}}
+			break
+		}
+	}
+	if ValidateFHIRBundle(bundle) == nil {
+		t.Errorf("bundle with a dangling provenance target passed validation")
+	}
+}
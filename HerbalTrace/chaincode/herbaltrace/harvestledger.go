@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Harvest quantities are booked as delta records instead of rewriting the
+// HarvestLimit document on every collection. Each limit is split into shards,
+// each owning an equal share of MaxQuantity and keeping its running total on a
+// shard total record. A transaction starts at the shard picked by its
+// transaction ID and only reads and writes the totals of the shards it books
+// into, so concurrent collections in the same zone rarely touch the same keys.
+// Because every shard total it writes has been read first, Fabric's MVCC check
+// keeps each shard (and therefore the whole limit) within bounds. The alert
+// threshold is checked over all shard totals by CheckHarvestThreshold, in a
+// transaction of its own.
+
+const (
+	harvestDeltaObjectType      = "harvestDelta"
+	harvestShardTotalObjectType = "harvestShardTotal"
+	harvestThresholdObjectType  = "harvestThreshold"
+	defaultHarvestShards        = 8
+	harvestEpsilon              = 1e-9
+)
+
+// HarvestDelta represents a quantity booked against one shard of a harvest limit
+type HarvestDelta struct {
+	Type      string  `json:"type"` // "HarvestDelta"
+	LimitID   string  `json:"limitId"`
+	Shard     int     `json:"shard"`
+	Quantity  float64 `json:"quantity"`
+	TxID      string  `json:"txId"`
+	Compacted bool    `json:"compacted,omitempty"` // true when the record folds several earlier deltas
+	Timestamp string  `json:"timestamp"`
+}
+
+// HarvestShardTotal is the running total of one shard of a harvest limit
+type HarvestShardTotal struct {
+	Type      string  `json:"type"` // "HarvestShardTotal"
+	LimitID   string  `json:"limitId"`
+	Shard     int     `json:"shard"`
+	Quantity  float64 `json:"quantity"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+// HarvestThresholdState is the limit status last reported by CheckHarvestThreshold
+type HarvestThresholdState struct {
+	Type            string  `json:"type"` // "HarvestThresholdState"
+	LimitID         string  `json:"limitId"`
+	Status          string  `json:"status"`
+	CurrentQuantity float64 `json:"currentQuantity"`
+	CheckedAt       string  `json:"checkedAt"`
+}
+
+// harvestStatusRank orders limit statuses so only a rise raises an alert
+var harvestStatusRank = map[string]int{
+	"normal":   0,
+	"warning":  1,
+	"exceeded": 2,
+}
+
+// harvestAllocation describes the part of a quantity placed into a single shard
+type harvestAllocation struct {
+	Shard      int
+	Quantity   float64
+	UsedBefore float64
+	Allowance  float64
+}
+
+// harvestLimitKey builds the ledger key of the limit for a species/zone/season
+func harvestLimitKey(species string, zone string, season string) string {
+	return fmt.Sprintf("limit_%s_%s_%s",
+		strings.ReplaceAll(species, " ", "_"),
+		strings.ReplaceAll(zone, " ", "_"),
+		strings.ReplaceAll(season, " ", "_"))
+}
+
+// harvestLimitStatus derives the limit status from the quantity used so far
+func harvestLimitStatus(limit *HarvestLimit, current float64) string {
+	percentageUsed := (current / limit.MaxQuantity) * 100
+	if percentageUsed >= 100 {
+		return "exceeded"
+	} else if percentageUsed >= limit.AlertThreshold {
+		return "warning"
+	}
+	return "normal"
+}
+
+// shardCount returns the number of shards the limit is split into
+func (limit *HarvestLimit) shardCount() int {
+	if limit.Shards <= 0 {
+		return defaultHarvestShards
+	}
+	return limit.Shards
+}
+
+// shardAllowance returns the share of MaxQuantity owned by each shard
+func (limit *HarvestLimit) shardAllowance() float64 {
+	return limit.MaxQuantity / float64(limit.shardCount())
+}
+
+// legacyShardBase spreads a quantity tracked before delta accounting across the shards.
+// Limits written by the old read-modify-write tracker have no Shards value and keep
+// their running total in CurrentQuantity.
+func (limit *HarvestLimit) legacyShardBase() float64 {
+	if limit.Shards > 0 {
+		return 0
+	}
+	return limit.CurrentQuantity / float64(limit.shardCount())
+}
+
+// homeShard picks the first shard a transaction books into
+func homeShard(txID string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(txID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardAttribute formats a shard number so shard ranges sort correctly
+func shardAttribute(shard int) string {
+	return fmt.Sprintf("%03d", shard)
+}
+
+// getHarvestLimit reads a harvest limit, returning nil when none is configured
+func (c *HerbalTraceContract) getHarvestLimit(ctx contractapi.TransactionContextInterface, limitID string) (*HarvestLimit, error) {
+	limitBytes, err := ctx.GetStub().GetState(limitID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read harvest limit: %v", err)
+	}
+	if limitBytes == nil {
+		return nil, nil
+	}
+
+	var limit HarvestLimit
+	err = json.Unmarshal(limitBytes, &limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal harvest limit: %v", err)
+	}
+
+	return &limit, nil
+}
+
+// sumHarvestDeltas adds up the delta records under a partial key of a limit
+func (c *HerbalTraceContract) sumHarvestDeltas(ctx contractapi.TransactionContextInterface, attributes []string) (float64, []string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(harvestDeltaObjectType, attributes)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read harvest deltas: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	total := 0.0
+	var keys []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to iterate harvest deltas: %v", err)
+		}
+
+		var delta HarvestDelta
+		err = json.Unmarshal(queryResponse.Value, &delta)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to unmarshal harvest delta %s: %v", queryResponse.Key, err)
+		}
+		total += delta.Quantity
+		keys = append(keys, queryResponse.Key)
+	}
+
+	return total, keys, nil
+}
+
+// harvestShardUsage returns the quantity booked in one shard of a limit
+func (c *HerbalTraceContract) harvestShardUsage(ctx contractapi.TransactionContextInterface, limit *HarvestLimit, shard int) (float64, error) {
+	total, err := getHarvestShardTotal(ctx, limit.ID, shard)
+	if err != nil {
+		return 0, err
+	}
+	if total != nil {
+		return total.Quantity, nil
+	}
+
+	// Shards booked before shard totals were kept are summed from their deltas
+	used, _, err := c.sumHarvestDeltas(ctx, []string{limit.ID, shardAttribute(shard)})
+	if err != nil {
+		return 0, err
+	}
+	return used + limit.legacyShardBase(), nil
+}
+
+// harvestTotal aggregates every shard of a limit from the shard totals
+func (c *HerbalTraceContract) harvestTotal(ctx contractapi.TransactionContextInterface, limit *HarvestLimit) (float64, error) {
+	total := 0.0
+	for shard := 0; shard < limit.shardCount(); shard++ {
+		used, err := c.harvestShardUsage(ctx, limit, shard)
+		if err != nil {
+			return 0, err
+		}
+		total += used
+	}
+	return total, nil
+}
+
+// harvestShardTotalKey builds the composite key of a shard total
+func harvestShardTotalKey(ctx contractapi.TransactionContextInterface, limitID string, shard int) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(harvestShardTotalObjectType, []string{limitID, shardAttribute(shard)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create harvest shard total key: %v", err)
+	}
+	return key, nil
+}
+
+// getHarvestShardTotal reads a shard total, returning nil when the shard has none yet
+func getHarvestShardTotal(ctx contractapi.TransactionContextInterface, limitID string, shard int) (*HarvestShardTotal, error) {
+	key, err := harvestShardTotalKey(ctx, limitID, shard)
+	if err != nil {
+		return nil, err
+	}
+	totalBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read harvest shard total: %v", err)
+	}
+	if totalBytes == nil {
+		return nil, nil
+	}
+
+	var total HarvestShardTotal
+	err = json.Unmarshal(totalBytes, &total)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal harvest shard total: %v", err)
+	}
+
+	return &total, nil
+}
+
+// putHarvestShardTotal writes the running total of a shard
+func putHarvestShardTotal(ctx contractapi.TransactionContextInterface, limitID string, shard int, quantity float64, timestamp string) error {
+	key, err := harvestShardTotalKey(ctx, limitID, shard)
+	if err != nil {
+		return err
+	}
+
+	totalBytes, err := json.Marshal(HarvestShardTotal{
+		Type:      "HarvestShardTotal",
+		LimitID:   limitID,
+		Shard:     shard,
+		Quantity:  quantity,
+		UpdatedAt: timestamp,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal harvest shard total: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, totalBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save harvest shard total: %v", err)
+	}
+
+	return nil
+}
+
+// planHarvestAllocation places a quantity into shards with remaining headroom, starting
+// at the transaction's home shard. It returns nil when the limit cannot absorb the quantity.
+func (c *HerbalTraceContract) planHarvestAllocation(ctx contractapi.TransactionContextInterface, limit *HarvestLimit, quantity float64) ([]harvestAllocation, error) {
+	shards := limit.shardCount()
+	allowance := limit.shardAllowance()
+	home := homeShard(ctx.GetStub().GetTxID(), shards)
+
+	var allocations []harvestAllocation
+	remaining := quantity
+	for i := 0; i < shards && remaining > harvestEpsilon; i++ {
+		shard := (home + i) % shards
+		used, err := c.harvestShardUsage(ctx, limit, shard)
+		if err != nil {
+			return nil, err
+		}
+
+		headroom := allowance - used
+		if headroom <= harvestEpsilon {
+			continue
+		}
+		take := remaining
+		if take > headroom {
+			take = headroom
+		}
+		allocations = append(allocations, harvestAllocation{
+			Shard:      shard,
+			Quantity:   take,
+			UsedBefore: used,
+			Allowance:  allowance,
+		})
+		remaining -= take
+	}
+
+	if remaining > harvestEpsilon {
+		return nil, nil
+	}
+	return allocations, nil
+}
+
+// trackHarvestQuantity books a quantity as delta records and returns where it was placed.
+// It returns a nil limit when no limit is configured for the species/zone/season.
+func (c *HerbalTraceContract) trackHarvestQuantity(ctx contractapi.TransactionContextInterface, species string, zone string, season string, quantity float64, unit string) (*HarvestLimit, []harvestAllocation, error) {
+	if species == "" || zone == "" || season == "" {
+		return nil, nil, fmt.Errorf("species, zone, and season are required")
+	}
+	if quantity <= 0 {
+		return nil, nil, fmt.Errorf("quantity must be greater than zero")
+	}
+
+	limit, err := c.getHarvestLimit(ctx, harvestLimitKey(species, zone, season))
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit == nil {
+		// No limit set for this combination - allow harvest
+		return nil, nil, nil
+	}
+
+	// Book the quantity in the limit's unit
+	quantity, err = convertQuantity(quantity, unit, limit.Unit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("harvest quantity does not match limit unit: %v", err)
+	}
+
+	allocations, err := c.planHarvestAllocation(ctx, limit, quantity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if allocations == nil {
+		return nil, nil, fmt.Errorf("harvest limit exceeded for %s/%s/%s", species, zone, season)
+	}
+
+	txID := ctx.GetStub().GetTxID()
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	timestamp := now.Format(time.RFC3339)
+	for _, allocation := range allocations {
+		err = c.putHarvestDelta(ctx, HarvestDelta{
+			Type:      "HarvestDelta",
+			LimitID:   limit.ID,
+			Shard:     allocation.Shard,
+			Quantity:  allocation.Quantity,
+			TxID:      txID,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		err = putHarvestShardTotal(ctx, limit.ID, allocation.Shard, allocation.UsedBefore+allocation.Quantity, timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return limit, allocations, nil
+}
+
+// putHarvestDelta writes a delta record under its composite key
+func (c *HerbalTraceContract) putHarvestDelta(ctx contractapi.TransactionContextInterface, delta HarvestDelta) error {
+	key, err := ctx.GetStub().CreateCompositeKey(harvestDeltaObjectType, []string{delta.LimitID, shardAttribute(delta.Shard), delta.TxID})
+	if err != nil {
+		return fmt.Errorf("failed to create harvest delta key: %v", err)
+	}
+
+	deltaBytes, err := json.Marshal(delta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal harvest delta: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, deltaBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save harvest delta: %v", err)
+	}
+
+	return nil
+}
+
+// clearHarvestDeltas deletes every delta record, shard total and reported threshold state of a limit
+func (c *HerbalTraceContract) clearHarvestDeltas(ctx contractapi.TransactionContextInterface, limit *HarvestLimit) error {
+	_, keys, err := c.sumHarvestDeltas(ctx, []string{limit.ID})
+	if err != nil {
+		return err
+	}
+	for shard := 0; shard < limit.shardCount(); shard++ {
+		key, err := harvestShardTotalKey(ctx, limit.ID, shard)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	thresholdKey, err := harvestThresholdKey(ctx, limit.ID)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, thresholdKey)
+
+	for _, key := range keys {
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete harvest record: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// CompactHarvestLimit folds the delta records of each shard into a single record
+// and refreshes the stored CurrentQuantity and Status snapshot on the limit
+func (c *HerbalTraceContract) CompactHarvestLimit(ctx contractapi.TransactionContextInterface, species string, zone string, season string) error {
+	if species == "" || zone == "" || season == "" {
+		return fmt.Errorf("species, zone, and season are required")
+	}
+
+	limitID := harvestLimitKey(species, zone, season)
+	limit, err := c.getHarvestLimit(ctx, limitID)
+	if err != nil {
+		return err
+	}
+	if limit == nil {
+		return fmt.Errorf("harvest limit for %s/%s/%s does not exist", species, zone, season)
+	}
+
+	txID := ctx.GetStub().GetTxID()
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	timestamp := now.Format(time.RFC3339)
+	total := 0.0
+	compactedCount := 0
+	for shard := 0; shard < limit.shardCount(); shard++ {
+		used, keys, err := c.sumHarvestDeltas(ctx, []string{limitID, shardAttribute(shard)})
+		if err != nil {
+			return err
+		}
+		used += limit.legacyShardBase()
+
+		for _, key := range keys {
+			err = ctx.GetStub().DelState(key)
+			if err != nil {
+				return fmt.Errorf("failed to delete harvest delta: %v", err)
+			}
+		}
+		compactedCount += len(keys)
+
+		err = putHarvestShardTotal(ctx, limitID, shard, used, timestamp)
+		if err != nil {
+			return err
+		}
+
+		if used > 0 {
+			err = c.putHarvestDelta(ctx, HarvestDelta{
+				Type:      "HarvestDelta",
+				LimitID:   limitID,
+				Shard:     shard,
+				Quantity:  used,
+				TxID:      txID,
+				Compacted: true,
+				Timestamp: timestamp,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		total += used
+	}
+
+	// Legacy limits switch to delta accounting once their base has been folded into shards
+	limit.Shards = limit.shardCount()
+	limit.CurrentQuantity = total
+	limit.Status = harvestLimitStatus(limit, total)
+	limit.UpdatedAt = timestamp
+
+	limitBytes, err := json.Marshal(limit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal harvest limit: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(limitID, limitBytes)
+	if err != nil {
+		return fmt.Errorf("failed to update harvest limit: %v", err)
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":       "HarvestLimitCompacted",
+		"limitId":         limitID,
+		"currentQuantity": total,
+		"compactedDeltas": compactedCount,
+		"status":          limit.Status,
+		"timestamp":       timestamp,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("HarvestLimitCompacted", eventBytes)
+
+	return nil
+}
+
+// CheckHarvestThreshold raises the harvest limit warning when the limit a collection event was
+// booked against has crossed its alert threshold. Collections only read the shards they book
+// into, so the total is checked here, in a transaction of its own, from the shard totals.
+// An alert is only raised when the status rises above the one last reported.
+func (c *HerbalTraceContract) CheckHarvestThreshold(ctx contractapi.TransactionContextInterface, eventID string) error {
+	event, err := c.GetCollectionEvent(ctx, eventID)
+	if err != nil {
+		return err
+	}
+	if event.HarvestLimitID == "" {
+		// Not booked against a harvest limit
+		return nil
+	}
+
+	limit, err := c.getHarvestLimit(ctx, event.HarvestLimitID)
+	if err != nil {
+		return err
+	}
+	if limit == nil {
+		return fmt.Errorf("harvest limit %s does not exist", event.HarvestLimitID)
+	}
+
+	current, err := c.harvestTotal(ctx, limit)
+	if err != nil {
+		return err
+	}
+	limit.CurrentQuantity = current
+	limit.Status = harvestLimitStatus(limit, current)
+
+	previous, err := getHarvestThresholdState(ctx, limit.ID)
+	if err != nil {
+		return err
+	}
+	previousStatus := "normal"
+	if previous != nil {
+		previousStatus = previous.Status
+	}
+	if limit.Status == previousStatus {
+		return nil
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	timestamp := now.Format(time.RFC3339)
+	err = putHarvestThresholdState(ctx, HarvestThresholdState{
+		Type:            "HarvestThresholdState",
+		LimitID:         limit.ID,
+		Status:          limit.Status,
+		CurrentQuantity: current,
+		CheckedAt:       timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	if harvestStatusRank[limit.Status] < harvestStatusRank[previousStatus] {
+		return nil
+	}
+
+	err = c.evaluateAlertRules(ctx, "HarvestLimit", "threshold_crossed", limit, map[string]interface{}{
+		"eventId":     eventID,
+		"percentUsed": (current / limit.MaxQuantity) * 100,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":       "HarvestThresholdCrossed",
+		"limitId":         limit.ID,
+		"eventId":         eventID,
+		"previousStatus":  previousStatus,
+		"status":          limit.Status,
+		"currentQuantity": current,
+		"maxQuantity":     limit.MaxQuantity,
+		"timestamp":       timestamp,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("HarvestThresholdCrossed", eventBytes)
+
+	return nil
+}
+
+// harvestThresholdKey builds the composite key of the threshold state of a limit
+func harvestThresholdKey(ctx contractapi.TransactionContextInterface, limitID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(harvestThresholdObjectType, []string{limitID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create harvest threshold key: %v", err)
+	}
+	return key, nil
+}
+
+// getHarvestThresholdState reads the last reported threshold state, returning nil when none is stored
+func getHarvestThresholdState(ctx contractapi.TransactionContextInterface, limitID string) (*HarvestThresholdState, error) {
+	key, err := harvestThresholdKey(ctx, limitID)
+	if err != nil {
+		return nil, err
+	}
+	stateBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read harvest threshold state: %v", err)
+	}
+	if stateBytes == nil {
+		return nil, nil
+	}
+
+	var state HarvestThresholdState
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal harvest threshold state: %v", err)
+	}
+
+	return &state, nil
+}
+
+// putHarvestThresholdState saves the reported threshold state of a limit
+func putHarvestThresholdState(ctx contractapi.TransactionContextInterface, state HarvestThresholdState) error {
+	key, err := harvestThresholdKey(ctx, state.LimitID)
+	if err != nil {
+		return err
+	}
+
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal harvest threshold state: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, stateBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save harvest threshold state: %v", err)
+	}
+
+	return nil
+}
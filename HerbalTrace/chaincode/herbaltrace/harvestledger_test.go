@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSpecies = "Withania somnifera"
+	testZone    = "Zone-A"
+	testSeason  = "2025-Spring"
+)
+
+var testFarmer = testIdentity{id: "farmer-1", mspID: "FarmersCoopMSP", attributes: map[string]string{"role": "farmer"}}
+
+// newHarvestLedger returns a ledger holding a harvest limit split into the given number of shards
+func newHarvestLedger(t *testing.T, maxQuantity float64, shards int) (*testLedger, *HarvestLimit) {
+	ledger := newTestLedger()
+	limit := &HarvestLimit{
+		ID:             harvestLimitKey(testSpecies, testZone, testSeason),
+		Type:           "HarvestLimit",
+		Species:        testSpecies,
+		Season:         testSeason,
+		Zone:           testZone,
+		MaxQuantity:    maxQuantity,
+		Unit:           "kg",
+		AlertThreshold: 80,
+		Status:         "normal",
+		Shards:         shards,
+	}
+	ledger.put(t, limit.ID, limit)
+	ledger.put(t, "COL-1", CollectionEvent{ID: "COL-1", Type: "CollectionEvent", Species: testSpecies, ZoneName: testZone, HarvestLimitID: limit.ID})
+	return ledger, limit
+}
+
+// txIDForShard returns a transaction ID whose bookings start at the given shard
+func txIDForShard(prefix string, shard int, shards int) string {
+	for i := 0; ; i++ {
+		txID := fmt.Sprintf("%s-%d", prefix, i)
+		if homeShard(txID, shards) == shard {
+			return txID
+		}
+	}
+}
+
+// endorseBooking simulates a collection booking a quantity against the limit
+func endorseBooking(ledger *testLedger, txID string, quantity float64) (*testTx, error) {
+	tx := ledger.begin(txID)
+	contract := new(HerbalTraceContract)
+	err := contract.TrackHarvestQuantity(tx.context(testFarmer), testSpecies, testZone, testSeason, quantity, "kg")
+	return tx, err
+}
+
+// committedHarvestTotal reads the booked total of a limit from committed state
+func committedHarvestTotal(t *testing.T, ledger *testLedger, limit *HarvestLimit) float64 {
+	t.Helper()
+	tx := ledger.begin("read-total")
+	contract := new(HerbalTraceContract)
+	total, err := contract.harvestTotal(tx.context(testFarmer), limit)
+	if err != nil {
+		t.Fatalf("failed to read harvest total: %v", err)
+	}
+	return total
+}
+
+// committedDeltaTotal sums the delta records of a limit from committed state
+func committedDeltaTotal(t *testing.T, ledger *testLedger, limit *HarvestLimit) float64 {
+	t.Helper()
+	tx := ledger.begin("read-deltas")
+	contract := new(HerbalTraceContract)
+	total, _, err := contract.sumHarvestDeltas(tx.context(testFarmer), []string{limit.ID})
+	if err != nil {
+		t.Fatalf("failed to sum harvest deltas: %v", err)
+	}
+	return total
+}
+
+// committedAlerts returns the alerts on the ledger
+func committedAlerts(t *testing.T, ledger *testLedger) []Alert {
+	t.Helper()
+	var alerts []Alert
+	for _, key := range ledger.scan("", "") {
+		var alert Alert
+		if json.Unmarshal(ledger.state[key], &alert) == nil && alert.Type == "Alert" {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+func TestParallelBookingsOnDifferentShardsCommit(t *testing.T) {
+	ledger, limit := newHarvestLedger(t, 800, 8)
+
+	// Every collection is endorsed against the same snapshot before any of them commits
+	var txs []*testTx
+	for shard := 0; shard < 8; shard++ {
+		tx, err := endorseBooking(ledger, txIDForShard("collect", shard, 8), 50)
+		if err != nil {
+			t.Fatalf("booking into shard %d was rejected: %v", shard, err)
+		}
+		txs = append(txs, tx)
+	}
+	for _, tx := range txs {
+		err := ledger.commit(tx)
+		if err != nil {
+			t.Fatalf("transaction %s did not commit: %v", tx.txID, err)
+		}
+	}
+
+	if total := committedHarvestTotal(t, ledger, limit); total != 400 {
+		t.Errorf("harvest total = %v, want 400", total)
+	}
+}
+
+func TestParallelBookingsOnSameShardConflict(t *testing.T) {
+	ledger, limit := newHarvestLedger(t, 800, 8)
+
+	first, err := endorseBooking(ledger, txIDForShard("first", 3, 8), 40)
+	if err != nil {
+		t.Fatalf("first booking was rejected: %v", err)
+	}
+	second, err := endorseBooking(ledger, txIDForShard("second", 3, 8), 40)
+	if err != nil {
+		t.Fatalf("second booking was rejected: %v", err)
+	}
+
+	err = ledger.commit(first)
+	if err != nil {
+		t.Fatalf("first booking did not commit: %v", err)
+	}
+	err = ledger.commit(second)
+	if err == nil {
+		t.Fatalf("second booking on the same shard committed without a conflict")
+	}
+
+	// The resubmitted collection sees the first booking and commits
+	retry, err := endorseBooking(ledger, txIDForShard("retry", 3, 8), 40)
+	if err != nil {
+		t.Fatalf("resubmitted booking was rejected: %v", err)
+	}
+	err = ledger.commit(retry)
+	if err != nil {
+		t.Fatalf("resubmitted booking did not commit: %v", err)
+	}
+
+	if total := committedHarvestTotal(t, ledger, limit); total != 80 {
+		t.Errorf("harvest total = %v, want 80", total)
+	}
+}
+
+func TestHarvestLimitHoldsUnderParallelSubmissions(t *testing.T) {
+	ledger, limit := newHarvestLedger(t, 100, 4)
+
+	// Rounds of parallel collections, each spilling over shard boundaries, until the limit is full
+	committed := 0.0
+	for round := 0; round < 50; round++ {
+		var txs []*testTx
+		for i := 0; i < 6; i++ {
+			tx, err := endorseBooking(ledger, fmt.Sprintf("round-%d-%d", round, i), 7.5)
+			if err == nil {
+				txs = append(txs, tx)
+			}
+		}
+		if len(txs) == 0 {
+			break
+		}
+		for _, tx := range txs {
+			if ledger.commit(tx) == nil {
+				committed += 7.5
+			}
+		}
+	}
+
+	if committed > limit.MaxQuantity {
+		t.Errorf("committed %v exceeds the limit of %v", committed, limit.MaxQuantity)
+	}
+	if committed < limit.MaxQuantity-7.5 {
+		t.Errorf("committed %v leaves more than one collection of headroom in %v", committed, limit.MaxQuantity)
+	}
+	if total := committedHarvestTotal(t, ledger, limit); math.Abs(total-committed) > harvestEpsilon {
+		t.Errorf("shard totals = %v, want %v", total, committed)
+	}
+	if total := committedDeltaTotal(t, ledger, limit); math.Abs(total-committed) > harvestEpsilon {
+		t.Errorf("delta records = %v, want %v", total, committed)
+	}
+}
+
+func TestCheckHarvestThresholdRaisesOnTotal(t *testing.T) {
+	ledger, limit := newHarvestLedger(t, 800, 8)
+	contract := new(HerbalTraceContract)
+
+	checkThreshold := func(txID string) *testTx {
+		t.Helper()
+		tx := ledger.begin(txID)
+		err := contract.CheckHarvestThreshold(tx.context(testFarmer), "COL-1")
+		if err != nil {
+			t.Fatalf("threshold check failed: %v", err)
+		}
+		// Alert rules are read by key range; no other range may conflict with bookings
+		for _, rangeRead := range tx.ranges {
+			if rangeRead.start != alertRuleKey("") {
+				t.Errorf("threshold check range-read %q-%q, want shard totals only", rangeRead.start, rangeRead.end)
+			}
+		}
+		err = ledger.commit(tx)
+		if err != nil {
+			t.Fatalf("threshold check did not commit: %v", err)
+		}
+		return tx
+	}
+
+	// Shard 0 fills up while the limit as a whole is still at 12.5%
+	tx, err := endorseBooking(ledger, txIDForShard("fill", 0, 8), 100)
+	if err != nil {
+		t.Fatalf("booking was rejected: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("booking did not commit: %v", err)
+	}
+	for shard := 1; shard < 8; shard++ {
+		tx, err := endorseBooking(ledger, txIDForShard("empty", shard, 8), 1)
+		if err != nil {
+			t.Fatalf("booking was rejected: %v", err)
+		}
+		if err = ledger.commit(tx); err != nil {
+			t.Fatalf("booking did not commit: %v", err)
+		}
+	}
+	checkThreshold("check-1")
+	if alerts := committedAlerts(t, ledger); len(alerts) != 0 {
+		t.Fatalf("raised %d alerts below the threshold", len(alerts))
+	}
+
+	// The other shards stay below 80% each, but the total passes it
+	for shard := 1; shard < 8; shard++ {
+		tx, err := endorseBooking(ledger, txIDForShard("top-up", shard, 8), 77)
+		if err != nil {
+			t.Fatalf("booking was rejected: %v", err)
+		}
+		if err = ledger.commit(tx); err != nil {
+			t.Fatalf("booking did not commit: %v", err)
+		}
+	}
+	checkThreshold("check-2")
+
+	alerts := committedAlerts(t, ledger)
+	if len(alerts) != 1 {
+		t.Fatalf("raised %d alerts, want 1", len(alerts))
+	}
+	if alerts[0].RuleID != "warning" || alerts[0].Zone != testZone {
+		t.Errorf("raised alert %+v, want a harvest warning for %s", alerts[0], testZone)
+	}
+
+	// Checking again without a change of status raises nothing new
+	checkThreshold("check-3")
+	alerts = committedAlerts(t, ledger)
+	if len(alerts) != 1 || alerts[0].OccurrenceCount != 1 {
+		t.Errorf("repeated check changed the alerts: %+v", alerts)
+	}
+
+	var state HarvestThresholdState
+	key, _ := ledger.begin("read-state").CreateCompositeKey(harvestThresholdObjectType, []string{limit.ID})
+	ledger.get(t, key, &state)
+	if state.Status != "warning" {
+		t.Errorf("threshold state = %s, want warning", state.Status)
+	}
+}
+
+func TestThresholdCheckDoesNotConflictWithBookings(t *testing.T) {
+	ledger, _ := newHarvestLedger(t, 800, 8)
+	contract := new(HerbalTraceContract)
+
+	booking, err := endorseBooking(ledger, txIDForShard("collect", 2, 8), 650)
+	if err != nil {
+		t.Fatalf("booking was rejected: %v", err)
+	}
+	if err = ledger.commit(booking); err != nil {
+		t.Fatalf("booking did not commit: %v", err)
+	}
+
+	check := ledger.begin("check")
+	err = contract.CheckHarvestThreshold(check.context(testFarmer), "COL-1")
+	if err != nil {
+		t.Fatalf("threshold check failed: %v", err)
+	}
+	next, err := endorseBooking(ledger, txIDForShard("next", 5, 8), 10)
+	if err != nil {
+		t.Fatalf("booking was rejected: %v", err)
+	}
+
+	if err = ledger.commit(check); err != nil {
+		t.Fatalf("threshold check did not commit: %v", err)
+	}
+	if err = ledger.commit(next); err != nil {
+		t.Errorf("booking endorsed alongside the threshold check did not commit: %v", err)
+	}
+}
+
+func TestHarvestRecordsUseTransactionTime(t *testing.T) {
+	ledger, limit := newHarvestLedger(t, 100, 1)
+	contract := new(HerbalTraceContract)
+
+	tx, err := endorseBooking(ledger, "collect", 90)
+	if err != nil {
+		t.Fatalf("booking was rejected: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("booking did not commit: %v", err)
+	}
+	tx = ledger.begin("check")
+	if err = contract.CheckHarvestThreshold(tx.context(testFarmer), "COL-1"); err != nil {
+		t.Fatalf("threshold check failed: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("threshold check did not commit: %v", err)
+	}
+	tx = ledger.begin("compact")
+	if err = contract.CompactHarvestLimit(tx.context(testFarmer), limit.Species, limit.Zone, limit.Season); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("compaction did not commit: %v", err)
+	}
+
+	// Every peer endorses the same timestamps, so they come from the transaction
+	want := testTime.Format(time.RFC3339)
+	stamped := map[string]int{}
+	for _, key := range ledger.scan("", "") {
+		var record struct {
+			Type      string `json:"type"`
+			Timestamp string `json:"timestamp"`
+			UpdatedAt string `json:"updatedAt"`
+			CheckedAt string `json:"checkedAt"`
+		}
+		if json.Unmarshal(ledger.state[key], &record) != nil || !strings.HasPrefix(record.Type, "Harvest") || record.Type == "HarvestLimit" {
+			continue
+		}
+		stamp := firstNonEmpty(record.Timestamp, record.UpdatedAt, record.CheckedAt)
+		if stamp != want {
+			t.Errorf("%s %q is stamped %q, want the transaction time %s", record.Type, key, stamp, want)
+		}
+		stamped[record.Type]++
+	}
+	for _, recordType := range []string{"HarvestDelta", "HarvestShardTotal", "HarvestThresholdState"} {
+		if stamped[recordType] == 0 {
+			t.Errorf("no %s record was written", recordType)
+		}
+	}
+}
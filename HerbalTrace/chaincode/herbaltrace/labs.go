@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Lab represents a testing laboratory and its accreditation, e.g. NABL under ISO/IEC 17025.
+// Results can only be recorded for a lab by identities of the organisation it is bound to whose
+// certificate names the lab in its labId attribute.
+type Lab struct {
+	ID                  string     `json:"id"`
+	Type                string     `json:"type"` // "Lab"
+	Name                string     `json:"name"`
+	MSPID               string     `json:"mspId"`             // Organisation whose identities record the lab's results
+	AccreditationBody   string     `json:"accreditationBody"` // "NABL"
+	AccreditationNumber string     `json:"accreditationNumber"`
+	Scope               []LabScope `json:"scope"`
+	ValidFrom           string     `json:"validFrom"`
+	ValidUntil          string     `json:"validUntil"`
+	Status              string     `json:"status"` // "active", "suspended", "withdrawn"
+	StatusReason        string     `json:"statusReason,omitempty"`
+	RegisteredBy        string     `json:"registeredBy"`
+	UpdatedBy           string     `json:"updatedBy"`
+	CreatedAt           string     `json:"createdAt"`
+	UpdatedAt           string     `json:"updatedAt"`
+}
+
+// LabScope is a test type a lab is accredited for and the accredited methods, empty for any method
+type LabScope struct {
+	TestType string   `json:"testType"`
+	Methods  []string `json:"methods,omitempty"` // e.g. "ICP-MS", "AOAC 2007.01"
+}
+
+const (
+	roleAccreditationBody = "accreditation_body"
+	labIDAttribute        = "labId" // Certificate attribute naming the lab an analyst works for
+)
+
+// labTestTypes lists the test types a lab can be accredited for
+var labTestTypes = map[string]bool{
+	"moisture":       true,
+	"pesticide":      true,
+	"dna_barcode":    true,
+	"heavy_metals":   true,
+	"microbial_load": true,
+	"aflatoxins":     true,
+}
+
+// labStatuses lists the accreditation statuses a lab can be moved to and whether a reason is required
+var labStatuses = map[string]bool{
+	"active":    false,
+	"suspended": true,
+	"withdrawn": true,
+}
+
+// RegisterLab records a laboratory's accreditation (only accreditation bodies)
+func (c *HerbalTraceContract) RegisterLab(ctx contractapi.TransactionContextInterface, labJSON string) error {
+	if err := requireRole(ctx, roleAccreditationBody); err != nil {
+		return err
+	}
+
+	var lab Lab
+	err := json.Unmarshal([]byte(labJSON), &lab)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal lab JSON: %v", err)
+	}
+
+	// Validate required fields
+	if lab.ID == "" {
+		return fmt.Errorf("lab ID is required")
+	}
+	if lab.Name == "" {
+		return fmt.Errorf("lab name is required")
+	}
+	if lab.MSPID == "" {
+		return fmt.Errorf("lab MSP ID is required")
+	}
+	if lab.AccreditationBody == "" || lab.AccreditationNumber == "" {
+		return fmt.Errorf("accreditation body and number are required")
+	}
+	err = validateLabAccreditation(&lab)
+	if err != nil {
+		return err
+	}
+
+	// Check if lab already exists
+	existingLab, err := ctx.GetStub().GetState(lab.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if lab exists: %v", err)
+	}
+	if existingLab != nil {
+		return fmt.Errorf("lab with ID %s already exists", lab.ID)
+	}
+
+	registeredBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Set default values
+	lab.Type = "Lab"
+	lab.Status = "active"
+	lab.StatusReason = ""
+	lab.RegisteredBy = registeredBy
+	lab.UpdatedBy = registeredBy
+	lab.CreatedAt = now.Format(time.RFC3339)
+	lab.UpdatedAt = lab.CreatedAt
+
+	err = c.putLab(ctx, &lab)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":           "LabRegistered",
+		"labId":               lab.ID,
+		"mspId":               lab.MSPID,
+		"accreditationNumber": lab.AccreditationNumber,
+		"validUntil":          lab.ValidUntil,
+		"timestamp":           lab.CreatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("LabRegistered", eventBytes)
+
+	return nil
+}
+
+// RenewLabAccreditation replaces a lab's accreditation number, scope and validity after reassessment
+func (c *HerbalTraceContract) RenewLabAccreditation(ctx contractapi.TransactionContextInterface, labID string, accreditationJSON string) error {
+	if err := requireRole(ctx, roleAccreditationBody); err != nil {
+		return err
+	}
+
+	lab, err := c.GetLab(ctx, labID)
+	if err != nil {
+		return err
+	}
+	if lab.Status == "withdrawn" {
+		return fmt.Errorf("lab %s has its accreditation withdrawn and must be registered again", labID)
+	}
+
+	var renewal Lab
+	err = json.Unmarshal([]byte(accreditationJSON), &renewal)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal accreditation JSON: %v", err)
+	}
+	err = validateLabAccreditation(&renewal)
+	if err != nil {
+		return err
+	}
+
+	updatedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	lab.AccreditationNumber = firstNonEmpty(renewal.AccreditationNumber, lab.AccreditationNumber)
+	lab.Scope = renewal.Scope
+	lab.ValidFrom = renewal.ValidFrom
+	lab.ValidUntil = renewal.ValidUntil
+	lab.UpdatedBy = updatedBy
+	lab.UpdatedAt = now.Format(time.RFC3339)
+
+	err = c.putLab(ctx, lab)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":           "LabAccreditationRenewed",
+		"labId":               lab.ID,
+		"accreditationNumber": lab.AccreditationNumber,
+		"validUntil":          lab.ValidUntil,
+		"timestamp":           lab.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("LabAccreditationRenewed", eventBytes)
+
+	return nil
+}
+
+// SetLabStatus suspends, reinstates or withdraws a lab's accreditation. Suspending and withdrawing
+// require a reason; a withdrawn accreditation cannot be reinstated.
+func (c *HerbalTraceContract) SetLabStatus(ctx contractapi.TransactionContextInterface, labID string, status string, reason string) error {
+	if err := requireRole(ctx, roleAccreditationBody); err != nil {
+		return err
+	}
+
+	reasonRequired, valid := labStatuses[status]
+	if !valid {
+		return fmt.Errorf("invalid lab status: %s. Valid statuses: active, suspended, withdrawn", status)
+	}
+	if reasonRequired && reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	lab, err := c.GetLab(ctx, labID)
+	if err != nil {
+		return err
+	}
+	if lab.Status == "withdrawn" {
+		return fmt.Errorf("lab %s has its accreditation withdrawn", labID)
+	}
+	if lab.Status == status {
+		return fmt.Errorf("lab %s is already %s", labID, status)
+	}
+
+	updatedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	oldStatus := lab.Status
+	lab.Status = status
+	lab.StatusReason = reason
+	lab.UpdatedBy = updatedBy
+	lab.UpdatedAt = now.Format(time.RFC3339)
+
+	err = c.putLab(ctx, lab)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "LabStatusChanged",
+		"labId":     lab.ID,
+		"oldStatus": oldStatus,
+		"newStatus": status,
+		"reason":    reason,
+		"timestamp": lab.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("LabStatusChanged", eventBytes)
+
+	return nil
+}
+
+// GetLab retrieves a lab by ID
+func (c *HerbalTraceContract) GetLab(ctx contractapi.TransactionContextInterface, labID string) (*Lab, error) {
+	if labID == "" {
+		return nil, fmt.Errorf("lab ID is required")
+	}
+
+	labBytes, err := ctx.GetStub().GetState(labID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lab from ledger: %v", err)
+	}
+	if labBytes == nil {
+		return nil, fmt.Errorf("lab with ID %s does not exist", labID)
+	}
+
+	var lab Lab
+	err = json.Unmarshal(labBytes, &lab)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lab: %v", err)
+	}
+	if lab.Type != "Lab" {
+		return nil, fmt.Errorf("%s is not a lab", labID)
+	}
+
+	return &lab, nil
+}
+
+var labsQuery = defineQuery("labs",
+	`{"selector":{"type":"Lab"}}`,
+	"type")
+
+// GetAllLabs retrieves every registered lab
+func (c *HerbalTraceContract) GetAllLabs(ctx contractapi.TransactionContextInterface) ([]*Lab, error) {
+	labs := []*Lab{}
+	err := queryRecords(ctx, labsQuery.format(), func(value []byte) error {
+		var lab Lab
+		if json.Unmarshal(value, &lab) == nil {
+			labs = append(labs, &lab)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return labs, nil
+}
+
+// checkLabAccreditation verifies that the caller belongs to the lab's organisation and that the lab
+// is accredited today for every test type
+func (c *HerbalTraceContract) checkLabAccreditation(ctx contractapi.TransactionContextInterface, labID string, testTypes []string) (*Lab, error) {
+	if labID == "" {
+		return nil, fmt.Errorf("lab ID is required")
+	}
+	lab, err := c.GetLab(ctx, labID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, callerMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if callerMSP != lab.MSPID {
+		return nil, fmt.Errorf("results for lab %s can only be recorded by %s", labID, lab.MSPID)
+	}
+	// Labs can share an organisation, so the certificate must also name the lab
+	callerLab, _, err := ctx.GetClientIdentity().GetAttributeValue(labIDAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read caller lab: %v", err)
+	}
+	if callerLab != lab.ID {
+		return nil, fmt.Errorf("results for lab %s can only be recorded by its analysts, caller is from lab %q", labID, callerLab)
+	}
+
+	if lab.Status != "active" {
+		return nil, fmt.Errorf("lab %s accreditation is %s", labID, lab.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	validFrom, err := time.Parse(time.RFC3339, lab.ValidFrom)
+	if err != nil {
+		return nil, fmt.Errorf("lab %s has an invalid valid from date: %v", labID, err)
+	}
+	validUntil, err := time.Parse(time.RFC3339, lab.ValidUntil)
+	if err != nil {
+		return nil, fmt.Errorf("lab %s has an invalid valid until date: %v", labID, err)
+	}
+	if now.Before(validFrom) || now.After(validUntil) {
+		return nil, fmt.Errorf("lab %s accreditation is not valid on %s", labID, now.Format(time.RFC3339))
+	}
+
+	scope := make(map[string]bool)
+	for _, entry := range lab.Scope {
+		scope[entry.TestType] = true
+	}
+	for _, testType := range testTypes {
+		if !scope[testType] {
+			return nil, fmt.Errorf("lab %s is not accredited for %s testing", labID, testType)
+		}
+	}
+
+	return lab, nil
+}
+
+// checkLabMethods verifies that every test type with accredited methods was tested by one of them
+func checkLabMethods(lab *Lab, testTypes []string, methods map[string]string) error {
+	scope := make(map[string][]string)
+	for _, entry := range lab.Scope {
+		scope[entry.TestType] = entry.Methods
+	}
+	for _, testType := range testTypes {
+		accredited := scope[testType]
+		if len(accredited) == 0 {
+			continue
+		}
+		method := methods[testType]
+		if method == "" {
+			return fmt.Errorf("a method is required for %s testing at lab %s", testType, lab.ID)
+		}
+		if !inScope(accredited, method) {
+			return fmt.Errorf("lab %s is not accredited for %s testing by %s", lab.ID, testType, method)
+		}
+	}
+	return nil
+}
+
+// qualityTestTypes returns the test types a quality test declares or reports results for
+func qualityTestTypes(test *QualityTest) []string {
+	types := make(map[string]bool)
+	for _, testType := range test.TestTypes {
+		types[testType] = true
+	}
+	types["moisture"] = types["moisture"] || test.MoistureContent > 0
+	types["pesticide"] = types["pesticide"] || len(test.PesticideResults) > 0
+	types["heavy_metals"] = types["heavy_metals"] || len(test.HeavyMetals) > 0
+	types["dna_barcode"] = types["dna_barcode"] || test.DNASequence != ""
+	types["microbial_load"] = types["microbial_load"] || test.MicrobialLoad > 0
+	types["aflatoxins"] = types["aflatoxins"] || test.Aflatoxins > 0
+
+	var performed []string
+	for _, testType := range sortedKeys(types) {
+		if types[testType] {
+			performed = append(performed, testType)
+		}
+	}
+	return performed
+}
+
+// validateLabAccreditation checks a lab's scope and validity dates
+func validateLabAccreditation(lab *Lab) error {
+	if len(lab.Scope) == 0 {
+		return fmt.Errorf("accreditation scope is required")
+	}
+	seen := make(map[string]bool)
+	for _, entry := range lab.Scope {
+		if !labTestTypes[entry.TestType] {
+			return fmt.Errorf("invalid test type in scope: %s", entry.TestType)
+		}
+		if seen[entry.TestType] {
+			return fmt.Errorf("test type %s appears twice in scope", entry.TestType)
+		}
+		seen[entry.TestType] = true
+	}
+
+	validFrom, err := time.Parse(time.RFC3339, lab.ValidFrom)
+	if err != nil {
+		return fmt.Errorf("invalid valid from date: %v", err)
+	}
+	validUntil, err := time.Parse(time.RFC3339, lab.ValidUntil)
+	if err != nil {
+		return fmt.Errorf("invalid valid until date: %v", err)
+	}
+	if !validUntil.After(validFrom) {
+		return fmt.Errorf("valid until must be after valid from")
+	}
+
+	return nil
+}
+
+// putLab saves a lab to the ledger
+func (c *HerbalTraceContract) putLab(ctx contractapi.TransactionContextInterface, lab *Lab) error {
+	labBytes, err := json.Marshal(lab)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lab: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(lab.ID, labBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save lab to ledger: %v", err)
+	}
+
+	return nil
+}
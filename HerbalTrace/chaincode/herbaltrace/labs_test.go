@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAnalyst = testIdentity{id: "analyst-1", mspID: "TestingLabsMSP", attributes: map[string]string{"role": "lab", labIDAttribute: "LAB-1"}}
+
+// newLabLedger returns a ledger holding two accredited labs of the same organisation
+func newLabLedger(t *testing.T) *testLedger {
+	ledger := newTestLedger()
+	for _, labID := range []string{"LAB-1", "LAB-2"} {
+		ledger.put(t, labID, Lab{
+			ID:         labID,
+			Type:       "Lab",
+			MSPID:      "TestingLabsMSP",
+			Scope:      []LabScope{{TestType: "moisture"}},
+			ValidFrom:  testTime.AddDate(-1, 0, 0).Format(time.RFC3339),
+			ValidUntil: testTime.AddDate(1, 0, 0).Format(time.RFC3339),
+			Status:     "active",
+		})
+	}
+	return ledger
+}
+
+func TestLabResultsRequireTheCallersLab(t *testing.T) {
+	ledger := newLabLedger(t)
+	contract := new(HerbalTraceContract)
+	tx := ledger.begin("record")
+	ctx := tx.context(testAnalyst)
+
+	if _, err := contract.checkLabAccreditation(ctx, "LAB-1", []string{"moisture"}); err != nil {
+		t.Errorf("analyst could not record results for their own lab: %v", err)
+	}
+	if _, err := contract.checkLabAccreditation(ctx, "LAB-2", []string{"moisture"}); err == nil {
+		t.Errorf("analyst recorded results for another lab of their organisation")
+	}
+}
+
+func TestRegulatorRolesRequireTheRegulatorOrganisation(t *testing.T) {
+	ledger := newLabLedger(t)
+	contract := new(HerbalTraceContract)
+	labJSON := `{"id":"LAB-3","name":"Self-accredited lab","mspId":"TestingLabsMSP"}`
+
+	// A lab's own CA can issue any role, including the accreditation body's
+	selfIssued := testIdentity{id: "lab-admin", mspID: "TestingLabsMSP", attributes: map[string]string{"role": roleAccreditationBody}}
+	tx := ledger.begin("self-accredit")
+	if err := contract.RegisterLab(tx.context(selfIssued), labJSON); err == nil || !strings.Contains(err.Error(), regulatorMSP) {
+		t.Errorf("a lab's own accreditation was not refused for its organisation: %v", err)
+	}
+
+	selfIssued.attributes = map[string]string{"role": roleForestAuthority}
+	if err := requireRole(tx.context(selfIssued), roleForestAuthority); err == nil {
+		t.Errorf("a self-issued forest authority role was accepted")
+	}
+
+	regulator := testIdentity{id: "regulator-1", mspID: regulatorMSP, attributes: map[string]string{"role": roleForestAuthority}}
+	if err := requireRole(tx.context(regulator), roleRegistryAdmin, roleForestAuthority); err != nil {
+		t.Errorf("forest authority of the regulator was refused: %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testTime is the timestamp of every simulated transaction
+var testTime = time.Date(2025, time.April, 15, 10, 0, 0, 0, time.UTC)
+
+// testLedger is committed world state with key versions, validated the way a Fabric peer
+// validates transactions: every key read must still have the version it was read at, and
+// every range read must still return the same keys and versions (the phantom read check).
+type testLedger struct {
+	state    map[string][]byte
+	versions map[string]int
+	height   int
+}
+
+func newTestLedger() *testLedger {
+	return &testLedger{state: map[string][]byte{}, versions: map[string]int{}}
+}
+
+// put writes a key directly, as if committed by an earlier block
+func (l *testLedger) put(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("failed to marshal %s: %v", key, err)
+	}
+	l.height++
+	l.state[key] = valueBytes
+	l.versions[key] = l.height
+}
+
+// get unmarshals a committed key into value, failing the test when it is missing
+func (l *testLedger) get(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	valueBytes, found := l.state[key]
+	if !found {
+		t.Fatalf("key %q is not on the ledger", key)
+	}
+	err := json.Unmarshal(valueBytes, value)
+	if err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", key, err)
+	}
+}
+
+// scan returns the committed keys in [start, end), in key order
+func (l *testLedger) scan(start string, end string) []string {
+	var keys []string
+	for key := range l.state {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// testRangeRead is a range read with the versions of the keys it returned
+type testRangeRead struct {
+	start    string
+	end      string
+	versions map[string]int
+}
+
+// testTx is one transaction simulated against the committed state of a testLedger. Like a
+// Fabric peer, it reads committed state only and buffers its writes until commit.
+type testTx struct {
+	*shimtest.MockStub
+	ledger    *testLedger
+	txID      string
+	reads     map[string]int
+	ranges    []testRangeRead
+	queries   []string
+	writes    map[string][]byte
+	writeKeys []string
+	events    map[string][]byte
+}
+
+// begin starts a transaction against the current committed state
+func (l *testLedger) begin(txID string) *testTx {
+	stub := shimtest.NewMockStub("herbaltrace", nil)
+	stub.TxID = txID
+	return &testTx{
+		MockStub: stub,
+		ledger:   l,
+		txID:     txID,
+		reads:    map[string]int{},
+		writes:   map[string][]byte{},
+		events:   map[string][]byte{},
+	}
+}
+
+// commit validates a transaction's read set against the committed state and applies its writes
+func (l *testLedger) commit(tx *testTx) error {
+	for key, version := range tx.reads {
+		if l.versions[key] != version {
+			return fmt.Errorf("MVCC_READ_CONFLICT on %q", key)
+		}
+	}
+	for _, rangeRead := range tx.ranges {
+		keys := l.scan(rangeRead.start, rangeRead.end)
+		if len(keys) != len(rangeRead.versions) {
+			return fmt.Errorf("PHANTOM_READ_CONFLICT on range %q-%q", rangeRead.start, rangeRead.end)
+		}
+		for _, key := range keys {
+			version, found := rangeRead.versions[key]
+			if !found || l.versions[key] != version {
+				return fmt.Errorf("PHANTOM_READ_CONFLICT on range %q-%q", rangeRead.start, rangeRead.end)
+			}
+		}
+	}
+
+	l.height++
+	for _, key := range tx.writeKeys {
+		value := tx.writes[key]
+		if value == nil {
+			delete(l.state, key)
+			delete(l.versions, key)
+			continue
+		}
+		l.state[key] = value
+		l.versions[key] = l.height
+	}
+	return nil
+}
+
+func (tx *testTx) GetTxID() string {
+	return tx.txID
+}
+
+func (tx *testTx) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	return timestamppb.New(testTime), nil
+}
+
+func (tx *testTx) GetState(key string) ([]byte, error) {
+	tx.reads[key] = tx.ledger.versions[key]
+	return tx.ledger.state[key], nil
+}
+
+func (tx *testTx) PutState(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.write(key, value)
+	return nil
+}
+
+func (tx *testTx) DelState(key string) error {
+	tx.write(key, nil)
+	return nil
+}
+
+// PurgePrivateData removes a private key; the mock stub keeps private data per transaction
+func (tx *testTx) PurgePrivateData(collection string, key string) error {
+	delete(tx.PvtState[collection], key)
+	return nil
+}
+
+func (tx *testTx) write(key string, value []byte) {
+	if _, found := tx.writes[key]; !found {
+		tx.writeKeys = append(tx.writeKeys, key)
+	}
+	tx.writes[key] = value
+}
+
+func (tx *testTx) SetEvent(name string, payload []byte) error {
+	tx.events[name] = payload
+	return nil
+}
+
+func (tx *testTx) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return tx.rangeQuery(startKey, endKey), nil
+}
+
+func (tx *testTx) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return tx.rangeQuery(prefix, prefix+string(utf8.MaxRune)), nil
+}
+
+func (tx *testTx) rangeQuery(start string, end string) shim.StateQueryIteratorInterface {
+	rangeRead := testRangeRead{start: start, end: end, versions: map[string]int{}}
+	iterator := &testIterator{}
+	for _, key := range tx.ledger.scan(start, end) {
+		rangeRead.versions[key] = tx.ledger.versions[key]
+		iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: key, Value: tx.ledger.state[key]})
+	}
+	tx.ranges = append(tx.ranges, rangeRead)
+	return iterator
+}
+
+// GetQueryResult matches top-level selector fields by equality or with the $eq, $gt, $gte, $lt
+// and $lte operators, returning documents in key order. Like CouchDB rich queries on a peer,
+// the results are not re-checked at commit.
+func (tx *testTx) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %s: %v", query, err)
+	}
+	tx.queries = append(tx.queries, query)
+
+	iterator := &testIterator{}
+	for _, key := range tx.ledger.scan("", "") {
+		var doc map[string]interface{}
+		if json.Unmarshal(tx.ledger.state[key], &doc) != nil {
+			continue
+		}
+		matches := true
+		for field, condition := range parsed.Selector {
+			operators, isOperator := condition.(map[string]interface{})
+			if !isOperator {
+				operators = map[string]interface{}{"$eq": condition}
+			}
+			for operator, value := range operators {
+				match, err := selectorMatches(doc[field], operator, value)
+				if err != nil {
+					return nil, fmt.Errorf("%v: %s", err, query)
+				}
+				matches = matches && match
+			}
+		}
+		if matches {
+			iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: key, Value: tx.ledger.state[key]})
+		}
+	}
+	return iterator, nil
+}
+
+// selectorMatches applies one selector operator to a document field. Ordering operators
+// compare strings with strings and numbers with numbers; other pairs never match.
+func selectorMatches(field interface{}, operator string, value interface{}) (bool, error) {
+	if operator == "$eq" {
+		return fmt.Sprint(field) == fmt.Sprint(value), nil
+	}
+	var order int
+	switch f := field.(type) {
+	case string:
+		v, ok := value.(string)
+		if !ok {
+			return false, nil
+		}
+		order = strings.Compare(f, v)
+	case float64:
+		v, ok := value.(float64)
+		if !ok {
+			return false, nil
+		}
+		switch {
+		case f < v:
+			order = -1
+		case f > v:
+			order = 1
+		}
+	default:
+		return false, nil
+	}
+	switch operator {
+	case "$gt":
+		return order > 0, nil
+	case "$gte":
+		return order >= 0, nil
+	case "$lt":
+		return order < 0, nil
+	case "$lte":
+		return order <= 0, nil
+	}
+	return false, fmt.Errorf("selector operator %s is not supported", operator)
+}
+
+// GetQueryResultWithPagination returns up to pageSize matches after the bookmark, which is the
+// key of the last document of the previous page. Like CouchDB, a bookmark is returned with every
+// page, including the last one.
+func (tx *testTx) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iterator, err := tx.GetQueryResult(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	page := &testIterator{}
+	for _, kv := range iterator.(*testIterator).kvs {
+		if kv.Key > bookmark && (pageSize <= 0 || len(page.kvs) < int(pageSize)) {
+			page.kvs = append(page.kvs, kv)
+		}
+	}
+	if len(page.kvs) > 0 {
+		bookmark = page.kvs[len(page.kvs)-1].Key
+	}
+	return page, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page.kvs)), Bookmark: bookmark}, nil
+}
+
+// testIterator iterates over a fixed set of key/value pairs
+type testIterator struct {
+	kvs  []*queryresult.KV
+	next int
+}
+
+func (it *testIterator) HasNext() bool {
+	return it.next < len(it.kvs)
+}
+
+func (it *testIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("iterator exhausted")
+	}
+	it.next++
+	return it.kvs[it.next-1], nil
+}
+
+func (it *testIterator) Close() error {
+	return nil
+}
+
+// testIdentity is a submitting client with an MSP and certificate attributes
+type testIdentity struct {
+	id         string
+	mspID      string
+	attributes map[string]string
+}
+
+func (identity testIdentity) GetID() (string, error) {
+	return identity.id, nil
+}
+
+func (identity testIdentity) GetMSPID() (string, error) {
+	return identity.mspID, nil
+}
+
+func (identity testIdentity) GetAttributeValue(name string) (string, bool, error) {
+	value, found := identity.attributes[name]
+	return value, found, nil
+}
+
+func (identity testIdentity) AssertAttributeValue(name string, value string) error {
+	if identity.attributes[name] != value {
+		return fmt.Errorf("attribute %s does not have value %s", name, value)
+	}
+	return nil
+}
+
+func (identity testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// context wraps the transaction for a contract call by the given identity
+func (tx *testTx) context(identity testIdentity) *contractapi.TransactionContext {
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(tx)
+	ctx.SetClientIdentity(identity)
+	return ctx
+}
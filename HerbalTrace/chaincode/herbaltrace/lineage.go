@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// gatherProvenanceRecords fills the supply chain records behind a product. Records are derived
+// from the product's batch; the product's own ID lists are only used where the batch yields
+// nothing, e.g. for products recorded without a batch.
+func (c *HerbalTraceContract) gatherProvenanceRecords(ctx contractapi.TransactionContextInterface, prov *Provenance) {
+	product := &prov.Product
+	completeness := &prov.Completeness
+
+	prov.DerivedFrom = "product"
+	if product.BatchID != "" {
+		var batch Batch
+		if c.resolveProvenanceRecord(ctx, completeness, "Batch", product.BatchID, &batch) {
+			prov.Batch = &batch
+			prov.DerivedFrom = "batch"
+		}
+	}
+	batch := prov.Batch
+
+	// Collection events come from the batch composition
+	eventIDs := product.CollectionEventIDs
+	if batch != nil && len(batch.CollectionEventIDs) > 0 {
+		eventIDs = batch.CollectionEventIDs
+	}
+	if len(eventIDs) == 0 {
+		completeness.addMissing("CollectionEvent", "", "missing", "neither the batch nor the product references any collection events")
+	}
+	for _, eventID := range eventIDs {
+		var event CollectionEvent
+		if c.resolveProvenanceRecord(ctx, completeness, "CollectionEvent", eventID, &event) {
+			redactCollectionEvent(&event)
+			prov.CollectionEvents = append(prov.CollectionEvents, event)
+		}
+	}
+
+	// Quality tests, processing steps and QC certificates recorded against the batch
+	if batch != nil {
+		tests, err := c.queryQualityTestsByBatch(ctx, batch.ID)
+		if err != nil {
+			completeness.addMissing("QualityTest", batch.ID, "query_failed", fmt.Sprintf("failed to query quality tests for batch: %v", err))
+		} else {
+			completeness.addResolved(len(tests))
+			prov.QualityTests = tests
+		}
+
+		steps, err := c.queryProcessingStepsByBatch(ctx, batch.ID)
+		if err != nil {
+			completeness.addMissing("ProcessingStep", batch.ID, "query_failed", fmt.Sprintf("failed to query processing steps for batch: %v", err))
+		} else {
+			completeness.addResolved(len(steps))
+			prov.ProcessingSteps = steps
+		}
+
+		certificates, err := c.QueryCertificatesByBatch(ctx, batch.ID)
+		if err != nil {
+			completeness.addMissing("QCCertificate", batch.ID, "query_failed", fmt.Sprintf("failed to query QC certificates for batch: %v", err))
+		} else {
+			completeness.addResolved(len(certificates))
+			for _, certificate := range certificates {
+				prov.QCCertificates = append(prov.QCCertificates, *certificate)
+			}
+		}
+	}
+
+	// Fall back to the product's explicit lists
+	if len(prov.QualityTests) == 0 {
+		for _, testID := range product.QualityTestIDs {
+			var test QualityTest
+			if c.resolveProvenanceRecord(ctx, completeness, "QualityTest", testID, &test) {
+				prov.QualityTests = append(prov.QualityTests, test)
+			}
+		}
+	}
+	if len(prov.ProcessingSteps) == 0 {
+		for _, stepID := range product.ProcessingStepIDs {
+			var step ProcessingStep
+			if c.resolveProvenanceRecord(ctx, completeness, "ProcessingStep", stepID, &step) {
+				prov.ProcessingSteps = append(prov.ProcessingSteps, step)
+			}
+		}
+	}
+
+	// Alerts raised against any entity in the chain
+	alerts, err := c.queryAlertsForEntities(ctx, provenanceEntityIDs(prov))
+	if err != nil {
+		completeness.addMissing("Alert", product.ID, "query_failed", fmt.Sprintf("failed to query alerts: %v", err))
+	} else {
+		prov.Alerts = alerts
+	}
+}
+
+// provenanceEntityIDs lists the IDs of every record in a provenance bundle
+func provenanceEntityIDs(prov *Provenance) []string {
+	ids := []string{prov.Product.ID}
+	if prov.Batch != nil {
+		ids = append(ids, prov.Batch.ID)
+	}
+	for _, event := range prov.CollectionEvents {
+		ids = append(ids, event.ID)
+	}
+	for _, test := range prov.QualityTests {
+		ids = append(ids, test.ID)
+	}
+	for _, step := range prov.ProcessingSteps {
+		ids = append(ids, step.ID)
+	}
+	for _, certificate := range prov.QCCertificates {
+		ids = append(ids, certificate.ID)
+	}
+	return ids
+}
+
+var alertsForEntitiesQuery = defineQuery("alertsForEntities",
+	`{"selector":{"type":"Alert","entityId":{"$in":%s}}}`,
+	"type", "entityId")
+
+// queryAlertsForEntities retrieves the alerts raised against any of the given entities, newest first
+func (c *HerbalTraceContract) queryAlertsForEntities(ctx contractapi.TransactionContextInterface, entityIDs []string) ([]Alert, error) {
+	entityIDsJSON, err := json.Marshal(entityIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal entity IDs: %v", err)
+	}
+
+	queryString := alertsForEntitiesQuery.format(entityIDsJSON)
+	results, err := c.queryAlerts(ctx, queryString)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := make([]Alert, 0, len(results))
+	for _, alert := range results {
+		alerts = append(alerts, *alert)
+	}
+	sort.SliceStable(alerts, func(i, j int) bool {
+		if alerts[i].Timestamp != alerts[j].Timestamp {
+			return alerts[i].Timestamp > alerts[j].Timestamp
+		}
+		return alerts[i].ID < alerts[j].ID
+	})
+
+	return alerts, nil
+}
+
+// batchRecordObjectType indexes the quality tests, processing steps and QC certificates of a
+// batch, so transactions can list them with a range read instead of a rich query
+const batchRecordObjectType = "batchRecord"
+
+// putBatchRecordIndex records that an entity was recorded against a batch
+func putBatchRecordIndex(ctx contractapi.TransactionContextInterface, batchID string, entityType string, entityID string) error {
+	if batchID == "" {
+		return nil
+	}
+	indexKey, err := ctx.GetStub().CreateCompositeKey(batchRecordObjectType, []string{batchID, entityType, entityID})
+	if err != nil {
+		return fmt.Errorf("failed to create batch record key: %v", err)
+	}
+	err = ctx.GetStub().PutState(indexKey, []byte(entityID))
+	if err != nil {
+		return fmt.Errorf("failed to save batch record index: %v", err)
+	}
+
+	return nil
+}
+
+// batchRecordIDs lists the IDs of the entities of a type indexed against a batch, in key order
+func batchRecordIDs(ctx contractapi.TransactionContextInterface, batchID string, entityType string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(batchRecordObjectType, []string{batchID, entityType})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch record index: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var ids []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate batch record index: %v", err)
+		}
+		ids = append(ids, string(queryResponse.Value))
+	}
+
+	return ids, nil
+}
+
+// IndexBatchRecords adds the batch record index entries for tests, steps and certificates
+// recorded against a batch before the index existed
+func (c *HerbalTraceContract) IndexBatchRecords(ctx contractapi.TransactionContextInterface, batchID string) (int, error) {
+	if err := requireRole(ctx, roleRegistryAdmin); err != nil {
+		return 0, err
+	}
+
+	var refs []ProvenanceRecordDigest
+	tests, err := c.queryQualityTestsByBatch(ctx, batchID)
+	if err != nil {
+		return 0, err
+	}
+	for _, test := range tests {
+		refs = append(refs, ProvenanceRecordDigest{EntityType: "QualityTest", EntityID: test.ID})
+	}
+	steps, err := c.queryProcessingStepsByBatch(ctx, batchID)
+	if err != nil {
+		return 0, err
+	}
+	for _, step := range steps {
+		refs = append(refs, ProvenanceRecordDigest{EntityType: "ProcessingStep", EntityID: step.ID})
+	}
+	certificates, err := c.QueryCertificatesByBatch(ctx, batchID)
+	if err != nil {
+		return 0, err
+	}
+	for _, certificate := range certificates {
+		refs = append(refs, ProvenanceRecordDigest{EntityType: "QCCertificate", EntityID: certificate.ID})
+	}
+
+	for _, ref := range refs {
+		err = putBatchRecordIndex(ctx, batchID, ref.EntityType, ref.EntityID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(refs), nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
@@ -18,16 +19,16 @@ type CollectionEvent struct {
 	ID                string  `json:"id"`
 	Type              string  `json:"type"` // "CollectionEvent"
 	FarmerID          string  `json:"farmerId"`
-	FarmerName        string  `json:"farmerName"`
+	FarmerName        string  `json:"farmerName,omitempty"` // Legacy; now held in CollectionEventPrivateDetails
 	Species           string  `json:"species"`
 	CommonName        string  `json:"commonName"`
 	ScientificName    string  `json:"scientificName"`
 	Quantity          float64 `json:"quantity"`
 	Unit              string  `json:"unit"`
-	Latitude          float64 `json:"latitude"`
+	Latitude          float64 `json:"latitude"` // Coarse; the exact location is in CollectionEventPrivateDetails
 	Longitude         float64 `json:"longitude"`
-	Altitude          float64 `json:"altitude,omitempty"`
-	Accuracy          float64 `json:"accuracy,omitempty"` // GPS accuracy in meters
+	Altitude          float64 `json:"altitude,omitempty"` // Legacy
+	Accuracy          float64 `json:"accuracy,omitempty"` // Legacy
 	HarvestDate       string  `json:"harvestDate"`
 	Timestamp         string  `json:"timestamp"`
 	HarvestMethod     string  `json:"harvestMethod"` // "manual", "mechanical"
@@ -38,9 +39,20 @@ type CollectionEvent struct {
 	ApprovedZone      bool    `json:"approvedZone"`
 	ZoneName          string  `json:"zoneName,omitempty"`
 	ConservationStatus string `json:"conservationStatus,omitempty"` // "Endangered", "Vulnerable", "Least Concern"
-	CertificationIDs  []string `json:"certificationIds,omitempty"` // Organic, Fair Trade, etc.
+	CertificationIDs  []string `json:"certificationIds,omitempty"` // Certification asset IDs held by the farmer
+	PermitID          string  `json:"permitId,omitempty"` // Required for permit-listed threatened species
+	HarvestLimitID    string  `json:"harvestLimitId,omitempty"` // Harvest limit the quantity was booked against
 	Status            string  `json:"status"` // "pending", "verified", "rejected"
 	NextStepID        string  `json:"nextStepId,omitempty"` // Link to quality test or processing
+	VerifiedBy        string  `json:"verifiedBy,omitempty"` // Field verifier or collection centre deciding the event
+	VerificationDate  string  `json:"verificationDate,omitempty"`
+	ReceivedQuantity  float64 `json:"receivedQuantity,omitempty"` // Weighed at the collection centre, in Unit
+	BatchedQuantity   float64 `json:"batchedQuantity,omitempty"` // Drawn into batches so far, in Unit
+	EvidenceNotes     string  `json:"evidenceNotes,omitempty"`
+	RejectionReason   string  `json:"rejectionReason,omitempty"` // Reason code, see collectionRejectionReasons
+	PrivateCollection string  `json:"privateCollection,omitempty"`
+	PrivateDataHashes map[string]string `json:"privateDataHashes,omitempty"` // Salted hash per private field
+	PersonalDataErased bool   `json:"personalDataErased,omitempty"` // Private details purged at the farmer's request
 }
 
 // QualityTest represents laboratory testing results
@@ -54,6 +66,7 @@ type QualityTest struct {
 	TestDate            string            `json:"testDate"`
 	Timestamp           string            `json:"timestamp"`
 	TestTypes           []string          `json:"testTypes"` // "moisture", "pesticide", "dna_barcode", "heavy_metals"
+	TestMethods         map[string]string `json:"testMethods,omitempty"` // test type -> method, e.g. "heavy_metals": "ICP-MS"
 	MoistureContent     float64           `json:"moistureContent,omitempty"`
 	PesticideResults    map[string]string `json:"pesticideResults,omitempty"` // pesticide name -> "pass"/"fail"
 	HeavyMetals         map[string]float64 `json:"heavyMetals,omitempty"` // metal name -> ppm
@@ -68,6 +81,8 @@ type QualityTest struct {
 	TesterSignature     string            `json:"testerSignature,omitempty"`
 	Status              string            `json:"status"` // "pending", "approved", "rejected"
 	NextStepID          string            `json:"nextStepId,omitempty"`
+	PrivateCollection   string            `json:"privateCollection,omitempty"` // Lab pricing, see QualityTestPrivateDetails
+	PrivateDataHashes   map[string]string `json:"privateDataHashes,omitempty"`
 }
 
 // ProcessingStep represents processing/manufacturing steps
@@ -84,8 +99,9 @@ type ProcessingStep struct {
 	InputQuantity     float64           `json:"inputQuantity"`
 	OutputQuantity    float64           `json:"outputQuantity"`
 	Unit              string            `json:"unit"`
-	Temperature       float64           `json:"temperature,omitempty"` // Celsius
-	Duration          float64           `json:"duration,omitempty"` // hours
+	OutputUnit        string            `json:"outputUnit,omitempty"` // Defaults to Unit, e.g. "l" for oil extraction
+	Temperature       float64           `json:"temperature,omitempty"` // Legacy; process parameters are in ProcessingStepPrivateDetails
+	Duration          float64           `json:"duration,omitempty"`
 	Equipment         string            `json:"equipment,omitempty"`
 	Parameters        map[string]string `json:"parameters,omitempty"`
 	QualityChecks     []string          `json:"qualityChecks,omitempty"`
@@ -94,8 +110,11 @@ type ProcessingStep struct {
 	Location          string            `json:"location"`
 	Latitude          float64           `json:"latitude,omitempty"`
 	Longitude         float64           `json:"longitude,omitempty"`
+	TransportMode     string            `json:"transportMode,omitempty"` // How material arrived here: "road", "rail", "sea", "air"
 	Status            string            `json:"status"` // "in_progress", "completed", "failed"
 	NextStepID        string            `json:"nextStepId,omitempty"`
+	PrivateCollection string            `json:"privateCollection,omitempty"`
+	PrivateDataHashes map[string]string `json:"privateDataHashes,omitempty"`
 }
 
 // QCCertificate represents a quality control certificate
@@ -110,11 +129,21 @@ type QCCertificate struct {
 	TestType        string                 `json:"testType"`
 	LabID           string                 `json:"labId"`
 	LabName         string                 `json:"labName"`
-	OverallResult   string                 `json:"overallResult"` // "PASS", "FAIL", "CONDITIONAL"
+	OverallResult   string                 `json:"overallResult"` // "PASS", "FAIL"
 	IssuedDate      string                 `json:"issuedDate"`
 	TestedBy        string                 `json:"testedBy"`
 	Results         []map[string]interface{} `json:"results"`
 	Timestamp       string                 `json:"timestamp"`
+	Version         int                    `json:"version"` // Prior versions are kept, see GetCertificateVersions
+	Status          string                 `json:"status"` // "issued", "amended", "revoked"
+	IssuedBy        string                 `json:"issuedBy"` // Identity that recorded the certificate
+	IssuerMSP       string                 `json:"issuerMsp"`
+	AmendmentReason string                 `json:"amendmentReason,omitempty"`
+	AmendedBy       string                 `json:"amendedBy,omitempty"`
+	AmendedDate     string                 `json:"amendedDate,omitempty"`
+	RevocationReason string                `json:"revocationReason,omitempty"`
+	RevokedBy       string                 `json:"revokedBy,omitempty"`
+	RevokedDate     string                 `json:"revokedDate,omitempty"`
 }
 
 // Product represents the final product with QR code
@@ -135,9 +164,20 @@ type Product struct {
 	CollectionEventIDs []string `json:"collectionEventIds"` // Trace back to origins
 	QualityTestIDs    []string `json:"qualityTestIds"`
 	ProcessingStepIDs []string `json:"processingStepIds"`
-	Certifications    []string `json:"certifications"` // "Organic", "Fair Trade", "AYUSH Certified"
+	GTIN              string   `json:"gtin,omitempty"` // GS1 trade item number, used for EPCIS identifiers
+	Certifications    []string `json:"certifications"` // Certification asset IDs held by the manufacturer
 	PackagingDate     string   `json:"packagingDate"`
-	Status            string   `json:"status"` // "manufactured", "distributed", "sold"
+	SiteName          string   `json:"siteName,omitempty"` // Manufacturing site
+	SiteLatitude      float64  `json:"siteLatitude,omitempty"`
+	SiteLongitude     float64  `json:"siteLongitude,omitempty"`
+	TransportMode     string   `json:"transportMode,omitempty"` // How material arrived at the site
+	ProvenanceDigest  string   `json:"provenanceDigest,omitempty"` // Anchored at creation, see VerifyProvenance
+	ProvenanceRecords []ProvenanceRecordDigest `json:"provenanceRecords,omitempty"`
+	ProvenanceAnchoredAt string `json:"provenanceAnchoredAt,omitempty"`
+	UnitsProduced     int      `json:"unitsProduced,omitempty"` // Packs produced, bounds legitimate QR scans
+	SerialCount       int      `json:"serialCount,omitempty"` // Unit serials issued, see SerializeProduct
+	Status            string   `json:"status"` // "manufactured", "distributed", "sold", "sold_out"
+	SoldOutDate       string   `json:"soldOutDate,omitempty"`
 	Timestamp         string   `json:"timestamp"`
 }
 
@@ -151,23 +191,43 @@ type Provenance struct {
 	QualityTests      []QualityTest      `json:"qualityTests"`
 	ProcessingSteps   []ProcessingStep   `json:"processingSteps"`
 	Product           Product            `json:"product"`
+	Batch             *Batch             `json:"batch,omitempty"`
+	Serial            *ProductSerial     `json:"serial,omitempty"` // Set when looked up by unit serial
+	QCCertificates    []QCCertificate    `json:"qcCertificates,omitempty"`
+	Alerts            []Alert            `json:"alerts,omitempty"` // Alerts raised against any entity in the chain
+	DerivedFrom       string             `json:"derivedFrom"` // "batch" or "product" (explicit ID lists)
+	Certifications    []Certification    `json:"certifications"` // Valid, in-scope certifications only
 	SustainabilityScore float64          `json:"sustainabilityScore"` // 0-100
+	ScoreBreakdown    []ScoreFactor      `json:"scoreBreakdown"`
+	ScoringModelVersion int              `json:"scoringModelVersion"`
 	TotalDistance     float64            `json:"totalDistance,omitempty"` // km traveled
+	RouteMeasured     bool               `json:"routeMeasured,omitempty"` // At least two located points, so a zero distance is real
+	TotalEmissions    float64            `json:"totalEmissionsKgCo2e,omitempty"` // Estimated transport emissions
+	Route             []RouteLeg         `json:"route,omitempty"`
+	Completeness      ProvenanceCompleteness `json:"completeness"` // Missing references and flagged entities
 }
 
 // InitLedger initializes the ledger with sample data
 func (c *HerbalTraceContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
 	log.Println("Initializing HerbalTrace ledger...")
+
+	// Seed the species registry used to normalise collection events
+	err := c.seedSpeciesRegistry(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to seed species registry: %v", err)
+	}
+
 	return nil
 }
 
-// CreateCollectionEvent records a new harvest/collection event with comprehensive validation
+// CreateCollectionEvent records a new harvest/collection event with comprehensive validation.
+// A rejected collection writes nothing, so its violation alert is raised by ReportCollectionViolation.
 func (c *HerbalTraceContract) CreateCollectionEvent(ctx contractapi.TransactionContextInterface, eventJSON string) error {
-	var event CollectionEvent
-	err := json.Unmarshal([]byte(eventJSON), &event)
+	prepared, details, species, err := c.prepareCollectionEvent(ctx, eventJSON)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal event: %v", err)
+		return err
 	}
+	event := *prepared
 
 	// 1. Validate season window
 	isInSeason, err := c.ValidateSeasonWindow(ctx, event.Species, event.HarvestDate, event.ZoneName)
@@ -175,122 +235,53 @@ func (c *HerbalTraceContract) CreateCollectionEvent(ctx contractapi.TransactionC
 		return fmt.Errorf("season validation error: %v", err)
 	}
 	if !isInSeason {
-		// Create season violation alert
-		alertJSON := fmt.Sprintf(`{
-			"id": "alert_season_%s",
-			"alertType": "season_violation",
-			"severity": "high",
-			"entityId": "%s",
-			"entityType": "CollectionEvent",
-			"species": "%s",
-			"zone": "%s",
-			"message": "Harvest outside allowed season window",
-			"details": "Species %s harvested on %s in %s is outside the permitted season window"
-		}`, event.ID, event.ID, event.Species, event.ZoneName, event.Species, event.HarvestDate, event.ZoneName)
-		c.CreateAlert(ctx, alertJSON)
-		
-		event.ApprovedZone = false
-		event.Status = "rejected"
 		return fmt.Errorf("harvest outside allowed season window for species: %s", event.Species)
 	}
 
 	// 2. Validate geo-fencing
 	if !c.validateGeoFencing(event.Latitude, event.Longitude, event.Species) {
-		// Create zone violation alert
-		alertJSON := fmt.Sprintf(`{
-			"id": "alert_zone_%s",
-			"alertType": "zone_violation",
-			"severity": "high",
-			"entityId": "%s",
-			"entityType": "CollectionEvent",
-			"species": "%s",
-			"zone": "%s",
-			"message": "Collection location outside approved zone",
-			"details": "Harvest at coordinates (%.6f, %.6f) is outside approved zone for species %s"
-		}`, event.ID, event.ID, event.Species, event.ZoneName, event.Latitude, event.Longitude, event.Species)
-		c.CreateAlert(ctx, alertJSON)
-		
-		event.ApprovedZone = false
-		event.Status = "rejected"
 		return fmt.Errorf("collection location outside approved zone for species: %s", event.Species)
 	} else {
 		event.ApprovedZone = true
-		if event.Status == "" {
-			event.Status = "pending"
-		}
+		// Events always start pending; only VerifyCollectionEvent can mark them verified
+		event.Status = "pending"
 	}
 
 	// 3. Validate harvest limit (check before tracking)
 	currentSeason := getCurrentSeason()
-	withinLimit, err := c.ValidateHarvestLimit(ctx, event.Species, event.ZoneName, currentSeason, event.Quantity)
+	withinLimit, err := c.ValidateHarvestLimit(ctx, event.Species, event.ZoneName, currentSeason, event.Quantity, event.Unit)
 	if err != nil {
 		return fmt.Errorf("harvest limit validation error: %v", err)
 	}
 	if !withinLimit {
-		// Create over-harvest alert
-		alertJSON := fmt.Sprintf(`{
-			"id": "alert_harvest_%s",
-			"alertType": "over_harvest",
-			"severity": "critical",
-			"entityId": "%s",
-			"entityType": "CollectionEvent",
-			"species": "%s",
-			"zone": "%s",
-			"message": "Harvest limit exceeded",
-			"details": "Attempting to harvest %.2f %s of %s in %s for season %s would exceed the limit"
-		}`, event.ID, event.ID, event.Species, event.ZoneName, event.Quantity, event.Unit, event.Species, event.ZoneName, currentSeason)
-		c.CreateAlert(ctx, alertJSON)
-		
-		event.Status = "rejected"
 		return fmt.Errorf("harvest limit exceeded for species: %s in zone: %s", event.Species, event.ZoneName)
 	}
 
-	// 4. Track harvest quantity (update the limit)
-	err = c.TrackHarvestQuantity(ctx, event.Species, event.ZoneName, currentSeason, event.Quantity)
+	// 4. Track harvest quantity (book delta records against the limit)
+	harvestLimit, _, err := c.trackHarvestQuantity(ctx, event.Species, event.ZoneName, currentSeason, event.Quantity, event.Unit)
 	if err != nil {
 		return fmt.Errorf("failed to track harvest quantity: %v", err)
 	}
 
-	// 5. Check if limit reached warning threshold
-	harvestStats, err := c.GetHarvestStatistics(ctx, event.Species, event.ZoneName, currentSeason)
-	if err == nil && harvestStats.Status == "warning" {
-		// Create warning alert
-		percentageUsed := (harvestStats.CurrentQuantity / harvestStats.MaxQuantity) * 100
-		alertJSON := fmt.Sprintf(`{
-			"id": "alert_warning_%s_%s_%s",
-			"alertType": "over_harvest",
-			"severity": "medium",
-			"entityId": "%s",
-			"entityType": "CollectionEvent",
-			"species": "%s",
-			"zone": "%s",
-			"message": "Harvest limit warning",
-			"details": "%.1f%% of harvest limit reached for %s in %s for season %s (%.2f / %.2f %s)"
-		}`, event.Species, event.ZoneName, currentSeason, event.ID, event.Species, event.ZoneName, 
-			percentageUsed, event.Species, event.ZoneName, currentSeason, 
-			harvestStats.CurrentQuantity, harvestStats.MaxQuantity, harvestStats.Unit)
-		c.CreateAlert(ctx, alertJSON)
+	// 5. The alert threshold is checked over all shards by CheckHarvestThreshold after the
+	// collection commits, so concurrent collections only share the shards they book into
+	if harvestLimit != nil {
+		event.HarvestLimitID = harvestLimit.ID
 	}
 
 	// 6. Validate conservation status
-	if err := c.validateConservationLimits(ctx, event.Species, event.Quantity); err != nil {
-		// Create compliance alert
-		alertJSON := fmt.Sprintf(`{
-			"id": "alert_conservation_%s",
-			"alertType": "compliance",
-			"severity": "high",
-			"entityId": "%s",
-			"entityType": "CollectionEvent",
-			"species": "%s",
-			"zone": "%s",
-			"message": "Conservation limit violation",
-			"details": "Conservation limits exceeded for species: %s"
-		}`, event.ID, event.ID, event.Species, event.ZoneName, event.Species)
-		c.CreateAlert(ctx, alertJSON)
+	if err := c.validateConservationLimits(ctx, &event, species); err != nil {
+		return err
+	}
+
+	// 7. Save collection event, keeping only a coarse location on the public record
+	event.PrivateCollection, event.PrivateDataHashes, err = putPrivateDetails(ctx, "CollectionEvent", event.ID, details)
+	if err != nil {
 		return err
 	}
+	event.Latitude = roundCoordinate(event.Latitude)
+	event.Longitude = roundCoordinate(event.Longitude)
 
-	// 7. Save collection event
 	eventBytes, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event: %v", err)
@@ -301,6 +292,12 @@ func (c *HerbalTraceContract) CreateCollectionEvent(ctx contractapi.TransactionC
 		return fmt.Errorf("failed to save collection event: %v", err)
 	}
 
+	// Alerts never block the record they are raised for
+	err = c.evaluateAlertRules(ctx, "CollectionEvent", "created", &event, nil)
+	if err != nil {
+		log.Printf("Warning: Failed to evaluate alert rules: %v", err)
+	}
+
 	// 8. Emit event
 	eventPayload := map[string]interface{}{
 		"eventType":  "CollectionEventCreated",
@@ -310,6 +307,7 @@ func (c *HerbalTraceContract) CreateCollectionEvent(ctx contractapi.TransactionC
 		"quantity":   event.Quantity,
 		"unit":       event.Unit,
 		"zone":       event.ZoneName,
+		"permitId":   event.PermitID,
 		"status":     event.Status,
 		"timestamp":  event.Timestamp,
 	}
@@ -319,6 +317,83 @@ func (c *HerbalTraceContract) CreateCollectionEvent(ctx contractapi.TransactionC
 	return nil
 }
 
+// prepareCollectionEvent parses a submitted collection, takes its exact location from the transient
+// private data and checks the farmer, species, quantity and certifications
+func (c *HerbalTraceContract) prepareCollectionEvent(ctx contractapi.TransactionContextInterface, eventJSON string) (*CollectionEvent, *CollectionEventPrivateDetails, *Species, error) {
+	var event CollectionEvent
+	err := json.Unmarshal([]byte(eventJSON), &event)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal event: %v", err)
+	}
+	if event.ID == "" {
+		return nil, nil, nil, fmt.Errorf("event ID is required")
+	}
+
+	// The harvester's name and exact location only go to the farmersCoopPrivate collection
+	err = sensitiveFieldError(map[string]bool{
+		"farmerName": event.FarmerName != "",
+		"latitude":   event.Latitude != 0,
+		"longitude":  event.Longitude != 0,
+		"altitude":   event.Altitude != 0,
+		"accuracy":   event.Accuracy != 0,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var details CollectionEventPrivateDetails
+	found, err := readPrivateDetails(ctx, &details)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !found {
+		return nil, nil, nil, fmt.Errorf("harvest location is required in the transient private data")
+	}
+	event.Latitude = details.Latitude
+	event.Longitude = details.Longitude
+
+	// Resubmitting an existing ID would reset its verification decision
+	existingEvent, err := ctx.GetStub().GetState(event.ID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to check if event exists: %v", err)
+	}
+	if existingEvent != nil {
+		return nil, nil, nil, fmt.Errorf("collection event with ID %s already exists", event.ID)
+	}
+	event.Type = "CollectionEvent"
+
+	// Only registered, active farmers can submit collections
+	farmer, err := c.requireActiveFarmer(ctx, event.FarmerID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("farmer validation error: %v", err)
+	}
+	if details.FarmerName == "" {
+		details.FarmerName = farmerName(ctx, farmer)
+	}
+
+	// 0. Normalise species, names and conservation status against the registry
+	species, err := c.applySpeciesRegistry(ctx, &event)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("species validation error: %v", err)
+	}
+	if event.Quantity <= 0 {
+		return nil, nil, nil, fmt.Errorf("quantity must be greater than zero")
+	}
+	event.Quantity, event.Unit, err = canonicalQuantity(event.Quantity, event.Unit)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("quantity validation error: %v", err)
+	}
+
+	// Certifications must be held by the farmer and cover this species and zone at harvest
+	for _, certificationID := range event.CertificationIDs {
+		_, err := c.checkCertification(ctx, certificationID, event.FarmerID, event.Species, event.ZoneName, activityTime(event.HarvestDate))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("certification validation error: %v", err)
+		}
+	}
+
+	return &event, &details, species, nil
+}
+
 // GetCollectionEvent retrieves a collection event by ID
 func (c *HerbalTraceContract) GetCollectionEvent(ctx contractapi.TransactionContextInterface, id string) (*CollectionEvent, error) {
 	eventBytes, err := ctx.GetStub().GetState(id)
@@ -345,23 +420,37 @@ func (c *HerbalTraceContract) CreateQualityTest(ctx contractapi.TransactionConte
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal test: %v", err)
 	}
+	test.Type = "QualityTest"
+
+	// Only the lab's own organisation can record results, and only within its accreditation
+	test.TestTypes = qualityTestTypes(&test)
+	lab, err := c.checkLabAccreditation(ctx, test.LabID, test.TestTypes)
+	if err != nil {
+		return err
+	}
+	err = checkLabMethods(lab, test.TestTypes, test.TestMethods)
+	if err != nil {
+		return err
+	}
+	test.LabName = lab.Name
+
+	// Lab pricing is shared with manufacturers only
+	var details QualityTestPrivateDetails
+	found, err := readPrivateDetails(ctx, &details)
+	if err != nil {
+		return err
+	}
+	if found {
+		test.PrivateCollection, test.PrivateDataHashes, err = putPrivateDetails(ctx, "QualityTest", test.ID, &details)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Validate quality gates
 	if !c.validateQualityGates(test) {
 		test.OverallResult = "fail"
 		test.Status = "rejected"
-		
-		// Create quality failure alert
-		alertJSON := fmt.Sprintf(`{
-			"id": "alert_quality_%s",
-			"alertType": "quality_failure",
-			"severity": "high",
-			"entityId": "%s",
-			"entityType": "QualityTest",
-			"message": "Quality test failed",
-			"details": "Batch %s failed quality testing at lab %s. Overall result: fail"
-		}`, test.ID, test.ID, test.BatchID, test.LabName)
-		c.CreateAlert(ctx, alertJSON)
 	} else {
 		test.OverallResult = "pass"
 		if test.Status == "" {
@@ -379,6 +468,16 @@ func (c *HerbalTraceContract) CreateQualityTest(ctx contractapi.TransactionConte
 	if err != nil {
 		return fmt.Errorf("failed to save quality test: %v", err)
 	}
+	err = putBatchRecordIndex(ctx, test.BatchID, "QualityTest", test.ID)
+	if err != nil {
+		return err
+	}
+
+	// Alerts never block the record they are raised for
+	err = c.evaluateAlertRules(ctx, "QualityTest", "created", &test, nil)
+	if err != nil {
+		log.Printf("Warning: Failed to evaluate alert rules: %v", err)
+	}
 
 	// Auto-update batch status if batch ID is provided
 	if test.BatchID != "" {
@@ -430,11 +529,47 @@ func (c *HerbalTraceContract) CreateProcessingStep(ctx contractapi.TransactionCo
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal step: %v", err)
 	}
+	step.Type = "ProcessingStep"
+
+	if step.BatchID != "" {
+		err = checkQCHold(ctx, step.BatchID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Process parameters are kept in the processorsPrivate collection
+	err = sensitiveFieldError(map[string]bool{
+		"temperature": step.Temperature != 0,
+		"duration":    step.Duration != 0,
+		"equipment":   step.Equipment != "",
+		"parameters":  len(step.Parameters) > 0,
+	})
+	if err != nil {
+		return err
+	}
+	var details ProcessingStepPrivateDetails
+	found, err := readPrivateDetails(ctx, &details)
+	if err != nil {
+		return err
+	}
+	if found {
+		step.PrivateCollection, step.PrivateDataHashes, err = putPrivateDetails(ctx, "ProcessingStep", step.ID, &details)
+		if err != nil {
+			return err
+		}
+	}
 
 	if step.Status == "" {
 		step.Status = "completed"
 	}
 
+	// Normalise quantities and check mass balance
+	err = c.normaliseProcessingQuantities(ctx, &step)
+	if err != nil {
+		return err
+	}
+
 	// Save processing step
 	stepBytes, err := json.Marshal(step)
 	if err != nil {
@@ -445,6 +580,10 @@ func (c *HerbalTraceContract) CreateProcessingStep(ctx contractapi.TransactionCo
 	if err != nil {
 		return fmt.Errorf("failed to save processing step: %v", err)
 	}
+	err = putBatchRecordIndex(ctx, step.BatchID, "ProcessingStep", step.ID)
+	if err != nil {
+		return err
+	}
 
 	// Auto-update batch status if batch ID is provided
 	if step.BatchID != "" {
@@ -470,6 +609,48 @@ func (c *HerbalTraceContract) CreateProcessingStep(ctx contractapi.TransactionCo
 	return nil
 }
 
+// normaliseProcessingQuantities converts step quantities to canonical units and checks that
+// a step neither outputs more than it took in nor takes in more than its batch holds
+func (c *HerbalTraceContract) normaliseProcessingQuantities(ctx contractapi.TransactionContextInterface, step *ProcessingStep) error {
+	if step.InputQuantity < 0 || step.OutputQuantity < 0 {
+		return fmt.Errorf("processing quantities cannot be negative")
+	}
+	if step.OutputUnit == "" {
+		step.OutputUnit = step.Unit
+	}
+	// Steps that record no quantities may leave the units out, but any unit given must be known
+	if step.InputQuantity == 0 && step.OutputQuantity == 0 && step.Unit == "" && step.OutputUnit == "" {
+		return nil
+	}
+
+	var err error
+	step.InputQuantity, step.Unit, err = canonicalQuantity(step.InputQuantity, step.Unit)
+	if err != nil {
+		return fmt.Errorf("invalid input unit: %v", err)
+	}
+	step.OutputQuantity, step.OutputUnit, err = canonicalQuantity(step.OutputQuantity, step.OutputUnit)
+	if err != nil {
+		return fmt.Errorf("invalid output unit: %v", err)
+	}
+
+	// Output can only be compared with input when both measure the same dimension
+	if step.Unit == step.OutputUnit && step.OutputQuantity > step.InputQuantity+harvestEpsilon {
+		return fmt.Errorf("output quantity %.3f %s exceeds input quantity %.3f %s", step.OutputQuantity, step.OutputUnit, step.InputQuantity, step.Unit)
+	}
+
+	if step.BatchID != "" {
+		batch, err := c.GetBatch(ctx, step.BatchID)
+		if err == nil && sameDimension(batch.Unit, step.Unit) {
+			batchQuantity, err := convertQuantity(batch.TotalQuantity, batch.Unit, step.Unit)
+			if err == nil && step.InputQuantity > batchQuantity+harvestEpsilon {
+				return fmt.Errorf("input quantity %.3f %s exceeds batch %s quantity %.3f %s", step.InputQuantity, step.Unit, batch.ID, batchQuantity, step.Unit)
+			}
+		}
+	}
+
+	return nil
+}
+
 // GetProcessingStep retrieves a processing step by ID
 func (c *HerbalTraceContract) GetProcessingStep(ctx contractapi.TransactionContextInterface, id string) (*ProcessingStep, error) {
 	stepBytes, err := ctx.GetStub().GetState(id)
@@ -489,55 +670,58 @@ func (c *HerbalTraceContract) GetProcessingStep(ctx contractapi.TransactionConte
 	return &step, nil
 }
 
-// RecordQCCertificate records a quality control certificate on the blockchain
-func (c *HerbalTraceContract) RecordQCCertificate(ctx contractapi.TransactionContextInterface, 
-	certificateId string, testId string, batchId string, batchNumber string,
-	speciesName string, testType string, labId string, labName string,
-	overallResult string, issuedDate string, testedBy string, resultsJSON string) error {
-	
-	// Parse results
-	var results []map[string]interface{}
-	if resultsJSON != "" {
-		err := json.Unmarshal([]byte(resultsJSON), &results)
-		if err != nil {
-			log.Printf("Warning: Failed to unmarshal results: %v", err)
-			results = []map[string]interface{}{}
-		}
+// RecordQCCertificate records a quality control certificate for a quality test on the blockchain.
+// The certificate must agree with the test it cites and cannot overwrite an existing certificate.
+func (c *HerbalTraceContract) RecordQCCertificate(ctx contractapi.TransactionContextInterface, certificateJSON string) error {
+	var certificate QCCertificate
+	err := json.Unmarshal([]byte(certificateJSON), &certificate)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal certificate: %v", err)
+	}
+	if certificate.ID == "" {
+		certificate.ID = certificate.CertificateID
+	}
+	if certificate.ID == "" {
+		return fmt.Errorf("certificate ID is required")
+	}
+
+	// Check if certificate already exists
+	existingCertificate, err := ctx.GetStub().GetState(certificate.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if certificate exists: %v", err)
+	}
+	if existingCertificate != nil {
+		return fmt.Errorf("certificate with ID %s already exists, use AmendCertificate to correct it", certificate.ID)
 	}
 
-	// Create certificate object
-	certificate := QCCertificate{
-		ID:            certificateId,
-		Type:          "QCCertificate",
-		CertificateID: certificateId,
-		TestID:        testId,
-		BatchID:       batchId,
-		BatchNumber:   batchNumber,
-		SpeciesName:   speciesName,
-		TestType:      testType,
-		LabID:         labId,
-		LabName:       labName,
-		OverallResult: overallResult,
-		IssuedDate:    issuedDate,
-		TestedBy:      testedBy,
-		Results:       results,
-		Timestamp:     issuedDate,
+	err = c.validateQCCertificate(ctx, &certificate)
+	if err != nil {
+		return err
 	}
 
-	// Save certificate
-	certBytes, err := json.Marshal(certificate)
+	issuedBy, issuerMSP, err := getCallerIdentity(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal certificate: %v", err)
+		return err
 	}
 
-	err = ctx.GetStub().PutState(certificateId, certBytes)
+	// Set default values
+	certificate.Type = "QCCertificate"
+	certificate.CertificateID = certificate.ID
+	certificate.Version = 1
+	certificate.Status = "issued"
+	certificate.IssuedBy = issuedBy
+	certificate.IssuerMSP = issuerMSP
+	certificate.Timestamp = time.Now().Format(time.RFC3339)
+
+	err = putQCCertificate(ctx, &certificate)
 	if err != nil {
-		return fmt.Errorf("failed to save certificate: %v", err)
+		return err
 	}
 
-	// Update batch status if applicable
-	if batchId != "" {
-		err = c.UpdateBatchStatus(ctx, batchId, "quality_tested")
+	// Update batch status if applicable. A passing certificate also releases a hold left by a
+	// revoked one, in the same write as the status.
+	if certificate.BatchID != "" {
+		err = c.updateBatchStatus(ctx, certificate.BatchID, "quality_tested", certificate.OverallResult == "PASS")
 		if err != nil {
 			log.Printf("Warning: Failed to update batch status: %v", err)
 		}
@@ -546,17 +730,17 @@ func (c *HerbalTraceContract) RecordQCCertificate(ctx contractapi.TransactionCon
 	// Emit event
 	eventPayload := map[string]interface{}{
 		"eventType":     "QCCertificateRecorded",
-		"certificateId": certificateId,
-		"testId":        testId,
-		"batchId":       batchId,
-		"labId":         labId,
-		"overallResult": overallResult,
-		"timestamp":     issuedDate,
+		"certificateId": certificate.ID,
+		"testId":        certificate.TestID,
+		"batchId":       certificate.BatchID,
+		"labId":         certificate.LabID,
+		"overallResult": certificate.OverallResult,
+		"timestamp":     certificate.Timestamp,
 	}
 	eventPayloadBytes, _ := json.Marshal(eventPayload)
 	ctx.GetStub().SetEvent("QCCertificateRecorded", eventPayloadBytes)
 
-	log.Printf("QC Certificate recorded: %s for batch %s (result: %s)", certificateId, batchId, overallResult)
+	log.Printf("QC Certificate recorded: %s for batch %s (result: %s)", certificate.ID, certificate.BatchID, certificate.OverallResult)
 	return nil
 }
 
@@ -575,13 +759,20 @@ func (c *HerbalTraceContract) QueryQCCertificate(ctx contractapi.TransactionCont
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal certificate: %v", err)
 	}
+	if certificate.Type != "QCCertificate" {
+		return nil, fmt.Errorf("%s is not a QC certificate", certificateId)
+	}
 
 	return &certificate, nil
 }
 
+var certificatesByBatchQuery = defineQuery("certificatesByBatch",
+	`{"selector":{"type":"QCCertificate","batchId":"%s"}}`,
+	"type", "batchId")
+
 // QueryCertificatesByBatch retrieves all certificates for a specific batch
 func (c *HerbalTraceContract) QueryCertificatesByBatch(ctx contractapi.TransactionContextInterface, batchId string) ([]*QCCertificate, error) {
-	queryString := fmt.Sprintf(`{"selector":{"type":"QCCertificate","batchId":"%s"}}`, batchId)
+	queryString := certificatesByBatchQuery.format(batchId)
 	
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
@@ -639,9 +830,13 @@ func (c *HerbalTraceContract) GetCertificateHistory(ctx contractapi.TransactionC
 	return history, nil
 }
 
+var certificatesQuery = defineQuery("certificates",
+	`{"selector":{"type":"QCCertificate"}}`,
+	"type")
+
 // GetAllCertificates retrieves all certificates with pagination
 func (c *HerbalTraceContract) GetAllCertificates(ctx contractapi.TransactionContextInterface, pageSize int, bookmark string) (map[string]interface{}, error) {
-	queryString := `{"selector":{"type":"QCCertificate"}}`
+	queryString := certificatesQuery.format()
 	
 	resultsIterator, responseMetadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, int32(pageSize), bookmark)
 	if err != nil {
@@ -680,11 +875,48 @@ func (c *HerbalTraceContract) CreateProduct(ctx contractapi.TransactionContextIn
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal product: %v", err)
 	}
+	product.Type = "Product"
+
+	err = requireMSP(ctx, "ManufacturersMSP")
+	if err != nil {
+		return err
+	}
+
+	// Check if product already exists
+	existingProduct, err := ctx.GetStub().GetState(product.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if product exists: %v", err)
+	}
+	if existingProduct != nil {
+		return fmt.Errorf("product with ID %s already exists", product.ID)
+	}
+
+	if product.BatchID != "" {
+		err = checkQCHold(ctx, product.BatchID)
+		if err != nil {
+			return err
+		}
+	}
 
 	if product.Status == "" {
 		product.Status = "manufactured"
 	}
 
+	// Certifications must be held by the manufacturer and cover the batch species
+	species, speciesErr := c.productSpecies(ctx, &product)
+	for _, certificationID := range product.Certifications {
+		_, err := c.checkProductCertification(ctx, certificationID, &product, species, speciesErr)
+		if err != nil {
+			return fmt.Errorf("certification validation error: %v", err)
+		}
+	}
+
+	// Anchor a digest of the upstream records so later changes can be detected
+	err = c.anchorProvenanceDigest(ctx, &product)
+	if err != nil {
+		return err
+	}
+
 	// Save product
 	productBytes, err := json.Marshal(product)
 	if err != nil {
@@ -712,6 +944,7 @@ func (c *HerbalTraceContract) CreateProduct(ctx contractapi.TransactionContextIn
 		"qrCode":         product.QRCode,
 		"manufacturerId": product.ManufacturerID,
 		"status":         product.Status,
+		"provenanceDigest": product.ProvenanceDigest,
 		"timestamp":      product.ManufactureDate,
 	}
 	eventPayloadBytes, _ := json.Marshal(eventPayload)
@@ -739,9 +972,13 @@ func (c *HerbalTraceContract) GetProduct(ctx contractapi.TransactionContextInter
 	return &product, nil
 }
 
+var productsByQRCodeQuery = defineQuery("productsByQRCode",
+	`{"selector":{"type":"Product","qrCode":"%s"}}`,
+	"type", "qrCode")
+
 // GetProductByQRCode retrieves a product by QR code (for consumer scanning)
 func (c *HerbalTraceContract) GetProductByQRCode(ctx contractapi.TransactionContextInterface, qrCode string) (*Product, error) {
-	queryString := fmt.Sprintf(`{"selector":{"type":"Product","qrCode":"%s"}}`, qrCode)
+	queryString := productsByQRCodeQuery.format(qrCode)
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query product: %v", err)
@@ -766,6 +1003,62 @@ func (c *HerbalTraceContract) GetProductByQRCode(ctx contractapi.TransactionCont
 	return &product, nil
 }
 
+// UpdateProductStatus moves a product through distribution; "sold_out" marks the last pack sold
+func (c *HerbalTraceContract) UpdateProductStatus(ctx contractapi.TransactionContextInterface, productID string, newStatus string) error {
+	validStatuses := map[string]bool{
+		"manufactured": true,
+		"distributed":  true,
+		"sold":         true,
+		"sold_out":     true,
+	}
+	if !validStatuses[newStatus] {
+		return fmt.Errorf("invalid status: %s. Valid statuses: manufactured, distributed, sold, sold_out", newStatus)
+	}
+
+	err := requireMSP(ctx, "ManufacturersMSP")
+	if err != nil {
+		return err
+	}
+
+	product, err := c.GetProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	oldStatus := product.Status
+	product.Status = newStatus
+	product.Timestamp = time.Now().Format(time.RFC3339)
+	if newStatus == "sold_out" {
+		product.SoldOutDate = product.Timestamp
+	} else {
+		product.SoldOutDate = ""
+	}
+
+	productBytes, err := json.Marshal(product)
+	if err != nil {
+		return fmt.Errorf("failed to marshal product: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(product.ID, productBytes)
+	if err != nil {
+		return fmt.Errorf("failed to update product: %v", err)
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "ProductStatusUpdated",
+		"productId": product.ID,
+		"qrCode":    product.QRCode,
+		"oldStatus": oldStatus,
+		"newStatus": newStatus,
+		"timestamp": product.Timestamp,
+	}
+	eventPayloadBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("ProductStatusUpdated", eventPayloadBytes)
+
+	return nil
+}
+
 // GenerateProvenance creates a complete FHIR-style provenance bundle
 func (c *HerbalTraceContract) GenerateProvenance(ctx contractapi.TransactionContextInterface, productID string) (*Provenance, error) {
 	// Get the product
@@ -778,35 +1071,28 @@ func (c *HerbalTraceContract) GenerateProvenance(ctx contractapi.TransactionCont
 		ID:        "PROV-" + productID,
 		ProductID: productID,
 		QRCode:    product.QRCode,
+		GeneratedDate: time.Now().Format(time.RFC3339),
 		Product:   *product,
 	}
 
-	// Gather all collection events
-	for _, eventID := range product.CollectionEventIDs {
-		event, err := c.GetCollectionEvent(ctx, eventID)
-		if err == nil {
-			provenance.CollectionEvents = append(provenance.CollectionEvents, *event)
-		}
-	}
+	// Gather the supply chain records, deriving them from the product's batch
+	c.gatherProvenanceRecords(ctx, provenance)
+	checkProvenanceCompleteness(provenance)
 
-	// Gather all quality tests
-	for _, testID := range product.QualityTestIDs {
-		test, err := c.GetQualityTest(ctx, testID)
-		if err == nil {
-			provenance.QualityTests = append(provenance.QualityTests, *test)
-		}
+	// Trace the physical route and estimate transport emissions
+	err = c.buildRoute(ctx, provenance)
+	if err != nil {
+		return nil, err
 	}
 
-	// Gather all processing steps
-	for _, stepID := range product.ProcessingStepIDs {
-		step, err := c.GetProcessingStep(ctx, stepID)
-		if err == nil {
-			provenance.ProcessingSteps = append(provenance.ProcessingSteps, *step)
-		}
-	}
+	// Gather certifications that are still valid and in scope
+	provenance.Certifications = c.provenanceCertifications(ctx, provenance)
 
-	// Calculate sustainability score (simplified)
-	provenance.SustainabilityScore = c.calculateSustainabilityScore(provenance)
+	// Calculate sustainability score with the configured scoring model
+	err = c.calculateSustainabilityScore(ctx, provenance)
+	if err != nil {
+		return nil, err
+	}
 
 	return provenance, nil
 }
@@ -821,15 +1107,33 @@ func (c *HerbalTraceContract) GetProvenanceByQRCode(ctx contractapi.TransactionC
 	return c.GenerateProvenance(ctx, product.ID)
 }
 
+var collectionEventsByFarmerQuery = defineQuery("collectionEventsByFarmer",
+	`{"selector":{"type":"CollectionEvent","farmerId":"%s"}}`,
+	"type", "farmerId")
+
 // QueryCollectionsByFarmer queries collection events by farmer ID
 func (c *HerbalTraceContract) QueryCollectionsByFarmer(ctx contractapi.TransactionContextInterface, farmerID string) ([]*CollectionEvent, error) {
-	queryString := fmt.Sprintf(`{"selector":{"type":"CollectionEvent","farmerId":"%s"}}`, farmerID)
+	queryString := collectionEventsByFarmerQuery.format(farmerID)
+	return c.queryCollectionEvents(ctx, queryString)
+}
+
+var collectionEventsByStatusQuery = defineQuery("collectionEventsByStatus",
+	`{"selector":{"type":"CollectionEvent","status":"%s"}}`,
+	"type", "status")
+
+// QueryCollectionsByStatus queries collection events by verification status
+func (c *HerbalTraceContract) QueryCollectionsByStatus(ctx contractapi.TransactionContextInterface, status string) ([]*CollectionEvent, error) {
+	queryString := collectionEventsByStatusQuery.format(status)
 	return c.queryCollectionEvents(ctx, queryString)
 }
 
+var collectionEventsBySpeciesQuery = defineQuery("collectionEventsBySpecies",
+	`{"selector":{"type":"CollectionEvent","species":"%s"}}`,
+	"type", "species")
+
 // QueryCollectionsBySpecies queries collection events by species
 func (c *HerbalTraceContract) QueryCollectionsBySpecies(ctx contractapi.TransactionContextInterface, species string) ([]*CollectionEvent, error) {
-	queryString := fmt.Sprintf(`{"selector":{"type":"CollectionEvent","species":"%s"}}`, species)
+	queryString := collectionEventsBySpeciesQuery.format(species)
 	return c.queryCollectionEvents(ctx, queryString)
 }
 
@@ -866,9 +1170,9 @@ func (c *HerbalTraceContract) validateGeoFencing(lat, lon float64, species strin
 		return false
 	}
 	
-	// Define approved zones for specific species
+	// Define approved zones for specific species (registry scientific names)
 	// Neem zone: Greater Noida area (30.268804, 77.993259) with 50km radius
-	if species == "Neem" {
+	if species == "Azadirachta indica" {
 		neemLat := 30.268804
 		neemLon := 77.993259
 		radius := 0.5 // ~50km in degrees (approximate)
@@ -884,12 +1188,12 @@ func (c *HerbalTraceContract) validateGeoFencing(lat, lon float64, species strin
 	}
 	
 	// Ashwagandha zone: Keep existing zone (allow all for now)
-	if species == "Ashwagandha" {
+	if species == "Withania somnifera" {
 		return true
 	}
 	
 	// Tulsi, Brahmi: Year-round herbs, allow all locations
-	if species == "Tulsi" || species == "Brahmi" {
+	if species == "Ocimum tenuiflorum" || species == "Bacopa monnieri" {
 		return true
 	}
 	
@@ -897,22 +1201,18 @@ func (c *HerbalTraceContract) validateGeoFencing(lat, lon float64, species strin
 	return true
 }
 
-// validateConservationLimits checks species conservation limits
-func (c *HerbalTraceContract) validateConservationLimits(ctx contractapi.TransactionContextInterface, species string, quantity float64) error {
-	// Simplified validation - in production, check against conservation database
-	// and accumulated harvest quantities per season
-	
-	// Example: Block endangered species harvest
-	endangeredSpecies := map[string]bool{
-		"Aconitum heterophyllum": true,
-		"Nardostachys jatamansi": true,
-		"Picrorhiza kurroa":      true,
+// validateConservationLimits checks species conservation limits. Species the registry
+// marks as permit-required are only accepted against a valid permit, which is drawn down here.
+func (c *HerbalTraceContract) validateConservationLimits(ctx contractapi.TransactionContextInterface, event *CollectionEvent, species *Species) error {
+	if !species.PermitRequired {
+		return nil
 	}
-	
-	if endangeredSpecies[species] {
-		return fmt.Errorf("species %s is endangered and requires special permit", species)
+
+	_, err := c.drawDownPermit(ctx, event)
+	if err != nil {
+		return fmt.Errorf("species %s is endangered and requires a valid permit: %v", event.Species, err)
 	}
-	
+
 	return nil
 }
 
@@ -954,36 +1254,17 @@ func (c *HerbalTraceContract) validateQualityGates(test QualityTest) bool {
 	return true
 }
 
-// calculateSustainabilityScore calculates a sustainability score (0-100)
-func (c *HerbalTraceContract) calculateSustainabilityScore(prov *Provenance) float64 {
-	score := 100.0
-
-	// Deduct points for non-approved zones
-	for _, event := range prov.CollectionEvents {
-		if !event.ApprovedZone {
-			score -= 10.0
-		}
-	}
-
-	// Deduct points for failed quality tests
-	for _, test := range prov.QualityTests {
-		if test.OverallResult == "fail" {
-			score -= 15.0
-		}
+// calculateSustainabilityScore calculates a sustainability score (0-100) and its per-factor breakdown
+func (c *HerbalTraceContract) calculateSustainabilityScore(ctx contractapi.TransactionContextInterface, prov *Provenance) error {
+	model, err := c.GetScoringModel(ctx)
+	if err != nil {
+		return err
 	}
 
-	// Add points for certifications
-	certificationBonus := float64(len(prov.Product.Certifications)) * 5.0
-	score += certificationBonus
-
-	if score < 0 {
-		score = 0
-	}
-	if score > 100 {
-		score = 100
-	}
+	prov.SustainabilityScore, prov.ScoreBreakdown = c.scoreProvenance(ctx, model, prov)
+	prov.ScoringModelVersion = model.Version
 
-	return score
+	return nil
 }
 
 func main() {
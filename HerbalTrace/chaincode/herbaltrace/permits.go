@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Permit represents a forest authority permit to harvest a threatened species
+type Permit struct {
+	ID           string  `json:"id"`
+	Type         string  `json:"type"`                 // "Permit"
+	HolderID     string  `json:"holderId"`             // Farmer ID allowed to collect under the permit
+	HolderName   string  `json:"holderName,omitempty"` // Legacy; new permits keep it in PermitPrivateDetails
+	Species      string  `json:"species"`
+	Zone         string  `json:"zone"`
+	MaxQuantity  float64 `json:"maxQuantity"`
+	UsedQuantity float64 `json:"usedQuantity"`
+	Unit         string  `json:"unit"`
+	ValidFrom    string  `json:"validFrom"`
+	ValidUntil   string  `json:"validUntil"`
+	Status       string  `json:"status"` // "active", "exhausted", "revoked"
+	IssuedBy     string  `json:"issuedBy"`
+	IssuerMSP    string  `json:"issuerMsp"`
+	RevokedBy    string  `json:"revokedBy,omitempty"`
+	RevokedDate  string  `json:"revokedDate,omitempty"`
+	RevokeReason string  `json:"revokeReason,omitempty"`
+	CreatedAt    string  `json:"createdAt"`
+	UpdatedAt    string  `json:"updatedAt"`
+
+	PrivateCollection string            `json:"privateCollection,omitempty"` // Holds PermitPrivateDetails
+	PrivateDataHashes map[string]string `json:"privateDataHashes,omitempty"`
+}
+
+// IssuePermit issues a harvest permit for a threatened species (forest authority only). The holder's
+// name is passed in the transient map under "privateData" and kept in the farmersCoopPrivate collection.
+func (c *HerbalTraceContract) IssuePermit(ctx contractapi.TransactionContextInterface, permitJSON string) error {
+	if err := requireRole(ctx, roleForestAuthority); err != nil {
+		return err
+	}
+
+	var permit Permit
+	err := json.Unmarshal([]byte(permitJSON), &permit)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal permit JSON: %v", err)
+	}
+
+	// Validate required fields
+	if permit.ID == "" {
+		return fmt.Errorf("permit ID is required")
+	}
+	if permit.HolderID == "" {
+		return fmt.Errorf("holder ID is required")
+	}
+	if err := sensitiveFieldError(map[string]bool{"holderName": permit.HolderName != ""}); err != nil {
+		return err
+	}
+	var details PermitPrivateDetails
+	found, err := readPrivateDetails(ctx, &details)
+	if err != nil {
+		return err
+	}
+	if permit.Species == "" {
+		return fmt.Errorf("species is required")
+	}
+	species, err := c.resolveActiveSpecies(ctx, permit.Species)
+	if err != nil {
+		return err
+	}
+	permit.Species = species.ScientificName
+	if permit.Zone == "" {
+		return fmt.Errorf("zone is required")
+	}
+	if permit.MaxQuantity <= 0 {
+		return fmt.Errorf("max quantity must be greater than zero")
+	}
+	if permit.Unit == "" {
+		return fmt.Errorf("unit is required")
+	}
+	permit.MaxQuantity, permit.Unit, err = canonicalQuantity(permit.MaxQuantity, permit.Unit)
+	if err != nil {
+		return err
+	}
+	validFrom, err := time.Parse(time.RFC3339, permit.ValidFrom)
+	if err != nil {
+		return fmt.Errorf("invalid valid from date: %v", err)
+	}
+	validUntil, err := time.Parse(time.RFC3339, permit.ValidUntil)
+	if err != nil {
+		return fmt.Errorf("invalid valid until date: %v", err)
+	}
+	if !validUntil.After(validFrom) {
+		return fmt.Errorf("valid until must be after valid from")
+	}
+
+	// Check if permit already exists
+	existingPermit, err := ctx.GetStub().GetState(permit.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if permit exists: %v", err)
+	}
+	if existingPermit != nil {
+		return fmt.Errorf("permit with ID %s already exists", permit.ID)
+	}
+
+	issuerID, issuerMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Set default values
+	permit.Type = "Permit"
+	permit.UsedQuantity = 0
+	permit.Status = "active"
+	permit.IssuedBy = issuerID
+	permit.IssuerMSP = issuerMSP
+	permit.CreatedAt = time.Now().Format(time.RFC3339)
+	permit.UpdatedAt = permit.CreatedAt
+
+	if found {
+		permit.PrivateCollection, permit.PrivateDataHashes, err = putPrivateDetails(ctx, "Permit", permit.ID, &details)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.putPermit(ctx, &permit)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":   "PermitIssued",
+		"permitId":    permit.ID,
+		"holderId":    permit.HolderID,
+		"species":     permit.Species,
+		"zone":        permit.Zone,
+		"maxQuantity": permit.MaxQuantity,
+		"unit":        permit.Unit,
+		"validUntil":  permit.ValidUntil,
+		"timestamp":   permit.CreatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("PermitIssued", eventBytes)
+
+	return nil
+}
+
+// GetPermit retrieves a permit by ID
+func (c *HerbalTraceContract) GetPermit(ctx contractapi.TransactionContextInterface, permitID string) (*Permit, error) {
+	if permitID == "" {
+		return nil, fmt.Errorf("permit ID is required")
+	}
+
+	permitBytes, err := ctx.GetStub().GetState(permitID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read permit from ledger: %v", err)
+	}
+	if permitBytes == nil {
+		return nil, fmt.Errorf("permit with ID %s does not exist", permitID)
+	}
+
+	var permit Permit
+	err = json.Unmarshal(permitBytes, &permit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal permit: %v", err)
+	}
+	if permit.Type != "Permit" {
+		return nil, fmt.Errorf("%s is not a permit", permitID)
+	}
+
+	return &permit, nil
+}
+
+// RevokePermit revokes an active permit (forest authority only)
+func (c *HerbalTraceContract) RevokePermit(ctx contractapi.TransactionContextInterface, permitID string, reason string) error {
+	if err := requireRole(ctx, roleForestAuthority); err != nil {
+		return err
+	}
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	permit, err := c.GetPermit(ctx, permitID)
+	if err != nil {
+		return err
+	}
+	if permit.Status == "revoked" {
+		return fmt.Errorf("permit %s is already revoked", permitID)
+	}
+
+	revokedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	permit.Status = "revoked"
+	permit.RevokedBy = revokedBy
+	permit.RevokedDate = time.Now().Format(time.RFC3339)
+	permit.RevokeReason = reason
+	permit.UpdatedAt = permit.RevokedDate
+
+	err = c.putPermit(ctx, permit)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "PermitRevoked",
+		"permitId":  permitID,
+		"revokedBy": revokedBy,
+		"reason":    reason,
+		"timestamp": permit.RevokedDate,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("PermitRevoked", eventBytes)
+
+	return nil
+}
+
+var permitsByHolderQuery = defineQuery("permitsByHolder",
+	`{"selector":{"type":"Permit","holderId":"%s"}}`,
+	"type", "holderId")
+
+// QueryPermitsByHolder retrieves all permits issued to a farmer
+func (c *HerbalTraceContract) QueryPermitsByHolder(ctx contractapi.TransactionContextInterface, holderID string) ([]*Permit, error) {
+	if holderID == "" {
+		return nil, fmt.Errorf("holder ID is required")
+	}
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(permitsByHolderQuery.format(holderID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permits: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var permits []*Permit
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate query results: %v", err)
+		}
+
+		var permit Permit
+		err = json.Unmarshal(queryResponse.Value, &permit)
+		if err != nil {
+			continue
+		}
+		permits = append(permits, &permit)
+	}
+
+	return permits, nil
+}
+
+// drawDownPermit checks that a permit covers a collection and deducts its quantity.
+// The permit is read and written in the same transaction, so two collections racing
+// for the last of a permit's quantity cannot both commit.
+func (c *HerbalTraceContract) drawDownPermit(ctx contractapi.TransactionContextInterface, event *CollectionEvent) (*Permit, error) {
+	permit, quantity, err := c.checkPermit(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	permit.UsedQuantity += quantity
+	if permit.MaxQuantity-permit.UsedQuantity <= harvestEpsilon {
+		permit.Status = "exhausted"
+	}
+	permit.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	err = c.putPermit(ctx, permit)
+	if err != nil {
+		return nil, err
+	}
+
+	return permit, nil
+}
+
+// checkPermit checks that a permit covers a collection without drawing it down, and returns
+// the collection quantity in the permit's unit
+func (c *HerbalTraceContract) checkPermit(ctx contractapi.TransactionContextInterface, event *CollectionEvent) (*Permit, float64, error) {
+	if event.PermitID == "" {
+		return nil, 0, fmt.Errorf("species %s requires a harvest permit", event.Species)
+	}
+
+	permit, err := c.GetPermit(ctx, event.PermitID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if permit.Status != "active" {
+		return nil, 0, fmt.Errorf("permit %s is %s", permit.ID, permit.Status)
+	}
+	if permit.HolderID != event.FarmerID {
+		return nil, 0, fmt.Errorf("permit %s is not held by farmer %s", permit.ID, event.FarmerID)
+	}
+	if permit.Species != event.Species {
+		return nil, 0, fmt.Errorf("permit %s does not cover species %s", permit.ID, event.Species)
+	}
+	if permit.Zone != event.ZoneName {
+		return nil, 0, fmt.Errorf("permit %s does not cover zone %s", permit.ID, event.ZoneName)
+	}
+
+	// Both the harvest date and the submission must fall inside the validity period,
+	// so an expired permit cannot be used by backdating the harvest
+	validFrom, err := time.Parse(time.RFC3339, permit.ValidFrom)
+	if err != nil {
+		return nil, 0, fmt.Errorf("permit %s has an invalid valid from date: %v", permit.ID, err)
+	}
+	validUntil, err := time.Parse(time.RFC3339, permit.ValidUntil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("permit %s has an invalid valid until date: %v", permit.ID, err)
+	}
+	harvestDate, err := time.Parse(time.RFC3339, event.HarvestDate)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid harvest date format: %v", err)
+	}
+	if harvestDate.Before(validFrom) || harvestDate.After(validUntil) {
+		return nil, 0, fmt.Errorf("harvest date %s is outside the validity of permit %s", event.HarvestDate, permit.ID)
+	}
+	if time.Now().After(validUntil) {
+		return nil, 0, fmt.Errorf("permit %s expired on %s", permit.ID, permit.ValidUntil)
+	}
+
+	quantity, err := convertQuantity(event.Quantity, event.Unit, permit.Unit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("collection quantity does not match permit unit: %v", err)
+	}
+	remaining := permit.MaxQuantity - permit.UsedQuantity
+	if quantity > remaining+harvestEpsilon {
+		return nil, 0, fmt.Errorf("permit %s has %.2f %s remaining, requested %.2f %s", permit.ID, remaining, permit.Unit, quantity, permit.Unit)
+	}
+
+	return permit, quantity, nil
+}
+
+// putPermit saves a permit to the ledger
+func (c *HerbalTraceContract) putPermit(ctx contractapi.TransactionContextInterface, permit *Permit) error {
+	permitBytes, err := json.Marshal(permit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal permit: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(permit.ID, permitBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save permit to ledger: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+var testForestOfficer = testIdentity{id: "forest-officer-1", mspID: regulatorMSP, attributes: map[string]string{"role": roleForestAuthority}}
+
+// newPermitLedger returns a ledger holding PERMIT-1, allowing FARMER-1 to collect 10 kg of the
+// test species in the test zone, of which usedQuantity kg are already used
+func newPermitLedger(t *testing.T, usedQuantity float64, status string) *testLedger {
+	ledger := newTestLedger()
+	ledger.put(t, "PERMIT-1", Permit{ID: "PERMIT-1", Type: "Permit", HolderID: "FARMER-1", Species: testSpecies, Zone: testZone,
+		MaxQuantity: 10, UsedQuantity: usedQuantity, Unit: "kg", ValidFrom: "2025-01-01T00:00:00Z", ValidUntil: "2099-12-31T23:59:59Z", Status: status})
+	return ledger
+}
+
+// permitCollection returns a collection of the given quantity under PERMIT-1
+func permitCollection(quantity float64, unit string) *CollectionEvent {
+	return &CollectionEvent{ID: "COL-1", Type: "CollectionEvent", FarmerID: "FARMER-1", Species: testSpecies, ZoneName: testZone,
+		PermitID: "PERMIT-1", Quantity: quantity, Unit: unit, HarvestDate: "2025-04-15T08:00:00Z"}
+}
+
+func TestDrawDownPermit(t *testing.T) {
+	tests := []struct {
+		name       string
+		used       float64
+		event      *CollectionEvent
+		wantUsed   float64
+		wantStatus string
+	}{
+		{"part of the permit", 0, permitCollection(4, "kg"), 4, "active"},
+		{"grams", 0, permitCollection(4000, "g"), 4, "active"},
+		{"exactly the remainder", 6, permitCollection(4, "kg"), 10, "exhausted"},
+		{"quintals", 0, permitCollection(0.1, "qtl"), 10, "exhausted"},
+		{"within rounding of the remainder", 6, permitCollection(4+harvestEpsilon/2, "kg"), 10 + harvestEpsilon/2, "exhausted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newPermitLedger(t, tt.used, "active")
+			tx := ledger.begin("collect")
+			if _, err := new(HerbalTraceContract).drawDownPermit(tx.context(testFarmer), tt.event); err != nil {
+				t.Fatalf("draw-down failed: %v", err)
+			}
+			if err := ledger.commit(tx); err != nil {
+				t.Fatalf("draw-down did not commit: %v", err)
+			}
+			var permit Permit
+			ledger.get(t, "PERMIT-1", &permit)
+			if permit.UsedQuantity != tt.wantUsed || permit.Status != tt.wantStatus {
+				t.Errorf("permit used %v kg and is %s, want %v kg and %s", permit.UsedQuantity, permit.Status, tt.wantUsed, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDrawDownPermitRejectsUncoveredCollections(t *testing.T) {
+	tests := []struct {
+		name   string
+		used   float64
+		status string
+		modify func(event *CollectionEvent)
+	}{
+		{"over the remainder", 7, "active", func(event *CollectionEvent) { event.Quantity = 4 }},
+		{"over the permit in grams", 0, "active", func(event *CollectionEvent) { event.Quantity, event.Unit = 10001, "g" }},
+		{"volume unit", 0, "active", func(event *CollectionEvent) { event.Unit = "l" }},
+		{"no permit", 0, "active", func(event *CollectionEvent) { event.PermitID = "" }},
+		{"unknown permit", 0, "active", func(event *CollectionEvent) { event.PermitID = "PERMIT-9" }},
+		{"another farmer", 0, "active", func(event *CollectionEvent) { event.FarmerID = "FARMER-2" }},
+		{"another species", 0, "active", func(event *CollectionEvent) { event.Species = "Azadirachta indica" }},
+		{"another zone", 0, "active", func(event *CollectionEvent) { event.ZoneName = "Haridwar" }},
+		{"harvested before the permit", 0, "active", func(event *CollectionEvent) { event.HarvestDate = "2024-12-31T23:00:00Z" }},
+		{"revoked permit", 0, "revoked", func(event *CollectionEvent) {}},
+		{"exhausted permit", 10, "exhausted", func(event *CollectionEvent) { event.Quantity = 0.1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newPermitLedger(t, tt.used, tt.status)
+			event := permitCollection(1, "kg")
+			tt.modify(event)
+			tx := ledger.begin("collect")
+			if _, err := new(HerbalTraceContract).drawDownPermit(tx.context(testFarmer), event); err == nil {
+				t.Errorf("collection was drawn down from the permit")
+			}
+			if len(tx.writes) != 0 {
+				t.Errorf("rejected draw-down wrote %d keys", len(tx.writes))
+			}
+		})
+	}
+}
+
+func TestConcurrentDrawDownsCannotOverdrawPermit(t *testing.T) {
+	ledger := newPermitLedger(t, 0, "active")
+	contract := new(HerbalTraceContract)
+
+	// Both collections are endorsed against the same permit state, each within the remainder
+	first := ledger.begin("collect-1")
+	second := ledger.begin("collect-2")
+	for _, tx := range []*testTx{first, second} {
+		if _, err := contract.drawDownPermit(tx.context(testFarmer), permitCollection(6, "kg")); err != nil {
+			t.Fatalf("draw-down was rejected at endorsement: %v", err)
+		}
+	}
+	if err := ledger.commit(first); err != nil {
+		t.Fatalf("first draw-down did not commit: %v", err)
+	}
+	if err := ledger.commit(second); err == nil {
+		t.Fatalf("second draw-down committed and overdrew the permit")
+	}
+
+	// Resubmitted, the second collection sees what is left
+	retry := ledger.begin("collect-2-retry")
+	if _, err := contract.drawDownPermit(retry.context(testFarmer), permitCollection(6, "kg")); err == nil {
+		t.Errorf("resubmitted collection overdrew the permit")
+	}
+	var permit Permit
+	ledger.get(t, "PERMIT-1", &permit)
+	if permit.UsedQuantity != 6 {
+		t.Errorf("permit used %v kg, want 6", permit.UsedQuantity)
+	}
+}
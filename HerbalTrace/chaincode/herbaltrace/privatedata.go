@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	// transientPrivateData is the transient map key carrying a record's sensitive fields
+	transientPrivateData = "privateData"
+	minPrivateSaltLength = 16
+)
+
+// privateCollections maps record types to the collection holding their sensitive fields, see collections_config.json
+var privateCollections = map[string]string{
+	"Farmer":          "farmersCoopPrivate",
+	"CollectionEvent": "farmersCoopPrivate",
+	"ProcessingStep":  "processorsPrivate",
+	"QualityTest":     "labsManufacturersShared",
+	"Permit":          "farmersCoopPrivate",
+}
+
+// privateDetails is implemented by the sensitive part of each record type
+type privateDetails interface {
+	saltValue() string
+}
+
+// FarmerPrivateDetails holds a farmer's personal data
+type FarmerPrivateDetails struct {
+	Name    string `json:"name"`
+	Phone   string `json:"phone,omitempty"`
+	Address string `json:"address,omitempty"`
+	Salt    string `json:"salt"`
+}
+
+// CollectionEventPrivateDetails holds the harvester's identity and the exact harvest location
+type CollectionEventPrivateDetails struct {
+	FarmerName string  `json:"farmerName,omitempty"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Altitude   float64 `json:"altitude,omitempty"`
+	Accuracy   float64 `json:"accuracy,omitempty"` // GPS accuracy in meters
+	Salt       string  `json:"salt"`
+}
+
+// PermitPrivateDetails holds the name of a permit's holder
+type PermitPrivateDetails struct {
+	HolderName string `json:"holderName,omitempty"`
+	Salt       string `json:"salt"`
+}
+
+// QualityTestPrivateDetails holds the commercial terms of a lab test
+type QualityTestPrivateDetails struct {
+	TestFee    float64 `json:"testFee,omitempty"`
+	Currency   string  `json:"currency,omitempty"`
+	InvoiceRef string  `json:"invoiceRef,omitempty"`
+	Salt       string  `json:"salt"`
+}
+
+// ProcessingStepPrivateDetails holds a processor's process parameters
+type ProcessingStepPrivateDetails struct {
+	Temperature float64           `json:"temperature,omitempty"` // Celsius
+	Duration    float64           `json:"duration,omitempty"`    // hours
+	Equipment   string            `json:"equipment,omitempty"`
+	Parameters  map[string]string `json:"parameters,omitempty"`
+	Salt        string            `json:"salt"`
+}
+
+func (d *FarmerPrivateDetails) saltValue() string          { return d.Salt }
+func (d *CollectionEventPrivateDetails) saltValue() string { return d.Salt }
+func (d *PermitPrivateDetails) saltValue() string          { return d.Salt }
+func (d *QualityTestPrivateDetails) saltValue() string     { return d.Salt }
+func (d *ProcessingStepPrivateDetails) saltValue() string  { return d.Salt }
+
+// PrivateFieldCheck is the result of checking one disclosed value against its public hash
+type PrivateFieldCheck struct {
+	Field   string `json:"field"`
+	Matches bool   `json:"matches"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// PrivateDataVerification is the result of checking disclosed private values against a record
+type PrivateDataVerification struct {
+	RecordID   string              `json:"recordId"`
+	RecordType string              `json:"recordType"`
+	Collection string              `json:"collection"`
+	Verified   bool                `json:"verified"`
+	Fields     []PrivateFieldCheck `json:"fields"`
+}
+
+// privateDataDisclosure is the input to VerifyPrivateData
+type privateDataDisclosure struct {
+	Salt   string                 `json:"salt"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// privateRecordHeader is the part of a public record describing its private data
+type privateRecordHeader struct {
+	Type              string            `json:"type"`
+	PrivateCollection string            `json:"privateCollection"`
+	PrivateDataHashes map[string]string `json:"privateDataHashes"`
+}
+
+// VerifyPrivateData checks values disclosed by a data owner against the salted hashes on a public record.
+// The disclosure is {"salt": "...", "fields": {"farmerName": "..."}}; any subset of fields may be disclosed.
+func (c *HerbalTraceContract) VerifyPrivateData(ctx contractapi.TransactionContextInterface, recordID string, disclosureJSON string) (*PrivateDataVerification, error) {
+	var disclosure privateDataDisclosure
+	err := json.Unmarshal([]byte(disclosureJSON), &disclosure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal disclosure: %v", err)
+	}
+	if disclosure.Salt == "" || len(disclosure.Fields) == 0 {
+		return nil, fmt.Errorf("salt and at least one field are required")
+	}
+
+	header, err := getPrivateRecordHeader(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	verification := &PrivateDataVerification{
+		RecordID:   recordID,
+		RecordType: header.Type,
+		Collection: header.PrivateCollection,
+		Verified:   true,
+		Fields:     []PrivateFieldCheck{},
+	}
+	for _, field := range sortedKeys(disclosure.Fields) {
+		check := PrivateFieldCheck{Field: field}
+		expected, found := header.PrivateDataHashes[field]
+		if !found {
+			check.Detail = "no hash recorded for this field"
+		} else {
+			actual, err := privateFieldHash(disclosure.Salt, field, disclosure.Fields[field])
+			if err != nil {
+				return nil, err
+			}
+			check.Matches = actual == expected
+			if !check.Matches {
+				check.Detail = "disclosed value does not match the recorded hash"
+			}
+		}
+		verification.Verified = verification.Verified && check.Matches
+		verification.Fields = append(verification.Fields, check)
+	}
+
+	return verification, nil
+}
+
+// GetPrivateDetails returns the private fields of a record, readable only by members of its collection
+func (c *HerbalTraceContract) GetPrivateDetails(ctx contractapi.TransactionContextInterface, recordID string) (string, error) {
+	header, err := getPrivateRecordHeader(ctx, recordID)
+	if err != nil {
+		return "", err
+	}
+
+	detailsBytes, err := ctx.GetStub().GetPrivateData(header.PrivateCollection, recordID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private data: %v", err)
+	}
+	if detailsBytes == nil {
+		return "", fmt.Errorf("no private data found for %s", recordID)
+	}
+
+	return string(detailsBytes), nil
+}
+
+// readPrivateDetails reads a record's sensitive fields from the transient map into details.
+// It returns false if the transaction carries no private data.
+func readPrivateDetails(ctx contractapi.TransactionContextInterface, details privateDetails) (bool, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return false, fmt.Errorf("failed to read transient data: %v", err)
+	}
+	detailsBytes, found := transient[transientPrivateData]
+	if !found || len(detailsBytes) == 0 {
+		return false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(detailsBytes))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(details)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal private data: %v", err)
+	}
+	if len(details.saltValue()) < minPrivateSaltLength {
+		return false, fmt.Errorf("private data requires a random salt of at least %d characters", minPrivateSaltLength)
+	}
+
+	return true, nil
+}
+
+// putPrivateDetails writes a record's sensitive fields to its collection and returns the collection
+// name and the salted hash of each field for the public record
+func putPrivateDetails(ctx contractapi.TransactionContextInterface, recordType string, recordID string, details privateDetails) (string, map[string]string, error) {
+	collection, found := privateCollections[recordType]
+	if !found {
+		return "", nil, fmt.Errorf("no private data collection for %s records", recordType)
+	}
+
+	detailsBytes, err := json.Marshal(details)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal private data: %v", err)
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(detailsBytes, &fields)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to unmarshal private data: %v", err)
+	}
+	delete(fields, "salt")
+
+	hashes := make(map[string]string)
+	for field, value := range fields {
+		hashes[field], err = privateFieldHash(details.saltValue(), field, value)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	err = ctx.GetStub().PutPrivateData(collection, recordID, detailsBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to save private data: %v", err)
+	}
+
+	return collection, hashes, nil
+}
+
+// getPrivateRecordHeader reads the private data description of a public record
+func getPrivateRecordHeader(ctx contractapi.TransactionContextInterface, recordID string) (*privateRecordHeader, error) {
+	recordBytes, err := ctx.GetStub().GetState(recordID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record: %v", err)
+	}
+	if recordBytes == nil {
+		return nil, fmt.Errorf("record not found: %s", recordID)
+	}
+
+	var header privateRecordHeader
+	err = json.Unmarshal(recordBytes, &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record: %v", err)
+	}
+	if header.PrivateCollection == "" {
+		return nil, fmt.Errorf("record %s has no private data", recordID)
+	}
+
+	return &header, nil
+}
+
+// privateFieldHash returns the salted hash of one private field. The field name is included so
+// equal values in different fields hash differently, and the value is hashed as canonical JSON.
+func privateFieldHash(salt string, field string, value interface{}) (string, error) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s: %v", field, err)
+	}
+	canonical, err := canonicalJSON(valueBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to canonicalize %s: %v", field, err)
+	}
+
+	return sha256Hex([]byte(salt + "|" + field + "|" + string(canonical))), nil
+}
+
+// sensitiveFieldError reports sensitive fields submitted in the public arguments, which are
+// recorded in the block even when the record itself keeps them private
+func sensitiveFieldError(fields map[string]bool) error {
+	var present []string
+	for field, set := range fields {
+		if set {
+			present = append(present, field)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+
+	sort.Strings(present)
+	return fmt.Errorf("sensitive fields %v must be passed in the transient map under %q", present, transientPrivateData)
+}
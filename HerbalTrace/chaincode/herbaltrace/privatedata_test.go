@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testSalt = "5f2b9c0e7a1d4e3f8b6a2c9d"
+
+// issuePrivatePermit commits PERMIT-1 for FARMER-1 with the holder's name in the transient map
+func issuePrivatePermit(t *testing.T, ledger *testLedger) {
+	t.Helper()
+	tx := ledger.begin("issue")
+	tx.TransientMap = map[string][]byte{transientPrivateData: []byte(`{"holderName":"Asha Devi","salt":"` + testSalt + `"}`)}
+	permitJSON := `{"id":"PERMIT-1","holderId":"FARMER-1","species":"` + testSpecies + `","zone":"` + testZone + `","maxQuantity":10,"unit":"kg",` +
+		`"validFrom":"2025-01-01T00:00:00Z","validUntil":"2099-12-31T23:59:59Z"}`
+	if err := new(HerbalTraceContract).IssuePermit(tx.context(testForestOfficer), permitJSON); err != nil {
+		t.Fatalf("permit was rejected: %v", err)
+	}
+	if value, _ := tx.GetPrivateData(privateCollections["Permit"], "PERMIT-1"); !strings.Contains(string(value), "Asha Devi") {
+		t.Errorf("holder name was not written to the private collection: %s", value)
+	}
+	if err := ledger.commit(tx); err != nil {
+		t.Fatalf("permit did not commit: %v", err)
+	}
+}
+
+func TestVerifyPrivateData(t *testing.T) {
+	ledger := newTestLedger()
+	registerTestSpecies(t, ledger)
+	issuePrivatePermit(t, ledger)
+
+	if strings.Contains(string(ledger.state["PERMIT-1"]), "Asha Devi") {
+		t.Fatalf("public permit names its holder: %s", ledger.state["PERMIT-1"])
+	}
+
+	// A collection event whose hashes cover numbers as well as strings
+	tx := ledger.begin("collect")
+	ctx := tx.context(testFarmer)
+	collection, hashes, err := putPrivateDetails(ctx, "CollectionEvent", "COL-1", &CollectionEventPrivateDetails{FarmerName: "Asha Devi", Latitude: 30.27, Longitude: 77.99, Salt: testSalt})
+	if err != nil {
+		t.Fatalf("failed to write private details: %v", err)
+	}
+	ledger.put(t, "COL-1", CollectionEvent{ID: "COL-1", Type: "CollectionEvent", PrivateCollection: collection, PrivateDataHashes: hashes})
+	ledger.put(t, "COL-2", CollectionEvent{ID: "COL-2", Type: "CollectionEvent"})
+
+	tests := []struct {
+		name       string
+		recordID   string
+		disclosure string
+		want       map[string]bool // Field -> matches
+	}{
+		{"holder name", "PERMIT-1", `{"salt":"` + testSalt + `","fields":{"holderName":"Asha Devi"}}`, map[string]bool{"holderName": true}},
+		{"wrong holder name", "PERMIT-1", `{"salt":"` + testSalt + `","fields":{"holderName":"Asha  Devi"}}`, map[string]bool{"holderName": false}},
+		{"wrong salt", "PERMIT-1", `{"salt":"` + strings.ToUpper(testSalt) + `","fields":{"holderName":"Asha Devi"}}`, map[string]bool{"holderName": false}},
+		{"field without hash", "PERMIT-1", `{"salt":"` + testSalt + `","fields":{"holderName":"Asha Devi","phone":"98765"}}`, map[string]bool{"holderName": true, "phone": false}},
+		{"subset of fields", "COL-1", `{"salt":"` + testSalt + `","fields":{"latitude":30.270}}`, map[string]bool{"latitude": true}},
+		{"every field", "COL-1", `{"salt":"` + testSalt + `","fields":{"farmerName":"Asha Devi","latitude":30.27,"longitude":77.99}}`,
+			map[string]bool{"farmerName": true, "latitude": true, "longitude": true}},
+		{"value of another field", "COL-1", `{"salt":"` + testSalt + `","fields":{"longitude":30.27}}`, map[string]bool{"longitude": false}},
+		{"number as string", "COL-1", `{"salt":"` + testSalt + `","fields":{"latitude":"30.27"}}`, map[string]bool{"latitude": false}},
+	}
+	contract := new(HerbalTraceContract)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := ledger.begin("verify")
+			verification, err := contract.VerifyPrivateData(tx.context(testConsumer), tt.recordID, tt.disclosure)
+			if err != nil {
+				t.Fatalf("verification failed: %v", err)
+			}
+			verified := true
+			for _, check := range verification.Fields {
+				want, listed := tt.want[check.Field]
+				if !listed || check.Matches != want {
+					t.Errorf("field %s matches = %v (%s), want %v", check.Field, check.Matches, check.Detail, want)
+				}
+				verified = verified && want
+			}
+			if len(verification.Fields) != len(tt.want) || verification.Verified != verified {
+				t.Errorf("verification %+v, want fields %v", verification, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		name       string
+		recordID   string
+		disclosure string
+	}{
+		{"no salt", "PERMIT-1", `{"fields":{"holderName":"Asha Devi"}}`},
+		{"no fields", "PERMIT-1", `{"salt":"` + testSalt + `","fields":{}}`},
+		{"malformed disclosure", "PERMIT-1", `{"salt":`},
+		{"record without private data", "COL-2", `{"salt":"` + testSalt + `","fields":{"farmerName":"Asha Devi"}}`},
+		{"missing record", "COL-9", `{"salt":"` + testSalt + `","fields":{"farmerName":"Asha Devi"}}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := ledger.begin("verify")
+			if _, err := contract.VerifyPrivateData(tx.context(testConsumer), tt.recordID, tt.disclosure); err == nil {
+				t.Errorf("disclosure was verified")
+			}
+		})
+	}
+}
+
+func TestIssuePermitKeepsHolderNameOffTheLedger(t *testing.T) {
+	ledger := newTestLedger()
+	registerTestSpecies(t, ledger)
+	contract := new(HerbalTraceContract)
+	permitJSON := func(holderName string) string {
+		permit := map[string]interface{}{"id": "PERMIT-1", "holderId": "FARMER-1", "holderName": holderName, "species": testSpecies, "zone": testZone,
+			"maxQuantity": 10, "unit": "kg", "validFrom": "2025-01-01T00:00:00Z", "validUntil": "2099-12-31T23:59:59Z"}
+		permitBytes, _ := json.Marshal(permit)
+		return string(permitBytes)
+	}
+
+	tx := ledger.begin("public-name")
+	if err := contract.IssuePermit(tx.context(testForestOfficer), permitJSON("Asha Devi")); err == nil {
+		t.Errorf("permit with a public holder name was issued")
+	}
+
+	tx = ledger.begin("weak-salt")
+	tx.TransientMap = map[string][]byte{transientPrivateData: []byte(`{"holderName":"Asha Devi","salt":"1234"}`)}
+	if err := contract.IssuePermit(tx.context(testForestOfficer), permitJSON("")); err == nil {
+		t.Errorf("permit with a short salt was issued")
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// qcCertificateVersionObjectType is the composite key prefix of superseded QC certificate versions
+const qcCertificateVersionObjectType = "qcCertificateVersion"
+
+// qcCertificateResults lists the valid overall results of a QC certificate
+var qcCertificateResults = map[string]bool{
+	"PASS": true,
+	"FAIL": true,
+}
+
+// QCCertificateVersion is a superseded version of a QC certificate, kept when it is amended or revoked
+type QCCertificateVersion struct {
+	Type           string        `json:"type"` // "QCCertificateVersion"
+	Certificate    QCCertificate `json:"certificate"`
+	SupersededBy   string        `json:"supersededBy"`
+	SupersededDate string        `json:"supersededDate"`
+}
+
+// AmendCertificate replaces the content of a QC certificate, e.g. after a retest, keeping the prior
+// version. Only the issuing organisation can amend, and the amended certificate is validated like a new one.
+func (c *HerbalTraceContract) AmendCertificate(ctx contractapi.TransactionContextInterface, certificateID string, certificateJSON string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	current, err := c.checkCertificateIssuer(ctx, certificateID)
+	if err != nil {
+		return err
+	}
+
+	var amended QCCertificate
+	err = json.Unmarshal([]byte(certificateJSON), &amended)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal certificate: %v", err)
+	}
+	if amended.ID != "" && amended.ID != certificateID {
+		return fmt.Errorf("certificate ID %s does not match %s", amended.ID, certificateID)
+	}
+	err = c.validateQCCertificate(ctx, &amended)
+	if err != nil {
+		return err
+	}
+
+	amendedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	amendedDate := time.Now().Format(time.RFC3339)
+
+	err = archiveQCCertificate(ctx, current, amendedBy, amendedDate)
+	if err != nil {
+		return err
+	}
+
+	amended.ID = current.ID
+	amended.Type = "QCCertificate"
+	amended.CertificateID = current.CertificateID
+	amended.Timestamp = current.Timestamp
+	amended.IssuedBy = current.IssuedBy
+	amended.IssuerMSP = current.IssuerMSP
+	amended.Version = current.Version + 1
+	amended.Status = "amended"
+	amended.AmendmentReason = reason
+	amended.AmendedBy = amendedBy
+	amended.AmendedDate = amendedDate
+	amended.RevocationReason = ""
+	amended.RevokedBy = ""
+	amended.RevokedDate = ""
+
+	err = putQCCertificate(ctx, &amended)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":      "QCCertificateAmended",
+		"certificateId":  certificateID,
+		"version":        amended.Version,
+		"previousResult": current.OverallResult,
+		"overallResult":  amended.OverallResult,
+		"reason":         reason,
+		"timestamp":      amendedDate,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("QCCertificateAmended", eventBytes)
+
+	return nil
+}
+
+// RevokeCertificate withdraws a QC certificate, keeping the prior version (only the issuing organisation)
+func (c *HerbalTraceContract) RevokeCertificate(ctx contractapi.TransactionContextInterface, certificateID string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+
+	certificate, err := c.checkCertificateIssuer(ctx, certificateID)
+	if err != nil {
+		return err
+	}
+
+	revokedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	revokedDate := time.Now().Format(time.RFC3339)
+
+	err = archiveQCCertificate(ctx, certificate, revokedBy, revokedDate)
+	if err != nil {
+		return err
+	}
+
+	certificate.Version++
+	certificate.Status = "revoked"
+	certificate.RevocationReason = reason
+	certificate.RevokedBy = revokedBy
+	certificate.RevokedDate = revokedDate
+
+	err = putQCCertificate(ctx, certificate)
+	if err != nil {
+		return err
+	}
+
+	// The batch no longer carries a valid certificate, so it is held until a new one is recorded
+	if certificate.BatchID != "" {
+		err = c.holdBatchForQC(ctx, certificate.BatchID, fmt.Sprintf("QC certificate %s revoked: %s", certificateID, reason), revokedDate)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":     "QCCertificateRevoked",
+		"certificateId": certificateID,
+		"batchId":       certificate.BatchID,
+		"version":       certificate.Version,
+		"reason":        reason,
+		"timestamp":     revokedDate,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("QCCertificateRevoked", eventBytes)
+
+	return nil
+}
+
+// GetCertificateVersions retrieves every version of a QC certificate, oldest first, ending with the current one
+func (c *HerbalTraceContract) GetCertificateVersions(ctx contractapi.TransactionContextInterface, certificateID string) ([]*QCCertificate, error) {
+	current, err := c.QueryQCCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(qcCertificateVersionObjectType, []string{certificateID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate versions: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var versions []*QCCertificate
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate certificate versions: %v", err)
+		}
+
+		var version QCCertificateVersion
+		err = json.Unmarshal(queryResponse.Value, &version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal certificate version %s: %v", queryResponse.Key, err)
+		}
+		versions = append(versions, &version.Certificate)
+	}
+
+	return append(versions, current), nil
+}
+
+// validateQCCertificate checks a certificate against the quality test it cites and the lab's
+// accreditation, filling in the batch, lab and issue date from the test where they are missing
+func (c *HerbalTraceContract) validateQCCertificate(ctx contractapi.TransactionContextInterface, certificate *QCCertificate) error {
+	if certificate.TestID == "" {
+		return fmt.Errorf("test ID is required")
+	}
+	test, err := c.GetQualityTest(ctx, certificate.TestID)
+	if err != nil {
+		return err
+	}
+	if test.Type != "QualityTest" {
+		return fmt.Errorf("%s is not a quality test", certificate.TestID)
+	}
+
+	certificate.BatchID = firstNonEmpty(certificate.BatchID, test.BatchID)
+	if certificate.BatchID != test.BatchID {
+		return fmt.Errorf("certificate batch %s does not match batch %s of test %s", certificate.BatchID, test.BatchID, test.ID)
+	}
+	certificate.LabID = firstNonEmpty(certificate.LabID, test.LabID)
+	if certificate.LabID != test.LabID {
+		return fmt.Errorf("certificate lab %s does not match lab %s of test %s", certificate.LabID, test.LabID, test.ID)
+	}
+
+	certificate.OverallResult = strings.ToUpper(certificate.OverallResult)
+	if !qcCertificateResults[certificate.OverallResult] {
+		return fmt.Errorf("invalid overall result: %s. Valid results: PASS, FAIL", certificate.OverallResult)
+	}
+	if !strings.EqualFold(certificate.OverallResult, test.OverallResult) {
+		return fmt.Errorf("certificate result %s does not match result %s of test %s", certificate.OverallResult, test.OverallResult, test.ID)
+	}
+
+	// Certificates can only be issued by accredited labs, within scope for known test types
+	var scopeTestTypes []string
+	if labTestTypes[certificate.TestType] {
+		if !hasTestType(*test, certificate.TestType) {
+			return fmt.Errorf("test %s did not cover %s", test.ID, certificate.TestType)
+		}
+		scopeTestTypes = []string{certificate.TestType}
+	}
+	lab, err := c.checkLabAccreditation(ctx, certificate.LabID, scopeTestTypes)
+	if err != nil {
+		return err
+	}
+	certificate.LabName = lab.Name
+
+	if certificate.IssuedDate == "" {
+		certificate.IssuedDate = time.Now().Format(time.RFC3339)
+	}
+	_, err = time.Parse(time.RFC3339, certificate.IssuedDate)
+	if err != nil {
+		return fmt.Errorf("invalid issued date: %v", err)
+	}
+
+	return nil
+}
+
+// checkCertificateIssuer returns a certificate that can still be changed by the calling organisation
+func (c *HerbalTraceContract) checkCertificateIssuer(ctx contractapi.TransactionContextInterface, certificateID string) (*QCCertificate, error) {
+	certificate, err := c.QueryQCCertificate(ctx, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	if certificate.Status == "revoked" {
+		return nil, fmt.Errorf("certificate %s is revoked", certificateID)
+	}
+
+	_, callerMSP, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Certificates recorded before versioning carry no issuer, so the lab's organisation stands in
+	issuerMSP := certificate.IssuerMSP
+	if issuerMSP == "" {
+		lab, err := c.GetLab(ctx, certificate.LabID)
+		if err != nil {
+			return nil, err
+		}
+		issuerMSP = lab.MSPID
+	}
+	if callerMSP != issuerMSP {
+		return nil, fmt.Errorf("certificate %s can only be changed by %s", certificateID, issuerMSP)
+	}
+	// Labs can share an organisation, so the caller must also be an analyst of the certificate's lab
+	callerLab, _, err := ctx.GetClientIdentity().GetAttributeValue(labIDAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read caller lab: %v", err)
+	}
+	if callerLab != certificate.LabID {
+		return nil, fmt.Errorf("certificate %s can only be changed by analysts of lab %s, caller is from lab %q", certificateID, certificate.LabID, callerLab)
+	}
+
+	return certificate, nil
+}
+
+// archiveQCCertificate keeps the current version of a certificate before it is superseded
+func archiveQCCertificate(ctx contractapi.TransactionContextInterface, certificate *QCCertificate, supersededBy string, supersededDate string) error {
+	version := QCCertificateVersion{
+		Type:           "QCCertificateVersion",
+		Certificate:    *certificate,
+		SupersededBy:   supersededBy,
+		SupersededDate: supersededDate,
+	}
+	versionBytes, err := json.Marshal(version)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate version: %v", err)
+	}
+
+	versionKey, err := ctx.GetStub().CreateCompositeKey(qcCertificateVersionObjectType, []string{certificate.ID, fmt.Sprintf("%06d", certificate.Version)})
+	if err != nil {
+		return fmt.Errorf("failed to create certificate version key: %v", err)
+	}
+	err = ctx.GetStub().PutState(versionKey, versionBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save certificate version: %v", err)
+	}
+
+	return nil
+}
+
+// holdBatchForQC puts a batch on QC hold. Certificates can cite batches that were never recorded,
+// which have nothing to hold. A later passing certificate releases the hold, see updateBatchStatus.
+func (c *HerbalTraceContract) holdBatchForQC(ctx contractapi.TransactionContextInterface, batchID string, reason string, at string) error {
+	batchBytes, err := ctx.GetStub().GetState(batchID)
+	if err != nil {
+		return fmt.Errorf("failed to read batch: %v", err)
+	}
+	if batchBytes == nil {
+		return nil
+	}
+	var batch Batch
+	err = json.Unmarshal(batchBytes, &batch)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal batch: %v", err)
+	}
+	if batch.QCHold == reason {
+		return nil
+	}
+
+	batch.QCHold = reason
+	batch.Timestamp = at
+	batchBytes, err = json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %v", err)
+	}
+	err = ctx.GetStub().PutState(batchID, batchBytes)
+	if err != nil {
+		return fmt.Errorf("failed to update batch: %v", err)
+	}
+
+	return nil
+}
+
+// checkQCHold rejects work on a batch that is on QC hold
+func checkQCHold(ctx contractapi.TransactionContextInterface, batchID string) error {
+	batchBytes, err := ctx.GetStub().GetState(batchID)
+	if err != nil {
+		return fmt.Errorf("failed to read batch: %v", err)
+	}
+	if batchBytes == nil {
+		return nil
+	}
+	var batch Batch
+	err = json.Unmarshal(batchBytes, &batch)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal batch: %v", err)
+	}
+	if batch.QCHold != "" {
+		return fmt.Errorf("batch %s is on QC hold: %s", batchID, batch.QCHold)
+	}
+
+	return nil
+}
+
+// putQCCertificate saves a QC certificate to the ledger
+func putQCCertificate(ctx contractapi.TransactionContextInterface, certificate *QCCertificate) error {
+	certificateBytes, err := json.Marshal(certificate)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(certificate.ID, certificateBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save certificate: %v", err)
+	}
+	err = putBatchRecordIndex(ctx, certificate.BatchID, "QCCertificate", certificate.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// newQCLedger returns a lab ledger holding a batch and a passing moisture test of it by LAB-1
+func newQCLedger(t *testing.T) *testLedger {
+	ledger := newLabLedger(t)
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, Status: "testing"})
+	ledger.put(t, "QT-1", QualityTest{ID: "QT-1", Type: "QualityTest", BatchID: "BATCH-1", LabID: "LAB-1", TestTypes: []string{"moisture"}, OverallResult: "pass"})
+	return ledger
+}
+
+// recordCertificate records a certificate for QT-1 and commits it
+func recordCertificate(t *testing.T, ledger *testLedger, txID string, certificateJSON string) {
+	t.Helper()
+	tx := ledger.begin(txID)
+	err := new(HerbalTraceContract).RecordQCCertificate(tx.context(testAnalyst), certificateJSON)
+	if err != nil {
+		t.Fatalf("certificate was rejected: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("certificate did not commit: %v", err)
+	}
+}
+
+func TestRecordQCCertificateRejectsOverwrite(t *testing.T) {
+	ledger := newQCLedger(t)
+	recordCertificate(t, ledger, "record", `{"id":"QC-1","testId":"QT-1","testType":"moisture","overallResult":"PASS"}`)
+
+	tx := ledger.begin("overwrite")
+	err := new(HerbalTraceContract).RecordQCCertificate(tx.context(testAnalyst), `{"id":"QC-1","testId":"QT-1","testType":"moisture","overallResult":"PASS","testedBy":"someone else"}`)
+	if err == nil || !strings.Contains(err.Error(), "AmendCertificate") {
+		t.Errorf("certificate was overwritten, got %v", err)
+	}
+}
+
+func TestRecordQCCertificateMustMatchTheTest(t *testing.T) {
+	tests := []struct {
+		name            string
+		certificateJSON string
+		want            string
+	}{
+		{"batch", `{"id":"QC-1","testId":"QT-1","batchId":"BATCH-2","overallResult":"PASS"}`, "does not match batch BATCH-1"},
+		{"lab", `{"id":"QC-1","testId":"QT-1","labId":"LAB-2","overallResult":"PASS"}`, "does not match lab LAB-1"},
+		{"result", `{"id":"QC-1","testId":"QT-1","overallResult":"FAIL"}`, "does not match result pass"},
+		{"unknown result", `{"id":"QC-1","testId":"QT-1","overallResult":"CONDITIONAL"}`, "invalid overall result"},
+		{"test type", `{"id":"QC-1","testId":"QT-1","testType":"pesticide","overallResult":"PASS"}`, "did not cover pesticide"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newQCLedger(t)
+			tx := ledger.begin("record")
+			err := new(HerbalTraceContract).RecordQCCertificate(tx.context(testAnalyst), tt.certificateJSON)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("RecordQCCertificate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmendCertificateArchivesVersionsInOrder(t *testing.T) {
+	ledger := newQCLedger(t)
+	contract := new(HerbalTraceContract)
+	recordCertificate(t, ledger, "record", `{"id":"QC-1","testId":"QT-1","testType":"moisture","overallResult":"PASS","testedBy":"analyst 0"}`)
+
+	// Enough amendments for the version numbers to need more than one digit
+	for i := 1; i <= 10; i++ {
+		tx := ledger.begin(fmt.Sprintf("amend-%d", i))
+		err := contract.AmendCertificate(tx.context(testAnalyst), "QC-1", fmt.Sprintf(`{"testId":"QT-1","testType":"moisture","overallResult":"PASS","testedBy":"analyst %d"}`, i), "typo")
+		if err != nil {
+			t.Fatalf("amendment %d was rejected: %v", i, err)
+		}
+		if err = ledger.commit(tx); err != nil {
+			t.Fatalf("amendment %d did not commit: %v", i, err)
+		}
+	}
+
+	tx := ledger.begin("versions")
+	versions, err := contract.GetCertificateVersions(tx.context(testAnalyst), "QC-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 11 {
+		t.Fatalf("got %d versions, want 11", len(versions))
+	}
+	for i, version := range versions {
+		if version.Version != i+1 || version.TestedBy != fmt.Sprintf("analyst %d", i) {
+			t.Errorf("versions[%d] is version %d tested by %q", i, version.Version, version.TestedBy)
+		}
+	}
+	if versions[0].Status != "issued" || versions[10].Status != "amended" || versions[10].AmendmentReason != "typo" {
+		t.Errorf("first version is %s, current version is %s (%q)", versions[0].Status, versions[10].Status, versions[10].AmendmentReason)
+	}
+}
+
+func TestCertificateChangesRequireTheCallersLab(t *testing.T) {
+	ledger := newQCLedger(t)
+	recordCertificate(t, ledger, "record", `{"id":"QC-1","testId":"QT-1","testType":"moisture","overallResult":"PASS"}`)
+
+	// Another lab of the same organisation
+	otherAnalyst := testIdentity{id: "analyst-2", mspID: "TestingLabsMSP", attributes: map[string]string{"role": "lab", labIDAttribute: "LAB-2"}}
+	tx := ledger.begin("revoke")
+	err := new(HerbalTraceContract).RevokeCertificate(tx.context(otherAnalyst), "QC-1", "not ours")
+	if err == nil || !strings.Contains(err.Error(), "lab LAB-1") {
+		t.Errorf("certificate of LAB-1 was revoked by an analyst of LAB-2, got %v", err)
+	}
+}
+
+func TestRevokeCertificateHoldsBatch(t *testing.T) {
+	ledger := newTestLedger()
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, Status: "testing"})
+	ledger.put(t, "QC-1", QCCertificate{ID: "QC-1", Type: "QCCertificate", CertificateID: "QC-1", BatchID: "BATCH-1", LabID: "LAB-1", OverallResult: "PASS", Version: 1, Status: "issued", IssuerMSP: "TestingLabsMSP"})
+
+	tx := ledger.begin("revoke")
+	err := new(HerbalTraceContract).RevokeCertificate(tx.context(testAnalyst), "QC-1", "sample mix-up")
+	if err != nil {
+		t.Fatalf("revocation failed: %v", err)
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("revocation did not commit: %v", err)
+	}
+
+	var batch Batch
+	ledger.get(t, "BATCH-1", &batch)
+	if !strings.Contains(batch.QCHold, "QC-1") {
+		t.Errorf("batch QC hold = %q, want it to name revoked certificate QC-1", batch.QCHold)
+	}
+}
+
+func TestQCHoldBlocksBatchWork(t *testing.T) {
+	ledger := newQCLedger(t)
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, Status: "testing", QCHold: "QC certificate QC-0 revoked"})
+	contract := new(HerbalTraceContract)
+	tx := ledger.begin("work")
+
+	if err := contract.UpdateBatchStatus(tx.context(testAnalyst), "BATCH-1", "processing"); err == nil {
+		t.Errorf("held batch moved to processing")
+	}
+	if err := contract.CreateProcessingStep(tx.context(testAnalyst), `{"id":"STEP-1","batchId":"BATCH-1"}`); err == nil {
+		t.Errorf("processing step recorded for a held batch")
+	}
+	if err := contract.CreateProduct(tx.context(testManufacturer), `{"id":"PROD-1","batchId":"BATCH-1"}`); err == nil {
+		t.Errorf("product made from a held batch")
+	}
+}
+
+func TestPassingCertificateReleasesHold(t *testing.T) {
+	ledger := newQCLedger(t)
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, Status: "testing", QCHold: "QC certificate QC-0 revoked"})
+
+	recordCertificate(t, ledger, "record", `{"id":"QC-1","testId":"QT-1","testType":"moisture","overallResult":"PASS"}`)
+
+	var batch Batch
+	ledger.get(t, "BATCH-1", &batch)
+	if batch.QCHold != "" || batch.Status != "quality_tested" {
+		t.Errorf("batch after passing certificate has status %q and hold %q", batch.Status, batch.QCHold)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxConditionLength bounds the size of an alert rule condition
+const maxConditionLength = 500
+
+// ruleExpr is a parsed alert rule condition. Conditions compare record fields with literals, e.g.
+// overallResult == "fail" && (moistureContent > 12 || !context.inSeason). Fields are JSON field
+// names; nested values are reached with dots. Evaluation depends on the facts alone, so every
+// endorsing peer reaches the same result.
+type ruleExpr interface {
+	eval(facts map[string]interface{}) interface{}
+}
+
+type ruleLiteral struct{ value interface{} }
+
+type ruleField struct{ path []string }
+
+type ruleNot struct{ operand ruleExpr }
+
+type ruleLogical struct {
+	op          string // "&&", "||"
+	left, right ruleExpr
+}
+
+type ruleComparison struct {
+	op          string // "==", "!=", "<", "<=", ">", ">="
+	left, right ruleExpr
+}
+
+func (e ruleLiteral) eval(facts map[string]interface{}) interface{} { return e.value }
+
+func (e ruleField) eval(facts map[string]interface{}) interface{} {
+	var value interface{} = facts
+	for _, part := range e.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return normalizeFact(value)
+}
+
+func (e ruleNot) eval(facts map[string]interface{}) interface{} {
+	return !ruleTruthy(e.operand.eval(facts))
+}
+
+func (e ruleLogical) eval(facts map[string]interface{}) interface{} {
+	left := ruleTruthy(e.left.eval(facts))
+	if e.op == "&&" {
+		return left && ruleTruthy(e.right.eval(facts))
+	}
+	return left || ruleTruthy(e.right.eval(facts))
+}
+
+// eval compares numbers numerically and strings lexically. Values of different types, including
+// missing fields, are only ever unequal.
+func (e ruleComparison) eval(facts map[string]interface{}) interface{} {
+	left := e.left.eval(facts)
+	right := e.right.eval(facts)
+
+	var order int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return e.op == "!="
+		}
+		switch {
+		case l < r:
+			order = -1
+		case l > r:
+			order = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return e.op == "!="
+		}
+		order = strings.Compare(l, r)
+	default:
+		equal := left == right
+		switch e.op {
+		case "==":
+			return equal
+		case "!=":
+			return !equal
+		}
+		return false
+	}
+
+	switch e.op {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// ruleTokenPattern splits a condition into strings, numbers, names, operators and parentheses
+var ruleTokenPattern = regexp.MustCompile(`^\s*("(?:[^"\\]|\\.)*"|-?[0-9]+(?:\.[0-9]+)?|[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*|==|!=|<=|>=|&&|\|\||[<>!()])`)
+
+// ruleParser is a recursive descent parser for alert rule conditions
+type ruleParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseRuleCondition parses an alert rule condition. An empty condition always holds.
+func parseRuleCondition(condition string) (ruleExpr, error) {
+	if len(condition) > maxConditionLength {
+		return nil, fmt.Errorf("condition is longer than %d characters", maxConditionLength)
+	}
+	if strings.TrimSpace(condition) == "" {
+		return ruleLiteral{value: true}, nil
+	}
+
+	var tokens []string
+	rest := condition
+	for strings.TrimSpace(rest) != "" {
+		match := ruleTokenPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected input at %q", strings.TrimSpace(rest))
+		}
+		tokens = append(tokens, match[1])
+		rest = rest[len(match[0]):]
+	}
+
+	parser := &ruleParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.pos])
+	}
+
+	return expr, nil
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *ruleParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleLogical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleLogical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return ruleNot{operand: operand}, nil
+	case "(":
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return expr, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return ruleComparison{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseOperand() (ruleExpr, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("condition ends unexpectedly")
+	case token == "true" || token == "false":
+		return ruleLiteral{value: token == "true"}, nil
+	case token == "null":
+		return ruleLiteral{value: nil}, nil
+	case strings.HasPrefix(token, `"`):
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s: %v", token, err)
+		}
+		return ruleLiteral{value: value}, nil
+	case token[0] == '-' || (token[0] >= '0' && token[0] <= '9'):
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s: %v", token, err)
+		}
+		return ruleLiteral{value: value}, nil
+	case ruleFieldPattern.MatchString(token):
+		return ruleField{path: strings.Split(token, ".")}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// ruleFieldPattern matches a field reference in conditions, templates and dedup scopes
+var ruleFieldPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// ruleTemplatePattern matches a {{field}} or {{field|%.2f}} placeholder in a message template
+var ruleTemplatePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.]+)\s*(?:\|\s*(%[-+# 0-9.]*[a-zA-Z])\s*)?\}\}`)
+
+// renderRuleTemplate fills the placeholders of a message template from the facts. Missing fields render empty.
+func renderRuleTemplate(template string, facts map[string]interface{}) string {
+	return ruleTemplatePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		match := ruleTemplatePattern.FindStringSubmatch(placeholder)
+		value := ruleField{path: strings.Split(match[1], ".")}.eval(facts)
+		if value == nil {
+			return ""
+		}
+		if match[2] != "" {
+			return fmt.Sprintf(match[2], value)
+		}
+		return formatFact(value)
+	})
+}
+
+// validateRuleTemplate checks that every placeholder of a message template is well formed
+func validateRuleTemplate(template string) error {
+	for _, match := range ruleTemplatePattern.FindAllStringSubmatch(template, -1) {
+		if !ruleFieldPattern.MatchString(match[1]) {
+			return fmt.Errorf("invalid field %q in template", match[1])
+		}
+	}
+	if strings.Count(template, "{{") != len(ruleTemplatePattern.FindAllString(template, -1)) {
+		return fmt.Errorf("malformed placeholder in template")
+	}
+	return nil
+}
+
+// ruleFacts builds the facts a rule is evaluated against: the record's JSON fields plus trigger
+// specific values under "context"
+func ruleFacts(record interface{}, context map[string]interface{}) (map[string]interface{}, error) {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %v", err)
+	}
+	facts := make(map[string]interface{})
+	err = json.Unmarshal(recordBytes, &facts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record: %v", err)
+	}
+
+	contextFacts := make(map[string]interface{})
+	for key, value := range context {
+		contextFacts[key] = normalizeFact(value)
+	}
+	facts["context"] = contextFacts
+
+	return facts, nil
+}
+
+// normalizeFact converts Go numbers to float64 so facts compare like JSON values
+func normalizeFact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+// formatFact renders a fact for a message template
+func formatFact(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	valueBytes, _ := json.Marshal(value)
+	return string(valueBytes)
+}
+
+// ruleTruthy reports whether a value counts as true in a condition
+func ruleTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case nil:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// ruleTestFacts are the facts the condition tests are evaluated against
+func ruleTestFacts(t *testing.T) map[string]interface{} {
+	t.Helper()
+	record := map[string]interface{}{
+		"overallResult":   "fail",
+		"moistureContent": 14.5,
+		"grade":           "B",
+		"approvedZone":    false,
+		"labId":           "",
+		"heavyMetals":     map[string]interface{}{"lead": 0.4},
+	}
+	facts, err := ruleFacts(record, map[string]interface{}{"inSeason": true, "count": 3})
+	if err != nil {
+		t.Fatalf("failed to build facts: %v", err)
+	}
+	return facts
+}
+
+func TestRuleConditionEvaluation(t *testing.T) {
+	facts := ruleTestFacts(t)
+
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{``, true},
+		{`overallResult == "fail"`, true},
+		{`overallResult != "fail"`, false},
+		{`moistureContent > 12`, true},
+		{`moistureContent <= 14.5`, true},
+		{`moistureContent >= 14.6`, false},
+		{`heavyMetals.lead < 0.5`, true},
+		{`context.count == 3`, true},
+		{`context.inSeason`, true},
+		{`grade < "C"`, true},
+		{`approvedZone == false`, true},
+
+		// && binds tighter than ||, parentheses override it
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`overallResult == "pass" || moistureContent > 12 && context.inSeason`, true},
+		{`(overallResult == "pass" || moistureContent > 12) && !context.inSeason`, false},
+
+		// ! applies to the whole comparison that follows it and can be repeated
+		{`!moistureContent == 1`, true},
+		{`!context.inSeason`, false},
+		{`!!context.inSeason`, true},
+		{`!(moistureContent > 12 && context.inSeason)`, false},
+		{`!approvedZone && !labId`, true},
+
+		// Values of different types are only ever unequal
+		{`moistureContent > "12"`, false},
+		{`moistureContent == "14.5"`, false},
+		{`moistureContent != "14.5"`, true},
+		{`overallResult < 1`, false},
+		{`approvedZone == 0`, false},
+		{`approvedZone >= false`, false},
+
+		// Missing fields are null
+		{`missingField == null`, true},
+		{`missingField > 0`, false},
+		{`missingField < 0`, false},
+		{`missingField != 0`, true},
+		{`missingField`, false},
+		{`!missingField`, true},
+		{`heavyMetals.mercury == null`, true},
+		{`overallResult.code == null`, true},
+		{`context.missing.deep == "x"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			expr, err := parseRuleCondition(tt.condition)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got := ruleTruthy(expr.eval(facts)); got != tt.want {
+				t.Errorf("condition evaluated to %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleConditionParseErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+	}{
+		{"missing operand", `moistureContent >`},
+		{"missing closing parenthesis", `(moistureContent > 12`},
+		{"unbalanced closing parenthesis", `moistureContent > 12)`},
+		{"dangling operator", `moistureContent > 12 &&`},
+		{"adjacent operands", `overallResult "fail"`},
+		{"chained comparison", `1 < moistureContent < 20`},
+		{"single equals", `overallResult = "fail"`},
+		{"unknown character", `moistureContent > 12 $ 1`},
+		{"unterminated string", `overallResult == "fail`},
+		{"empty field segment", `heavyMetals..lead > 1`},
+		{"operator without left operand", `== 1`},
+		{"over the length limit", `"` + strings.Repeat("a", maxConditionLength-1) + `"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseRuleCondition(tt.condition); err == nil {
+				t.Errorf("condition %q parsed", tt.condition)
+			}
+		})
+	}
+}
+
+func TestRuleConditionLengthLimit(t *testing.T) {
+	condition := `"` + strings.Repeat("a", maxConditionLength-2) + `"`
+	if len(condition) != maxConditionLength {
+		t.Fatalf("condition is %d characters, want %d", len(condition), maxConditionLength)
+	}
+	if _, err := parseRuleCondition(condition); err != nil {
+		t.Errorf("condition of exactly %d characters was rejected: %v", maxConditionLength, err)
+	}
+	if _, err := parseRuleCondition(condition + " "); err == nil {
+		t.Errorf("condition of %d characters parsed", maxConditionLength+1)
+	}
+}
+
+func TestRenderRuleTemplate(t *testing.T) {
+	facts := ruleTestFacts(t)
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`Result {{overallResult}}`, `Result fail`},
+		{`Moisture {{ moistureContent }}%`, `Moisture 14.5%`},
+		{`Moisture {{moistureContent|%.2f}}`, `Moisture 14.50`},
+		{`Lead {{heavyMetals.lead}}, {{context.count}} in a row`, `Lead 0.4, 3 in a row`},
+		{`In season: {{context.inSeason}}`, `In season: true`},
+		{`Missing [{{missingField}}] [{{missingField|%.2f}}]`, `Missing [] []`},
+		{`Metals {{heavyMetals}}`, `Metals {"lead":0.4}`},
+		{`No placeholders`, `No placeholders`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if err := validateRuleTemplate(tt.template); err != nil {
+				t.Fatalf("template rejected: %v", err)
+			}
+			if got := renderRuleTemplate(tt.template, facts); got != tt.want {
+				t.Errorf("rendered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRuleTemplateRejectsBadPlaceholders(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{"unclosed placeholder", `Moisture {{moistureContent`},
+		{"empty placeholder", `Moisture {{}}`},
+		{"empty field segment", `Lead {{heavyMetals..lead}}`},
+		{"field starting with a digit", `Value {{1field}}`},
+		{"format without verb", `Moisture {{moistureContent|%}}`},
+		{"format without percent", `Moisture {{moistureContent|.2f}}`},
+		{"invalid field character", `Value {{field-name}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRuleTemplate(tt.template); err == nil {
+				t.Errorf("template %q was accepted", tt.template)
+			}
+		})
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Counterfeit detection thresholds
+const (
+	scanMaxTravelSpeedKmh   = 900.0 // Faster than an airliner means two physical packs
+	scanMinTravelAlertKm    = 100.0 // Coarse locations within this distance are never flagged
+	scanLocationPrecision   = 2     // Decimal places kept from scan coordinates (~1 km)
+	counterfeitAlertType    = "counterfeit_suspected"
+	ruleImpossibleTravel    = "impossible_travel"
+	ruleScansExceedUnits    = "scans_exceed_units"
+	ruleScannedAfterSoldOut = "scanned_after_sold_out"
+	ruleVoidSerialScanned   = "void_serial_scanned"
+)
+
+// ProductScan records a single consumer or trade scan of a product QR code
+type ProductScan struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`             // "ProductScan"
+	QRCode    string   `json:"qrCode"`           // Lot QR code or unit serial
+	Serial    string   `json:"serial,omitempty"` // Set when a unit serial was scanned
+	ProductID string   `json:"productId"`
+	ScanTime  string   `json:"scanTime"`
+	Latitude  float64  `json:"latitude,omitempty"` // Rounded to a coarse location
+	Longitude float64  `json:"longitude,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Country   string   `json:"country,omitempty"`
+	Channel   string   `json:"channel"`             // "consumer_app", "web", "retail", "distributor", "customs", "other"
+	Suspected []string `json:"suspected,omitempty"` // Counterfeit rules triggered by this scan
+	Timestamp string   `json:"timestamp"`
+	CheckedAt string   `json:"checkedAt,omitempty"` // When CheckScan compared the scan with earlier scans
+}
+
+// productScanObjectType keys scan records by QR code, so each scan is its own record and
+// concurrent scans of one code never write the same key
+const productScanObjectType = "productScan"
+
+// QRScanStatistics aggregates the scans of one QR code
+type QRScanStatistics struct {
+	ID                   string         `json:"id"`
+	Type                 string         `json:"type"` // "QRScanStatistics"
+	QRCode               string         `json:"qrCode"`
+	ProductID            string         `json:"productId"`
+	TotalScans           int            `json:"totalScans"`
+	ChannelCounts        map[string]int `json:"channelCounts"`
+	CountryCounts        map[string]int `json:"countryCounts"`
+	FirstScanTime        string         `json:"firstScanTime"`
+	LastScanTime         string         `json:"lastScanTime"`
+	LastLatitude         float64        `json:"lastLatitude,omitempty"`
+	LastLongitude        float64        `json:"lastLongitude,omitempty"`
+	LastLocation         string         `json:"lastLocation,omitempty"`
+	HasLastPosition      bool           `json:"hasLastPosition"`
+	SuspectedCounterfeit bool           `json:"suspectedCounterfeit"`
+	TriggeredRules       map[string]int `json:"triggeredRules"` // Rule name to number of scans that triggered it
+	UpdatedAt            string         `json:"updatedAt"`
+}
+
+// RecordScan records a scan of a product QR code. Rules that depend on earlier scans of the
+// code are checked by CheckScan in a separate transaction, so scans never conflict.
+func (c *HerbalTraceContract) RecordScan(ctx contractapi.TransactionContextInterface, scanJSON string) (*ProductScan, error) {
+	var scan ProductScan
+	err := json.Unmarshal([]byte(scanJSON), &scan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scan: %v", err)
+	}
+
+	if scan.QRCode == "" {
+		return nil, fmt.Errorf("QR code is required")
+	}
+	validChannels := map[string]bool{
+		"consumer_app": true,
+		"web":          true,
+		"retail":       true,
+		"distributor":  true,
+		"customs":      true,
+		"other":        true,
+	}
+	if scan.Channel == "" {
+		scan.Channel = "consumer_app"
+	}
+	if !validChannels[scan.Channel] {
+		return nil, fmt.Errorf("invalid scan channel: %s", scan.Channel)
+	}
+	if scan.Latitude < -90 || scan.Latitude > 90 || scan.Longitude < -180 || scan.Longitude > 180 {
+		return nil, fmt.Errorf("invalid scan coordinates: %f, %f", scan.Latitude, scan.Longitude)
+	}
+
+	product, serial, err := c.resolveScanCode(ctx, scan.QRCode)
+	if err != nil {
+		return nil, err
+	}
+	// A unit serial is kept on the ledger by reference only
+	if serial != nil {
+		scan.Serial = serialRef(serial)
+		scan.QRCode = scan.Serial
+	}
+
+	// The scan is timed by the transaction, not by the client
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	scanTime := txTimestamp.AsTime().UTC()
+
+	// Only a coarse location is kept on the ledger
+	scan.Latitude = roundCoordinate(scan.Latitude)
+	scan.Longitude = roundCoordinate(scan.Longitude)
+	scan.ID = "SCAN_" + ctx.GetStub().GetTxID()
+	scan.Type = "ProductScan"
+	scan.ProductID = product.ID
+	scan.ScanTime = scanTime.Format(time.RFC3339)
+	scan.Timestamp = scan.ScanTime
+	scan.Suspected = checkScanRules(product, serial, &scan, scanTime)
+	scan.CheckedAt = ""
+
+	err = putProductScan(ctx, &scan)
+	if err != nil {
+		return nil, err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":            "ProductScanned",
+		"scanId":               scan.ID,
+		"qrCode":               scan.QRCode,
+		"productId":            scan.ProductID,
+		"channel":              scan.Channel,
+		"country":              scan.Country,
+		"suspectedCounterfeit": len(scan.Suspected) > 0,
+		"triggeredRules":       scan.Suspected,
+		"timestamp":            scan.ScanTime,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("ProductScanned", eventBytes)
+
+	return &scan, nil
+}
+
+// CheckScan checks a recorded scan against the scans of its code before it and raises a
+// counterfeit alert for each rule it triggered. Checking a scan again changes nothing.
+func (c *HerbalTraceContract) CheckScan(ctx contractapi.TransactionContextInterface, qrCode string, scanID string) (*ProductScan, error) {
+	scan, err := getProductScan(ctx, qrCode, scanID)
+	if err != nil {
+		return nil, err
+	}
+	if scan.CheckedAt != "" {
+		return scan, nil
+	}
+
+	product, err := c.GetProduct(ctx, scan.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	var serial *ProductSerial
+	if scan.Serial != "" {
+		serial, err = readSerial(ctx, serialKey(scan.Serial))
+		if err != nil {
+			return nil, err
+		}
+	}
+	previous, err := c.aggregateScanStatistics(ctx, qrCode, scan)
+	if err != nil {
+		return nil, err
+	}
+	scanTime := activityTime(scan.ScanTime)
+	scan.Suspected = append(scan.Suspected, checkScanHistoryRules(product, serial, previous, scan, scanTime)...)
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	scan.CheckedAt = txTimestamp.AsTime().UTC().Format(time.RFC3339)
+
+	err = putProductScan(ctx, scan)
+	if err != nil {
+		return nil, err
+	}
+
+	// Raise a counterfeit alert for each rule the scan triggered
+	for _, rule := range scan.Suspected {
+		err = c.raiseCounterfeitAlert(ctx, product, scan, previous, rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(scan.Suspected) > 0 {
+		eventPayload := map[string]interface{}{
+			"eventType":      "CounterfeitSuspected",
+			"scanId":         scan.ID,
+			"qrCode":         scan.QRCode,
+			"productId":      scan.ProductID,
+			"triggeredRules": scan.Suspected,
+			"timestamp":      scan.CheckedAt,
+		}
+		eventBytes, _ := json.Marshal(eventPayload)
+		ctx.GetStub().SetEvent("CounterfeitSuspected", eventBytes)
+	}
+
+	return scan, nil
+}
+
+// GetScanStatistics aggregates the scans of a QR code or unit serial, empty if it was never scanned
+func (c *HerbalTraceContract) GetScanStatistics(ctx contractapi.TransactionContextInterface, qrCode string) (*QRScanStatistics, error) {
+	serial, err := findSerial(ctx, qrCode)
+	if err != nil {
+		return nil, err
+	}
+	if serial != nil {
+		qrCode = serialRef(serial)
+	}
+
+	return c.aggregateScanStatistics(ctx, qrCode, nil)
+}
+
+// aggregateScanStatistics folds the scan records of a QR code into statistics, starting from the
+// totals kept before scans had their own records. When before is set, only scans ordered before
+// it are counted.
+func (c *HerbalTraceContract) aggregateScanStatistics(ctx contractapi.TransactionContextInterface, qrCode string, before *ProductScan) (*QRScanStatistics, error) {
+	statsID := "SCANSTATS_" + qrCode
+	statsBytes, err := ctx.GetStub().GetState(statsID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scan statistics: %v", err)
+	}
+
+	stats := &QRScanStatistics{
+		ID:     statsID,
+		Type:   "QRScanStatistics",
+		QRCode: qrCode,
+	}
+	if statsBytes != nil {
+		err = json.Unmarshal(statsBytes, stats)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal scan statistics: %v", err)
+		}
+	}
+	if stats.ChannelCounts == nil {
+		stats.ChannelCounts = make(map[string]int)
+	}
+	if stats.CountryCounts == nil {
+		stats.CountryCounts = make(map[string]int)
+	}
+	if stats.TriggeredRules == nil {
+		stats.TriggeredRules = make(map[string]int)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productScanObjectType, []string{qrCode})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scans: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var scans []*ProductScan
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate scans: %v", err)
+		}
+		var scan ProductScan
+		err = json.Unmarshal(queryResponse.Value, &scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal scan %s: %v", queryResponse.Key, err)
+		}
+		if before == nil || scanOrderedBefore(&scan, before) {
+			scans = append(scans, &scan)
+		}
+	}
+	sort.SliceStable(scans, func(i, j int) bool {
+		return scanOrderedBefore(scans[i], scans[j])
+	})
+
+	for _, scan := range scans {
+		stats.ProductID = scan.ProductID
+		stats.TotalScans++
+		stats.ChannelCounts[scan.Channel]++
+		if scan.Country != "" {
+			stats.CountryCounts[scan.Country]++
+		}
+		if stats.FirstScanTime == "" || scan.ScanTime < stats.FirstScanTime {
+			stats.FirstScanTime = scan.ScanTime
+		}
+		if stats.LastScanTime == "" || scan.ScanTime >= stats.LastScanTime {
+			stats.LastScanTime = scan.ScanTime
+			if hasScanPosition(scan) {
+				stats.LastLatitude = scan.Latitude
+				stats.LastLongitude = scan.Longitude
+				stats.HasLastPosition = true
+			}
+			stats.LastLocation = firstNonEmpty(scan.City, scan.Country, stats.LastLocation)
+		}
+		for _, rule := range scan.Suspected {
+			stats.TriggeredRules[rule]++
+			stats.SuspectedCounterfeit = true
+		}
+		stats.UpdatedAt = firstNonEmpty(scan.CheckedAt, scan.Timestamp)
+	}
+
+	return stats, nil
+}
+
+// scanOrderedBefore orders scans by scan time, then by ID
+func scanOrderedBefore(a *ProductScan, b *ProductScan) bool {
+	if a.ScanTime != b.ScanTime {
+		return a.ScanTime < b.ScanTime
+	}
+	return a.ID < b.ID
+}
+
+// productScanKey returns the ledger key of a scan record
+func productScanKey(ctx contractapi.TransactionContextInterface, qrCode string, scanID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(productScanObjectType, []string{qrCode, scanID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create scan key: %v", err)
+	}
+	return key, nil
+}
+
+// getProductScan reads a scan record
+func getProductScan(ctx contractapi.TransactionContextInterface, qrCode string, scanID string) (*ProductScan, error) {
+	key, err := productScanKey(ctx, qrCode, scanID)
+	if err != nil {
+		return nil, err
+	}
+	scanBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scan: %v", err)
+	}
+	if scanBytes == nil {
+		return nil, fmt.Errorf("scan %s of QR code %s does not exist", scanID, qrCode)
+	}
+
+	var scan ProductScan
+	err = json.Unmarshal(scanBytes, &scan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scan: %v", err)
+	}
+
+	return &scan, nil
+}
+
+// putProductScan saves a scan record
+func putProductScan(ctx contractapi.TransactionContextInterface, scan *ProductScan) error {
+	key, err := productScanKey(ctx, scan.QRCode, scan.ID)
+	if err != nil {
+		return err
+	}
+	scanBytes, err := json.Marshal(scan)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scan: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, scanBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save scan: %v", err)
+	}
+
+	return nil
+}
+
+var scansByQRCodeQuery = defineQuery("scansByQRCode",
+	`{"selector":{"type":"ProductScan","qrCode":"%s"}}`,
+	"type", "qrCode")
+
+// GetScansByQRCode retrieves all scans of a QR code in scan time order
+func (c *HerbalTraceContract) GetScansByQRCode(ctx contractapi.TransactionContextInterface, qrCode string) ([]*ProductScan, error) {
+	queryString := scansByQRCodeQuery.format(qrCode)
+
+	var scans []*ProductScan
+	err := queryRecords(ctx, queryString, func(value []byte) error {
+		var scan ProductScan
+		err := json.Unmarshal(value, &scan)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal scan: %v", err)
+		}
+		scans = append(scans, &scan)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(scans, func(i, j int) bool {
+		return scanOrderedBefore(scans[i], scans[j])
+	})
+
+	return scans, nil
+}
+
+// checkScanRules returns the counterfeit rules a scan triggers on its own
+func checkScanRules(product *Product, serial *ProductSerial, scan *ProductScan, scanTime time.Time) []string {
+	triggered := []string{}
+
+	// Scans after the last pack was sold
+	if product.Status == "sold_out" && product.SoldOutDate != "" && !scanTime.Before(activityTime(product.SoldOutDate)) {
+		triggered = append(triggered, ruleScannedAfterSoldOut)
+	}
+
+	// A voided unit should never reach a consumer
+	if serial != nil && serial.Status == "void" {
+		triggered = append(triggered, ruleVoidSerialScanned)
+	}
+
+	return triggered
+}
+
+// checkScanHistoryRules returns the counterfeit rules a scan triggers given the scans before it
+func checkScanHistoryRules(product *Product, serial *ProductSerial, stats *QRScanStatistics, scan *ProductScan, scanTime time.Time) []string {
+	triggered := []string{}
+
+	// One code seen in two places no traveller could connect
+	if stats.HasLastPosition && hasScanPosition(scan) {
+		distance := haversineKm(stats.LastLatitude, stats.LastLongitude, scan.Latitude, scan.Longitude)
+		lastTime := activityTime(stats.LastScanTime)
+		hours := math.Abs(scanTime.Sub(lastTime).Hours())
+		if distance >= scanMinTravelAlertKm && (hours == 0 || distance/hours > scanMaxTravelSpeedKmh) {
+			triggered = append(triggered, ruleImpossibleTravel)
+		}
+	}
+
+	// More scans of a lot code than packs were ever produced
+	if serial == nil && product.UnitsProduced > 0 && stats.TotalScans+1 > product.UnitsProduced {
+		triggered = append(triggered, ruleScansExceedUnits)
+	}
+
+	return triggered
+}
+
+// raiseCounterfeitAlert records a counterfeit-suspected alert for a triggered rule, given the
+// statistics as they were before the scan
+func (c *HerbalTraceContract) raiseCounterfeitAlert(ctx contractapi.TransactionContextInterface, product *Product, scan *ProductScan, previous *QRScanStatistics, rule string) error {
+	alert := Alert{
+		ID:         fmt.Sprintf("alert_counterfeit_%s_%s", rule, scan.ID),
+		AlertType:  counterfeitAlertType,
+		Severity:   "high",
+		EntityID:   product.ID,
+		EntityType: "Product",
+		CreatedBy:  "system",
+		DedupKey:   alertDedupKey(counterfeitAlertType, rule, product.ID),
+	}
+
+	location := firstNonEmpty(scan.City, scan.Country, "unknown location")
+	switch rule {
+	case ruleImpossibleTravel:
+		alert.Message = "QR code scanned in geographically impossible places"
+		alert.Details = fmt.Sprintf("QR code %s scanned at %s (%.2f, %.2f) on %s, previously at %s (%.2f, %.2f) on %s",
+			scan.QRCode, location, scan.Latitude, scan.Longitude, scan.ScanTime,
+			firstNonEmpty(previous.LastLocation, "unknown location"), previous.LastLatitude, previous.LastLongitude, previous.LastScanTime)
+	case ruleScansExceedUnits:
+		alert.Severity = "critical"
+		alert.Message = "QR code scanned more times than units produced"
+		alert.Details = fmt.Sprintf("QR code %s has been scanned %d times but only %d units were produced", scan.QRCode, previous.TotalScans+1, product.UnitsProduced)
+	case ruleScannedAfterSoldOut:
+		alert.Message = "QR code scanned after the product sold out"
+		alert.Details = fmt.Sprintf("QR code %s scanned at %s on %s, after the product sold out on %s", scan.QRCode, location, scan.ScanTime, product.SoldOutDate)
+	case ruleVoidSerialScanned:
+		alert.Message = "Voided unit serial scanned"
+		alert.Details = fmt.Sprintf("Serial %s scanned at %s on %s", scan.Serial, location, scan.ScanTime)
+	}
+
+	err := c.createAlert(ctx, &alert)
+	if err != nil {
+		return fmt.Errorf("failed to create counterfeit alert: %v", err)
+	}
+
+	return nil
+}
+
+// resolveScanCode resolves a scanned code, either a lot QR code or a unit serial, to its product
+func (c *HerbalTraceContract) resolveScanCode(ctx contractapi.TransactionContextInterface, code string) (*Product, *ProductSerial, error) {
+	serial, err := findSerial(ctx, code)
+	if err != nil {
+		return nil, nil, err
+	}
+	if serial == nil {
+		product, err := c.GetProductByQRCode(ctx, code)
+		return product, nil, err
+	}
+
+	product, err := c.GetProduct(ctx, serial.ProductID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return product, serial, nil
+}
+
+// hasScanPosition reports whether a scan carries coordinates
+func hasScanPosition(scan *ProductScan) bool {
+	return scan.Latitude != 0 || scan.Longitude != 0
+}
+
+// roundCoordinate reduces a coordinate to a coarse location
+func roundCoordinate(value float64) float64 {
+	scale := math.Pow(10, scanLocationPrecision)
+	return math.Round(value*scale) / scale
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testConsumer = testIdentity{id: "consumer-app", mspID: "FarmersCoopMSP"}
+
+// newScanLedger returns a ledger holding a product with a lot QR code
+func newScanLedger(t *testing.T) *testLedger {
+	ledger := newTestLedger()
+	ledger.put(t, "PROD-1", Product{ID: "PROD-1", Type: "Product", ProductName: "Ashwagandha powder", QRCode: "QR-1", UnitsProduced: 100, Status: "manufactured"})
+	return ledger
+}
+
+// endorseScan simulates RecordScan for a scan of QR-1 at a location
+func endorseScan(t *testing.T, ledger *testLedger, txID string, latitude float64, longitude float64) (*testTx, *ProductScan) {
+	t.Helper()
+	tx := ledger.begin(txID)
+	contract := new(HerbalTraceContract)
+	scan, err := contract.RecordScan(tx.context(testConsumer), `{"qrCode":"QR-1","scanTime":"2020-01-01T00:00:00Z","latitude":`+formatCoordinate(latitude)+`,"longitude":`+formatCoordinate(longitude)+`}`)
+	if err != nil {
+		t.Fatalf("scan was rejected: %v", err)
+	}
+	return tx, scan
+}
+
+// formatCoordinate writes a coordinate as a JSON number
+func formatCoordinate(value float64) string {
+	return fmt.Sprintf("%g", value)
+}
+
+func TestParallelScansOfOneCodeCommit(t *testing.T) {
+	ledger := newScanLedger(t)
+
+	first, firstScan := endorseScan(t, ledger, "scan-delhi", 28.61, 77.21)
+	second, _ := endorseScan(t, ledger, "scan-london", 51.51, -0.13)
+	if err := ledger.commit(first); err != nil {
+		t.Fatalf("first scan did not commit: %v", err)
+	}
+	if err := ledger.commit(second); err != nil {
+		t.Fatalf("second scan of the same code did not commit: %v", err)
+	}
+
+	if firstScan.ScanTime != testTime.Format(time.RFC3339) {
+		t.Errorf("scan time = %s, want the transaction time %s", firstScan.ScanTime, testTime.Format(time.RFC3339))
+	}
+
+	tx := ledger.begin("read-stats")
+	stats, err := new(HerbalTraceContract).GetScanStatistics(tx.context(testConsumer), "QR-1")
+	if err != nil {
+		t.Fatalf("failed to read scan statistics: %v", err)
+	}
+	if stats.TotalScans != 2 {
+		t.Errorf("total scans = %d, want 2", stats.TotalScans)
+	}
+}
+
+func TestCheckScanFlagsImpossibleTravel(t *testing.T) {
+	ledger := newScanLedger(t)
+	contract := new(HerbalTraceContract)
+
+	var scans []*ProductScan
+	for _, location := range []struct {
+		txID      string
+		latitude  float64
+		longitude float64
+	}{{"scan-a-delhi", 28.61, 77.21}, {"scan-b-london", 51.51, -0.13}} {
+		tx, scan := endorseScan(t, ledger, location.txID, location.latitude, location.longitude)
+		if err := ledger.commit(tx); err != nil {
+			t.Fatalf("scan did not commit: %v", err)
+		}
+		scans = append(scans, scan)
+	}
+
+	check := func(txID string, scan *ProductScan) *ProductScan {
+		t.Helper()
+		tx := ledger.begin(txID)
+		checked, err := contract.CheckScan(tx.context(testConsumer), "QR-1", scan.ID)
+		if err != nil {
+			t.Fatalf("scan check failed: %v", err)
+		}
+		if err = ledger.commit(tx); err != nil {
+			t.Fatalf("scan check did not commit: %v", err)
+		}
+		return checked
+	}
+
+	first := check("check-1", scans[0])
+	if len(first.Suspected) != 0 {
+		t.Errorf("first scan triggered %v", first.Suspected)
+	}
+	second := check("check-2", scans[1])
+	if len(second.Suspected) != 1 || second.Suspected[0] != ruleImpossibleTravel {
+		t.Errorf("second scan triggered %v, want %s", second.Suspected, ruleImpossibleTravel)
+	}
+	if alerts := committedAlerts(t, ledger); len(alerts) != 1 {
+		t.Errorf("raised %d alerts, want 1", len(alerts))
+	}
+
+	// Checking a scan again raises nothing new
+	check("check-3", scans[1])
+	if alerts := committedAlerts(t, ledger); len(alerts) != 1 || alerts[0].OccurrenceCount > 1 {
+		t.Errorf("repeated check changed the alerts: %+v", alerts)
+	}
+}
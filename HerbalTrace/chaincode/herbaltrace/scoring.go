@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ScoringModel configures how the sustainability score is calculated. Each factor scores a
+// product between 0 and 1; the final score is the weighted average scaled to 0-100.
+type ScoringModel struct {
+	ID                   string             `json:"id"`
+	Type                 string             `json:"type"` // "ScoringModel"
+	Version              int                `json:"version"`
+	Weights              map[string]float64 `json:"weights"`              // Factor name -> weight
+	ConservationScores   map[string]float64 `json:"conservationScores"`   // IUCN category -> 0-1
+	HarvestMethodScores  map[string]float64 `json:"harvestMethodScores"`  // Harvest method -> 0-1
+	PlantPartScores      map[string]float64 `json:"plantPartScores"`      // Plant part -> 0-1
+	UnknownScore         float64            `json:"unknownScore"`         // Used for methods or parts not listed
+	MaxTransportKm       float64            `json:"maxTransportKm"`       // Distance at which the transport factor reaches 0
+	TargetCertifications int                `json:"targetCertifications"` // Valid certifications for a full certification factor
+	UpdatedBy            string             `json:"updatedBy,omitempty"`
+	UpdatedAt            string             `json:"updatedAt,omitempty"`
+}
+
+// ScoreFactor explains one factor's contribution to a sustainability score
+type ScoreFactor struct {
+	Factor    string  `json:"factor"`
+	Weight    float64 `json:"weight"`
+	Value     float64 `json:"value"`  // 0-1
+	Points    float64 `json:"points"` // Contribution to the 0-100 score
+	Available bool    `json:"available"`
+	Detail    string  `json:"detail"`
+}
+
+const (
+	scoringModelKey = "SCORING_MODEL"
+
+	factorSeasonCompliance = "season_compliance"
+	factorZoneCompliance   = "zone_compliance"
+	factorConservation     = "conservation_status"
+	factorHarvestMethod    = "harvest_method"
+	factorPlantPart        = "plant_part"
+	factorTransport        = "transport_distance"
+	factorCertifications   = "certifications"
+	factorQualityTests     = "quality_tests"
+)
+
+// scoringFactors lists the factors in the order they appear in a score breakdown
+var scoringFactors = []string{
+	factorSeasonCompliance,
+	factorZoneCompliance,
+	factorConservation,
+	factorHarvestMethod,
+	factorPlantPart,
+	factorTransport,
+	factorCertifications,
+	factorQualityTests,
+}
+
+// defaultScoringModel is used until a registry admin stores a model on the ledger
+func defaultScoringModel() *ScoringModel {
+	return &ScoringModel{
+		ID:      scoringModelKey,
+		Type:    "ScoringModel",
+		Version: 0,
+		Weights: map[string]float64{
+			factorSeasonCompliance: 15,
+			factorZoneCompliance:   15,
+			factorConservation:     15,
+			factorHarvestMethod:    10,
+			factorPlantPart:        10,
+			factorTransport:        10,
+			factorCertifications:   10,
+			factorQualityTests:     15,
+		},
+		ConservationScores: map[string]float64{
+			"LC": 1.0,
+			"NT": 0.8,
+			"VU": 0.6,
+			"EN": 0.3,
+			"CR": 0.1,
+			"DD": 0.5,
+			"NE": 0.5,
+		},
+		HarvestMethodScores: map[string]float64{
+			"manual":     1.0,
+			"mechanical": 0.6,
+		},
+		// Harvesting roots, bark or the whole plant kills or damages the plant
+		PlantPartScores: map[string]float64{
+			"leaf":        1.0,
+			"flower":      1.0,
+			"fruit":       1.0,
+			"seed":        1.0,
+			"stem":        0.7,
+			"bark":        0.5,
+			"root":        0.3,
+			"rhizome":     0.3,
+			"whole_plant": 0.2,
+		},
+		UnknownScore:         0.5,
+		MaxTransportKm:       2000,
+		TargetCertifications: 2,
+	}
+}
+
+// SetScoringModel stores a new version of the sustainability scoring model (registry admin only)
+func (c *HerbalTraceContract) SetScoringModel(ctx contractapi.TransactionContextInterface, modelJSON string) error {
+	if err := requireRole(ctx, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	var model ScoringModel
+	err := json.Unmarshal([]byte(modelJSON), &model)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal scoring model JSON: %v", err)
+	}
+
+	err = validateScoringModel(&model)
+	if err != nil {
+		return err
+	}
+
+	current, err := c.GetScoringModel(ctx)
+	if err != nil {
+		return err
+	}
+
+	updatedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	model.ID = scoringModelKey
+	model.Type = "ScoringModel"
+	model.Version = current.Version + 1
+	model.UpdatedBy = updatedBy
+	model.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	modelBytes, err := json.Marshal(model)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scoring model: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(scoringModelKey, modelBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save scoring model: %v", err)
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "ScoringModelUpdated",
+		"version":   model.Version,
+		"updatedBy": updatedBy,
+		"timestamp": model.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("ScoringModelUpdated", eventBytes)
+
+	return nil
+}
+
+// GetScoringModel retrieves the current scoring model, or the default model if none is stored
+func (c *HerbalTraceContract) GetScoringModel(ctx contractapi.TransactionContextInterface) (*ScoringModel, error) {
+	modelBytes, err := ctx.GetStub().GetState(scoringModelKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scoring model: %v", err)
+	}
+	if modelBytes == nil {
+		return defaultScoringModel(), nil
+	}
+
+	var model ScoringModel
+	err = json.Unmarshal(modelBytes, &model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scoring model: %v", err)
+	}
+
+	return &model, nil
+}
+
+// validateScoringModel checks weights and factor scores are usable
+func validateScoringModel(model *ScoringModel) error {
+	known := map[string]bool{}
+	for _, factor := range scoringFactors {
+		known[factor] = true
+	}
+
+	var totalWeight float64
+	for factor, weight := range model.Weights {
+		if !known[factor] {
+			return fmt.Errorf("unknown scoring factor: %s", factor)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight for %s must not be negative", factor)
+		}
+		totalWeight += weight
+	}
+	if totalWeight <= 0 {
+		return fmt.Errorf("at least one factor must have a positive weight")
+	}
+
+	for category := range model.ConservationScores {
+		if _, ok := iucnStatusLabels[category]; !ok {
+			return fmt.Errorf("invalid IUCN status: %s", category)
+		}
+	}
+	for _, scores := range []map[string]float64{model.ConservationScores, model.HarvestMethodScores, model.PlantPartScores} {
+		for name, score := range scores {
+			if score < 0 || score > 1 {
+				return fmt.Errorf("score for %s must be between 0 and 1", name)
+			}
+		}
+	}
+	if model.UnknownScore < 0 || model.UnknownScore > 1 {
+		return fmt.Errorf("unknown score must be between 0 and 1")
+	}
+	if model.MaxTransportKm <= 0 {
+		return fmt.Errorf("max transport distance must be greater than zero")
+	}
+	if model.TargetCertifications <= 0 {
+		return fmt.Errorf("target certifications must be greater than zero")
+	}
+
+	return nil
+}
+
+// scoreProvenance evaluates every factor of the model against a provenance bundle. Factors
+// without data are reported as unavailable and left out of the weighted average.
+func (c *HerbalTraceContract) scoreProvenance(ctx contractapi.TransactionContextInterface, model *ScoringModel, prov *Provenance) (float64, []ScoreFactor) {
+	values := map[string]*ScoreFactor{}
+	for _, factor := range scoringFactors {
+		values[factor] = &ScoreFactor{Factor: factor, Weight: model.Weights[factor]}
+	}
+
+	// Collection factors are averaged by quantity so a small side lot does not outweigh the main harvest.
+	// Every recorded event passed the season and zone checks on submission, against dates and GPS the
+	// farmer declared, so those factors rest on the verifier's findings: a verified event scores 1, an
+	// event rejected for a date or location mismatch 0, and an unconfirmed event the unknown score.
+	if len(prov.CollectionEvents) > 0 {
+		var totalQuantity, season, zone, conservation, method, part float64
+		verified, seasonRejected, zoneRejected := 0, 0, 0
+		for _, event := range prov.CollectionEvents {
+			weight := event.Quantity
+			if weight <= 0 {
+				weight = 1
+			}
+			totalQuantity += weight
+
+			seasonValue, zoneValue := model.UnknownScore, model.UnknownScore
+			switch {
+			case event.Status == "verified":
+				seasonValue, zoneValue = 1, 1
+				verified++
+			case event.Status == "rejected" && event.RejectionReason == "harvest_date_mismatch":
+				seasonValue = 0
+				seasonRejected++
+			case event.Status == "rejected" && event.RejectionReason == "location_mismatch":
+				zoneValue = 0
+				zoneRejected++
+			}
+			if !event.ApprovedZone {
+				zoneValue = 0
+			}
+			season += weight * seasonValue
+			zone += weight * zoneValue
+			conservation += weight * c.conservationScore(ctx, model, event.Species)
+			method += weight * lookupScore(model.HarvestMethodScores, event.HarvestMethod, model.UnknownScore)
+			part += weight * lookupScore(model.PlantPartScores, event.PartCollected, model.UnknownScore)
+		}
+
+		setFactor(values[factorSeasonCompliance], season/totalQuantity,
+			fmt.Sprintf("%d of %d collection event(s) verified, %d rejected for harvest date", verified, len(prov.CollectionEvents), seasonRejected))
+		setFactor(values[factorZoneCompliance], zone/totalQuantity,
+			fmt.Sprintf("%d of %d collection event(s) verified, %d rejected for location", verified, len(prov.CollectionEvents), zoneRejected))
+		setFactor(values[factorConservation], conservation/totalQuantity, "IUCN status of collected species")
+		setFactor(values[factorHarvestMethod], method/totalQuantity, "harvest methods of collection events")
+		setFactor(values[factorPlantPart], part/totalQuantity, "plant parts collected")
+	}
+
+	// A route between points at the same place is a real zero distance
+	if prov.RouteMeasured {
+		setFactor(values[factorTransport], math.Max(0, 1-prov.TotalDistance/model.MaxTransportKm),
+			fmt.Sprintf("%.1f km transported", prov.TotalDistance))
+	}
+
+	setFactor(values[factorCertifications], math.Min(1, float64(len(prov.Certifications))/float64(model.TargetCertifications)),
+		fmt.Sprintf("%d valid certification(s)", len(prov.Certifications)))
+
+	if len(prov.QualityTests) > 0 {
+		passed := 0
+		for _, test := range prov.QualityTests {
+			if test.OverallResult != "fail" {
+				passed++
+			}
+		}
+		setFactor(values[factorQualityTests], float64(passed)/float64(len(prov.QualityTests)),
+			fmt.Sprintf("%d of %d quality test(s) passed", passed, len(prov.QualityTests)))
+	}
+
+	// Weighted average over the factors that could be evaluated
+	var totalWeight, weighted float64
+	for _, name := range scoringFactors {
+		factor := values[name]
+		if factor.Available {
+			totalWeight += factor.Weight
+			weighted += factor.Weight * factor.Value
+		}
+	}
+
+	breakdown := make([]ScoreFactor, 0, len(scoringFactors))
+	for _, name := range scoringFactors {
+		factor := values[name]
+		if factor.Available && totalWeight > 0 {
+			factor.Points = roundScore(100 * factor.Weight * factor.Value / totalWeight)
+		}
+		if !factor.Available && factor.Detail == "" {
+			factor.Detail = "no data"
+		}
+		breakdown = append(breakdown, *factor)
+	}
+
+	if totalWeight == 0 {
+		return 0, breakdown
+	}
+	return roundScore(100 * weighted / totalWeight), breakdown
+}
+
+// conservationScore looks up the score for a species' IUCN category
+func (c *HerbalTraceContract) conservationScore(ctx contractapi.TransactionContextInterface, model *ScoringModel, speciesName string) float64 {
+	species, err := c.ResolveSpecies(ctx, speciesName)
+	if err != nil {
+		return model.UnknownScore
+	}
+	return lookupScore(model.ConservationScores, species.IUCNStatus, model.UnknownScore)
+}
+
+// lookupScore returns the configured score for a name, ignoring case and spacing
+func lookupScore(scores map[string]float64, name string, fallback float64) float64 {
+	// Keys are visited in sorted order so the match is the same on every peer
+	keys := make([]string, 0, len(scores))
+	for key := range scores {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if scoreKey(key) == scoreKey(name) {
+			return scores[key]
+		}
+	}
+	return fallback
+}
+
+// scoreKey folds case and spacing so "Whole Plant" matches "whole_plant"
+func scoreKey(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+}
+
+// setFactor records an evaluated factor value
+func setFactor(factor *ScoreFactor, value float64, detail string) {
+	factor.Value = roundScore(value)
+	factor.Available = true
+	factor.Detail = detail
+}
+
+// roundScore rounds to two decimal places so scores are stable across peers
+func roundScore(value float64) float64 {
+	return math.Round(value*100) / 100
+}
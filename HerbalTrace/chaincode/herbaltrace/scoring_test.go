@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var testRegistryAdmin = testIdentity{id: "registry-admin-1", mspID: regulatorMSP, attributes: map[string]string{"role": roleRegistryAdmin}}
+
+// scoreFactors indexes a score breakdown by factor
+func scoreFactors(breakdown []ScoreFactor) map[string]ScoreFactor {
+	factors := make(map[string]ScoreFactor)
+	for _, factor := range breakdown {
+		factors[factor.Factor] = factor
+	}
+	return factors
+}
+
+func TestScoreProvenance(t *testing.T) {
+	ledger := newTestLedger()
+	registerTestSpecies(t, ledger)
+	tx := ledger.begin("score")
+	ctx := tx.context(testConsumer)
+
+	// The verified main harvest of a Least Concern species outweighs a side lot of an unregistered
+	// species, rejected for its harvest date, collected outside an approved zone
+	prov := &Provenance{
+		CollectionEvents: []CollectionEvent{
+			{ID: "COL-1", Species: testSpecies, Quantity: 30, Status: "verified", ApprovedZone: true, HarvestMethod: "Manual", PartCollected: "leaf"},
+			{ID: "COL-2", Species: "Unregistered herb", Quantity: 20, Status: "rejected", RejectionReason: "harvest_date_mismatch", HarvestMethod: "mechanical", PartCollected: "Root"},
+		},
+		RouteMeasured:  true,
+		TotalDistance:  500,
+		Certifications: []Certification{{ID: "CERT-1"}},
+		QualityTests:   []QualityTest{{ID: "QT-1", OverallResult: "pass"}, {ID: "QT-2", OverallResult: "fail"}, {ID: "QT-3", OverallResult: "conditional"}},
+	}
+	score, breakdown := new(HerbalTraceContract).scoreProvenance(ctx, defaultScoringModel(), prov)
+
+	want := map[string]float64{
+		factorSeasonCompliance: 0.6,  // 30 of 50 kg verified, the rest rejected for its date
+		factorZoneCompliance:   0.6,  // The side lot was not in an approved zone
+		factorConservation:     0.8,  // LC scores 1, the unregistered species the unknown score
+		factorHarvestMethod:    0.84, // (30 * 1 + 20 * 0.6) / 50
+		factorPlantPart:        0.72, // (30 * 1 + 20 * 0.3) / 50
+		factorTransport:        0.75, // 500 of 2000 km
+		factorCertifications:   0.5,  // 1 of 2
+		factorQualityTests:     0.67, // 2 of 3 did not fail
+	}
+	factors := scoreFactors(breakdown)
+	if len(breakdown) != len(scoringFactors) {
+		t.Errorf("breakdown has %d factors, want %d", len(breakdown), len(scoringFactors))
+	}
+	for name, value := range want {
+		if factor := factors[name]; !factor.Available || factor.Value != value {
+			t.Errorf("%s = %v (available %v), want %v", name, factor.Value, factor.Available, value)
+		}
+	}
+	// 15 * 0.6 + 15 * 0.6 + 15 * 0.8 + 10 * 0.84 + 10 * 0.72 + 10 * 0.75 + 10 * 0.5 + 15 * 0.67
+	if score != 68.15 {
+		t.Errorf("score = %v, want 68.15", score)
+	}
+	var points float64
+	for _, factor := range breakdown {
+		points += factor.Points
+	}
+	if roundScore(points) != score {
+		t.Errorf("factor points add up to %v, want the score %v", points, score)
+	}
+}
+
+func TestScoreProvenanceLeavesOutMissingFactors(t *testing.T) {
+	ledger := newTestLedger()
+	tx := ledger.begin("score")
+	ctx := tx.context(testConsumer)
+	contract := new(HerbalTraceContract)
+
+	// Without any data only the certification factor is evaluated, and no certifications score 0
+	score, breakdown := contract.scoreProvenance(ctx, defaultScoringModel(), &Provenance{})
+	factors := scoreFactors(breakdown)
+	if score != 0 || !factors[factorCertifications].Available {
+		t.Errorf("empty provenance scored %v with breakdown %+v", score, breakdown)
+	}
+	for _, name := range []string{factorSeasonCompliance, factorTransport, factorQualityTests} {
+		if factors[name].Available || factors[name].Detail != "no data" {
+			t.Errorf("%s was evaluated without data: %+v", name, factors[name])
+		}
+	}
+
+	// Passed tests and enough certifications score full marks over the factors available
+	score, _ = contract.scoreProvenance(ctx, defaultScoringModel(), &Provenance{
+		Certifications: []Certification{{ID: "CERT-1"}, {ID: "CERT-2"}, {ID: "CERT-3"}},
+		QualityTests:   []QualityTest{{ID: "QT-1", OverallResult: "pass"}},
+	})
+	if score != 100 {
+		t.Errorf("score = %v, want 100", score)
+	}
+
+	// A measured route between points at the same place is a full transport factor, a route
+	// beyond the maximum distance none
+	for distance, want := range map[float64]float64{0: 1, 4000: 0} {
+		_, breakdown = contract.scoreProvenance(ctx, defaultScoringModel(), &Provenance{RouteMeasured: true, TotalDistance: distance})
+		if factor := scoreFactors(breakdown)[factorTransport]; !factor.Available || factor.Value != want {
+			t.Errorf("transport factor for %v km = %+v, want %v", distance, factor, want)
+		}
+	}
+}
+
+func TestLookupScoreFoldsCaseAndSpacing(t *testing.T) {
+	scores := defaultScoringModel().PlantPartScores
+	tests := map[string]float64{
+		"whole_plant":  0.2,
+		"Whole Plant":  0.2,
+		" RHIZOME ":    0.3,
+		"tuber":        0.5,
+		"":             0.5,
+		"Flower":       1,
+		"whole  plant": 0.5,
+	}
+	for name, want := range tests {
+		if got := lookupScore(scores, name, 0.5); got != want {
+			t.Errorf("score of %q = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestValidateScoringModel(t *testing.T) {
+	if err := validateScoringModel(defaultScoringModel()); err != nil {
+		t.Fatalf("default model is invalid: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(model *ScoringModel)
+	}{
+		{"unknown factor", func(model *ScoringModel) { model.Weights["price"] = 5 }},
+		{"negative weight", func(model *ScoringModel) { model.Weights[factorTransport] = -1 }},
+		{"no positive weight", func(model *ScoringModel) { model.Weights = map[string]float64{factorTransport: 0} }},
+		{"unknown IUCN status", func(model *ScoringModel) { model.ConservationScores["XX"] = 0.5 }},
+		{"score above 1", func(model *ScoringModel) { model.HarvestMethodScores["manual"] = 1.5 }},
+		{"negative score", func(model *ScoringModel) { model.PlantPartScores["root"] = -0.1 }},
+		{"unknown score above 1", func(model *ScoringModel) { model.UnknownScore = 2 }},
+		{"no transport distance", func(model *ScoringModel) { model.MaxTransportKm = 0 }},
+		{"no certification target", func(model *ScoringModel) { model.TargetCertifications = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := defaultScoringModel()
+			tt.modify(model)
+			if err := validateScoringModel(model); err == nil {
+				t.Errorf("invalid model was accepted")
+			}
+		})
+	}
+}
+
+func TestSetScoringModelVersionsTheModel(t *testing.T) {
+	ledger := newTestLedger()
+	contract := new(HerbalTraceContract)
+	model := defaultScoringModel()
+	model.Weights = map[string]float64{factorQualityTests: 1}
+	modelBytes, _ := json.Marshal(model)
+
+	tx := ledger.begin("unauthorised")
+	if err := contract.SetScoringModel(tx.context(testFarmer), string(modelBytes)); err == nil {
+		t.Errorf("a farmer changed the scoring model")
+	}
+
+	for version := 1; version <= 2; version++ {
+		tx = ledger.begin("set-model")
+		if err := contract.SetScoringModel(tx.context(testRegistryAdmin), string(modelBytes)); err != nil {
+			t.Fatalf("registry admin could not set the scoring model: %v", err)
+		}
+		if err := ledger.commit(tx); err != nil {
+			t.Fatalf("scoring model did not commit: %v", err)
+		}
+		var stored ScoringModel
+		ledger.get(t, scoringModelKey, &stored)
+		if stored.Version != version || stored.UpdatedBy != testRegistryAdmin.id {
+			t.Errorf("stored model is version %d by %s, want version %d by %s", stored.Version, stored.UpdatedBy, version, testRegistryAdmin.id)
+		}
+	}
+
+	// Only the quality test factor counts under the stored model
+	tx = ledger.begin("score")
+	stored, err := contract.GetScoringModel(tx.context(testConsumer))
+	if err != nil {
+		t.Fatalf("failed to read scoring model: %v", err)
+	}
+	score, _ := contract.scoreProvenance(tx.context(testConsumer), stored, &Provenance{
+		QualityTests: []QualityTest{{ID: "QT-1", OverallResult: "pass"}, {ID: "QT-2", OverallResult: "fail"}},
+	})
+	if score != 50 {
+		t.Errorf("score = %v, want 50", score)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxSerialsPerTransaction bounds the write set of a single SerializeProduct call
+const maxSerialsPerTransaction = 5000
+
+// Each serial ends in a random token generated off-ledger and passed in the transient map, so
+// serials cannot be derived from public data. The ledger keeps only a hash of each serial.
+const (
+	transientSerialTokensKey = "serialTokens"
+	minSerialTokenLength     = 32 // Hex characters, 128 bits
+)
+
+// serialTransitions lists the statuses each serial status may move to
+var serialTransitions = map[string][]string{
+	"packed":  {"shipped", "sold", "void"},
+	"shipped": {"sold", "void"},
+	"sold":    {"void"},
+	"void":    {},
+}
+
+// ProductSerial is a unit-level code for a single pack within a product lot
+type ProductSerial struct {
+	Serial     string `json:"serial,omitempty"`     // Set on serials issued before the ledger kept only hashes
+	SerialHash string `json:"serialHash,omitempty"` // SHA-256 of the serial printed on the pack
+	Type       string `json:"type"`                 // "ProductSerial"
+	ProductID  string `json:"productId"`
+	QRCode     string `json:"qrCode"` // Lot-level QR code of the parent product
+	Sequence   int    `json:"sequence"`
+	Status     string `json:"status"` // "packed", "shipped", "sold", "void"
+	VoidReason string `json:"voidReason,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+// SerializeProduct registers the next count unit serials under a product. The transient map
+// carries one random token per unit; the caller prints serialFor(productID, sequence, token) on
+// each pack. Only the serial hashes are returned, as the response is recorded in the block.
+func (c *HerbalTraceContract) SerializeProduct(ctx contractapi.TransactionContextInterface, productID string, count int) ([]string, error) {
+	if count <= 0 || count > maxSerialsPerTransaction {
+		return nil, fmt.Errorf("serial count must be between 1 and %d", maxSerialsPerTransaction)
+	}
+
+	err := requireMSP(ctx, "ManufacturersMSP")
+	if err != nil {
+		return nil, err
+	}
+
+	product, err := c.GetProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if product.UnitsProduced > 0 && product.SerialCount+count > product.UnitsProduced {
+		return nil, fmt.Errorf("cannot serialize %d more units: %d of %d units already serialized", count, product.SerialCount, product.UnitsProduced)
+	}
+
+	tokens, err := readSerialTokens(ctx, count)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	serials := make([]string, 0, count)
+	for i, token := range tokens {
+		sequence := product.SerialCount + 1 + i
+		serial := ProductSerial{
+			SerialHash: serialHash(serialFor(product.ID, sequence, token)),
+			Type:       "ProductSerial",
+			ProductID:  product.ID,
+			QRCode:     product.QRCode,
+			Sequence:   sequence,
+			Status:     "packed",
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+
+		existing, err := ctx.GetStub().GetState(serialLedgerKey(&serial))
+		if err != nil {
+			return nil, fmt.Errorf("failed to check serial: %v", err)
+		}
+		if existing != nil {
+			return nil, fmt.Errorf("serial %d of product %s already exists", sequence, product.ID)
+		}
+
+		err = putSerial(ctx, &serial)
+		if err != nil {
+			return nil, err
+		}
+		serials = append(serials, serial.SerialHash)
+	}
+
+	product.SerialCount += count
+	product.Timestamp = now
+	productBytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal product: %v", err)
+	}
+	err = ctx.GetStub().PutState(product.ID, productBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update product: %v", err)
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":     "ProductSerialized",
+		"productId":     product.ID,
+		"count":         count,
+		"firstSequence": product.SerialCount - count + 1,
+		"lastSequence":  product.SerialCount,
+		"serialCount":   product.SerialCount,
+		"timestamp":     now,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("ProductSerialized", eventBytes)
+
+	return serials, nil
+}
+
+// GetSerial retrieves a unit serial by the serial printed on the pack
+func (c *HerbalTraceContract) GetSerial(ctx contractapi.TransactionContextInterface, serial string) (*ProductSerial, error) {
+	productSerial, err := findSerial(ctx, serial)
+	if err != nil {
+		return nil, err
+	}
+	if productSerial == nil {
+		return nil, fmt.Errorf("serial not found: %s", serial)
+	}
+
+	return productSerial, nil
+}
+
+// findSerial looks up a unit serial by the serial printed on the pack, returning nil if there is none.
+// Serial hashes are public, so a hash is never accepted in place of the serial.
+func findSerial(ctx contractapi.TransactionContextInterface, serial string) (*ProductSerial, error) {
+	productSerial, err := readSerial(ctx, serialKey(serialHash(serial)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Serials issued before the ledger kept only hashes are stored under the serial itself
+	if productSerial == nil {
+		productSerial, err = readSerial(ctx, serialKey(serial))
+		if err != nil {
+			return nil, err
+		}
+		if productSerial != nil && productSerial.SerialHash != "" {
+			productSerial = nil
+		}
+	}
+
+	return productSerial, nil
+}
+
+// readSerial reads a unit serial by ledger key, returning nil if there is none
+func readSerial(ctx contractapi.TransactionContextInterface, key string) (*ProductSerial, error) {
+	serialBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read serial: %v", err)
+	}
+	if serialBytes == nil {
+		return nil, nil
+	}
+
+	var productSerial ProductSerial
+	err = json.Unmarshal(serialBytes, &productSerial)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal serial: %v", err)
+	}
+
+	return &productSerial, nil
+}
+
+// UpdateSerialStatus moves a unit serial to packed, shipped, sold or void
+func (c *HerbalTraceContract) UpdateSerialStatus(ctx contractapi.TransactionContextInterface, serial string, newStatus string, reason string) error {
+	err := requireMSP(ctx, "ManufacturersMSP")
+	if err != nil {
+		return err
+	}
+
+	productSerial, err := c.GetSerial(ctx, serial)
+	if err != nil {
+		return err
+	}
+
+	if _, valid := serialTransitions[newStatus]; !valid {
+		return fmt.Errorf("invalid status: %s. Valid statuses: packed, shipped, sold, void", newStatus)
+	}
+	if !serialTransitionAllowed(productSerial.Status, newStatus) {
+		return fmt.Errorf("serial %s cannot move from %s to %s", serial, productSerial.Status, newStatus)
+	}
+	if newStatus == "void" && reason == "" {
+		return fmt.Errorf("a reason is required to void a serial")
+	}
+
+	oldStatus := productSerial.Status
+	productSerial.Status = newStatus
+	productSerial.VoidReason = ""
+	if newStatus == "void" {
+		productSerial.VoidReason = reason
+	}
+	productSerial.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	err = putSerial(ctx, productSerial)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "SerialStatusUpdated",
+		"serial":    serialRef(productSerial),
+		"sequence":  productSerial.Sequence,
+		"productId": productSerial.ProductID,
+		"oldStatus": oldStatus,
+		"newStatus": newStatus,
+		"timestamp": productSerial.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("SerialStatusUpdated", eventBytes)
+
+	return nil
+}
+
+var serialsByProductQuery = defineQuery("serialsByProduct",
+	`{"selector":{"type":"ProductSerial","productId":"%s"}}`,
+	"type", "productId")
+
+// GetSerialsByProduct retrieves the unit serials of a product in sequence order
+func (c *HerbalTraceContract) GetSerialsByProduct(ctx contractapi.TransactionContextInterface, productID string) ([]*ProductSerial, error) {
+	queryString := serialsByProductQuery.format(productID)
+
+	var serials []*ProductSerial
+	err := queryRecords(ctx, queryString, func(value []byte) error {
+		var serial ProductSerial
+		err := json.Unmarshal(value, &serial)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal serial: %v", err)
+		}
+		serials = append(serials, &serial)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(serials, func(i, j int) bool {
+		return serials[i].Sequence < serials[j].Sequence
+	})
+
+	return serials, nil
+}
+
+// GetProvenanceBySerial resolves a unit serial to its parent product's provenance
+func (c *HerbalTraceContract) GetProvenanceBySerial(ctx contractapi.TransactionContextInterface, serial string) (*Provenance, error) {
+	productSerial, err := c.GetSerial(ctx, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	provenance, err := c.GenerateProvenance(ctx, productSerial.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	provenance.Serial = productSerial
+
+	return provenance, nil
+}
+
+// serialFor builds the serial of a unit. The product ID and sequence make it unique; the random
+// token makes it impossible to guess. The backend builds the same serials from the tokens it
+// generates (serialFor in backend/src/fabric/fabricClient.ts), so the format must not change.
+func serialFor(productID string, sequence int, token string) string {
+	return fmt.Sprintf("%s-%06d-%s", productID, sequence, token)
+}
+
+// serialHash returns the hash under which a serial is kept on the ledger
+func serialHash(serial string) string {
+	sum := sha256.Sum256([]byte(serial))
+	return hex.EncodeToString(sum[:])
+}
+
+// serialRef identifies a unit serial in public records, such as scans, without revealing it
+func serialRef(serial *ProductSerial) string {
+	return firstNonEmpty(serial.SerialHash, serial.Serial)
+}
+
+// serialKey returns the ledger key of a unit serial, given its hash or, for legacy serials, the serial
+func serialKey(ref string) string {
+	return "SERIAL_" + ref
+}
+
+// serialLedgerKey returns the ledger key of a unit serial record
+func serialLedgerKey(serial *ProductSerial) string {
+	return serialKey(serialRef(serial))
+}
+
+// readSerialTokens reads the random serial tokens of a SerializeProduct call from the transient map
+func readSerialTokens(ctx contractapi.TransactionContextInterface, count int) ([]string, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient data: %v", err)
+	}
+	tokensBytes, found := transient[transientSerialTokensKey]
+	if !found {
+		return nil, fmt.Errorf("serial tokens must be passed in the transient map under %s", transientSerialTokensKey)
+	}
+
+	var tokens []string
+	err = json.Unmarshal(tokensBytes, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal serial tokens: %v", err)
+	}
+	if len(tokens) != count {
+		return nil, fmt.Errorf("got %d serial tokens for %d serials", len(tokens), count)
+	}
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if len(token) < minSerialTokenLength {
+			return nil, fmt.Errorf("serial tokens must be random hex strings of at least %d characters", minSerialTokenLength)
+		}
+		if _, err := hex.DecodeString(token); err != nil {
+			return nil, fmt.Errorf("serial tokens must be random hex strings of at least %d characters", minSerialTokenLength)
+		}
+		if seen[token] {
+			return nil, fmt.Errorf("serial tokens must be unique")
+		}
+		seen[token] = true
+	}
+
+	return tokens, nil
+}
+
+// putSerial saves a unit serial to the ledger
+func putSerial(ctx contractapi.TransactionContextInterface, serial *ProductSerial) error {
+	serialBytes, err := json.Marshal(serial)
+	if err != nil {
+		return fmt.Errorf("failed to marshal serial: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(serialLedgerKey(serial), serialBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save serial: %v", err)
+	}
+
+	return nil
+}
+
+// serialTransitionAllowed reports whether a serial may move between two statuses
+func serialTransitionAllowed(from string, to string) bool {
+	for _, next := range serialTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testPacker = testIdentity{id: "packer-1", mspID: "ManufacturersMSP", attributes: map[string]string{"role": "manufacturer"}}
+
+// serializeWithTokens commits SerializeProduct for PROD-1 with the given serial tokens
+func serializeWithTokens(t *testing.T, ledger *testLedger, txID string, tokens []string) ([]string, error) {
+	t.Helper()
+	tx := ledger.begin(txID)
+	tokensBytes, _ := json.Marshal(tokens)
+	tx.TransientMap = map[string][]byte{transientSerialTokensKey: tokensBytes}
+	hashes, err := new(HerbalTraceContract).SerializeProduct(tx.context(testPacker), "PROD-1", len(tokens))
+	if err != nil {
+		return nil, err
+	}
+	if err = ledger.commit(tx); err != nil {
+		t.Fatalf("serialization did not commit: %v", err)
+	}
+	return hashes, nil
+}
+
+func TestSerialsAreNotDerivableFromTheLedger(t *testing.T) {
+	ledger := newScanLedger(t)
+	tokens := []string{strings.Repeat("a1", 16), strings.Repeat("b2", 16)}
+
+	hashes, err := serializeWithTokens(t, ledger, "serialize", tokens)
+	if err != nil {
+		t.Fatalf("serialization was rejected: %v", err)
+	}
+	printed := serialFor("PROD-1", 1, tokens[0])
+
+	// Nothing on the ledger contains the printed serial or its token
+	for _, key := range ledger.scan("", "") {
+		if strings.Contains(key, tokens[0]) || strings.Contains(string(ledger.state[key]), tokens[0]) {
+			t.Errorf("ledger key %q exposes the serial token", key)
+		}
+	}
+
+	tx := ledger.begin("lookup")
+	contract := new(HerbalTraceContract)
+	serial, err := contract.GetSerial(tx.context(testConsumer), printed)
+	if err != nil {
+		t.Fatalf("printed serial did not resolve: %v", err)
+	}
+	if serial.Sequence != 1 || serial.SerialHash != hashes[0] {
+		t.Errorf("resolved serial %+v, want sequence 1 with hash %s", serial, hashes[0])
+	}
+
+	// The public hash and a serial without the token are not accepted in place of the serial
+	for _, forged := range []string{hashes[0], "PROD-1-000001", serialFor("PROD-1", 1, strings.Repeat("00", 16))} {
+		if _, err := contract.GetSerial(tx.context(testConsumer), forged); err == nil {
+			t.Errorf("forged serial %q resolved", forged)
+		}
+	}
+}
+
+func TestSerializeProductRejectsWeakTokens(t *testing.T) {
+	ledger := newScanLedger(t)
+
+	for _, tokens := range [][]string{
+		{"1234"},
+		{strings.Repeat("zz", 16)},
+		{strings.Repeat("ab", 16), strings.Repeat("ab", 16)},
+	} {
+		if _, err := serializeWithTokens(t, ledger, "serialize", tokens); err == nil {
+			t.Errorf("serial tokens %v were accepted", tokens)
+		}
+	}
+}
+
+// TestSerialFormat pins the serial format and hash the backend reproduces off-chain to print
+// serials and match them to the hashes SerializeProduct returns
+func TestSerialFormat(t *testing.T) {
+	serial := serialFor("PROD-1", 1, strings.Repeat("a1", 16))
+	if want := "PROD-1-000001-a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1"; serial != want {
+		t.Errorf("serial = %s, want %s", serial, want)
+	}
+	if want := "ba6f0b039cca940e0fd0fb68c832d642813ff62df9efa86ebc65f3575dc4e9dd"; serialHash(serial) != want {
+		t.Errorf("serial hash = %s, want %s", serialHash(serial), want)
+	}
+	if serial := serialFor("PROD-1", 1234567, "ff"); serial != "PROD-1-1234567-ff" {
+		t.Errorf("serial beyond six digits = %s", serial)
+	}
+}
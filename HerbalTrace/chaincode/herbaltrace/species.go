@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Species represents a registered medicinal plant species
+type Species struct {
+	ID                string   `json:"id"`
+	Type              string   `json:"type"` // "Species"
+	ScientificName    string   `json:"scientificName"`
+	CommonNames       []string `json:"commonNames"`          // First entry is the accepted common name
+	VernacularNames   []string `json:"vernacularNames"`      // Regional and trade synonyms
+	IUCNStatus        string   `json:"iucnStatus"`           // "CR", "EN", "VU", "NT", "LC", "DD", "NE"
+	NMPBStatus        string   `json:"nmpbStatus,omitempty"` // National Medicinal Plants Board listing, e.g. "prioritised"
+	PermitRequired    bool     `json:"permitRequired"`
+	AllowedPlantParts []string `json:"allowedPlantParts"` // "leaf", "root", "rhizome", "seed", etc.
+	DefaultUnit       string   `json:"defaultUnit"`
+	Active            bool     `json:"active"` // Changed only by ActivateSpecies and WithdrawSpecies
+	WithdrawalReason  string   `json:"withdrawalReason,omitempty"`
+	CreatedBy         string   `json:"createdBy"`
+	CreatedAt         string   `json:"createdAt"`
+	UpdatedAt         string   `json:"updatedAt"`
+}
+
+const (
+	speciesAliasObjectType = "speciesAlias"
+	roleRegistryAdmin      = "registry_admin"
+)
+
+// iucnStatusLabels maps IUCN Red List categories to the labels stored on collection events
+var iucnStatusLabels = map[string]string{
+	"CR": "Critically Endangered",
+	"EN": "Endangered",
+	"VU": "Vulnerable",
+	"NT": "Near Threatened",
+	"LC": "Least Concern",
+	"DD": "Data Deficient",
+	"NE": "Not Evaluated",
+}
+
+// seedSpecies is the registry content written by InitLedger
+var seedSpecies = []Species{
+	{ScientificName: "Azadirachta indica", CommonNames: []string{"Neem"}, VernacularNames: []string{"Nimba", "Margosa"},
+		IUCNStatus: "LC", AllowedPlantParts: []string{"leaf", "bark", "seed", "twig", "flower", "fruit"}, DefaultUnit: "kg"},
+	{ScientificName: "Withania somnifera", CommonNames: []string{"Ashwagandha"}, VernacularNames: []string{"Indian Ginseng", "Winter Cherry"},
+		IUCNStatus: "NE", AllowedPlantParts: []string{"root", "leaf", "seed"}, DefaultUnit: "kg"},
+	{ScientificName: "Ocimum tenuiflorum", CommonNames: []string{"Tulsi", "Holy Basil"}, VernacularNames: []string{"Ocimum sanctum", "Tulasi"},
+		IUCNStatus: "LC", AllowedPlantParts: []string{"leaf", "seed", "whole_plant"}, DefaultUnit: "kg"},
+	{ScientificName: "Bacopa monnieri", CommonNames: []string{"Brahmi"}, VernacularNames: []string{"Water Hyssop", "Jalnim"},
+		IUCNStatus: "LC", AllowedPlantParts: []string{"whole_plant", "leaf"}, DefaultUnit: "kg"},
+	{ScientificName: "Aconitum heterophyllum", CommonNames: []string{"Atis"}, VernacularNames: []string{"Ativisha", "Atees"},
+		IUCNStatus: "EN", NMPBStatus: "prioritised", PermitRequired: true, AllowedPlantParts: []string{"root"}, DefaultUnit: "kg"},
+	{ScientificName: "Nardostachys jatamansi", CommonNames: []string{"Jatamansi"}, VernacularNames: []string{"Spikenard", "Balchhar"},
+		IUCNStatus: "CR", NMPBStatus: "prioritised", PermitRequired: true, AllowedPlantParts: []string{"rhizome", "root"}, DefaultUnit: "kg"},
+	{ScientificName: "Picrorhiza kurroa", CommonNames: []string{"Kutki"}, VernacularNames: []string{"Katuka", "Kadu"},
+		IUCNStatus: "EN", NMPBStatus: "prioritised", PermitRequired: true, AllowedPlantParts: []string{"rhizome", "root"}, DefaultUnit: "kg"},
+}
+
+// normalizeSpeciesName folds case and whitespace so synonyms can be matched
+func normalizeSpeciesName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// speciesKey derives the ledger key of a species from its scientific name
+func speciesKey(scientificName string) string {
+	return "species_" + strings.ReplaceAll(normalizeSpeciesName(scientificName), " ", "_")
+}
+
+// conservationLabel returns the conservation status label for the species' IUCN category
+func (s *Species) conservationLabel() string {
+	if label, ok := iucnStatusLabels[s.IUCNStatus]; ok {
+		return label
+	}
+	return "Not Evaluated"
+}
+
+// allowsPart reports whether a plant part may be collected for the species
+func (s *Species) allowsPart(part string) bool {
+	if len(s.AllowedPlantParts) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedPlantParts {
+		if strings.EqualFold(allowed, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// speciesNames lists every name a species can be resolved by
+func (s *Species) speciesNames() []string {
+	names := []string{s.ScientificName}
+	names = append(names, s.CommonNames...)
+	return append(names, s.VernacularNames...)
+}
+
+// RegisterSpecies adds a species to the registry (registry admin or forest authority only)
+func (c *HerbalTraceContract) RegisterSpecies(ctx contractapi.TransactionContextInterface, speciesJSON string) error {
+	if err := requireRole(ctx, roleRegistryAdmin, roleForestAuthority); err != nil {
+		return err
+	}
+
+	var species Species
+	err := json.Unmarshal([]byte(speciesJSON), &species)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal species JSON: %v", err)
+	}
+
+	createdBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	species.CreatedBy = createdBy
+
+	err = c.registerSpecies(ctx, &species)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":      "SpeciesRegistered",
+		"speciesId":      species.ID,
+		"scientificName": species.ScientificName,
+		"iucnStatus":     species.IUCNStatus,
+		"permitRequired": species.PermitRequired,
+		"timestamp":      species.CreatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("SpeciesRegistered", eventBytes)
+
+	return nil
+}
+
+// registerSpecies validates a species, writes it and indexes all of its names
+func (c *HerbalTraceContract) registerSpecies(ctx contractapi.TransactionContextInterface, species *Species) error {
+	if species.ScientificName == "" {
+		return fmt.Errorf("scientific name is required")
+	}
+	if len(species.CommonNames) == 0 {
+		return fmt.Errorf("at least one common name is required")
+	}
+	if _, ok := iucnStatusLabels[species.IUCNStatus]; !ok {
+		return fmt.Errorf("invalid IUCN status: %s", species.IUCNStatus)
+	}
+	if species.DefaultUnit == "" {
+		return fmt.Errorf("default unit is required")
+	}
+	if _, err := lookupUnit(species.DefaultUnit); err != nil {
+		return err
+	}
+
+	species.ID = speciesKey(species.ScientificName)
+	existingSpecies, err := ctx.GetStub().GetState(species.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check if species exists: %v", err)
+	}
+	if existingSpecies != nil {
+		return fmt.Errorf("species %s is already registered", species.ScientificName)
+	}
+
+	// Set default values
+	species.Type = "Species"
+	species.Active = true
+	species.CreatedAt = time.Now().Format(time.RFC3339)
+	species.UpdatedAt = species.CreatedAt
+
+	err = c.indexSpeciesNames(ctx, species)
+	if err != nil {
+		return err
+	}
+
+	return c.putSpecies(ctx, species)
+}
+
+// UpdateSpecies replaces the synonyms, status, parts and unit of a registered species.
+// Whether the species is active is kept; see ActivateSpecies and WithdrawSpecies.
+func (c *HerbalTraceContract) UpdateSpecies(ctx contractapi.TransactionContextInterface, speciesJSON string) error {
+	if err := requireRole(ctx, roleRegistryAdmin, roleForestAuthority); err != nil {
+		return err
+	}
+
+	var updated Species
+	err := json.Unmarshal([]byte(speciesJSON), &updated)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal species JSON: %v", err)
+	}
+	if _, ok := iucnStatusLabels[updated.IUCNStatus]; !ok {
+		return fmt.Errorf("invalid IUCN status: %s", updated.IUCNStatus)
+	}
+	if len(updated.CommonNames) == 0 {
+		return fmt.Errorf("at least one common name is required")
+	}
+
+	existing, err := c.GetSpecies(ctx, speciesKey(updated.ScientificName))
+	if err != nil {
+		return err
+	}
+
+	// Drop the aliases of the old name set before indexing the new one
+	for _, name := range existing.speciesNames() {
+		aliasKey, err := ctx.GetStub().CreateCompositeKey(speciesAliasObjectType, []string{normalizeSpeciesName(name)})
+		if err != nil {
+			return fmt.Errorf("failed to create species alias key: %v", err)
+		}
+		err = ctx.GetStub().DelState(aliasKey)
+		if err != nil {
+			return fmt.Errorf("failed to delete species alias: %v", err)
+		}
+	}
+
+	// Preserve identity and audit fields
+	updated.ID = existing.ID
+	updated.Type = "Species"
+	updated.ScientificName = existing.ScientificName
+	updated.Active = existing.Active
+	updated.WithdrawalReason = existing.WithdrawalReason
+	updated.CreatedBy = existing.CreatedBy
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = time.Now().Format(time.RFC3339)
+	if updated.DefaultUnit == "" {
+		updated.DefaultUnit = existing.DefaultUnit
+	}
+	if _, err := lookupUnit(updated.DefaultUnit); err != nil {
+		return err
+	}
+
+	err = c.indexSpeciesNames(ctx, &updated)
+	if err != nil {
+		return err
+	}
+
+	err = c.putSpecies(ctx, &updated)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":      "SpeciesUpdated",
+		"speciesId":      updated.ID,
+		"iucnStatus":     updated.IUCNStatus,
+		"permitRequired": updated.PermitRequired,
+		"active":         updated.Active,
+		"timestamp":      updated.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("SpeciesUpdated", eventBytes)
+
+	return nil
+}
+
+// ActivateSpecies returns a withdrawn species to the registry so it can be collected again
+func (c *HerbalTraceContract) ActivateSpecies(ctx contractapi.TransactionContextInterface, speciesID string) error {
+	return c.setSpeciesActive(ctx, speciesID, true, "")
+}
+
+// WithdrawSpecies withdraws a species from the registry, so new collections and limits are rejected
+func (c *HerbalTraceContract) WithdrawSpecies(ctx contractapi.TransactionContextInterface, speciesID string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+	return c.setSpeciesActive(ctx, speciesID, false, reason)
+}
+
+// setSpeciesActive activates or withdraws a registered species
+func (c *HerbalTraceContract) setSpeciesActive(ctx contractapi.TransactionContextInterface, speciesID string, active bool, reason string) error {
+	if err := requireRole(ctx, roleRegistryAdmin, roleForestAuthority); err != nil {
+		return err
+	}
+
+	species, err := c.GetSpecies(ctx, speciesID)
+	if err != nil {
+		return err
+	}
+	if active && species.Active {
+		return fmt.Errorf("species %s is already active", species.ID)
+	}
+	if !active && !species.Active {
+		return fmt.Errorf("species %s is already withdrawn", species.ID)
+	}
+
+	species.Active = active
+	species.WithdrawalReason = reason
+	species.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	err = c.putSpecies(ctx, species)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "SpeciesStatusChanged",
+		"speciesId": species.ID,
+		"active":    species.Active,
+		"reason":    reason,
+		"timestamp": species.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("SpeciesStatusChanged", eventBytes)
+
+	return nil
+}
+
+// indexSpeciesNames points every name of a species at its registry key
+func (c *HerbalTraceContract) indexSpeciesNames(ctx contractapi.TransactionContextInterface, species *Species) error {
+	for _, name := range species.speciesNames() {
+		normalized := normalizeSpeciesName(name)
+		if normalized == "" {
+			continue
+		}
+
+		aliasKey, err := ctx.GetStub().CreateCompositeKey(speciesAliasObjectType, []string{normalized})
+		if err != nil {
+			return fmt.Errorf("failed to create species alias key: %v", err)
+		}
+
+		existingID, err := ctx.GetStub().GetState(aliasKey)
+		if err != nil {
+			return fmt.Errorf("failed to read species alias: %v", err)
+		}
+		if existingID != nil && string(existingID) != species.ID {
+			return fmt.Errorf("name %q is already used by species %s", name, string(existingID))
+		}
+
+		err = ctx.GetStub().PutState(aliasKey, []byte(species.ID))
+		if err != nil {
+			return fmt.Errorf("failed to save species alias: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// GetSpecies retrieves a registered species by ID
+func (c *HerbalTraceContract) GetSpecies(ctx contractapi.TransactionContextInterface, speciesID string) (*Species, error) {
+	if speciesID == "" {
+		return nil, fmt.Errorf("species ID is required")
+	}
+
+	speciesBytes, err := ctx.GetStub().GetState(speciesID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read species from ledger: %v", err)
+	}
+	if speciesBytes == nil {
+		return nil, fmt.Errorf("species with ID %s does not exist", speciesID)
+	}
+
+	var species Species
+	err = json.Unmarshal(speciesBytes, &species)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal species: %v", err)
+	}
+
+	return &species, nil
+}
+
+// ResolveSpecies looks up a species by scientific, common or vernacular name
+func (c *HerbalTraceContract) ResolveSpecies(ctx contractapi.TransactionContextInterface, name string) (*Species, error) {
+	normalized := normalizeSpeciesName(name)
+	if normalized == "" {
+		return nil, fmt.Errorf("species name is required")
+	}
+
+	aliasKey, err := ctx.GetStub().CreateCompositeKey(speciesAliasObjectType, []string{normalized})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create species alias key: %v", err)
+	}
+
+	speciesID, err := ctx.GetStub().GetState(aliasKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read species alias: %v", err)
+	}
+	if speciesID == nil {
+		return nil, fmt.Errorf("species %s is not registered", name)
+	}
+
+	return c.GetSpecies(ctx, string(speciesID))
+}
+
+var speciesQuery = defineQuery("species",
+	`{"selector":{"type":"Species"}}`,
+	"type")
+
+// GetAllSpecies retrieves every registered species
+func (c *HerbalTraceContract) GetAllSpecies(ctx contractapi.TransactionContextInterface) ([]*Species, error) {
+	queryString := speciesQuery.format()
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query species: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var species []*Species
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate query results: %v", err)
+		}
+
+		var entry Species
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			continue
+		}
+		species = append(species, &entry)
+	}
+
+	return species, nil
+}
+
+// resolveActiveSpecies resolves a species name and rejects species withdrawn from the registry
+func (c *HerbalTraceContract) resolveActiveSpecies(ctx contractapi.TransactionContextInterface, name string) (*Species, error) {
+	species, err := c.ResolveSpecies(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !species.Active {
+		return nil, fmt.Errorf("species %s is not active in the registry", species.ScientificName)
+	}
+	return species, nil
+}
+
+// applySpeciesRegistry normalises a collection event's species against the registry
+// and overwrites the client-supplied names and conservation status
+func (c *HerbalTraceContract) applySpeciesRegistry(ctx contractapi.TransactionContextInterface, event *CollectionEvent) (*Species, error) {
+	name := event.Species
+	if name == "" {
+		name = event.ScientificName
+	}
+	if name == "" {
+		name = event.CommonName
+	}
+
+	species, err := c.resolveActiveSpecies(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	event.Species = species.ScientificName
+	event.ScientificName = species.ScientificName
+	event.CommonName = species.CommonNames[0]
+	event.ConservationStatus = species.conservationLabel()
+
+	if event.PartCollected != "" && !species.allowsPart(event.PartCollected) {
+		return nil, fmt.Errorf("plant part %s may not be collected for %s (allowed: %s)",
+			event.PartCollected, species.ScientificName, strings.Join(species.AllowedPlantParts, ", "))
+	}
+	if event.Unit == "" {
+		event.Unit = species.DefaultUnit
+	}
+
+	return species, nil
+}
+
+// putSpecies saves a species to the ledger
+func (c *HerbalTraceContract) putSpecies(ctx contractapi.TransactionContextInterface, species *Species) error {
+	speciesBytes, err := json.Marshal(species)
+	if err != nil {
+		return fmt.Errorf("failed to marshal species: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(species.ID, speciesBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save species to ledger: %v", err)
+	}
+
+	return nil
+}
+
+// seedSpeciesRegistry registers the built-in species that are not yet on the ledger
+func (c *HerbalTraceContract) seedSpeciesRegistry(ctx contractapi.TransactionContextInterface) error {
+	for _, seed := range seedSpecies {
+		species := seed
+		existingSpecies, err := ctx.GetStub().GetState(speciesKey(species.ScientificName))
+		if err != nil {
+			return fmt.Errorf("failed to check if species exists: %v", err)
+		}
+		if existingSpecies != nil {
+			continue
+		}
+
+		species.CreatedBy = "system"
+		err = c.registerSpecies(ctx, &species)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TransportConfig holds the emission factors used to estimate transport emissions
+type TransportConfig struct {
+	ID              string             `json:"id"`
+	Type            string             `json:"type"` // "TransportConfig"
+	Version         int                `json:"version"`
+	EmissionFactors map[string]float64 `json:"emissionFactors"` // Transport mode -> kg CO2e per tonne-km
+	DefaultMode     string             `json:"defaultMode"`     // Used when a leg does not name a mode
+	UpdatedBy       string             `json:"updatedBy,omitempty"`
+	UpdatedAt       string             `json:"updatedAt,omitempty"`
+}
+
+// RouteLeg is one physical movement of material between two points in the supply chain
+type RouteLeg struct {
+	Sequence        int     `json:"sequence"`
+	FromID          string  `json:"fromId"`
+	FromType        string  `json:"fromType"` // "CollectionEvent", "ProcessingStep"
+	FromName        string  `json:"fromName,omitempty"`
+	FromLatitude    float64 `json:"fromLatitude"`
+	FromLongitude   float64 `json:"fromLongitude"`
+	ToID            string  `json:"toId"`
+	ToType          string  `json:"toType"` // "ProcessingStep", "ManufacturingSite"
+	ToName          string  `json:"toName,omitempty"`
+	ToLatitude      float64 `json:"toLatitude"`
+	ToLongitude     float64 `json:"toLongitude"`
+	Mode            string  `json:"mode"`
+	DistanceKm      float64 `json:"distanceKm"`
+	FreightKg       float64 `json:"freightKg"`
+	EmissionsKgCO2e float64 `json:"emissionsKgCo2e"`
+}
+
+// routePoint is a located stop on a product's route
+type routePoint struct {
+	ID        string
+	Type      string
+	Name      string
+	Latitude  float64
+	Longitude float64
+	Mode      string  // Mode used to arrive at this point
+	FreightKg float64 // Material leaving this point
+}
+
+const (
+	transportConfigKey = "TRANSPORT_CONFIG"
+	earthRadiusKm      = 6371.0088
+)
+
+// defaultTransportConfig is used until a registry admin stores a configuration. Factors are
+// typical well-to-wheel freight values in kg CO2e per tonne-km.
+func defaultTransportConfig() *TransportConfig {
+	return &TransportConfig{
+		ID:      transportConfigKey,
+		Type:    "TransportConfig",
+		Version: 0,
+		EmissionFactors: map[string]float64{
+			"road": 0.105,
+			"rail": 0.028,
+			"sea":  0.016,
+			"air":  0.602,
+		},
+		DefaultMode: "road",
+	}
+}
+
+// SetTransportConfig stores a new version of the transport emission factors (registry admin only)
+func (c *HerbalTraceContract) SetTransportConfig(ctx contractapi.TransactionContextInterface, configJSON string) error {
+	if err := requireRole(ctx, roleRegistryAdmin); err != nil {
+		return err
+	}
+
+	var config TransportConfig
+	err := json.Unmarshal([]byte(configJSON), &config)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal transport config JSON: %v", err)
+	}
+
+	if len(config.EmissionFactors) == 0 {
+		return fmt.Errorf("at least one emission factor is required")
+	}
+	for mode, factor := range config.EmissionFactors {
+		if factor < 0 {
+			return fmt.Errorf("emission factor for %s must not be negative", mode)
+		}
+	}
+	if _, ok := config.EmissionFactors[config.DefaultMode]; !ok {
+		return fmt.Errorf("default mode %s has no emission factor", config.DefaultMode)
+	}
+
+	current, err := c.GetTransportConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	updatedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	config.ID = transportConfigKey
+	config.Type = "TransportConfig"
+	config.Version = current.Version + 1
+	config.UpdatedBy = updatedBy
+	config.UpdatedAt = time.Now().Format(time.RFC3339)
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transport config: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(transportConfigKey, configBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save transport config: %v", err)
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType": "TransportConfigUpdated",
+		"version":   config.Version,
+		"updatedBy": updatedBy,
+		"timestamp": config.UpdatedAt,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("TransportConfigUpdated", eventBytes)
+
+	return nil
+}
+
+// GetTransportConfig retrieves the current transport config, or the default config if none is stored
+func (c *HerbalTraceContract) GetTransportConfig(ctx contractapi.TransactionContextInterface) (*TransportConfig, error) {
+	configBytes, err := ctx.GetStub().GetState(transportConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transport config: %v", err)
+	}
+	if configBytes == nil {
+		return defaultTransportConfig(), nil
+	}
+
+	var config TransportConfig
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transport config: %v", err)
+	}
+
+	return &config, nil
+}
+
+// buildRoute fills the provenance route, total distance and transport emissions. Material
+// travels from every collection point to the first located processing step, through the
+// processing steps in date order, and on to the manufacturer site. Points without
+// coordinates are skipped.
+func (c *HerbalTraceContract) buildRoute(ctx contractapi.TransactionContextInterface, prov *Provenance) error {
+	config, err := c.GetTransportConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Processing steps in the order they happened
+	steps := make([]ProcessingStep, 0, len(prov.ProcessingSteps))
+	for _, step := range prov.ProcessingSteps {
+		if hasCoordinates(step.Latitude, step.Longitude) {
+			steps = append(steps, step)
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].ProcessDate != steps[j].ProcessDate {
+			return steps[i].ProcessDate < steps[j].ProcessDate
+		}
+		return steps[i].ID < steps[j].ID
+	})
+
+	var stops []routePoint
+	for _, step := range steps {
+		stops = append(stops, routePoint{
+			ID:        step.ID,
+			Type:      "ProcessingStep",
+			Name:      step.Location,
+			Latitude:  step.Latitude,
+			Longitude: step.Longitude,
+			Mode:      step.TransportMode,
+			FreightKg: freightKg(step.OutputQuantity, outputUnit(step)),
+		})
+	}
+	product := prov.Product
+	if hasCoordinates(product.SiteLatitude, product.SiteLongitude) {
+		stops = append(stops, routePoint{
+			ID:        product.ManufacturerID,
+			Type:      "ManufacturingSite",
+			Name:      product.SiteName,
+			Latitude:  product.SiteLatitude,
+			Longitude: product.SiteLongitude,
+			Mode:      product.TransportMode,
+		})
+	}
+
+	prov.Route = nil
+	prov.TotalDistance = 0
+	prov.TotalEmissions = 0
+	prov.RouteMeasured = len(stops) > 1
+	if len(stops) == 0 {
+		return nil
+	}
+
+	// Every collection point feeds the first stop
+	for _, event := range prov.CollectionEvents {
+		if !hasCoordinates(event.Latitude, event.Longitude) {
+			continue
+		}
+		origin := routePoint{
+			ID:        event.ID,
+			Type:      "CollectionEvent",
+			Name:      event.ZoneName,
+			Latitude:  event.Latitude,
+			Longitude: event.Longitude,
+			FreightKg: freightKg(event.Quantity, event.Unit),
+		}
+		prov.addRouteLeg(config, origin, stops[0])
+		prov.RouteMeasured = true
+	}
+
+	for i := 1; i < len(stops); i++ {
+		prov.addRouteLeg(config, stops[i-1], stops[i])
+	}
+
+	prov.TotalDistance = roundScore(prov.TotalDistance)
+	prov.TotalEmissions = roundScore(prov.TotalEmissions)
+
+	return nil
+}
+
+// addRouteLeg appends a leg between two points, skipping points at the same location
+func (p *Provenance) addRouteLeg(config *TransportConfig, from routePoint, to routePoint) {
+	distance := haversineKm(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	if distance < 0.001 {
+		return
+	}
+
+	mode := to.Mode
+	if mode == "" {
+		mode = config.DefaultMode
+	}
+	factor, ok := config.EmissionFactors[mode]
+	if !ok {
+		factor = config.EmissionFactors[config.DefaultMode]
+	}
+
+	leg := RouteLeg{
+		Sequence:        len(p.Route) + 1,
+		FromID:          from.ID,
+		FromType:        from.Type,
+		FromName:        from.Name,
+		FromLatitude:    from.Latitude,
+		FromLongitude:   from.Longitude,
+		ToID:            to.ID,
+		ToType:          to.Type,
+		ToName:          to.Name,
+		ToLatitude:      to.Latitude,
+		ToLongitude:     to.Longitude,
+		Mode:            mode,
+		DistanceKm:      roundScore(distance),
+		FreightKg:       from.FreightKg,
+		EmissionsKgCO2e: roundScore(distance * from.FreightKg / 1000 * factor),
+	}
+
+	p.Route = append(p.Route, leg)
+	p.TotalDistance += distance
+	p.TotalEmissions += distance * from.FreightKg / 1000 * factor
+}
+
+// haversineKm returns the great-circle distance between two coordinates in kilometres
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// hasCoordinates reports whether a location was recorded (0,0 is treated as missing)
+func hasCoordinates(lat, lon float64) bool {
+	return !(lat == 0 && lon == 0) && lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// freightKg converts a shipped quantity to kilograms. Liquids are counted at 1 kg per litre
+// and unknown units contribute no freight weight.
+func freightKg(quantity float64, unit string) float64 {
+	canonical, _, err := canonicalQuantity(quantity, unit)
+	if err != nil {
+		return 0
+	}
+	return canonical
+}
+
+// outputUnit returns the unit a processing step's output is measured in
+func outputUnit(step ProcessingStep) string {
+	if step.OutputUnit != "" {
+		return step.OutputUnit
+	}
+	return step.Unit
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Quantities are stored in one canonical unit per dimension: kilograms for mass
+// and litres for volume (oils and liquid extracts). Client-supplied units are
+// converted on write so limits, batches and mass-balance checks compare like with like.
+
+const (
+	unitDimensionMass   = "mass"
+	unitDimensionVolume = "volume"
+
+	canonicalMassUnit   = "kg"
+	canonicalVolumeUnit = "l"
+)
+
+// unitDefinition describes a unit as a factor of its dimension's canonical unit
+type unitDefinition struct {
+	Symbol    string
+	Dimension string
+	Factor    float64
+}
+
+// unitDefinitions maps accepted spellings to their unit definition
+var unitDefinitions = map[string]unitDefinition{
+	"g":         {Symbol: "g", Dimension: unitDimensionMass, Factor: 0.001},
+	"gm":        {Symbol: "g", Dimension: unitDimensionMass, Factor: 0.001},
+	"gram":      {Symbol: "g", Dimension: unitDimensionMass, Factor: 0.001},
+	"grams":     {Symbol: "g", Dimension: unitDimensionMass, Factor: 0.001},
+	"kg":        {Symbol: "kg", Dimension: unitDimensionMass, Factor: 1},
+	"kgs":       {Symbol: "kg", Dimension: unitDimensionMass, Factor: 1},
+	"kilogram":  {Symbol: "kg", Dimension: unitDimensionMass, Factor: 1},
+	"kilograms": {Symbol: "kg", Dimension: unitDimensionMass, Factor: 1},
+	"q":         {Symbol: "quintal", Dimension: unitDimensionMass, Factor: 100},
+	"qtl":       {Symbol: "quintal", Dimension: unitDimensionMass, Factor: 100},
+	"quintal":   {Symbol: "quintal", Dimension: unitDimensionMass, Factor: 100},
+	"quintals":  {Symbol: "quintal", Dimension: unitDimensionMass, Factor: 100},
+	"t":         {Symbol: "tonne", Dimension: unitDimensionMass, Factor: 1000},
+	"tonne":     {Symbol: "tonne", Dimension: unitDimensionMass, Factor: 1000},
+	"tonnes":    {Symbol: "tonne", Dimension: unitDimensionMass, Factor: 1000},
+	"ml":        {Symbol: "ml", Dimension: unitDimensionVolume, Factor: 0.001},
+	"l":         {Symbol: "l", Dimension: unitDimensionVolume, Factor: 1},
+	"ltr":       {Symbol: "l", Dimension: unitDimensionVolume, Factor: 1},
+	"litre":     {Symbol: "l", Dimension: unitDimensionVolume, Factor: 1},
+	"litres":    {Symbol: "l", Dimension: unitDimensionVolume, Factor: 1},
+	"liter":     {Symbol: "l", Dimension: unitDimensionVolume, Factor: 1},
+	"liters":    {Symbol: "l", Dimension: unitDimensionVolume, Factor: 1},
+}
+
+// lookupUnit resolves a client-supplied unit, rejecting unknown units
+func lookupUnit(unit string) (unitDefinition, error) {
+	definition, ok := unitDefinitions[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok {
+		return unitDefinition{}, fmt.Errorf("unknown unit: %q", unit)
+	}
+	return definition, nil
+}
+
+// canonicalUnit returns the canonical unit of a dimension
+func canonicalUnit(dimension string) string {
+	if dimension == unitDimensionVolume {
+		return canonicalVolumeUnit
+	}
+	return canonicalMassUnit
+}
+
+// canonicalQuantity converts a quantity into the canonical unit of its dimension
+func canonicalQuantity(quantity float64, unit string) (float64, string, error) {
+	definition, err := lookupUnit(unit)
+	if err != nil {
+		return 0, "", err
+	}
+	return quantity * definition.Factor, canonicalUnit(definition.Dimension), nil
+}
+
+// convertQuantity converts a quantity between two units of the same dimension
+func convertQuantity(quantity float64, from string, to string) (float64, error) {
+	fromUnit, err := lookupUnit(from)
+	if err != nil {
+		return 0, err
+	}
+	toUnit, err := lookupUnit(to)
+	if err != nil {
+		return 0, err
+	}
+	if fromUnit.Dimension != toUnit.Dimension {
+		return 0, fmt.Errorf("cannot convert %s (%s) to %s (%s)", from, fromUnit.Dimension, to, toUnit.Dimension)
+	}
+	return quantity * fromUnit.Factor / toUnit.Factor, nil
+}
+
+// sameDimension reports whether two known units measure the same dimension
+func sameDimension(a string, b string) bool {
+	unitA, errA := lookupUnit(a)
+	unitB, errB := lookupUnit(b)
+	return errA == nil && errB == nil && unitA.Dimension == unitB.Dimension
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertQuantity(t *testing.T) {
+	tests := []struct {
+		quantity float64
+		from     string
+		to       string
+		want     float64
+	}{
+		{2, "qtl", "kg", 200},
+		{2, "Quintals", "kg", 200},
+		{150, "kg", "q", 1.5},
+		{1.5, "t", "kg", 1500},
+		{1, "tonne", "qtl", 10},
+		{250, "g", "kg", 0.25},
+		{3, "kg", "grams", 3000},
+		{0.2, "tonnes", "g", 200000},
+		{500, "ml", "l", 0.5},
+		{2, "Litres", "ml", 2000},
+		{1.25, "liter", "ltr", 1.25},
+		{7, " KG ", "kilograms", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			got, err := convertQuantity(tt.quantity, tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("conversion failed: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("%v %s = %v %s, want %v", tt.quantity, tt.from, got, tt.to, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertQuantityRejectsIncompatibleUnits(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+	}{
+		{"kg", "l"},
+		{"ml", "g"},
+		{"t", "ml"},
+		{"litres", "quintal"},
+		{"lb", "kg"},
+		{"kg", "bundles"},
+		{"", "kg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			if got, err := convertQuantity(1, tt.from, tt.to); err == nil {
+				t.Errorf("converted %s to %s as %v", tt.from, tt.to, got)
+			}
+			if sameDimension(tt.from, tt.to) {
+				t.Errorf("%s and %s reported as the same dimension", tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestCanonicalQuantity(t *testing.T) {
+	tests := []struct {
+		quantity float64
+		unit     string
+		want     float64
+		wantUnit string
+	}{
+		{3, "qtl", 300, "kg"},
+		{2, "tonnes", 2000, "kg"},
+		{1500, "gm", 1.5, "kg"},
+		{12, "kg", 12, "kg"},
+		{750, "ml", 0.75, "l"},
+		{4, "Liters", 4, "l"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unit, func(t *testing.T) {
+			got, unit, err := canonicalQuantity(tt.quantity, tt.unit)
+			if err != nil {
+				t.Fatalf("conversion failed: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 || unit != tt.wantUnit {
+				t.Errorf("%v %s = %v %s, want %v %s", tt.quantity, tt.unit, got, unit, tt.want, tt.wantUnit)
+			}
+		})
+	}
+
+	if _, _, err := canonicalQuantity(1, "bushel"); err == nil {
+		t.Errorf("unknown unit was accepted")
+	}
+}
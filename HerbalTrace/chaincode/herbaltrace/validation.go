@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
@@ -36,6 +35,7 @@ type HarvestLimit struct {
 	Unit            string  `json:"unit"`
 	AlertThreshold  float64 `json:"alertThreshold"` // Percentage (e.g., 80.0 for 80%)
 	Status          string  `json:"status"`         // "normal", "warning", "exceeded"
+	Shards          int     `json:"shards,omitempty"` // Delta accounting shards, see harvestledger.go
 	CreatedBy       string  `json:"createdBy"`
 	CreatedAt       string  `json:"createdAt"`
 	UpdatedAt       string  `json:"updatedAt"`
@@ -56,6 +56,11 @@ func (c *HerbalTraceContract) CreateSeasonWindow(ctx contractapi.TransactionCont
 	if window.Species == "" {
 		return fmt.Errorf("species is required")
 	}
+	species, err := c.resolveActiveSpecies(ctx, window.Species)
+	if err != nil {
+		return err
+	}
+	window.Species = species.ScientificName
 	if window.StartMonth < 1 || window.StartMonth > 12 {
 		return fmt.Errorf("start month must be between 1 and 12")
 	}
@@ -108,6 +113,10 @@ func (c *HerbalTraceContract) CreateSeasonWindow(ctx contractapi.TransactionCont
 	return nil
 }
 
+var activeSeasonWindowsQuery = defineQuery("activeSeasonWindows",
+	`{"selector":{"type":"SeasonWindow","species":"%s","region":"%s","active":true}}`,
+	"type", "species", "region", "active")
+
 // ValidateSeasonWindow checks if a harvest date falls within the allowed season window
 func (c *HerbalTraceContract) ValidateSeasonWindow(ctx contractapi.TransactionContextInterface, species string, harvestDate string, region string) (bool, error) {
 	if species == "" || harvestDate == "" || region == "" {
@@ -122,14 +131,7 @@ func (c *HerbalTraceContract) ValidateSeasonWindow(ctx contractapi.TransactionCo
 	harvestMonth := int(parsedDate.Month())
 
 	// Query for active season windows for this species and region
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "SeasonWindow",
-			"species": "%s",
-			"region": "%s",
-			"active": true
-		}
-	}`, species, region)
+	queryString := activeSeasonWindowsQuery.format(species, region)
 
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
@@ -168,18 +170,17 @@ func (c *HerbalTraceContract) ValidateSeasonWindow(ctx contractapi.TransactionCo
 	return false, nil
 }
 
+var seasonWindowsBySpeciesQuery = defineQuery("seasonWindowsBySpecies",
+	`{"selector":{"type":"SeasonWindow","species":"%s"}}`,
+	"type", "species")
+
 // GetSeasonWindows retrieves all season windows for a species
 func (c *HerbalTraceContract) GetSeasonWindows(ctx contractapi.TransactionContextInterface, species string) ([]*SeasonWindow, error) {
 	if species == "" {
 		return nil, fmt.Errorf("species is required")
 	}
 
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "SeasonWindow",
-			"species": "%s"
-		}
-	}`, species)
+	queryString := seasonWindowsBySpeciesQuery.format(species)
 
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
@@ -226,8 +227,14 @@ func (c *HerbalTraceContract) UpdateSeasonWindow(ctx contractapi.TransactionCont
 		return fmt.Errorf("failed to unmarshal season window JSON: %v", err)
 	}
 
-	// Preserve ID and type
+	species, err := c.resolveActiveSpecies(ctx, updatedWindow.Species)
+	if err != nil {
+		return err
+	}
+
+	// Preserve ID and type, normalise species
 	updatedWindow.ID = windowID
+	updatedWindow.Species = species.ScientificName
 	updatedWindow.Type = "SeasonWindow"
 	updatedWindow.UpdatedAt = time.Now().Format(time.RFC3339)
 
@@ -254,12 +261,14 @@ func (c *HerbalTraceContract) CreateHarvestLimit(ctx contractapi.TransactionCont
 	}
 
 	// Validate required fields
-	if limit.ID == "" {
-		return fmt.Errorf("harvest limit ID is required")
-	}
 	if limit.Species == "" {
 		return fmt.Errorf("species is required")
 	}
+	species, err := c.resolveActiveSpecies(ctx, limit.Species)
+	if err != nil {
+		return err
+	}
+	limit.Species = species.ScientificName
 	if limit.Season == "" {
 		return fmt.Errorf("season is required")
 	}
@@ -272,6 +281,13 @@ func (c *HerbalTraceContract) CreateHarvestLimit(ctx contractapi.TransactionCont
 	if limit.Unit == "" {
 		return fmt.Errorf("unit is required")
 	}
+	limit.MaxQuantity, limit.Unit, err = canonicalQuantity(limit.MaxQuantity, limit.Unit)
+	if err != nil {
+		return err
+	}
+
+	// The ID is derived from the normalised species so collections find the limit
+	limit.ID = harvestLimitKey(limit.Species, limit.Zone, limit.Season)
 
 	// Check if harvest limit already exists
 	existingLimit, err := ctx.GetStub().GetState(limit.ID)
@@ -286,6 +302,9 @@ func (c *HerbalTraceContract) CreateHarvestLimit(ctx contractapi.TransactionCont
 	limit.Type = "HarvestLimit"
 	limit.CurrentQuantity = 0
 	limit.Status = "normal"
+	if limit.Shards <= 0 {
+		limit.Shards = defaultHarvestShards
+	}
 	if limit.AlertThreshold == 0 {
 		limit.AlertThreshold = 80.0 // Default 80%
 	}
@@ -306,68 +325,14 @@ func (c *HerbalTraceContract) CreateHarvestLimit(ctx contractapi.TransactionCont
 	return nil
 }
 
-// TrackHarvestQuantity adds a quantity to the current harvest limit tracker
-func (c *HerbalTraceContract) TrackHarvestQuantity(ctx contractapi.TransactionContextInterface, species string, zone string, season string, quantity float64) error {
-	if species == "" || zone == "" || season == "" {
-		return fmt.Errorf("species, zone, and season are required")
-	}
-	if quantity <= 0 {
-		return fmt.Errorf("quantity must be greater than zero")
-	}
-
-	// Find the harvest limit for this species/zone/season
-	limitID := fmt.Sprintf("limit_%s_%s_%s", 
-		strings.ReplaceAll(species, " ", "_"),
-		strings.ReplaceAll(zone, " ", "_"),
-		strings.ReplaceAll(season, " ", "_"))
-
-	limitBytes, err := ctx.GetStub().GetState(limitID)
-	if err != nil {
-		return fmt.Errorf("failed to read harvest limit: %v", err)
-	}
-	if limitBytes == nil {
-		// No limit set for this combination - allow harvest
-		return nil
-	}
-
-	var limit HarvestLimit
-	err = json.Unmarshal(limitBytes, &limit)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal harvest limit: %v", err)
-	}
-
-	// Update current quantity
-	limit.CurrentQuantity += quantity
-	limit.UpdatedAt = time.Now().Format(time.RFC3339)
-
-	// Calculate percentage used
-	percentageUsed := (limit.CurrentQuantity / limit.MaxQuantity) * 100
-
-	// Update status based on percentage
-	if percentageUsed >= 100 {
-		limit.Status = "exceeded"
-	} else if percentageUsed >= limit.AlertThreshold {
-		limit.Status = "warning"
-	} else {
-		limit.Status = "normal"
-	}
-
-	// Save updated limit
-	limitBytes, err = json.Marshal(limit)
-	if err != nil {
-		return fmt.Errorf("failed to marshal harvest limit: %v", err)
-	}
-
-	err = ctx.GetStub().PutState(limitID, limitBytes)
-	if err != nil {
-		return fmt.Errorf("failed to update harvest limit: %v", err)
-	}
-
-	return nil
+// TrackHarvestQuantity books a quantity against the harvest limit as delta records
+func (c *HerbalTraceContract) TrackHarvestQuantity(ctx contractapi.TransactionContextInterface, species string, zone string, season string, quantity float64, unit string) error {
+	_, _, err := c.trackHarvestQuantity(ctx, species, zone, season, quantity, unit)
+	return err
 }
 
 // ValidateHarvestLimit checks if adding a quantity would exceed the harvest limit
-func (c *HerbalTraceContract) ValidateHarvestLimit(ctx contractapi.TransactionContextInterface, species string, zone string, season string, quantity float64) (bool, error) {
+func (c *HerbalTraceContract) ValidateHarvestLimit(ctx contractapi.TransactionContextInterface, species string, zone string, season string, quantity float64, unit string) (bool, error) {
 	if species == "" || zone == "" || season == "" {
 		return false, fmt.Errorf("species, zone, and season are required")
 	}
@@ -375,34 +340,28 @@ func (c *HerbalTraceContract) ValidateHarvestLimit(ctx contractapi.TransactionCo
 		return false, fmt.Errorf("quantity must be greater than zero")
 	}
 
-	// Find the harvest limit
-	limitID := fmt.Sprintf("limit_%s_%s_%s",
-		strings.ReplaceAll(species, " ", "_"),
-		strings.ReplaceAll(zone, " ", "_"),
-		strings.ReplaceAll(season, " ", "_"))
-
-	limitBytes, err := ctx.GetStub().GetState(limitID)
+	limit, err := c.getHarvestLimit(ctx, harvestLimitKey(species, zone, season))
 	if err != nil {
-		return false, fmt.Errorf("failed to read harvest limit: %v", err)
+		return false, err
 	}
-	if limitBytes == nil {
+	if limit == nil {
 		// No limit set - allow harvest
 		return true, nil
 	}
 
-	var limit HarvestLimit
-	err = json.Unmarshal(limitBytes, &limit)
+	// Compare in the limit's unit, rejecting unknown or incompatible units
+	quantity, err = convertQuantity(quantity, unit, limit.Unit)
 	if err != nil {
-		return false, fmt.Errorf("failed to unmarshal harvest limit: %v", err)
+		return false, fmt.Errorf("harvest quantity does not match limit unit: %v", err)
 	}
 
-	// Check if adding this quantity would exceed the limit
-	newTotal := limit.CurrentQuantity + quantity
-	if newTotal > limit.MaxQuantity {
-		return false, nil
+	// Plan the same shard placement TrackHarvestQuantity would use
+	allocations, err := c.planHarvestAllocation(ctx, limit, quantity)
+	if err != nil {
+		return false, err
 	}
 
-	return true, nil
+	return allocations != nil, nil
 }
 
 // GetHarvestStatistics retrieves the current harvest statistics for a species/zone/season
@@ -411,40 +370,36 @@ func (c *HerbalTraceContract) GetHarvestStatistics(ctx contractapi.TransactionCo
 		return nil, fmt.Errorf("species, zone, and season are required")
 	}
 
-	limitID := fmt.Sprintf("limit_%s_%s_%s",
-		strings.ReplaceAll(species, " ", "_"),
-		strings.ReplaceAll(zone, " ", "_"),
-		strings.ReplaceAll(season, " ", "_"))
-
-	limitBytes, err := ctx.GetStub().GetState(limitID)
+	limit, err := c.getHarvestLimit(ctx, harvestLimitKey(species, zone, season))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read harvest limit: %v", err)
+		return nil, err
 	}
-	if limitBytes == nil {
+	if limit == nil {
 		return nil, fmt.Errorf("harvest limit for %s/%s/%s does not exist", species, zone, season)
 	}
 
-	var limit HarvestLimit
-	err = json.Unmarshal(limitBytes, &limit)
+	// Aggregate the delta records into the live quantity and status
+	current, err := c.harvestTotal(ctx, limit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal harvest limit: %v", err)
+		return nil, err
 	}
+	limit.CurrentQuantity = current
+	limit.Status = harvestLimitStatus(limit, current)
 
-	return &limit, nil
+	return limit, nil
 }
 
+var harvestLimitsBySeasonQuery = defineQuery("harvestLimitsBySeason",
+	`{"selector":{"type":"HarvestLimit","season":"%s"}}`,
+	"type", "season")
+
 // ResetSeasonalLimits resets the current quantities for all limits of a given season
 func (c *HerbalTraceContract) ResetSeasonalLimits(ctx contractapi.TransactionContextInterface, season string) error {
 	if season == "" {
 		return fmt.Errorf("season is required")
 	}
 
-	queryString := fmt.Sprintf(`{
-		"selector": {
-			"type": "HarvestLimit",
-			"season": "%s"
-		}
-	}`, season)
+	queryString := harvestLimitsBySeasonQuery.format(season)
 
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
@@ -465,9 +420,14 @@ func (c *HerbalTraceContract) ResetSeasonalLimits(ctx contractapi.TransactionCon
 			continue
 		}
 
-		// Reset current quantity and status
+		// Drop the booked deltas, then reset current quantity and status
+		err = c.clearHarvestDeltas(ctx, &limit)
+		if err != nil {
+			return err
+		}
 		limit.CurrentQuantity = 0
 		limit.Status = "normal"
+		limit.Shards = limit.shardCount()
 		limit.UpdatedAt = time.Now().Format(time.RFC3339)
 
 		// Save updated limit
@@ -497,16 +457,15 @@ func (c *HerbalTraceContract) ResetSeasonalLimits(ctx contractapi.TransactionCon
 	return nil
 }
 
+var harvestLimitsQuery = defineQuery("harvestLimits",
+	`{"selector":{"type":"HarvestLimit"}}`,
+	"type")
+
 // GetHarvestLimitAlerts retrieves all harvest limits with warning or exceeded status
 func (c *HerbalTraceContract) GetHarvestLimitAlerts(ctx contractapi.TransactionContextInterface) ([]*HarvestLimit, error) {
-	queryString := `{
-		"selector": {
-			"type": "HarvestLimit",
-			"status": {
-				"$in": ["warning", "exceeded"]
-			}
-		}
-	}`
+	// The stored status is only a snapshot from the last compaction, so every
+	// limit is aggregated from its delta records before filtering
+	queryString := harvestLimitsQuery.format()
 
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
@@ -526,7 +485,16 @@ func (c *HerbalTraceContract) GetHarvestLimitAlerts(ctx contractapi.TransactionC
 		if err != nil {
 			continue
 		}
-		alerts = append(alerts, &limit)
+
+		current, err := c.harvestTotal(ctx, &limit)
+		if err != nil {
+			return nil, err
+		}
+		limit.CurrentQuantity = current
+		limit.Status = harvestLimitStatus(&limit, current)
+		if limit.Status == "warning" || limit.Status == "exceeded" {
+			alerts = append(alerts, &limit)
+		}
 	}
 
 	return alerts, nil
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	roleFieldVerifier    = "field_verifier"
+	roleCollectionCentre = "collection_centre"
+)
+
+// collectionRejectionReasons lists the reason codes accepted by RejectCollectionEvent
+var collectionRejectionReasons = map[string]bool{
+	"wrong_species":         true,
+	"quantity_mismatch":     true,
+	"quality_unacceptable":  true,
+	"location_mismatch":     true,
+	"harvest_date_mismatch": true,
+	"missing_documentation": true,
+	"other":                 true,
+}
+
+// VerifyCollectionEvent marks a pending collection event as verified, recording the
+// weight received at the collection centre (field verifier or collection centre only)
+func (c *HerbalTraceContract) VerifyCollectionEvent(ctx contractapi.TransactionContextInterface, eventID string, receivedQuantity float64, unit string, evidenceNotes string) error {
+	if err := requireRole(ctx, roleFieldVerifier, roleCollectionCentre); err != nil {
+		return err
+	}
+	if receivedQuantity <= 0 {
+		return fmt.Errorf("received quantity must be greater than zero")
+	}
+
+	event, err := c.getPendingCollectionEvent(ctx, eventID)
+	if err != nil {
+		return err
+	}
+
+	// Record the received weight in the event's unit
+	received, err := convertQuantity(receivedQuantity, unit, event.Unit)
+	if err != nil {
+		return fmt.Errorf("received quantity does not match event unit: %v", err)
+	}
+	// A collector cannot bank more than they declared, which is what the harvest limit was booked against
+	if received > event.Quantity+harvestEpsilon {
+		return fmt.Errorf("received quantity %.3f %s exceeds declared quantity %.3f %s, reject the event as quantity_mismatch instead", received, event.Unit, event.Quantity, event.Unit)
+	}
+
+	verifiedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	event.Status = "verified"
+	event.VerifiedBy = verifiedBy
+	event.VerificationDate = time.Now().Format(time.RFC3339)
+	event.ReceivedQuantity = received
+	event.EvidenceNotes = evidenceNotes
+
+	err = c.putCollectionEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":        "CollectionEventVerified",
+		"eventId":          event.ID,
+		"farmerId":         event.FarmerID,
+		"declaredQuantity": event.Quantity,
+		"receivedQuantity": event.ReceivedQuantity,
+		"unit":             event.Unit,
+		"verifiedBy":       verifiedBy,
+		"timestamp":        event.VerificationDate,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("CollectionEventVerified", eventBytes)
+
+	return nil
+}
+
+// RejectCollectionEvent marks a pending collection event as rejected with a reason code
+// (field verifier or collection centre only). The harvested quantity stays booked
+// against the harvest limit, since the plants have already been taken from the wild.
+func (c *HerbalTraceContract) RejectCollectionEvent(ctx contractapi.TransactionContextInterface, eventID string, reasonCode string, evidenceNotes string) error {
+	if err := requireRole(ctx, roleFieldVerifier, roleCollectionCentre); err != nil {
+		return err
+	}
+	if !collectionRejectionReasons[reasonCode] {
+		return fmt.Errorf("invalid rejection reason: %s", reasonCode)
+	}
+	if reasonCode == "other" && evidenceNotes == "" {
+		return fmt.Errorf("evidence notes are required for reason code other")
+	}
+
+	event, err := c.getPendingCollectionEvent(ctx, eventID)
+	if err != nil {
+		return err
+	}
+
+	rejectedBy, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	event.Status = "rejected"
+	event.VerifiedBy = rejectedBy
+	event.VerificationDate = time.Now().Format(time.RFC3339)
+	event.RejectionReason = reasonCode
+	event.EvidenceNotes = evidenceNotes
+
+	err = c.putCollectionEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	// Emit event
+	eventPayload := map[string]interface{}{
+		"eventType":  "CollectionEventRejected",
+		"eventId":    event.ID,
+		"farmerId":   event.FarmerID,
+		"reasonCode": reasonCode,
+		"rejectedBy": rejectedBy,
+		"timestamp":  event.VerificationDate,
+	}
+	eventBytes, _ := json.Marshal(eventPayload)
+	ctx.GetStub().SetEvent("CollectionEventRejected", eventBytes)
+
+	return nil
+}
+
+// getPendingCollectionEvent loads a collection event that is still awaiting a decision
+func (c *HerbalTraceContract) getPendingCollectionEvent(ctx contractapi.TransactionContextInterface, eventID string) (*CollectionEvent, error) {
+	if eventID == "" {
+		return nil, fmt.Errorf("event ID is required")
+	}
+
+	event, err := c.GetCollectionEvent(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if event.Type != "CollectionEvent" {
+		return nil, fmt.Errorf("%s is not a collection event", eventID)
+	}
+	if event.Status != "pending" {
+		return nil, fmt.Errorf("collection event %s is already %s", eventID, event.Status)
+	}
+
+	return event, nil
+}
+
+// putCollectionEvent saves a collection event to the ledger
+func (c *HerbalTraceContract) putCollectionEvent(ctx contractapi.TransactionContextInterface, event *CollectionEvent) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(event.ID, eventBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save collection event: %v", err)
+	}
+
+	return nil
+}
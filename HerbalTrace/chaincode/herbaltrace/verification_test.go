@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testVerifier = testIdentity{id: "verifier-1", mspID: "FarmersCoopMSP", attributes: map[string]string{"role": roleCollectionCentre}}
+
+func TestVerifyCollectionEventChecksTheEvent(t *testing.T) {
+	ledger := newTestLedger()
+	ledger.put(t, "COL-1", CollectionEvent{ID: "COL-1", Type: "CollectionEvent", Species: testSpecies, Quantity: 50, Unit: "kg", Status: "pending"})
+	ledger.put(t, "BATCH-1", Batch{ID: "BATCH-1", Type: "Batch", Species: testSpecies, TotalQuantity: 50, Unit: "kg", Status: "pending"})
+
+	tests := []struct {
+		name     string
+		eventID  string
+		quantity float64
+		unit     string
+		want     string
+	}{
+		{"received within declared", "COL-1", 0.05, "tonne", ""},
+		{"received over declared", "COL-1", 50.5, "kg", "exceeds declared quantity"},
+		{"not a collection event", "BATCH-1", 10, "kg", "is not a collection event"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := ledger.begin("verify")
+			err := new(HerbalTraceContract).VerifyCollectionEvent(tx.context(testVerifier), tt.eventID, tt.quantity, tt.unit, "")
+			if tt.want == "" && err != nil {
+				t.Errorf("VerifyCollectionEvent() error = %v", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("VerifyCollectionEvent() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -51,6 +51,15 @@ PeerOrgs:
       Count: 2
     Users:
       Count: 2
+
+  # Regulators only submit transactions, so the organisation runs no peers
+  - Name: Regulator
+    Domain: regulator.herbaltrace.com
+    EnableNodeOUs: true
+    Template:
+      Count: 0
+    Users:
+      Count: 2
 EOF
 
 cryptogen generate --config=./crypto-config.yaml --output="${CRYPTO_CONFIG_DIR}"
@@ -69,7 +78,7 @@ if [ -d "${CRYPTO_CONFIG_DIR}/ordererOrganizations-temp/herbaltrace.com" ]; then
 fi
 
 # Move peer orgs
-for org in farmers.herbaltrace.com labs.herbaltrace.com processors.herbaltrace.com manufacturers.herbaltrace.com; do
+for org in farmers.herbaltrace.com labs.herbaltrace.com processors.herbaltrace.com manufacturers.herbaltrace.com regulator.herbaltrace.com; do
   if [ -d "${CRYPTO_CONFIG_DIR}/peerOrganizations-temp/${org}" ]; then
     cp -r ${CRYPTO_CONFIG_DIR}/peerOrganizations-temp/${org} ${CRYPTO_CONFIG_DIR}/peerOrganizations/
   fi
@@ -239,6 +239,15 @@ PeerOrgs:
       Count: 2
     Users:
       Count: 2
+
+  # Regulators only submit transactions, so the organisation runs no peers
+  - Name: Regulator
+    Domain: regulator.herbaltrace.com
+    EnableNodeOUs: true
+    Template:
+      Count: 0
+    Users:
+      Count: 2
 EOF
 
 cryptogen generate --config=./crypto-config.yaml --output="${CRYPTO_CONFIG_DIR}"
@@ -257,7 +266,7 @@ if [ -d "${CRYPTO_CONFIG_DIR}/ordererOrganizations-temp/herbaltrace.com" ]; then
 fi
 
 # Move peer orgs
-for org in farmers.herbaltrace.com labs.herbaltrace.com processors.herbaltrace.com manufacturers.herbaltrace.com; do
+for org in farmers.herbaltrace.com labs.herbaltrace.com processors.herbaltrace.com manufacturers.herbaltrace.com regulator.herbaltrace.com; do
   if [ -d "${CRYPTO_CONFIG_DIR}/peerOrganizations-temp/${org}" ]; then
     cp -r ${CRYPTO_CONFIG_DIR}/peerOrganizations-temp/${org} ${CRYPTO_CONFIG_DIR}/peerOrganizations/
   fi
@@ -466,6 +475,7 @@ echo "Package ID: ${PACKAGE_ID}"
 println "Approving chaincode for all organizations..."
 CHANNEL_NAME="herbaltrace-channel"
 ORDERER_CA=${PWD}/organizations/ordererOrganizations/herbaltrace.com/orderers/orderer.herbaltrace.com/msp/tlscacerts/tlsca.herbaltrace.com-cert.pem
+COLLECTIONS_CONFIG=${PROJECT_ROOT}/chaincode/herbaltrace/collections_config.json
 
 # Approve for FarmersCoop
 export CORE_PEER_LOCALMSPID="FarmersCoopMSP"
@@ -475,7 +485,7 @@ export CORE_PEER_ADDRESS=localhost:7051
 
 peer lifecycle chaincode approveformyorg -o localhost:7050 --ordererTLSHostnameOverride orderer.herbaltrace.com \
   --tls --cafile $ORDERER_CA --channelID $CHANNEL_NAME --name herbaltrace --version 1.0 \
-  --package-id $PACKAGE_ID --sequence 1
+  --package-id $PACKAGE_ID --sequence 1 --collections-config $COLLECTIONS_CONFIG
 
 # Approve for TestingLabs
 export CORE_PEER_LOCALMSPID="TestingLabsMSP"
@@ -485,7 +495,7 @@ export CORE_PEER_ADDRESS=localhost:9051
 
 peer lifecycle chaincode approveformyorg -o localhost:7050 --ordererTLSHostnameOverride orderer.herbaltrace.com \
   --tls --cafile $ORDERER_CA --channelID $CHANNEL_NAME --name herbaltrace --version 1.0 \
-  --package-id $PACKAGE_ID --sequence 1
+  --package-id $PACKAGE_ID --sequence 1 --collections-config $COLLECTIONS_CONFIG
 
 # Approve for Processors
 export CORE_PEER_LOCALMSPID="ProcessorsMSP"
@@ -495,7 +505,7 @@ export CORE_PEER_ADDRESS=localhost:11051
 
 peer lifecycle chaincode approveformyorg -o localhost:7050 --ordererTLSHostnameOverride orderer.herbaltrace.com \
   --tls --cafile $ORDERER_CA --channelID $CHANNEL_NAME --name herbaltrace --version 1.0 \
-  --package-id $PACKAGE_ID --sequence 1
+  --package-id $PACKAGE_ID --sequence 1 --collections-config $COLLECTIONS_CONFIG
 
 # Approve for Manufacturers
 export CORE_PEER_LOCALMSPID="ManufacturersMSP"
@@ -505,11 +515,12 @@ export CORE_PEER_ADDRESS=localhost:13051
 
 peer lifecycle chaincode approveformyorg -o localhost:7050 --ordererTLSHostnameOverride orderer.herbaltrace.com \
   --tls --cafile $ORDERER_CA --channelID $CHANNEL_NAME --name herbaltrace --version 1.0 \
-  --package-id $PACKAGE_ID --sequence 1
+  --package-id $PACKAGE_ID --sequence 1 --collections-config $COLLECTIONS_CONFIG
 
 println "Committing chaincode definition..."
 peer lifecycle chaincode commit -o localhost:7050 --ordererTLSHostnameOverride orderer.herbaltrace.com \
   --tls --cafile $ORDERER_CA --channelID $CHANNEL_NAME --name herbaltrace --version 1.0 --sequence 1 \
+  --collections-config $COLLECTIONS_CONFIG \
   --peerAddresses localhost:7051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/farmers.herbaltrace.com/peers/peer0.farmers.herbaltrace.com/tls/ca.crt \
   --peerAddresses localhost:9051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/labs.herbaltrace.com/peers/peer0.labs.herbaltrace.com/tls/ca.crt \
   --peerAddresses localhost:11051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/processors.herbaltrace.com/peers/peer0.processors.herbaltrace.com/tls/ca.crt \
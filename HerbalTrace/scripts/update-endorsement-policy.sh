@@ -22,6 +22,7 @@ CHANNEL_NAME="herbaltrace-channel"
 CC_NAME="herbaltrace"
 CC_VERSION="2.1"
 CC_SEQUENCE=4  # Increment sequence number
+COLLECTIONS_CONFIG=/opt/gopath/src/github.com/chaincode/herbaltrace/collections_config.json  # Must be repeated on every definition update
 
 echo "📦 Step 1: Approve new endorsement policy for FarmersCoopMSP..."
 docker exec cli peer lifecycle chaincode approveformyorg \
@@ -34,7 +35,8 @@ docker exec cli peer lifecycle chaincode approveformyorg \
   --sequence $CC_SEQUENCE \
   --tls \
   --cafile $ORDERER_CA \
-  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')"
+  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')" \
+  --collections-config $COLLECTIONS_CONFIG
 
 echo ""
 echo "✅ FarmersCoopMSP approved!"
@@ -57,7 +59,8 @@ docker exec cli peer lifecycle chaincode approveformyorg \
   --sequence $CC_SEQUENCE \
   --tls \
   --cafile $ORDERER_CA \
-  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')"
+  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')" \
+  --collections-config $COLLECTIONS_CONFIG
 
 echo ""
 echo "✅ TestingLabsMSP approved!"
@@ -79,7 +82,8 @@ docker exec cli peer lifecycle chaincode approveformyorg \
   --sequence $CC_SEQUENCE \
   --tls \
   --cafile $ORDERER_CA \
-  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')"
+  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')" \
+  --collections-config $COLLECTIONS_CONFIG
 
 echo ""
 echo "✅ ProcessorsMSP approved!"
@@ -101,7 +105,8 @@ docker exec cli peer lifecycle chaincode approveformyorg \
   --sequence $CC_SEQUENCE \
   --tls \
   --cafile $ORDERER_CA \
-  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')"
+  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')" \
+  --collections-config $COLLECTIONS_CONFIG
 
 echo ""
 echo "✅ ManufacturersMSP approved!"
@@ -126,7 +131,8 @@ docker exec cli peer lifecycle chaincode commit \
   --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/organizations/peerOrganizations/farmers.herbaltrace.com/peers/peer0.farmers.herbaltrace.com/tls/ca.crt \
   --peerAddresses peer0.labs.herbaltrace.com:9051 \
   --tlsRootCertFiles /opt/gopath/src/github.com/hyperledger/fabric/peer/organizations/peerOrganizations/labs.herbaltrace.com/peers/peer0.labs.herbaltrace.com/tls/ca.crt \
-  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')"
+  --signature-policy "OR('FarmersCoopMSP.peer','TestingLabsMSP.peer','ProcessorsMSP.peer','ManufacturersMSP.peer')" \
+  --collections-config $COLLECTIONS_CONFIG
 
 echo ""
 echo "✅ Policy committed to channel!"